@@ -8,12 +8,13 @@ import (
 	"github.com/hysios/mx"
 	"github.com/hysios/mx/discovery"
 	"github.com/hysios/mx/discovery/agent"
+	"github.com/hysios/mx/discovery/resolver"
 	"github.com/hysios/mx/internal/delegate"
 	"github.com/hysios/mx/logger"
+	"github.com/hysios/mx/telemetry"
+	"github.com/hysios/mx/tlsconfig"
 	"github.com/hysios/mx/utils"
 	"go.uber.org/zap"
-
-	grpc_opentracing "github.com/grpc-ecosystem/go-grpc-middleware/tracing/opentracing"
 	"google.golang.org/grpc"
 )
 
@@ -37,8 +38,10 @@ func getDiscoveryConn(serviceName string, opts *MakeOption) (grpc.ClientConnInte
 		return nil, mx.ErrServiceNotFound
 	}
 
-	logger.Logger.Info("dial", zap.String("target", services[0].TargetURI))
-	rawconn, err := dial(services[0].TargetURI, opts)
+	// the resolver follows the instances as they join and leave
+	target := resolver.Target(discovery.Namespace, serviceName)
+	logger.Logger.Info("dial", zap.String("target", target))
+	rawconn, err := dial(target, opts, grpc.WithDefaultServiceConfig(resolver.RoundRobin))
 	if err != nil {
 		return nil, err
 	}
@@ -202,17 +205,30 @@ func SetStreamClientInterceptor(interceptors ...grpc.StreamClientInterceptor) {
 	commonOption.streamInterceptors = interceptors
 }
 
-func dial(target string, opts *MakeOption) (*grpc.ClientConn, error) {
+func dial(target string, opts *MakeOption, extra ...grpc.DialOption) (*grpc.ClientConn, error) {
 	var (
-		dialOpts []grpc.DialOption
+		dialOpts = extra
 	)
 
-	if opts.Insecure {
+	switch {
+	case opts.Insecure:
 		dialOpts = append(dialOpts, grpc.WithInsecure())
+	case opts.TLS != nil:
+		dialOpts = append(dialOpts, opts.TLS.DialOption())
+	default:
+		t, err := tlsconfig.Load()
+		if err != nil {
+			return nil, err
+		}
+
+		if t != nil {
+			dialOpts = append(dialOpts, t.DialOption())
+		}
 	}
 
 	dialOpts = append(dialOpts, grpc.WithChainUnaryInterceptor(opts.unaryInterceptors...))
 	dialOpts = append(dialOpts, grpc.WithChainStreamInterceptor(opts.streamInterceptors...))
+	dialOpts = append(dialOpts, grpc.WithStatsHandler(telemetry.ClientHandler()))
 	dialOpts = append(dialOpts, opts.dialOptions...)
 
 	return grpc.Dial(target, dialOpts...)
@@ -220,8 +236,8 @@ func dial(target string, opts *MakeOption) (*grpc.ClientConn, error) {
 
 func evaluteOptions(opts ...MakeOptionFunc) *MakeOption {
 	opt := &MakeOption{
-		unaryInterceptors:  append(commonOption.unaryInterceptors, defaultUnaryInterceptors()...),
-		streamInterceptors: append(commonOption.streamInterceptors, defaultStreamInterceptors()...),
+		unaryInterceptors:  append([]grpc.UnaryClientInterceptor(nil), commonOption.unaryInterceptors...),
+		streamInterceptors: append([]grpc.StreamClientInterceptor(nil), commonOption.streamInterceptors...),
 	}
 
 	for _, optfn := range opts {
@@ -230,15 +246,3 @@ func evaluteOptions(opts ...MakeOptionFunc) *MakeOption {
 
 	return opt
 }
-
-func defaultUnaryInterceptors() []grpc.UnaryClientInterceptor {
-	return []grpc.UnaryClientInterceptor{
-		grpc_opentracing.UnaryClientInterceptor(),
-	}
-}
-
-func defaultStreamInterceptors() []grpc.StreamClientInterceptor {
-	return []grpc.StreamClientInterceptor{
-		grpc_opentracing.StreamClientInterceptor(),
-	}
-}
@@ -1,10 +1,15 @@
 package client
 
-import "google.golang.org/grpc"
+import (
+	"github.com/hysios/mx/tlsconfig"
+	"google.golang.org/grpc"
+)
 
 type MakeOption struct {
-	ConnectURI         string
-	Insecure           bool
+	ConnectURI string
+	Insecure   bool
+	// TLS dials over TLS, default is tlsconfig.Load
+	TLS                *tlsconfig.TLS
 	mockClient         grpc.ClientConnInterface
 	unaryInterceptors  []grpc.UnaryClientInterceptor
 	streamInterceptors []grpc.StreamClientInterceptor
@@ -55,3 +60,11 @@ func WithUserAgent(userAgent string) MakeOptionFunc {
 		o.dialOptions = append(o.dialOptions, grpc.WithUserAgent(userAgent))
 	}
 }
+
+// WithTLS dials over TLS, presenting its certificate to servers requiring
+// client auth
+func WithTLS(t *tlsconfig.TLS) MakeOptionFunc {
+	return func(o *MakeOption) {
+		o.TLS = t
+	}
+}
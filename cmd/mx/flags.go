@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/hysios/mx/flags"
+	"github.com/urfave/cli/v2"
+)
+
+func flagsCmd() *cli.Command {
+	return &cli.Command{
+		Name:  "flags",
+		Usage: "manage feature flags",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "list",
+				Usage: "list the feature flags",
+				Flags: scopeFlags(),
+				Action: func(ctx *cli.Context) error {
+					cfg, err := scopedConfig(ctx)
+					if err != nil {
+						return err
+					}
+
+					for _, flag := range flags.New(cfg).Definitions() {
+						rollout := "-"
+						if flag.Rollout != nil {
+							rollout = strconv.FormatFloat(*flag.Rollout, 'f', -1, 64) + "%"
+						}
+
+						fmt.Printf("%-24s %-8s enabled=%-5t rollout=%-6s value=%v default=%v rules=%d\n",
+							flag.Name, flag.Type, flag.Enabled, rollout, flag.Value, flag.Default, len(flag.Rules))
+					}
+					return nil
+				},
+			},
+			{
+				Name:      "set",
+				Usage:     "create or update a feature flag",
+				ArgsUsage: "<name>",
+				Flags: append(scopeFlags(),
+					&cli.BoolFlag{
+						Name:  "enabled",
+						Usage: "enable or disable the flag",
+					},
+					&cli.StringFlag{
+						Name:  "type",
+						Usage: "flag type, one of bool, string, int, float",
+					},
+					&cli.StringFlag{
+						Name:  "value",
+						Usage: "flag value served to targeted requests",
+					},
+					&cli.StringFlag{
+						Name:  "default",
+						Usage: "flag value served to the other requests",
+					},
+					&cli.Float64Flag{
+						Name:  "rollout",
+						Usage: "percentage of targets, 0 to 100, which get the value",
+					},
+					&cli.StringFlag{
+						Name:  "description",
+						Usage: "flag description",
+					},
+				),
+				Action: func(ctx *cli.Context) error {
+					name := ctx.Args().First()
+					if name == "" {
+						return cli.Exit("missing flag name, example: mx flags set new_checkout --enabled", 1)
+					}
+
+					cfg, err := scopedConfig(ctx)
+					if err != nil {
+						return err
+					}
+
+					var (
+						selector = flags.Selector + "." + name
+						typ      = ctx.String("type")
+					)
+
+					if typ == "" {
+						typ = flags.TypeBool
+						if flag, ok := flags.New(cfg).Lookup(name); ok {
+							typ = flag.Type
+						}
+					}
+
+					var vals = map[string]interface{}{"type": typ}
+					if ctx.IsSet("enabled") {
+						vals["enabled"] = ctx.Bool("enabled")
+					}
+
+					for _, field := range []string{"value", "default"} {
+						if !ctx.IsSet(field) {
+							continue
+						}
+
+						v, err := parseFlagValue(typ, ctx.String(field))
+						if err != nil {
+							return cli.Exit(fmt.Sprintf("invalid %s: %v", field, err), 1)
+						}
+						vals[field] = v
+					}
+
+					if ctx.IsSet("rollout") {
+						rollout := ctx.Float64("rollout")
+						if rollout < 0 || rollout > 100 {
+							return cli.Exit("rollout must be between 0 and 100", 1)
+						}
+						vals["rollout"] = rollout
+					}
+
+					if ctx.IsSet("description") {
+						vals["description"] = ctx.String("description")
+					}
+
+					for field, v := range vals {
+						if _, err := cfg.Set(selector+"."+field, v); err != nil {
+							return cli.Exit(fmt.Sprintf("set flag %s error %v", name, err), 1)
+						}
+					}
+					return nil
+				},
+			},
+		},
+	}
+}
+
+// parseFlagValue converts the value to the flag type
+func parseFlagValue(typ, val string) (interface{}, error) {
+	switch typ {
+	case flags.TypeBool:
+		return strconv.ParseBool(val)
+	case flags.TypeInt:
+		return strconv.Atoi(val)
+	case flags.TypeFloat:
+		return strconv.ParseFloat(val, 64)
+	case flags.TypeString:
+		return val, nil
+	default:
+		return nil, fmt.Errorf("unknown flag type %s", typ)
+	}
+}
@@ -1,18 +1,25 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/hysios/mx/config"
+	"github.com/hysios/mx/config/provider/remote"
 	"github.com/hysios/mx/discovery/agent"
 	_ "github.com/hysios/mx/discovery/provider/consul"
 	"github.com/hysios/mx/gateway"
 	"github.com/hysios/mx/logger"
+	"github.com/hysios/mx/server"
+	"github.com/hysios/mx/telemetry"
 	"github.com/urfave/cli/v2"
 	"go.uber.org/zap"
 )
@@ -28,6 +35,8 @@ func main() {
 				Subcommands: genSubCmds(),
 			},
 			provisionCmd(),
+			flagsCmd(),
+			registryCmd(),
 			{
 				Name:  "gateway",
 				Usage: "run a microservices gateway",
@@ -42,7 +51,24 @@ func main() {
 					},
 				},
 				Action: func(ctx *cli.Context) error {
-					return gateway.New().Serve(ctx.String("addr"))
+					flush := setupTelemetry(ctx.Context, "mx.gateway")
+					defer flush()
+
+					var errc = make(chan error, 1)
+					go func() {
+						errc <- gateway.New().Serve(ctx.String("addr"))
+					}()
+
+					// the telemetry is flushed on SIGINT or SIGTERM
+					sigctx, stop := signal.NotifyContext(ctx.Context, os.Interrupt, syscall.SIGTERM)
+					defer stop()
+
+					select {
+					case err := <-errc:
+						return err
+					case <-sigctx.Done():
+						return nil
+					}
 				},
 			},
 			{
@@ -59,7 +85,7 @@ func main() {
 					{
 						Name:  "set",
 						Usage: "set a config item",
-						Flags: []cli.Flag{
+						Flags: append(scopeFlags(),
 							&cli.StringFlag{
 								Name:  "key",
 								Usage: "config key, example: gateway.addr",
@@ -72,9 +98,9 @@ func main() {
 								Usage: "config value type",
 								Value: "string",
 							},
-						},
+						),
 						Action: func(ctx *cli.Context) error {
-							cfg, err := agent.Config(nil)
+							cfg, err := scopedConfig(ctx)
 							if err != nil {
 								return err
 							}
@@ -146,7 +172,7 @@ func main() {
 					{
 						Name:  "get",
 						Usage: "get a config item",
-						Flags: []cli.Flag{
+						Flags: append(scopeFlags(),
 							&cli.StringFlag{
 								Name:  "key",
 								Usage: "config key",
@@ -155,9 +181,9 @@ func main() {
 								Name:  "quite",
 								Usage: "quite mode",
 							},
-						},
+						),
 						Action: func(ctx *cli.Context) error {
-							cfg, err := agent.Config(nil)
+							cfg, err := scopedConfig(ctx)
 							if err != nil {
 								return err
 							}
@@ -176,11 +202,44 @@ func main() {
 							return nil
 						},
 					},
+					{
+						Name:      "explain",
+						Usage:     "explain which config layer supplies a key",
+						ArgsUsage: "<key>",
+						Flags:     scopeFlags(),
+						Action: func(ctx *cli.Context) error {
+							key := ctx.Args().First()
+							if key == "" {
+								return cli.Exit("missing key, example: mx config explain database.mysql.host", 1)
+							}
+
+							cfg, err := scopedConfig(ctx)
+							if err != nil {
+								return err
+							}
+
+							layers := cfg.Explain(key)
+							if len(layers) == 0 {
+								return cli.Exit("key not found", 1)
+							}
+
+							// the first layer wins, the others are shadowed
+							for i, layer := range layers {
+								mark := " "
+								if i == 0 {
+									mark = "*"
+								}
+								fmt.Printf("%s %-20s %v\n", mark, layer.Name, layer.Value.Data())
+							}
+							return nil
+						},
+					},
 					{
 						Name:  "cat",
 						Usage: "cat a config file",
+						Flags: scopeFlags(),
 						Action: func(ctx *cli.Context) error {
-							cfg, err := agent.Config(nil)
+							cfg, err := scopedConfig(ctx)
 							if err != nil {
 								return err
 							}
@@ -190,16 +249,50 @@ func main() {
 							return nil
 						},
 					},
+					{
+						Name:  "serve",
+						Usage: "serve the config over gRPC, so services need no redis credentials",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "addr",
+								Usage: "config server listen address",
+								Value: ":0",
+							},
+							&cli.BoolFlag{
+								Name:  "writable",
+								Usage: "accept Set calls, any caller reaching the server can change the config",
+							},
+						},
+						Action: func(ctx *cli.Context) error {
+							var optfns []remote.ServerOptionFunc
+							if ctx.Bool("writable") {
+								optfns = append(optfns, remote.WithWritable())
+							}
+
+							cs, err := agent.ConfigServer(optfns...)
+							if err != nil {
+								return err
+							}
+
+							s := server.New("mx.Config")
+							cs.Register(s)
+							if err := agent.RegisterConfigServer(s); err != nil {
+								return err
+							}
+
+							return s.ServeOn(ctx.String("addr"))
+						},
+					},
 					&cli.Command{
 						Name: "put",
-						Flags: []cli.Flag{
+						Flags: append(scopeFlags(),
 							&cli.StringFlag{
 								Name:  "data",
 								Usage: "config data",
 							},
-						},
+						),
 						Action: func(ctx *cli.Context) error {
-							cfg, err := agent.Config(nil)
+							cfg, err := scopedConfig(ctx)
 							if err != nil {
 								return err
 							}
@@ -238,6 +331,44 @@ func main() {
 	}
 }
 
+// scopeFlags returns the flags selecting the config scope
+func scopeFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "global",
+			Usage: "target the global config shared by all namespaces",
+		},
+		&cli.StringFlag{
+			Name:  "namespace",
+			Usage: "target the config of the namespace, default is the discovery namespace",
+		},
+		&cli.StringFlag{
+			Name:  "service",
+			Usage: "target the config of the service, example: user",
+		},
+		&cli.StringFlag{
+			Name:  "instance",
+			Usage: "target the config of the service instance, requires --service",
+		},
+	}
+}
+
+// scopedConfig returns the config of the scope selected by the flags
+func scopedConfig(ctx *cli.Context) (*config.Config, error) {
+	scope := agent.Scope{
+		Global:    ctx.Bool("global"),
+		Namespace: ctx.String("namespace"),
+		Service:   ctx.String("service"),
+		Instance:  ctx.String("instance"),
+	}
+
+	if scope.Instance != "" && scope.Service == "" {
+		return nil, cli.Exit("--instance requires --service", 1)
+	}
+
+	return agent.ScopedConfig(scope, nil)
+}
+
 func setError(key string, err error) {
 	if err != nil {
 		cli.Exit(fmt.Sprintf("set key %s error %v", key, err), 1)
@@ -253,3 +384,28 @@ func LogError(err error) {
 func init() {
 	logger.SetLogger(zap.NewExample())
 }
+
+// setupTelemetry sets up the telemetry of the "telemetry" config of the
+// namespace, the returned func flushes it
+func setupTelemetry(ctx context.Context, name string) func() {
+	cfg, err := agent.Config(nil)
+	if err != nil {
+		logger.Cli.Warn("telemetry config", zap.Error(err))
+		return func() {}
+	}
+
+	t, err := telemetry.Setup(ctx, telemetry.WithConfig(cfg), telemetry.WithServiceName(name))
+	if err != nil {
+		logger.Cli.Warn("telemetry setup", zap.Error(err))
+		return func() {}
+	}
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := t.Shutdown(ctx); err != nil {
+			logger.Cli.Warn("telemetry shutdown", zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hysios/mx/discovery"
+	"github.com/hysios/mx/discovery/provider/consul"
+	"github.com/hysios/mx/discovery/provider/etcd"
+	"github.com/hysios/mx/discovery/provider/static"
+	"github.com/hysios/mx/discovery/schema"
+	"github.com/urfave/cli/v2"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/reflect/protodesc"
+)
+
+func registryCmd() *cli.Command {
+	var namespaceFlag = &cli.StringFlag{
+		Name:  "namespace",
+		Usage: "registry namespace",
+		Value: discovery.Namespace,
+	}
+
+	return &cli.Command{
+		Name:  "registry",
+		Usage: "manage the schema registry",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "provider",
+				Usage: "registry provider, consul or etcd, default is etcd when ETCD_ENDPOINTS is set",
+				Value: defaultRegistryProvider(),
+			},
+		},
+		Subcommands: []*cli.Command{
+			{
+				Name:  "list",
+				Usage: "list the registered schemas",
+				Flags: []cli.Flag{namespaceFlag},
+				Action: func(ctx *cli.Context) error {
+					reg, closefn, err := schemaRegistry(ctx)
+					if err != nil {
+						return err
+					}
+					defer closefn()
+
+					ns := ctx.String("namespace")
+					keys, err := reg.Keys(ctx.Context, ns)
+					if err != nil {
+						return err
+					}
+
+					for _, key := range keys {
+						versions, err := reg.Versions(ctx.Context, ns, key)
+						if err != nil {
+							return err
+						}
+
+						if len(versions) == 0 {
+							continue
+						}
+
+						latest := versions[len(versions)-1]
+						fmt.Printf("%-40s v%-4d %s %s versions=%d\n",
+							key, latest.Version, latest.Created.Format("2006-01-02 15:04:05"), latest.Hash[:12], len(versions))
+					}
+					return nil
+				},
+			},
+			{
+				Name:      "show",
+				Usage:     "show a version of a schema",
+				ArgsUsage: "<key>",
+				Flags: []cli.Flag{
+					namespaceFlag,
+					&cli.IntFlag{
+						Name:  "version",
+						Usage: "schema version, default is the latest",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					key := ctx.Args().First()
+					if key == "" {
+						return cli.Exit("missing schema key, example: mx registry show hello.proto", 1)
+					}
+
+					reg, closefn, err := schemaRegistry(ctx)
+					if err != nil {
+						return err
+					}
+					defer closefn()
+
+					version, fd, err := reg.Get(ctx.Context, ctx.String("namespace"), key, ctx.Int("version"))
+					if err != nil {
+						return err
+					}
+
+					b, err := prototext.MarshalOptions{Multiline: true}.Marshal(protodesc.ToFileDescriptorProto(fd))
+					if err != nil {
+						return err
+					}
+
+					fmt.Printf("# %s v%d %s %s\n%s", key, version.Version, version.Created.Format("2006-01-02 15:04:05"), version.Hash, b)
+					return nil
+				},
+			},
+			{
+				Name:      "diff",
+				Usage:     "show the changes between two versions of a schema",
+				ArgsUsage: "<key> <from> [to]",
+				Flags:     []cli.Flag{namespaceFlag},
+				Action: func(ctx *cli.Context) error {
+					var (
+						key     = ctx.Args().Get(0)
+						from, _ = strconv.Atoi(ctx.Args().Get(1))
+						to, _   = strconv.Atoi(ctx.Args().Get(2))
+					)
+
+					if key == "" || from == 0 {
+						return cli.Exit("missing schema key or version, example: mx registry diff hello.proto 1 2", 1)
+					}
+
+					reg, closefn, err := schemaRegistry(ctx)
+					if err != nil {
+						return err
+					}
+					defer closefn()
+
+					ns := ctx.String("namespace")
+					_, old, err := reg.Get(ctx.Context, ns, key, from)
+					if err != nil {
+						return err
+					}
+
+					_, fd, err := reg.Get(ctx.Context, ns, key, to)
+					if err != nil {
+						return err
+					}
+
+					for _, change := range schema.Diff(old, fd) {
+						fmt.Println(change)
+					}
+					return nil
+				},
+			},
+			{
+				Name:      "check",
+				Usage:     "check a .proto file or descriptor set against the latest version of a schema",
+				ArgsUsage: "<key> <file>",
+				Flags: []cli.Flag{
+					namespaceFlag,
+					&cli.StringSliceFlag{
+						Name:    "import-path",
+						Aliases: []string{"I"},
+						Usage:   "import paths of the .proto file",
+					},
+					&cli.StringFlag{
+						Name:  "service",
+						Usage: "service of the descriptor set, default is its last file",
+					},
+				},
+				Action: func(ctx *cli.Context) error {
+					var (
+						key  = ctx.Args().Get(0)
+						path = ctx.Args().Get(1)
+					)
+
+					if key == "" || path == "" {
+						return cli.Exit("missing schema key or file, example: mx registry check hello.proto proto/hello.proto", 1)
+					}
+
+					fd, err := static.LoadFileDescriptor(path, ctx.String("service"), ctx.StringSlice("import-path")...)
+					if err != nil {
+						return err
+					}
+
+					reg, closefn, err := schemaRegistry(ctx)
+					if err != nil {
+						return err
+					}
+					defer closefn()
+
+					breaking, err := reg.Check(ctx.Context, ctx.String("namespace"), key, fd)
+					if err != nil {
+						return err
+					}
+
+					for _, change := range breaking {
+						fmt.Println(change)
+					}
+
+					if len(breaking) > 0 {
+						return cli.Exit(fmt.Sprintf("%s has %d breaking changes", path, len(breaking)), 1)
+					}
+
+					fmt.Printf("%s is compatible\n", path)
+					return nil
+				},
+			},
+		},
+	}
+}
+
+func defaultRegistryProvider() string {
+	if os.Getenv("ETCD_ENDPOINTS") != "" {
+		return "etcd"
+	}
+	return "consul"
+}
+
+// schemaRegistry returns the registry of the provider, Consul configured by
+// the CONSUL_HTTP_* environment variables or etcd by the ETCD_* ones
+func schemaRegistry(ctx *cli.Context) (*schema.Registry, func(), error) {
+	switch provider := ctx.String("provider"); provider {
+	case "consul":
+		client, err := api.NewClient(api.DefaultConfig())
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return schema.NewRegistry(consul.SchemaStore(client)), func() {}, nil
+	case "etcd":
+		client, err := clientv3.New(*etcd.DefaultConfig())
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return schema.NewRegistry(etcd.SchemaStore(client)), func() { client.Close() }, nil
+	default:
+		return nil, nil, cli.Exit(fmt.Sprintf("unknown registry provider %s, use consul or etcd", provider), 1)
+	}
+}
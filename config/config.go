@@ -1,3 +1,12 @@
+// Package config layers configuration values from several providers.
+//
+// Values are resolved from the last provider to the first, then from the
+// defaults. agent.Config layers the environment over the remote backend:
+//
+//	defaults < remote (redis, etcd) < env
+//
+// File and flag providers are not wired by the agent. Add them with Use,
+// the provider added last takes precedence.
 package config
 
 import (
@@ -26,6 +35,12 @@ func NewConfig(defaults map[string]interface{}, providers ...ConfigProvider) *Co
 	}
 }
 
+// Use appends providers to the config, they take precedence over the
+// providers already in use.
+func (c *Config) Use(providers ...ConfigProvider) {
+	c.providers = append(c.providers, providers...)
+}
+
 func (c *Config) reverseProviders() []ConfigProvider {
 	var providers = make([]ConfigProvider, len(c.providers))
 	for i, p := range c.providers {
@@ -44,6 +59,7 @@ func (c *Config) Get(selector string) (val *Value, ok bool) {
 	}
 
 	val = c.defaults.Get(selector)
+	ok = !val.IsNil()
 	return
 }
 
@@ -62,7 +78,7 @@ func (c *Config) Set(selector string, val interface{}) (old interface{}, err err
 		}
 	}()
 
-	for _, p := range c.reverseProviders() {
+	for _, p := range c.writableProviders() {
 		old = p.Set(selector, val)
 		break
 	}
@@ -70,24 +86,65 @@ func (c *Config) Set(selector string, val interface{}) (old interface{}, err err
 	return
 }
 
+// writableProviders returns the providers which accept writes, in
+// precedence order.
+func (c *Config) writableProviders() []ConfigProvider {
+	var providers []ConfigProvider
+	for _, p := range c.reverseProviders() {
+		if isReadOnly(p) {
+			continue
+		}
+		providers = append(providers, p)
+	}
+
+	return providers
+}
+
+// Layer describes a config layer which supplies a value for a selector.
+type Layer struct {
+	Name  string
+	Value *Value
+}
+
+// Explain returns every layer which supplies a value for the given selector,
+// in precedence order. The first layer is the one Get resolves to.
+func (c *Config) Explain(selector string) []Layer {
+	var layers []Layer
+	for _, p := range c.reverseProviders() {
+		if val, ok := p.LookupPath(selector); ok {
+			layers = append(layers, Layer{Name: ProviderName(p), Value: val})
+		}
+	}
+
+	if val := c.defaults.Get(selector); !val.IsNil() {
+		layers = append(layers, Layer{Name: "defaults", Value: val})
+	}
+
+	return layers
+}
+
 // Update updates the config with the given values.
 func (c *Config) DefaultsUpdate(vals map[string]interface{}) Map {
 	return c.defaults.MergeHere(objx.New(vals))
 }
 
+// Update updates the highest writable layer with the given values, like Set.
 func (c *Config) Update(vals map[string]interface{}) Map {
 	var m = Map{}
-	for _, p := range c.reverseProviders() {
+	for _, p := range c.writableProviders() {
 		m.MergeHere(p.Update(vals))
+		break
 	}
 
 	return m
 }
 
+// All returns the merged data of all providers, higher precedence layers
+// override lower ones key by key.
 func (c *Config) All() Map {
 	var m = Map{}
-	for _, p := range c.reverseProviders() {
-		m.MergeHere(p.Data())
+	for _, p := range c.providers {
+		deepMerge(m, p.Data())
 	}
 
 	return m
@@ -286,6 +343,24 @@ func (c *Config) Map(selector string) map[string]interface{} {
 	return map[string]interface{}(val.ObjxMap())
 }
 
+// MergedMap returns the map value of the given selector merged over the
+// defaults and all providers, unlike Map which returns the one of the
+// highest layer having it. Keys of lower layers are kept unless a higher
+// layer overrides them.
+func (c *Config) MergedMap(selector string) map[string]interface{} {
+	var m = Map{}
+	deepMerge(m, c.defaults)
+	for _, p := range c.providers {
+		deepMerge(m, p.Data())
+	}
+
+	val := m.Get(selector)
+	if val.IsNil() {
+		return nil
+	}
+	return map[string]interface{}(val.ObjxMap())
+}
+
 // Slice returns the slice value of the given selector.
 func (c *Config) Slice(selector string) []interface{} {
 	val, ok := c.Get(selector)
@@ -0,0 +1,102 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type mapProvider struct {
+	name     string
+	readOnly bool
+	vals     Map
+}
+
+func (p *mapProvider) LookupPath(selector string) (val *Value, ok bool) {
+	val = p.vals.Get(selector)
+	return val, !val.IsNil()
+}
+
+func (p *mapProvider) Set(selector string, val interface{}) interface{} {
+	old := p.vals.Get(selector)
+	p.vals.Set(selector, val)
+	return old.Data()
+}
+
+func (p *mapProvider) Update(vals map[string]interface{}) Map {
+	return p.vals.MergeHere(vals)
+}
+
+func (p *mapProvider) Data() Map      { return p.vals }
+func (p *mapProvider) Name() string   { return p.name }
+func (p *mapProvider) ReadOnly() bool { return p.readOnly }
+
+func newTestConfig() (*Config, *mapProvider, *mapProvider) {
+	var (
+		remote = &mapProvider{name: "remote", vals: NewMap(map[string]interface{}{
+			"database": map[string]interface{}{"host": "remote.local", "port": 3306},
+		})}
+		env = &mapProvider{name: "env", readOnly: true, vals: NewMap(map[string]interface{}{
+			"database": map[string]interface{}{"host": "env.local"},
+		})}
+	)
+
+	cfg := NewConfig(map[string]interface{}{
+		"database": map[string]interface{}{"host": "127.0.0.1", "user": "root"},
+	}, remote, env)
+
+	return cfg, remote, env
+}
+
+func TestConfig_Precedence(t *testing.T) {
+	cfg, _, _ := newTestConfig()
+
+	assert.Equal(t, "env.local", cfg.Str("database.host"))
+	assert.Equal(t, 3306, cfg.Int("database.port"))
+	assert.Equal(t, "root", cfg.Str("database.user"))
+}
+
+func TestConfig_Explain(t *testing.T) {
+	cfg, _, _ := newTestConfig()
+
+	layers := cfg.Explain("database.host")
+	if assert.Len(t, layers, 3) {
+		assert.Equal(t, "env", layers[0].Name)
+		assert.Equal(t, "env.local", layers[0].Value.Str())
+		assert.Equal(t, "remote", layers[1].Name)
+		assert.Equal(t, "defaults", layers[2].Name)
+	}
+
+	assert.Empty(t, cfg.Explain("database.none"))
+}
+
+func TestConfig_SetSkipsReadOnly(t *testing.T) {
+	cfg, remote, env := newTestConfig()
+
+	old, err := cfg.Set("database.port", 3307)
+	assert.NoError(t, err)
+	assert.Equal(t, 3306, old)
+	assert.Equal(t, 3307, remote.vals.Get("database.port").Int())
+	assert.True(t, env.vals.Get("database.port").IsNil())
+}
+
+func TestConfig_All(t *testing.T) {
+	cfg, _, _ := newTestConfig()
+
+	all := cfg.All()
+	assert.Equal(t, "env.local", all.Get("database.host").Str())
+	assert.Equal(t, 3306, all.Get("database.port").Int())
+}
+
+func TestConfig_MergedMap(t *testing.T) {
+	cfg, _, _ := newTestConfig()
+
+	// Map only has the keys of the highest layer
+	assert.Equal(t, map[string]interface{}{"host": "env.local"}, cfg.Map("database"))
+	assert.Equal(t, map[string]interface{}{
+		"host": "env.local",
+		"port": 3306,
+		"user": "root",
+	}, cfg.MergedMap("database"))
+	assert.Nil(t, cfg.MergedMap("missing"))
+}
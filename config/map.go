@@ -1,7 +1,62 @@
 package config
 
-import "github.com/stretchr/objx"
+import (
+	"strconv"
+	"strings"
+
+	"github.com/stretchr/objx"
+)
 
 func NewMap(val interface{}) Map {
 	return objx.New(val)
 }
+
+// ParseValue converts a raw string, as found in environment variables or
+// command-line flags, into an int, float, bool or string value.
+func ParseValue(s string) interface{} {
+	if i, err := strconv.Atoi(s); err == nil {
+		return i
+	}
+
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f
+	}
+
+	switch {
+	case strings.EqualFold(s, "true"):
+		return true
+	case strings.EqualFold(s, "false"):
+		return false
+	}
+
+	return s
+}
+
+// deepMerge merges src into dst, nested maps are merged instead of replaced.
+func deepMerge(dst, src map[string]interface{}) {
+	for k, v := range src {
+		srcMap, ok := asMap(v)
+		if !ok {
+			dst[k] = v
+			continue
+		}
+
+		dstMap, ok := asMap(dst[k])
+		if !ok {
+			dstMap = make(map[string]interface{})
+		}
+		deepMerge(dstMap, srcMap)
+		dst[k] = dstMap
+	}
+}
+
+func asMap(v interface{}) (map[string]interface{}, bool) {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		return x, true
+	case Map:
+		return x, true
+	default:
+		return nil, false
+	}
+}
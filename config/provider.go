@@ -1,8 +1,36 @@
 package config
 
+import "fmt"
+
 type ConfigProvider interface {
 	LookupPath(selector string) (val *Value, ok bool)
 	Set(selector string, val interface{}) interface{}
 	Update(vals map[string]interface{}) Map
 	Data() Map
 }
+
+// NamedProvider is implemented by providers that report a readable layer
+// name, used by Config.Explain.
+type NamedProvider interface {
+	Name() string
+}
+
+// ReadOnlyProvider is implemented by providers that only supply values, such
+// as environment variables or command-line flags. Config never writes to them.
+type ReadOnlyProvider interface {
+	ReadOnly() bool
+}
+
+// ProviderName returns the layer name of the provider.
+func ProviderName(p ConfigProvider) string {
+	if named, ok := p.(NamedProvider); ok {
+		return named.Name()
+	}
+
+	return fmt.Sprintf("%T", p)
+}
+
+func isReadOnly(p ConfigProvider) bool {
+	ro, ok := p.(ReadOnlyProvider)
+	return ok && ro.ReadOnly()
+}
@@ -0,0 +1,166 @@
+package env
+
+import (
+	"os"
+	"strings"
+
+	"github.com/hysios/mx/config"
+)
+
+const (
+	DefaultPrefix    = "MX_"
+	DefaultSeparator = "__"
+)
+
+// EnvProvider is a read-only config provider backed by environment variables.
+//
+// A variable is mapped to a selector by trimming the prefix, splitting on the
+// separator and lower casing each part, so MX_DATABASE__MYSQL__HOST becomes
+// database.mysql.host. Values are parsed with config.ParseValue.
+type EnvProvider struct {
+	prefix    string
+	separator string
+	environ   func() []string
+	vals      config.Map
+}
+
+type EnvOption struct {
+	Prefix    string
+	Separator string
+	Environ   func() []string
+}
+
+type EnvOptionFunc func(*EnvOption)
+
+// WithPrefix sets the prefix of the variables to read, default is MX_.
+func WithPrefix(prefix string) EnvOptionFunc {
+	return func(o *EnvOption) {
+		o.Prefix = prefix
+	}
+}
+
+// WithSeparator sets the separator between selector parts, default is __.
+func WithSeparator(sep string) EnvOptionFunc {
+	return func(o *EnvOption) {
+		o.Separator = sep
+	}
+}
+
+// WithEnviron sets the source of the variables, default is os.Environ.
+func WithEnviron(environ func() []string) EnvOptionFunc {
+	return func(o *EnvOption) {
+		o.Environ = environ
+	}
+}
+
+// NewEnvProvider returns a new EnvProvider.
+func NewEnvProvider(optfns ...EnvOptionFunc) *EnvProvider {
+	var opt = EnvOption{
+		Prefix:    DefaultPrefix,
+		Separator: DefaultSeparator,
+		Environ:   os.Environ,
+	}
+
+	for _, fn := range optfns {
+		fn(&opt)
+	}
+
+	return &EnvProvider{
+		prefix:    opt.Prefix,
+		separator: opt.Separator,
+		environ:   opt.Environ,
+	}
+}
+
+// Selector returns the selector of the variable name, ok is false if the
+// name does not have the provider prefix.
+func (p *EnvProvider) Selector(name string) (selector string, ok bool) {
+	if !strings.HasPrefix(name, p.prefix) {
+		return "", false
+	}
+
+	parts := strings.Split(strings.TrimPrefix(name, p.prefix), p.separator)
+	for i, part := range parts {
+		if part == "" {
+			return "", false
+		}
+		parts[i] = strings.ToLower(part)
+	}
+
+	return strings.Join(parts, "."), true
+}
+
+// load reads the variables into a map
+func (p *EnvProvider) load() config.Map {
+	var vals = config.Map{}
+	for _, kv := range p.environ() {
+		name, val, ok := strings.Cut(kv, "=")
+		if !ok {
+			continue
+		}
+
+		selector, ok := p.Selector(name)
+		if !ok {
+			continue
+		}
+
+		vals.Set(selector, config.ParseValue(val))
+	}
+
+	return vals
+}
+
+// Reload reads the environment variables again.
+func (p *EnvProvider) Reload() {
+	p.vals = p.load()
+}
+
+// LookupPath returns the value of the given selector.
+func (p *EnvProvider) LookupPath(selector string) (val *config.Value, ok bool) {
+	if p.vals == nil {
+		p.Reload()
+	}
+
+	val = p.vals.Get(selector)
+	ok = !val.IsNil()
+	return
+}
+
+// Set sets the value of the given selector in memory only.
+func (p *EnvProvider) Set(selector string, val interface{}) interface{} {
+	if p.vals == nil {
+		p.Reload()
+	}
+
+	old := p.vals.Get(selector)
+	p.vals.Set(selector, val)
+	return old.Data()
+}
+
+// Update updates the values of the given map in memory only.
+func (p *EnvProvider) Update(vals map[string]interface{}) config.Map {
+	if p.vals == nil {
+		p.Reload()
+	}
+
+	return p.vals.MergeHere(vals)
+}
+
+// Data returns the data of the provider.
+func (p *EnvProvider) Data() config.Map {
+	if p.vals == nil {
+		p.Reload()
+	}
+
+	return p.vals
+}
+
+// Name returns the layer name of the provider.
+func (p *EnvProvider) Name() string {
+	return "env"
+}
+
+// ReadOnly reports the provider never persists writes.
+func (p *EnvProvider) ReadOnly() bool {
+	return true
+}
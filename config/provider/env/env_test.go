@@ -0,0 +1,87 @@
+package env
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testEnviron() []string {
+	return []string{
+		"MX_DATABASE__MYSQL__HOST=db.local",
+		"MX_DATABASE__MYSQL__PORT=3307",
+		"MX_GATEWAY__API_PREFIX=/v1",
+		"MX_DEBUG=true",
+		"MX_BROKEN____KEY=1",
+		"HOME=/root",
+	}
+}
+
+func TestEnvProvider_Selector(t *testing.T) {
+	provider := NewEnvProvider()
+
+	tests := []struct {
+		name     string
+		variable string
+		want     string
+		wantOk   bool
+	}{
+		{"nested", "MX_DATABASE__MYSQL__HOST", "database.mysql.host", true},
+		{"underscore", "MX_GATEWAY__API_PREFIX", "gateway.api_prefix", true},
+		{"top level", "MX_DEBUG", "debug", true},
+		{"empty part", "MX_BROKEN____KEY", "", false},
+		{"no prefix", "HOME", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := provider.Selector(tt.variable)
+			assert.Equal(t, tt.wantOk, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestEnvProvider_LookupPath(t *testing.T) {
+	provider := NewEnvProvider(WithEnviron(testEnviron))
+
+	tests := []struct {
+		name     string
+		selector string
+		want     interface{}
+		wantOk   bool
+	}{
+		{"string", "database.mysql.host", "db.local", true},
+		{"int", "database.mysql.port", 3307, true},
+		{"bool", "debug", true, true},
+		{"underscore", "gateway.api_prefix", "/v1", true},
+		{"non-existing", "home", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := provider.LookupPath(tt.selector)
+			assert.Equal(t, tt.wantOk, ok)
+			if tt.wantOk {
+				assert.Equal(t, tt.want, got.Data())
+			}
+		})
+	}
+}
+
+func TestEnvProvider_Prefix(t *testing.T) {
+	provider := NewEnvProvider(
+		WithPrefix("APP_"),
+		WithSeparator("_"),
+		WithEnviron(func() []string {
+			return []string{"APP_REDIS_ADDR=127.0.0.1:6379", "MX_DEBUG=true"}
+		}),
+	)
+
+	val, ok := provider.LookupPath("redis.addr")
+	assert.True(t, ok)
+	assert.Equal(t, "127.0.0.1:6379", val.Str())
+
+	_, ok = provider.LookupPath("debug")
+	assert.False(t, ok)
+}
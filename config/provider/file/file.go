@@ -1,57 +1,421 @@
 package file
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/hysios/mx/config"
+	"github.com/hysios/mx/logger"
+	"github.com/pelletier/go-toml/v2"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
 )
 
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+	FormatTOML = "toml"
+)
+
+// FileProvider is a config provider that uses a JSON, YAML or TOML file as
+// the backend, the format is detected by the file extension.
 type FileProvider struct {
-	// contains filtered or unexported fields
-	vals config.Map
+	path     string
+	format   string
+	writable bool
+	onChange func(config.Map)
+
+	vals    config.Map
+	watcher *fsnotify.Watcher
+	l       sync.RWMutex
+}
+
+type FileOption struct {
+	// Format overrides the format detected from the file extension
+	Format string
+	// Writable writes Set and Update back to the file
+	Writable bool
+	// Watch reloads the file when it changes on disk
+	Watch bool
+	// OnChange is called with the new values after a reload
+	OnChange func(config.Map)
+}
+
+type FileOptionFunc func(*FileOption)
+
+// WithFormat sets the file format, one of json, yaml or toml.
+func WithFormat(format string) FileOptionFunc {
+	return func(o *FileOption) {
+		o.Format = format
+	}
+}
+
+// WithWritable writes changes back to the file with an atomic rename.
+func WithWritable() FileOptionFunc {
+	return func(o *FileOption) {
+		o.Writable = true
+	}
+}
+
+// WithWatch reloads the file when it changes on disk.
+func WithWatch() FileOptionFunc {
+	return func(o *FileOption) {
+		o.Watch = true
+	}
 }
 
-func NewFileProvider(path string) (*FileProvider, error) {
-	// open file
-	// read file
-	f, err := os.OpenFile(path, os.O_RDONLY, 0644)
+// WithOnChange sets the callback called after the file is reloaded.
+func WithOnChange(fn func(config.Map)) FileOptionFunc {
+	return func(o *FileOption) {
+		o.OnChange = fn
+	}
+}
+
+// NewFileProvider returns a new FileProvider.
+func NewFileProvider(path string, optfns ...FileOptionFunc) (*FileProvider, error) {
+	var opt FileOption
+	for _, fn := range optfns {
+		fn(&opt)
+	}
+
+	format := opt.Format
+	if format == "" {
+		format = formatOf(path)
+	}
+
+	switch format {
+	case FormatJSON, FormatYAML, FormatTOML:
+	default:
+		return nil, fmt.Errorf("unsupported config file format: %s", path)
+	}
+
+	f := &FileProvider{
+		path:     path,
+		format:   format,
+		writable: opt.Writable,
+		onChange: opt.OnChange,
+	}
+
+	vals, err := f.load()
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
-	// json unmarshal to map[string]interface{}
-	var vals = make(map[string]interface{})
+	f.vals = vals
 
-	if err = json.NewDecoder(f).Decode(vals); err != nil {
-		return nil, err
+	if opt.Watch {
+		if err := f.watch(); err != nil {
+			return nil, err
+		}
 	}
 
-	return &FileProvider{vals: config.NewMap(vals)}, nil
+	return f, nil
 }
 
 // MustFileProvider returns a new FileProvider or panic.
-func MustFileProvider(path string) *FileProvider {
-	f, err := NewFileProvider(path)
+func MustFileProvider(path string, optfns ...FileOptionFunc) *FileProvider {
+	f, err := NewFileProvider(path, optfns...)
 	if err != nil {
 		panic(err)
 	}
 	return f
 }
 
+// formatOf returns the format of the file extension
+func formatOf(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return FormatJSON
+	case ".yaml", ".yml":
+		return FormatYAML
+	case ".toml":
+		return FormatTOML
+	default:
+		return ""
+	}
+}
+
+// load reads the file into a map
+func (f *FileProvider) load() (config.Map, error) {
+	b, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var vals = make(map[string]interface{})
+	if len(bytes.TrimSpace(b)) == 0 {
+		return vals, nil
+	}
+
+	switch f.format {
+	case FormatJSON:
+		err = json.Unmarshal(b, &vals)
+	case FormatYAML:
+		err = yaml.Unmarshal(b, &vals)
+	case FormatTOML:
+		err = toml.Unmarshal(b, &vals)
+		normalizeInts(vals)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decode %s: %w", f.path, err)
+	}
+
+	return config.NewMap(vals), nil
+}
+
+// normalizeInts converts the int64 values decoded from TOML to int, which
+// the config getters expect.
+func normalizeInts(vals map[string]interface{}) {
+	for k, v := range vals {
+		vals[k] = normalizeInt(v)
+	}
+}
+
+// normalizeInt converts the int64 value, or the ones nested in the tables
+// and arrays, e.g. the arrays of tables
+func normalizeInt(v interface{}) interface{} {
+	switch x := v.(type) {
+	case int64:
+		return int(x)
+	case map[string]interface{}:
+		normalizeInts(x)
+	case []interface{}:
+		for i, item := range x {
+			x[i] = normalizeInt(item)
+		}
+	}
+
+	return v
+}
+
+// encode marshals the values in the file format
+func (f *FileProvider) encode(vals config.Map) ([]byte, error) {
+	var data = map[string]interface{}(vals)
+
+	switch f.format {
+	case FormatJSON:
+		return json.MarshalIndent(data, "", "    ")
+	case FormatYAML:
+		return yaml.Marshal(data)
+	case FormatTOML:
+		return toml.Marshal(data)
+	default:
+		return nil, fmt.Errorf("unsupported config file format: %s", f.format)
+	}
+}
+
+// store writes the values to a temporary file and renames it over the
+// config file, so readers never see a partial write.
+func (f *FileProvider) store(vals config.Map) error {
+	b, err := f.encode(vals)
+	if err != nil {
+		return err
+	}
+
+	var mode os.FileMode = 0644
+	if fi, err := os.Stat(f.path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), "."+filepath.Base(f.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	if err = os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), f.path)
+}
+
+// Reload reads the file again and replaces the values.
+func (f *FileProvider) Reload() error {
+	vals, err := f.load()
+	if err != nil {
+		return err
+	}
+
+	f.l.Lock()
+	f.vals = vals
+	f.l.Unlock()
+
+	if f.onChange != nil {
+		f.onChange(vals)
+	}
+	return nil
+}
+
+// watch watches the file directory, editors and the atomic write-back
+// replace the file, which a watch on the file itself would lose.
+func (f *FileProvider) watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	if err = watcher.Add(filepath.Dir(f.path)); err != nil {
+		watcher.Close()
+		return err
+	}
+	f.watcher = watcher
+
+	go func() {
+		var name = filepath.Clean(f.path)
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+
+				if filepath.Clean(event.Name) != name {
+					continue
+				}
+
+				if !event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) {
+					continue
+				}
+
+				if err := f.Reload(); err != nil {
+					logger.Logger.Warn("reload config file failed", zap.String("path", f.path), zap.Error(err))
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logger.Logger.Warn("watch config file failed", zap.String("path", f.path), zap.Error(err))
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Close stops watching the file.
+func (f *FileProvider) Close() error {
+	if f.watcher != nil {
+		return f.watcher.Close()
+	}
+
+	return nil
+}
+
+// LookupPath returns the value of the given selector.
 func (f *FileProvider) LookupPath(selector string) (val *config.Value, ok bool) {
+	f.l.RLock()
+	defer f.l.RUnlock()
+
 	val = f.vals.Get(selector)
 	ok = !val.IsNil()
-
 	return
 }
 
-func (f *FileProvider) Set(selector string, val interface{}) (interface{}, error) {
-	old := f.vals.Get(selector)
-	f.vals.Set(selector, val)
-	return old.Data(), nil
+// Set sets the value of the given selector. A writable provider writes the
+// file first and keeps the old values when the write fails.
+func (f *FileProvider) Set(selector string, val interface{}) interface{} {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	old := f.vals.Get(selector).Data()
+	vals := cloneMap(f.vals)
+	vals.Set(selector, val)
+
+	if err := f.commit(vals); err != nil {
+		logger.Logger.Warn("store config file failed", zap.String("path", f.path), zap.Error(err))
+	}
+
+	return old
 }
 
+// Update updates the values of the given map. A writable provider writes
+// the file first and keeps the old values when the write fails.
 func (f *FileProvider) Update(vals map[string]interface{}) config.Map {
-	return f.vals.MergeHere(vals)
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	merged := cloneMap(f.vals).MergeHere(vals)
+	if err := f.commit(merged); err != nil {
+		logger.Logger.Warn("store config file failed", zap.String("path", f.path), zap.Error(err))
+	}
+
+	return f.vals
+}
+
+// commit stores the values when the provider is writable, then replaces the
+// values in memory. The caller must hold the lock.
+func (f *FileProvider) commit(vals config.Map) error {
+	if f.writable {
+		if err := f.store(vals); err != nil {
+			return err
+		}
+	}
+
+	f.vals = vals
+	return nil
+}
+
+// cloneMap deep copies the nested maps and slices of the values, so a
+// change can be prepared without touching the current values.
+func cloneMap(vals config.Map) config.Map {
+	return config.Map(cloneValue(map[string]interface{}(vals)).(map[string]interface{}))
+}
+
+func cloneValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(x))
+		for k, item := range x {
+			m[k] = cloneValue(item)
+		}
+		return m
+	case config.Map:
+		return config.Map(cloneValue(map[string]interface{}(x)).(map[string]interface{}))
+	case []interface{}:
+		s := make([]interface{}, len(x))
+		for i, item := range x {
+			s[i] = cloneValue(item)
+		}
+		return s
+	default:
+		return v
+	}
+}
+
+// Data returns the data of the provider.
+func (f *FileProvider) Data() config.Map {
+	f.l.RLock()
+	defer f.l.RUnlock()
+
+	return f.vals
+}
+
+// Name returns the layer name of the provider.
+func (f *FileProvider) Name() string {
+	return "file:" + f.path
+}
+
+// ReadOnly reports whether the provider does not write changes back.
+func (f *FileProvider) ReadOnly() bool {
+	return !f.writable
 }
@@ -0,0 +1,155 @@
+package file
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hysios/mx/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, []byte(content), 0644)
+	assert.NoError(t, err)
+	return path
+}
+
+func TestNewFileProvider_Formats(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+	}{
+		{"json", "config.json", `{"database": {"mysql": {"host": "127.0.0.1", "port": 3306}}}`},
+		{"yaml", "config.yaml", "database:\n  mysql:\n    host: 127.0.0.1\n    port: 3306\n"},
+		{"yml", "config.yml", "database:\n  mysql:\n    host: 127.0.0.1\n    port: 3306\n"},
+		{"toml", "config.toml", "[database.mysql]\nhost = \"127.0.0.1\"\nport = 3306\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider, err := NewFileProvider(writeFile(t, tt.file, tt.content))
+			assert.NoError(t, err)
+
+			val, ok := provider.LookupPath("database.mysql.host")
+			assert.True(t, ok)
+			assert.Equal(t, "127.0.0.1", val.Str())
+
+			cfg := config.NewConfig(nil, provider)
+			assert.Equal(t, 3306, cfg.Int("database.mysql.port"))
+		})
+	}
+}
+
+func TestNewFileProvider_TOMLArrayOfTables(t *testing.T) {
+	provider, err := NewFileProvider(writeFile(t, "config.toml", "ports = [80, 443]\n\n[[servers]]\nname = \"a\"\nport = 8080\n\n[[servers]]\nname = \"b\"\nport = 8081\nweights = [[1, 2]]\n"))
+	assert.NoError(t, err)
+
+	vals := provider.Data()
+	assert.Equal(t, []interface{}{80, 443}, vals["ports"])
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"name": "a", "port": 8080},
+		map[string]interface{}{"name": "b", "port": 8081, "weights": []interface{}{[]interface{}{1, 2}}},
+	}, vals["servers"])
+}
+
+func TestNewFileProvider_UnknownFormat(t *testing.T) {
+	_, err := NewFileProvider(writeFile(t, "config.ini", "a=1"))
+	assert.Error(t, err)
+}
+
+func TestFileProvider_WriteBack(t *testing.T) {
+	for _, file := range []string{"config.json", "config.yaml", "config.toml"} {
+		t.Run(file, func(t *testing.T) {
+			path := writeFile(t, file, "")
+			provider, err := NewFileProvider(path, WithWritable())
+			assert.NoError(t, err)
+			assert.False(t, provider.ReadOnly())
+
+			provider.Set("gateway.addr", ":8080")
+			provider.Update(map[string]interface{}{"debug": true})
+
+			reload, err := NewFileProvider(path)
+			assert.NoError(t, err)
+
+			val, ok := reload.LookupPath("gateway.addr")
+			assert.True(t, ok)
+			assert.Equal(t, ":8080", val.Str())
+
+			val, ok = reload.LookupPath("debug")
+			assert.True(t, ok)
+			assert.True(t, val.Bool())
+
+			// no temporary file is left behind
+			entries, err := os.ReadDir(filepath.Dir(path))
+			assert.NoError(t, err)
+			assert.Len(t, entries, 1)
+		})
+	}
+}
+
+func TestFileProvider_WriteBackFailed(t *testing.T) {
+	path := writeFile(t, "config.json", `{"database": {"host": "127.0.0.1"}}`)
+	provider, err := NewFileProvider(path, WithWritable())
+	assert.NoError(t, err)
+
+	// the temporary file can't be created once the directory is gone
+	assert.NoError(t, os.RemoveAll(filepath.Dir(path)))
+
+	assert.NotPanics(t, func() {
+		provider.Set("database.host", "10.0.0.1")
+	})
+	provider.Update(map[string]interface{}{"debug": true})
+
+	val, ok := provider.LookupPath("database.host")
+	assert.True(t, ok)
+	assert.Equal(t, "127.0.0.1", val.Str())
+
+	_, ok = provider.LookupPath("debug")
+	assert.False(t, ok)
+}
+
+func TestFileProvider_ReadOnly(t *testing.T) {
+	path := writeFile(t, "config.json", `{"a": 1}`)
+	provider, err := NewFileProvider(path)
+	assert.NoError(t, err)
+	assert.True(t, provider.ReadOnly())
+
+	provider.Set("a", 2)
+	b, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"a": 1}`, string(b))
+}
+
+func TestFileProvider_Watch(t *testing.T) {
+	var (
+		path    = writeFile(t, "config.yaml", "name: old\n")
+		changed = make(chan config.Map, 1)
+	)
+
+	provider, err := NewFileProvider(path, WithWatch(), WithOnChange(func(vals config.Map) {
+		select {
+		case changed <- vals:
+		default:
+		}
+	}))
+	assert.NoError(t, err)
+	defer provider.Close()
+
+	err = os.WriteFile(path, []byte("name: new\n"), 0644)
+	assert.NoError(t, err)
+
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("file change not observed")
+	}
+
+	assert.Eventually(t, func() bool {
+		val, ok := provider.LookupPath("name")
+		return ok && val.Str() == "new"
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,220 @@
+package flag
+
+import (
+	"time"
+
+	"github.com/hysios/mx/config"
+	"github.com/spf13/pflag"
+	"github.com/urfave/cli/v2"
+)
+
+// FlagProvider is a read-only config provider backed by command-line flags.
+//
+// Only flags that were explicitly set on the command line supply values, so
+// flag defaults never shadow lower layers. A flag name is used as selector
+// as-is (e.g. --database.mysql.host), use Bind to map other names.
+type FlagProvider struct {
+	source flagSource
+	binds  map[string]string
+	vals   config.Map
+}
+
+// flagSource abstracts the flag library
+type flagSource interface {
+	// setNames returns the names of the flags set on the command line
+	setNames() []string
+	// value returns the typed value of the named flag
+	value(name string) interface{}
+}
+
+// NewPFlagProvider returns a new FlagProvider reading from a pflag.FlagSet.
+func NewPFlagProvider(fs *pflag.FlagSet) *FlagProvider {
+	return newFlagProvider(&pflagSource{fs: fs})
+}
+
+// NewCliProvider returns a new FlagProvider reading from a urfave/cli
+// context, including the flags of its parent commands.
+func NewCliProvider(ctx *cli.Context) *FlagProvider {
+	return newFlagProvider(&cliSource{ctx: ctx})
+}
+
+func newFlagProvider(source flagSource) *FlagProvider {
+	return &FlagProvider{
+		source: source,
+		binds:  make(map[string]string),
+	}
+}
+
+// Bind maps the flag name to the selector.
+func (p *FlagProvider) Bind(name, selector string) *FlagProvider {
+	p.binds[name] = selector
+	p.vals = nil
+	return p
+}
+
+// selector returns the selector of the flag name
+func (p *FlagProvider) selector(name string) string {
+	if selector, ok := p.binds[name]; ok {
+		return selector
+	}
+
+	return name
+}
+
+// load reads the set flags into a map
+func (p *FlagProvider) load() config.Map {
+	var vals = config.Map{}
+	for _, name := range p.source.setNames() {
+		val := p.source.value(name)
+		if val == nil {
+			continue
+		}
+		vals.Set(p.selector(name), val)
+	}
+
+	return vals
+}
+
+// LookupPath returns the value of the given selector.
+func (p *FlagProvider) LookupPath(selector string) (val *config.Value, ok bool) {
+	if p.vals == nil {
+		p.vals = p.load()
+	}
+
+	val = p.vals.Get(selector)
+	ok = !val.IsNil()
+	return
+}
+
+// Set sets the value of the given selector in memory only.
+func (p *FlagProvider) Set(selector string, val interface{}) interface{} {
+	if p.vals == nil {
+		p.vals = p.load()
+	}
+
+	old := p.vals.Get(selector)
+	p.vals.Set(selector, val)
+	return old.Data()
+}
+
+// Update updates the values of the given map in memory only.
+func (p *FlagProvider) Update(vals map[string]interface{}) config.Map {
+	if p.vals == nil {
+		p.vals = p.load()
+	}
+
+	return p.vals.MergeHere(vals)
+}
+
+// Data returns the data of the provider.
+func (p *FlagProvider) Data() config.Map {
+	if p.vals == nil {
+		p.vals = p.load()
+	}
+
+	return p.vals
+}
+
+// Name returns the layer name of the provider.
+func (p *FlagProvider) Name() string {
+	return "flag"
+}
+
+// ReadOnly reports the provider never persists writes.
+func (p *FlagProvider) ReadOnly() bool {
+	return true
+}
+
+type pflagSource struct {
+	fs *pflag.FlagSet
+}
+
+func (s *pflagSource) setNames() []string {
+	var names []string
+	s.fs.Visit(func(f *pflag.Flag) {
+		names = append(names, f.Name)
+	})
+
+	return names
+}
+
+func (s *pflagSource) value(name string) interface{} {
+	f := s.fs.Lookup(name)
+	if f == nil {
+		return nil
+	}
+
+	switch f.Value.Type() {
+	case "bool":
+		v, _ := s.fs.GetBool(name)
+		return v
+	case "duration":
+		v, _ := s.fs.GetDuration(name)
+		return int64(v)
+	case "stringSlice":
+		v, _ := s.fs.GetStringSlice(name)
+		return v
+	case "stringArray":
+		v, _ := s.fs.GetStringArray(name)
+		return v
+	case "string":
+		return f.Value.String()
+	default:
+		return config.ParseValue(f.Value.String())
+	}
+}
+
+type cliSource struct {
+	ctx *cli.Context
+}
+
+// setNames returns the names set on the command line of the context and
+// its parents
+func (s *cliSource) setNames() []string {
+	var (
+		names []string
+		seen  = make(map[string]bool)
+	)
+
+	for _, ctx := range s.ctx.Lineage() {
+		for _, name := range ctx.LocalFlagNames() {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+
+	return names
+}
+
+// value returns the value of the innermost context which set the flag, a
+// subcommand's flag wins over the one of its parent
+func (s *cliSource) value(name string) interface{} {
+	for _, ctx := range s.ctx.Lineage() {
+		for _, local := range ctx.LocalFlagNames() {
+			if local == name {
+				return cliValue(ctx.Value(name))
+			}
+		}
+	}
+
+	return nil
+}
+
+func cliValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case time.Duration:
+		return int64(v)
+	case cli.StringSlice:
+		return v.Value()
+	case cli.IntSlice:
+		return v.Value()
+	case cli.Int64Slice:
+		return v.Value()
+	case cli.Float64Slice:
+		return v.Value()
+	default:
+		return v
+	}
+}
@@ -0,0 +1,113 @@
+package flag
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli/v2"
+)
+
+func TestPFlagProvider_LookupPath(t *testing.T) {
+	fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	fs.String("database.mysql.host", "127.0.0.1", "mysql host")
+	fs.Int("port", 8080, "listen port")
+	fs.Duration("timeout", time.Second, "timeout")
+	fs.Bool("debug", false, "debug mode")
+
+	err := fs.Parse([]string{"--database.mysql.host=db.local", "--port=9090", "--timeout=3s"})
+	assert.NoError(t, err)
+
+	provider := NewPFlagProvider(fs).Bind("port", "gateway.port")
+
+	tests := []struct {
+		name     string
+		selector string
+		want     interface{}
+		wantOk   bool
+	}{
+		{"string", "database.mysql.host", "db.local", true},
+		{"bound", "gateway.port", 9090, true},
+		{"duration", "timeout", int64(3 * time.Second), true},
+		{"not set", "debug", nil, false},
+		{"unbound name", "port", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := provider.LookupPath(tt.selector)
+			assert.Equal(t, tt.wantOk, ok)
+			if tt.wantOk {
+				assert.Equal(t, tt.want, got.Data())
+			}
+		})
+	}
+}
+
+func TestCliProvider_LookupPath(t *testing.T) {
+	var provider *FlagProvider
+
+	app := &cli.App{
+		Name: "test",
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "database.mysql.host", Value: "127.0.0.1"},
+			&cli.IntFlag{Name: "port", Value: 8080},
+			&cli.StringSliceFlag{Name: "tags"},
+			&cli.BoolFlag{Name: "debug"},
+		},
+		Action: func(ctx *cli.Context) error {
+			provider = NewCliProvider(ctx)
+			return nil
+		},
+	}
+
+	err := app.Run([]string{"test", "--database.mysql.host=db.local", "--port=9090", "--tags=a", "--tags=b"})
+	assert.NoError(t, err)
+
+	val, ok := provider.LookupPath("database.mysql.host")
+	assert.True(t, ok)
+	assert.Equal(t, "db.local", val.Str())
+
+	val, ok = provider.LookupPath("port")
+	assert.True(t, ok)
+	assert.Equal(t, 9090, val.Int())
+
+	val, ok = provider.LookupPath("tags")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"a", "b"}, val.StrSlice())
+
+	_, ok = provider.LookupPath("debug")
+	assert.False(t, ok)
+}
+
+func TestCliProvider_Subcommand(t *testing.T) {
+	var provider *FlagProvider
+
+	app := &cli.App{
+		Name:  "test",
+		Flags: []cli.Flag{&cli.IntFlag{Name: "port", Value: 8080}},
+		Commands: []*cli.Command{{
+			Name:  "serve",
+			Flags: []cli.Flag{&cli.IntFlag{Name: "port", Value: 8000}},
+			Action: func(ctx *cli.Context) error {
+				provider = NewCliProvider(ctx)
+				return nil
+			},
+		}},
+	}
+
+	// the subcommand's flag wins
+	err := app.Run([]string{"test", "--port=9090", "serve", "--port=9091"})
+	assert.NoError(t, err)
+	val, ok := provider.LookupPath("port")
+	assert.True(t, ok)
+	assert.Equal(t, 9091, val.Int())
+
+	// the parent's flag when the subcommand's is not set
+	err = app.Run([]string{"test", "--port=9090", "serve"})
+	assert.NoError(t, err)
+	val, ok = provider.LookupPath("port")
+	assert.True(t, ok)
+	assert.Equal(t, 9090, val.Int())
+}
@@ -69,6 +69,28 @@ func (p *RedisProvider) load() (val config.Map, ok bool) {
 	return val, true
 }
 
+// Reload reads the value from redis again, for the changes made by other
+// writers. A missing key is an empty config, on error the loaded value is
+// kept.
+func (p *RedisProvider) Reload() error {
+	rslt, err := p.rdb.Get(context.Background(), p.Key).Result()
+	switch {
+	case err == redis.Nil:
+		p.vals = config.Map{}
+		return nil
+	case err != nil:
+		return err
+	}
+
+	val := make(config.Map)
+	if err = json.Unmarshal([]byte(rslt), &val); err != nil {
+		return err
+	}
+
+	p.vals = val
+	return nil
+}
+
 // store set value to redis
 func (p *RedisProvider) store(val config.Map) (interface{}, error) {
 	var ctx = context.Background()
@@ -141,3 +163,8 @@ func (p *RedisProvider) Data() config.Map {
 	}
 	return p.vals
 }
+
+// Name returns the layer name of the provider.
+func (p *RedisProvider) Name() string {
+	return "redis:" + p.Key
+}
@@ -1,6 +1,7 @@
 package redis
 
 import (
+	"errors"
 	"reflect"
 	"testing"
 
@@ -137,3 +138,32 @@ func TestUpdate(t *testing.T) {
 		t.Errorf("Update() = %v, want %v", oldm, expect)
 	}
 }
+
+func TestReload(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	mock.ExpectPing().SetVal("PONG")
+	mock.ExpectGet("test").SetVal(`{"a": 1}`)
+	mock.ExpectGet("test").SetVal(`{"a": 2}`)
+	mock.ExpectGet("test").SetErr(errors.New("connection refused"))
+	mock.ExpectGet("test").RedisNil()
+
+	provider, err := NewRedisProvider(&RedisOption{
+		Key:  "test",
+		Mock: db,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, provider.Data().Get("a").Int())
+
+	// a change made by another writer
+	assert.NoError(t, provider.Reload())
+	assert.Equal(t, 2, provider.Data().Get("a").Int())
+
+	// a failed reload keeps the loaded value
+	assert.Error(t, provider.Reload())
+	assert.Equal(t, 2, provider.Data().Get("a").Int())
+
+	// the deleted key is an empty config
+	assert.NoError(t, provider.Reload())
+	assert.Empty(t, provider.Data())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,202 @@
+// Package remote serves config providers over the mx.Config gRPC service
+// and reads them back with RemoteProvider, so services need no credentials
+// of the config backend.
+package remote
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/hysios/mx/config"
+	"github.com/hysios/mx/config/provider/remote/pb"
+	"github.com/hysios/mx/logger"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+// RemoteProvider is a config provider reading the config of a key from a
+// mx.Config server. The config is cached and kept up to date by a watch
+// stream, writes go to the server.
+type RemoteProvider struct {
+	cli     pb.ConfigClient
+	key     string
+	timeout time.Duration
+
+	vals    config.Map
+	l       sync.RWMutex
+	closefn context.CancelFunc
+}
+
+type RemoteOption struct {
+	// Timeout is the timeout of Get and Set calls, default is 5s
+	Timeout time.Duration
+	// OnChange is called with the new values pushed by the server
+	OnChange func(config.Map)
+}
+
+type RemoteOptionFunc func(*RemoteOption)
+
+// WithTimeout sets the timeout of Get and Set calls.
+func WithTimeout(d time.Duration) RemoteOptionFunc {
+	return func(o *RemoteOption) {
+		o.Timeout = d
+	}
+}
+
+// WithOnChange sets the callback called when the server pushes a change.
+func WithOnChange(fn func(config.Map)) RemoteOptionFunc {
+	return func(o *RemoteOption) {
+		o.OnChange = fn
+	}
+}
+
+// NewRemoteProvider returns a new RemoteProvider of the key, it loads the
+// config and then watches it until Close.
+func NewRemoteProvider(conn grpc.ClientConnInterface, key string, optfns ...RemoteOptionFunc) (*RemoteProvider, error) {
+	var opt = RemoteOption{
+		Timeout: 5 * time.Second,
+	}
+
+	for _, fn := range optfns {
+		fn(&opt)
+	}
+
+	p := &RemoteProvider{
+		cli:     pb.NewConfigClient(conn),
+		key:     key,
+		timeout: opt.Timeout,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	resp, err := p.cli.Get(ctx, &pb.GetRequest{Key: key})
+	if err != nil {
+		return nil, err
+	}
+	p.vals = asMap(fromValue(resp.Value))
+
+	ctx, p.closefn = context.WithCancel(context.Background())
+	go p.watch(ctx, opt.OnChange)
+
+	return p, nil
+}
+
+// watch keeps the cache up to date, reconnecting with backoff
+func (p *RemoteProvider) watch(ctx context.Context, onChange func(config.Map)) {
+	var backoff = time.Second
+
+	for {
+		stream, err := p.cli.Watch(ctx, &pb.WatchRequest{Key: p.key})
+		if err == nil {
+			for {
+				resp, err := stream.Recv()
+				if err != nil {
+					break
+				}
+				backoff = time.Second
+
+				vals := asMap(normalize(resp.Data.AsMap()))
+				p.l.Lock()
+				p.vals = vals
+				p.l.Unlock()
+
+				if onChange != nil {
+					onChange(vals)
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		logger.Logger.Warn("rewatch remote config", zap.String("key", p.key))
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+// Close stops watching the config.
+func (p *RemoteProvider) Close() error {
+	if p.closefn != nil {
+		p.closefn()
+	}
+	return nil
+}
+
+// LookupPath returns the value of the given selector.
+func (p *RemoteProvider) LookupPath(selector string) (val *config.Value, ok bool) {
+	p.l.RLock()
+	defer p.l.RUnlock()
+
+	val = p.vals.Get(selector)
+	ok = !val.IsNil()
+	return
+}
+
+// Set sets the value of the given selector on the server.
+func (p *RemoteProvider) Set(selector string, val interface{}) interface{} {
+	value, err := toValue(val)
+	if err != nil {
+		panic(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	resp, err := p.cli.Set(ctx, &pb.SetRequest{Key: p.key, Selector: selector, Value: value})
+	if err != nil {
+		panic(err)
+	}
+
+	p.l.Lock()
+	p.vals.Set(selector, val)
+	p.l.Unlock()
+
+	return fromValue(resp.Old)
+}
+
+// Update sets each top level value of the given map on the server.
+func (p *RemoteProvider) Update(vals map[string]interface{}) config.Map {
+	for k, v := range vals {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					logger.Logger.Warn("update remote config failed", zap.String("key", k), zap.Any("error", r))
+				}
+			}()
+			p.Set(k, v)
+		}()
+	}
+
+	return p.Data()
+}
+
+// Data returns the data of the provider.
+func (p *RemoteProvider) Data() config.Map {
+	p.l.RLock()
+	defer p.l.RUnlock()
+
+	return p.vals
+}
+
+// Name returns the layer name of the provider.
+func (p *RemoteProvider) Name() string {
+	return "remote:" + p.key
+}
+
+func asMap(v interface{}) config.Map {
+	if m, ok := v.(map[string]interface{}); ok {
+		return config.Map(m)
+	}
+
+	if v != nil {
+		logger.Logger.Warn("remote config is not a map", zap.Any("value", v))
+	}
+	return config.Map{}
+}
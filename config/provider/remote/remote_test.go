@@ -0,0 +1,196 @@
+package remote
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redismock/v8"
+	"github.com/hysios/mx/config"
+	"github.com/hysios/mx/config/provider/file"
+	"github.com/hysios/mx/config/provider/redis"
+	"github.com/hysios/mx/config/provider/remote/pb"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func testFile(t *testing.T, data string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	assert.NoError(t, os.WriteFile(path, []byte(data), 0644))
+	return path
+}
+
+func testProvider(t *testing.T, data string) *file.FileProvider {
+	return file.MustFileProvider(testFile(t, data), file.WithWritable())
+}
+
+func serve(t *testing.T, srv *Server) *grpc.ClientConn {
+	ln := bufconn.Listen(1 << 20)
+	s := grpc.NewServer()
+	pb.RegisterConfigServer(s, srv)
+	go s.Serve(ln)
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return ln.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	assert.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestRemoteProvider(t *testing.T) {
+	var (
+		backend = testProvider(t, `{"database": {"mysql": {"host": "db.local", "port": 3306}}, "tags": ["a", "b"]}`)
+		conn    = serve(t, NewServer(backend, WithPollInterval(10*time.Millisecond), WithWritable()))
+	)
+
+	p, err := NewRemoteProvider(conn, "/mx.config")
+	assert.NoError(t, err)
+	defer p.Close()
+
+	cfg := config.NewConfig(nil, p)
+	assert.Equal(t, "db.local", cfg.Str("database.mysql.host"))
+	assert.Equal(t, 3306, cfg.Int("database.mysql.port"))
+	assert.Equal(t, []interface{}{"a", "b"}, cfg.Slice("tags"))
+	assert.Equal(t, "remote:/mx.config", config.ProviderName(p))
+
+	old, err := cfg.Set("database.mysql.host", "db.remote")
+	assert.NoError(t, err)
+	assert.Equal(t, "db.local", old)
+	assert.Equal(t, "db.remote", cfg.Str("database.mysql.host"))
+
+	// the write reached the backend
+	val, ok := backend.LookupPath("database.mysql.host")
+	assert.True(t, ok)
+	assert.Equal(t, "db.remote", val.Str())
+}
+
+func TestRemoteProviderWatch(t *testing.T) {
+	var (
+		path    = testFile(t, `{"feature": false}`)
+		conn    = serve(t, NewServer(file.MustFileProvider(path), WithPollInterval(10*time.Millisecond)))
+		changes = make(chan config.Map, 10)
+	)
+
+	p, err := NewRemoteProvider(conn, "", WithOnChange(func(m config.Map) {
+		changes <- m
+	}))
+	assert.NoError(t, err)
+	defer p.Close()
+
+	// the current config is sent first
+	select {
+	case <-changes:
+	case <-time.After(time.Second):
+		t.Fatal("watch not started")
+	}
+
+	// a change made outside the server is picked up by polling
+	assert.NoError(t, os.WriteFile(path, []byte(`{"feature": true}`), 0644))
+
+	select {
+	case m := <-changes:
+		assert.Equal(t, true, m.Get("feature").Bool())
+	case <-time.After(time.Second):
+		t.Fatal("change not pushed")
+	}
+
+	val, ok := p.LookupPath("feature")
+	assert.True(t, ok)
+	assert.True(t, val.Bool())
+}
+
+func TestRemoteProviderWatchRedis(t *testing.T) {
+	db, mock := redismock.NewClientMock()
+	mock.ExpectPing().SetVal("PONG")
+	mock.ExpectGet("/mx.config").SetVal(`{"feature": false}`)
+	// written to redis by another replica or mx config set
+	mock.ExpectGet("/mx.config").SetVal(`{"feature": true}`)
+
+	var (
+		backend = redis.MustRedisProvider(&redis.RedisOption{Key: "/mx.config", Mock: db})
+		conn    = serve(t, NewScopedServer(func(key string) (config.ConfigProvider, error) {
+			return backend, nil
+		}, WithPollInterval(10*time.Millisecond)))
+		changes = make(chan config.Map, 10)
+	)
+
+	p, err := NewRemoteProvider(conn, "/mx.config", WithOnChange(func(m config.Map) {
+		changes <- m
+	}))
+	assert.NoError(t, err)
+	defer p.Close()
+
+	select {
+	case m := <-changes:
+		assert.Equal(t, false, m.Get("feature").Bool())
+	case <-time.After(time.Second):
+		t.Fatal("watch not started")
+	}
+
+	select {
+	case m := <-changes:
+		assert.Equal(t, true, m.Get("feature").Bool())
+	case <-time.After(time.Second):
+		t.Fatal("change not pushed")
+	}
+}
+
+func TestScopedServer(t *testing.T) {
+	var (
+		backends = map[string]config.ConfigProvider{
+			"/mx.config":      testProvider(t, `{"addr": ":8080", "name": "mx"}`),
+			"/mx.user.config": testProvider(t, `{"addr": ":9090"}`),
+		}
+		resolved []string
+		conn     = serve(t, NewScopedServer(func(key string) (config.ConfigProvider, error) {
+			resolved = append(resolved, key)
+			return backends[key], nil
+		}))
+		providers []config.ConfigProvider
+	)
+
+	for _, key := range []string{"/mx.config", "/mx.user.config"} {
+		p, err := NewRemoteProvider(conn, key)
+		assert.NoError(t, err)
+		defer p.Close()
+		providers = append(providers, p)
+	}
+
+	cfg := config.NewConfig(nil, providers...)
+	assert.Equal(t, ":9090", cfg.Str("addr"))
+	assert.Equal(t, "mx", cfg.Str("name"))
+
+	_, err := NewRemoteProvider(conn, "/missing.config")
+	assert.Error(t, err)
+
+	// only the keys of the scope layout are resolved
+	for _, key := range []string{"session:1234", "/mx.user.1.extra.config", "/global.user.config", "/secrets/mx.config", "mx..config"} {
+		_, err = NewRemoteProvider(conn, key)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), key)
+	}
+	assert.Equal(t, []string{"/mx.config", "/mx.user.config", "/missing.config"}, resolved)
+
+	// the server is read-only by default
+	_, err = cfg.Set("addr", ":7070")
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.Equal(t, ":9090", cfg.Str("addr"))
+}
+
+func TestServiceDesc(t *testing.T) {
+	desc := ServiceDesc("mx.config", "[::]:9000")
+	assert.Equal(t, "127.0.0.1:9000", desc.Address)
+	assert.Equal(t, "grpc://127.0.0.1:9000/mx.config", desc.TargetURI)
+	assert.Equal(t, "config_provider", desc.Type)
+}
@@ -0,0 +1,443 @@
+package remote
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hysios/mx"
+	"github.com/hysios/mx/config"
+	"github.com/hysios/mx/config/provider/remote/pb"
+	"github.com/hysios/mx/discovery"
+	"github.com/hysios/mx/server"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Resolver returns the provider serving the config scope key.
+type Resolver func(key string) (config.ConfigProvider, error)
+
+// Server implements the mx.Config gRPC service on top of config providers.
+type Server struct {
+	pb.UnimplementedConfigServer
+
+	resolve  Resolver
+	interval time.Duration
+	writable bool
+	// scoped servers only resolve the keys of the scope layout
+	scoped bool
+
+	providers map[string]*keyProvider
+	l         sync.Mutex
+}
+
+type ServerOption struct {
+	// PollInterval is the interval to check the providers for changes made
+	// outside the server, default is 5s
+	PollInterval time.Duration
+	// Writable accepts Set calls, the server is read-only by default
+	Writable bool
+}
+
+type ServerOptionFunc func(*ServerOption)
+
+// WithPollInterval sets the interval to check the providers for changes.
+func WithPollInterval(d time.Duration) ServerOptionFunc {
+	return func(o *ServerOption) {
+		o.PollInterval = d
+	}
+}
+
+// WithWritable accepts Set calls. Any caller reaching the server, e.g.
+// through the gateway, can then change the config of every scope, so
+// guard the server with an auth func.
+func WithWritable() ServerOptionFunc {
+	return func(o *ServerOption) {
+		o.Writable = true
+	}
+}
+
+// NewServer returns a server serving the provider for every key.
+func NewServer(provider config.ConfigProvider, optfns ...ServerOptionFunc) *Server {
+	return newServer(func(key string) (config.ConfigProvider, error) {
+		return provider, nil
+	}, false, optfns...)
+}
+
+// NewScopedServer returns a server serving each key from the provider
+// returned by resolve, the provider is reused for later calls. Only the keys
+// of the scope layout are resolved, see ScopeKey.
+func NewScopedServer(resolve Resolver, optfns ...ServerOptionFunc) *Server {
+	return newServer(resolve, true, optfns...)
+}
+
+func newServer(resolve Resolver, scoped bool, optfns ...ServerOptionFunc) *Server {
+	var opt = ServerOption{
+		PollInterval: 5 * time.Second,
+	}
+
+	for _, fn := range optfns {
+		fn(&opt)
+	}
+
+	return &Server{
+		resolve:   resolve,
+		interval:  opt.PollInterval,
+		writable:  opt.Writable,
+		scoped:    scoped,
+		providers: make(map[string]*keyProvider),
+	}
+}
+
+var scopePart = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// ScopeKey reports whether the key is a config key of the scope layout,
+// global.config, <ns>.config, <ns>.<svc>.config or <ns>.<svc>.<inst>.config,
+// with an optional leading slash
+func ScopeKey(key string) bool {
+	name, ok := strings.CutSuffix(strings.TrimPrefix(key, "/"), ".config")
+	if !ok || strings.Contains(name, "/") {
+		return false
+	}
+
+	parts := strings.Split(name, ".")
+	if len(parts) > 3 || (parts[0] == "global" && len(parts) > 1) {
+		return false
+	}
+
+	for _, part := range parts {
+		if !scopePart.MatchString(part) {
+			return false
+		}
+	}
+	return true
+}
+
+// Register registers the service on the server.
+func (s *Server) Register(srv *server.Server) {
+	srv.RegisterService(&pb.Config_ServiceDesc, s, server.WithFileDescriptor(pb.File_config_provider_remote_pb_config_proto))
+}
+
+// ServiceDesc returns the config_provider service desc of a config server
+// listening on addr, the name is the config name, e.g. mx.config
+func ServiceDesc(name string, addr string) discovery.ServiceDesc {
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+			addr = net.JoinHostPort("127.0.0.1", port)
+		}
+	}
+
+	return discovery.ServiceDesc{
+		ID:        name + "_" + addr,
+		Service:   name,
+		Type:      mx.ConfigType,
+		Address:   addr,
+		TargetURI: "grpc://" + addr + "/" + name,
+	}
+}
+
+// provider returns the provider of the key
+func (s *Server) provider(key string) (*keyProvider, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if p, ok := s.providers[key]; ok {
+		return p, nil
+	}
+
+	if s.scoped && !ScopeKey(key) {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid config key %q", key)
+	}
+
+	provider, err := s.resolve(key)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "resolve config %s: %v", key, err)
+	}
+
+	if provider == nil {
+		return nil, status.Errorf(codes.NotFound, "config %s not found", key)
+	}
+
+	p := &keyProvider{
+		provider: provider,
+		interval: s.interval,
+		watchers: make(map[chan *structpb.Struct]struct{}),
+	}
+	s.providers[key] = p
+	return p, nil
+}
+
+// Get returns the value of the selector.
+func (s *Server) Get(ctx context.Context, req *pb.GetRequest) (*pb.GetResponse, error) {
+	p, err := s.provider(req.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	value, ok, err := p.get(req.Selector)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &pb.GetResponse{Value: value, Found: ok}, nil
+}
+
+// Set sets the value of the selector, unless the server is read-only.
+func (s *Server) Set(ctx context.Context, req *pb.SetRequest) (*pb.SetResponse, error) {
+	if !s.writable {
+		return nil, status.Error(codes.PermissionDenied, "config server is read-only")
+	}
+
+	if req.Selector == "" {
+		return nil, status.Error(codes.InvalidArgument, "selector is required")
+	}
+
+	p, err := s.provider(req.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	old, err := p.set(req.Selector, fromValue(req.Value))
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.SetResponse{Old: old}, nil
+}
+
+// Watch streams the config of the key on every change.
+func (s *Server) Watch(req *pb.WatchRequest, stream pb.Config_WatchServer) error {
+	p, err := s.provider(req.Key)
+	if err != nil {
+		return err
+	}
+
+	ch, data, err := p.watch()
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	defer p.unwatch(ch)
+
+	if err := stream.Send(&pb.WatchResponse{Data: data}); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case data := <-ch:
+			if err := stream.Send(&pb.WatchResponse{Data: data}); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// keyProvider guards the provider of a key and broadcasts its changes. The
+// provider values are only read under the lock, and leave it serialized.
+type keyProvider struct {
+	provider config.ConfigProvider
+	interval time.Duration
+
+	l        sync.Mutex
+	watchers map[chan *structpb.Struct]struct{}
+	last     []byte
+	stop     chan struct{}
+}
+
+// get returns the value of the selector, the whole config if it is empty
+func (p *keyProvider) get(selector string) (*structpb.Value, bool, error) {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	if selector == "" {
+		st, err := toStruct(p.provider.Data())
+		if err != nil {
+			return nil, false, err
+		}
+		return structpb.NewStructValue(st), true, nil
+	}
+
+	val, ok := p.provider.LookupPath(selector)
+	if !ok {
+		return nil, false, nil
+	}
+
+	value, err := toValue(val.Data())
+	return value, err == nil, err
+}
+
+func (p *keyProvider) set(selector string, val interface{}) (old *structpb.Value, err error) {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	// providers report store errors by panic, like config.Config.Set
+	defer func() {
+		if r := recover(); r != nil {
+			err = status.Errorf(codes.Internal, "set %s: %v", selector, r)
+		}
+	}()
+
+	old, err = toValue(p.provider.Set(selector, val))
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	p.broadcast()
+	return old, nil
+}
+
+// watch subscribes to the changes and returns the current config, the
+// provider is polled while there are subscribers.
+func (p *keyProvider) watch() (chan *structpb.Struct, *structpb.Struct, error) {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	b, err := json.Marshal(p.provider.Data())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var data structpb.Struct
+	if err := data.UnmarshalJSON(b); err != nil {
+		return nil, nil, err
+	}
+
+	ch := make(chan *structpb.Struct, 1)
+	p.watchers[ch] = struct{}{}
+
+	if p.stop == nil {
+		p.last = b
+		p.stop = make(chan struct{})
+		go p.poll(p.stop)
+	}
+
+	return ch, &data, nil
+}
+
+func (p *keyProvider) unwatch(ch chan *structpb.Struct) {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	delete(p.watchers, ch)
+	if len(p.watchers) == 0 && p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+	}
+}
+
+func (p *keyProvider) poll(stop chan struct{}) {
+	tick := time.NewTicker(p.interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			p.l.Lock()
+			if reloader, ok := p.provider.(interface{ Reload() error }); ok {
+				_ = reloader.Reload()
+			}
+			p.broadcast()
+			p.l.Unlock()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// broadcast sends the data to the watchers if it changed, the lock must be
+// held. A slow watcher only gets the latest data.
+func (p *keyProvider) broadcast() {
+	if len(p.watchers) == 0 {
+		return
+	}
+
+	b, err := json.Marshal(p.provider.Data())
+	if err != nil || string(b) == string(p.last) {
+		return
+	}
+	p.last = b
+
+	for ch := range p.watchers {
+		var data structpb.Struct
+		if err := data.UnmarshalJSON(b); err != nil {
+			return
+		}
+
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- &data
+	}
+}
+
+// toValue converts the config value to a protobuf value, going through
+// JSON so typed slices and maps are supported.
+func toValue(v interface{}) (*structpb.Value, error) {
+	if v == nil {
+		return structpb.NewNullValue(), nil
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var value structpb.Value
+	if err := value.UnmarshalJSON(b); err != nil {
+		return nil, err
+	}
+	return &value, nil
+}
+
+func toStruct(m config.Map) (*structpb.Struct, error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	var st structpb.Struct
+	if err := st.UnmarshalJSON(b); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// fromValue converts the protobuf value to a config value, whole numbers
+// become int, which the config getters expect.
+func fromValue(v *structpb.Value) interface{} {
+	if v == nil {
+		return nil
+	}
+
+	return normalize(v.AsInterface())
+}
+
+func normalize(v interface{}) interface{} {
+	switch x := v.(type) {
+	case float64:
+		if x == float64(int(x)) {
+			return int(x)
+		}
+		return x
+	case map[string]interface{}:
+		for k, item := range x {
+			x[k] = normalize(item)
+		}
+		return x
+	case []interface{}:
+		for i, item := range x {
+			x[i] = normalize(item)
+		}
+		return x
+	default:
+		return v
+	}
+}
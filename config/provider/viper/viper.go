@@ -59,3 +59,8 @@ func (vp *ViperProvider) Data() config.Map {
 	}
 	return vp.vals
 }
+
+// Name returns the layer name of the provider.
+func (vp *ViperProvider) Name() string {
+	return "viper"
+}
@@ -6,15 +6,21 @@ import (
 	"net/url"
 	"os"
 	"strconv"
+	"sync"
 
+	"github.com/hysios/mx"
 	"github.com/hysios/mx/config"
+	"github.com/hysios/mx/config/provider/env"
 	"github.com/hysios/mx/config/provider/redis"
+	"github.com/hysios/mx/config/provider/remote"
 	"github.com/hysios/mx/discovery"
 	"github.com/hysios/mx/logger"
 	"github.com/hysios/mx/server"
+	"github.com/hysios/mx/tlsconfig"
 	"github.com/hysios/x/utils"
 	"go.uber.org/multierr"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
 )
 
 var Default discovery.Agent = MemoryAgent()
@@ -36,7 +42,8 @@ func Deregister(serviceID string) error {
 }
 
 var (
-	_config     *config.Config
+	configs     = make(map[Scope]*config.Config)
+	configsLock sync.Mutex
 	defaultDesc = []discovery.ServiceDesc{
 		{
 			ID:        "",
@@ -75,16 +82,33 @@ func configName() string {
 	return discovery.Namespace + ".config"
 }
 
+// Config returns the config of the current namespace, layered over the
+// global config.
 func Config(defaults map[string]interface{}) (*config.Config, error) {
-	if _config != nil {
-		return _config, nil
+	return ScopedConfig(Scope{}, defaults)
+}
+
+// ServiceConfig returns the config of the service, its own section is
+// layered over the namespace and global ones.
+func ServiceConfig(service string, defaults map[string]interface{}) (*config.Config, error) {
+	return ScopedConfig(Scope{Service: service}, defaults)
+}
+
+// ScopedConfig returns the config of the scope. Each scope layer is stored
+// under its own key of the config provider, see Scope.Keys.
+func ScopedConfig(scope Scope, defaults map[string]interface{}) (*config.Config, error) {
+	configsLock.Lock()
+	defer configsLock.Unlock()
+
+	if cfg, ok := configs[scope]; ok {
+		return cfg, nil
 	}
 
 	if Default == nil {
 		return nil, errors.New("discovery agent is not set")
 	}
 
-	descs, ok := Default.Lookup(configName(), discovery.WithServiceType("config_provider"))
+	descs, ok := Default.Lookup(configName(), discovery.WithServiceType(mx.ConfigType))
 	if !ok {
 		// return nil, errors.New("mx.Config service not found")
 		descs = []discovery.ServiceDesc{
@@ -99,77 +123,205 @@ func Config(defaults map[string]interface{}) (*config.Config, error) {
 		}
 	}
 
-	getpass := func(u *url.URL) string {
-		pass, _ := u.User.Password()
-		return pass
+	providers, err := buildProviders(descs, scope)
+	if err != nil {
+		return nil, err
 	}
 
-	getrdb := func(u *url.URL) int {
-		db := u.Query().Get("db")
-		if len(db) == 0 {
-			return 0
-		}
+	// environment variables override the remote providers
+	providers = append(providers, env.NewEnvProvider())
 
-		i, err := strconv.Atoi(db)
+	cfg := config.NewConfig(defaults, providers...)
+	configs[scope] = cfg
+	return cfg, nil
+}
+
+// buildProviders builds a provider per scope layer for each config service,
+// from the lowest to the highest precedence.
+func buildProviders(descs []discovery.ServiceDesc, scope Scope) ([]config.ConfigProvider, error) {
+	var (
+		providers []config.ConfigProvider
+		errs      error
+	)
+
+	for _, desc := range descs {
+		desc.Type = "mx.config"
+		u, err := url.Parse(desc.TargetURI)
 		if err != nil {
-			return 0
+			continue
 		}
-		return i
-	}
 
-	buildProviders := func() ([]config.ConfigProvider, error) {
-		var (
-			providers []config.ConfigProvider
-			errs      error
-		)
-		for _, desc := range descs {
-			desc.Type = "mx.config"
-			u, err := url.Parse(desc.TargetURI)
+		switch u.Scheme {
+		case "grpc":
+			// a mx.Config server holds the backend credentials
+			opt, err := tlsconfig.DialOption()
 			if err != nil {
-				continue
+				errs = multierr.Append(errs, err)
+				break
+			}
+
+			conn, err := grpc.Dial(u.Host, opt)
+			if err != nil {
+				errs = multierr.Append(errs, err)
+				break
 			}
 
-			switch u.Scheme {
-			case "etcd":
-				// providers = append(providers, config.NewEtcdProvider(desc))
-			case "redis":
+			for _, key := range scope.Keys(u.Path) {
+				provider, err := remote.NewRemoteProvider(conn, key)
+				if err != nil {
+					errs = multierr.Append(errs, err)
+					break
+				}
+				providers = append(providers, provider)
+			}
+		case "etcd":
+			// providers = append(providers, config.NewEtcdProvider(desc))
+		case "redis":
+			for _, key := range scope.Keys(u.Path) {
 				provider, err := redis.NewRedisProvider(&redis.RedisOption{
 					Addr:     u.Host,
 					Password: getpass(u),
 					DB:       getrdb(u),
-					Key:      u.Path,
+					Key:      key,
 				})
 				if err != nil {
 					errs = multierr.Append(errs, err)
-					continue
+					break
 				}
 				providers = append(providers, provider)
 			}
 		}
-
-		return providers, errs
 	}
 
-	providers, err := buildProviders()
+	return providers, errs
+}
+
+// ConfigServer returns a mx.Config server backed by the redis config of
+// the environment (REDIS_ADDR, REDIS_PASSWORD, ...), each scope key is
+// served by its own redis provider.
+func ConfigServer(optfns ...remote.ServerOptionFunc) (*remote.Server, error) {
+	u, err := url.Parse(defaultServiceDesc().TargetURI)
 	if err != nil {
 		return nil, err
 	}
 
-	_config = config.NewConfig(defaults, providers...)
-	return _config, nil
+	return remote.NewScopedServer(func(key string) (config.ConfigProvider, error) {
+		return redis.NewRedisProvider(&redis.RedisOption{
+			Addr:     u.Host,
+			Password: getpass(u),
+			DB:       getrdb(u),
+			Key:      key,
+		})
+	}, optfns...), nil
+}
+
+// RegisterConfigServer registers the server as the config_provider of the
+// namespace once it listens, services then read their config through it.
+// The registration is removed when the server shuts down.
+func RegisterConfigServer(srv *server.Server) error {
+	var (
+		l    sync.Mutex
+		desc *discovery.ServiceDesc
+	)
+
+	srv.OnShutdown(server.ShutdownHook{
+		Deregister: func() error {
+			l.Lock()
+			defer l.Unlock()
+
+			if desc == nil {
+				return nil
+			}
+
+			err := Deregister(desc.ID)
+			desc = nil
+			return err
+		},
+	})
+
+	go func() {
+		addr := <-srv.AddrCh()
+		d := remote.ServiceDesc(configName(), addr.String())
+		if err := Register(d); err != nil {
+			logger.Logger.Warn("register config server failed", zap.Any("service", d), zap.Error(err))
+			return
+		}
+
+		l.Lock()
+		desc = &d
+		l.Unlock()
+	}()
+
+	return nil
+}
+
+func getpass(u *url.URL) string {
+	pass, _ := u.User.Password()
+	return pass
+}
+
+func getrdb(u *url.URL) int {
+	db := u.Query().Get("db")
+	if len(db) == 0 {
+		return 0
+	}
+
+	i, err := strconv.Atoi(db)
+	if err != nil {
+		return 0
+	}
+	return i
 }
 
 func SetDefaultAgent(agent discovery.Agent) {
 	Default = agent
 }
 
-func RegisterServer(server *server.Server) error {
+// RegisterServer registers the services of the server once it listens, on
+// shutdown they are marked draining, then deregistered after the server
+// stopped.
+func RegisterServer(srv *server.Server) error {
+	var (
+		l     sync.Mutex
+		descs []discovery.ServiceDesc
+	)
+
+	srv.OnShutdown(server.ShutdownHook{
+		Drain: func() error {
+			l.Lock()
+			defer l.Unlock()
+
+			var errs error
+			for _, desc := range descs {
+				desc.Draining = true
+				errs = multierr.Append(errs, Register(desc))
+			}
+			return errs
+		},
+		Deregister: func() error {
+			l.Lock()
+			defer l.Unlock()
+
+			var errs error
+			for _, desc := range descs {
+				errs = multierr.Append(errs, Deregister(desc.ID))
+			}
+			descs = nil
+			return errs
+		},
+	})
+
 	go func() {
-		<-server.AddrCh()
-		for _, desc := range server.ServiceDescs() {
+		<-srv.AddrCh()
+		for _, desc := range srv.ServiceDescs() {
 			if err := Register(desc); err != nil {
 				logger.Logger.Warn("register service failed", zap.Any("service", desc), zap.Error(err))
+				continue
 			}
+
+			l.Lock()
+			descs = append(descs, desc)
+			l.Unlock()
 		}
 	}()
 
@@ -180,3 +332,12 @@ type lazyProvider struct {
 	provider  config.ConfigProvider
 	providers []config.ConfigProvider
 }
+
+// ServerConfig returns the config of the server, layering the sections of
+// the server instance and service over the namespace and global ones.
+func ServerConfig(server *server.Server, defaults map[string]interface{}) (*config.Config, error) {
+	return ScopedConfig(Scope{
+		Service:  server.ServerName,
+		Instance: server.GetID(),
+	}, defaults)
+}
@@ -1,12 +1,21 @@
 package agent
 
 import (
+	"sync"
+
+	"github.com/hysios/mx"
 	"github.com/hysios/mx/discovery"
 )
 
 // memory is a simple in-memory implementation of the registry.Agent interface.
+// It is safe for concurrent use, and is a discovery provider of the servers
+// registered into it, so a gateway and servers in one process need no
+// registry.
 type memory struct {
+	l        sync.RWMutex
 	services map[string]discovery.ServiceDesc
+	watchers []*memoryWatcher
+	notify   *memoryWatcher
 }
 
 // MemoryAgent returns a new Memory instance.
@@ -16,25 +25,218 @@ func MemoryAgent() *memory {
 	}
 }
 
-// Register registers a new service.
+// Register registers a new service, registering an existing ID again
+// updates the service.
 func (m *memory) Register(desc discovery.ServiceDesc) error {
+	if desc.Namespace == "" {
+		desc.Namespace = discovery.Namespace
+	}
+
+	// dial the address like the consul resolver
+	if desc.TargetURI == "" {
+		desc.TargetURI = desc.Address
+	}
+
+	m.l.Lock()
+	defer m.l.Unlock()
+
+	var method = discovery.ServiceJoin
+	if old, ok := m.services[desc.ID]; ok {
+		if !desc.Changed(old) {
+			m.services[desc.ID] = desc
+			return nil
+		}
+		method = discovery.ServiceUpdate
+	}
+
 	m.services[desc.ID] = desc
+	m.broadcast(discovery.RegistryMessage{Method: method, Desc: desc})
 	return nil
 }
 
 // Deregister deregisters a service.
 func (m *memory) Deregister(serviceID string) error {
-	delete(m.services, serviceID)
+	m.l.Lock()
+	defer m.l.Unlock()
+
+	if old, ok := m.services[serviceID]; ok {
+		delete(m.services, serviceID)
+		m.broadcast(discovery.RegistryMessage{Method: discovery.ServiceLeave, Desc: old})
+	}
 	return nil
 }
 
-// Lookup looks up a service.
+// Lookup looks up a service, the namespace defaults to discovery.Namespace.
 func (m *memory) Lookup(serviceName string, optfns ...discovery.LookupOptionFunc) ([]discovery.ServiceDesc, bool) {
+	var opt = discovery.LookupOption{}
+	for _, fn := range optfns {
+		fn(&opt)
+	}
+
+	if opt.Namespace == "" {
+		opt.Namespace = discovery.Namespace
+	}
+
+	m.l.RLock()
+	defer m.l.RUnlock()
+
 	var services []discovery.ServiceDesc
 	for _, desc := range m.services {
-		if desc.Service == serviceName {
-			services = append(services, desc)
+		if desc.Service != serviceName {
+			continue
+		}
+
+		if !opt.MatchNamespace(desc.Namespace) || !opt.MatchServiceType(desc.Type) {
+			continue
 		}
+
+		services = append(services, desc)
 	}
 	return services, len(services) > 0
 }
+
+// Notify returns the joins and leaves of the servers in discovery.Namespace,
+// the servers registered before are sent first.
+func (m *memory) Notify() chan discovery.RegistryMessage {
+	m.l.Lock()
+	defer m.l.Unlock()
+
+	if m.notify == nil {
+		m.notify = m.watch()
+	}
+	return m.notify.msgch
+}
+
+// Discover returns a new service discover of the agent, so it can be
+// registered with discovery.RegistryProvider. Close it to stop watching.
+func (m *memory) Discover() discovery.ServiceDiscover {
+	m.l.Lock()
+	defer m.l.Unlock()
+
+	return m.watch()
+}
+
+// watch adds a watcher replaying the registered servers, the lock must be
+// held
+func (m *memory) watch() *memoryWatcher {
+	w := newMemoryWatcher(m, discovery.Namespace)
+	for _, desc := range m.services {
+		w.push(discovery.RegistryMessage{Method: discovery.ServiceJoin, Desc: desc})
+	}
+
+	m.watchers = append(m.watchers, w)
+	return w
+}
+
+// broadcast queues the message to the watchers, the lock must be held
+func (m *memory) broadcast(msg discovery.RegistryMessage) {
+	for _, w := range m.watchers {
+		w.push(msg)
+	}
+}
+
+// remove drops the watcher, so no more messages are queued to it
+func (m *memory) remove(w *memoryWatcher) {
+	m.l.Lock()
+	defer m.l.Unlock()
+
+	for i, watcher := range m.watchers {
+		if watcher == w {
+			m.watchers = append(m.watchers[:i], m.watchers[i+1:]...)
+			break
+		}
+	}
+
+	if m.notify == w {
+		m.notify = nil
+	}
+}
+
+// memoryWatcher queues the messages of a watcher without bound, so the
+// agent never blocks on a slow reader and no message is dropped.
+type memoryWatcher struct {
+	agent     *memory
+	namespace string
+
+	l     sync.Mutex
+	queue []discovery.RegistryMessage
+	wake  chan struct{}
+	msgch chan discovery.RegistryMessage
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newMemoryWatcher(m *memory, ns string) *memoryWatcher {
+	w := &memoryWatcher{
+		agent:     m,
+		namespace: ns,
+		wake:      make(chan struct{}, 1),
+		msgch:     make(chan discovery.RegistryMessage),
+		done:      make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *memoryWatcher) push(msg discovery.RegistryMessage) {
+	if msg.Desc.Type != mx.ServerType || msg.Desc.Namespace != w.namespace {
+		return
+	}
+
+	w.l.Lock()
+	w.queue = append(w.queue, msg)
+	w.l.Unlock()
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run sends the queued messages until the watcher is closed, then closes
+// the channel
+func (w *memoryWatcher) run() {
+	defer close(w.msgch)
+
+	for {
+		w.l.Lock()
+		if len(w.queue) == 0 {
+			w.l.Unlock()
+			select {
+			case <-w.wake:
+			case <-w.done:
+				return
+			}
+			continue
+		}
+
+		msg := w.queue[0]
+		w.queue[0] = discovery.RegistryMessage{}
+		w.queue = w.queue[1:]
+		w.l.Unlock()
+
+		select {
+		case w.msgch <- msg:
+		case <-w.done:
+			return
+		}
+	}
+}
+
+func (w *memoryWatcher) Notify() chan discovery.RegistryMessage {
+	return w.msgch
+}
+
+// Close removes the watcher from the agent and closes its channel, the
+// queued messages are dropped.
+func (w *memoryWatcher) Close() error {
+	w.once.Do(func() {
+		w.agent.remove(w)
+		close(w.done)
+
+		w.l.Lock()
+		w.queue = nil
+		w.l.Unlock()
+	})
+	return nil
+}
@@ -0,0 +1,141 @@
+package agent
+
+import (
+	"io"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hysios/mx"
+	"github.com/hysios/mx/discovery"
+	"github.com/stretchr/testify/assert"
+)
+
+func recv(t *testing.T, sd discovery.ServiceDiscover) discovery.RegistryMessage {
+	select {
+	case msg := <-sd.Notify():
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatal("no registry message")
+		return discovery.RegistryMessage{}
+	}
+}
+
+func TestMemoryAgent_Lookup(t *testing.T) {
+	m := MemoryAgent()
+	assert.NoError(t, m.Register(discovery.ServiceDesc{ID: "hello_1", Service: "hello.Greeter", Type: mx.ServerType, Address: "127.0.0.1:9000"}))
+	assert.NoError(t, m.Register(discovery.ServiceDesc{ID: "hello_2", Service: "hello.Greeter", Type: mx.ServerType, Namespace: "shop"}))
+	assert.NoError(t, m.Register(discovery.ServiceDesc{ID: "config_1", Service: "hello.Greeter", Type: mx.ConfigType}))
+
+	descs, ok := m.Lookup("hello.Greeter", discovery.WithServiceType(mx.ServerType))
+	assert.True(t, ok)
+	if assert.Len(t, descs, 1) {
+		assert.Equal(t, "hello_1", descs[0].ID)
+		assert.Equal(t, "127.0.0.1:9000", descs[0].TargetURI)
+	}
+
+	descs, _ = m.Lookup("hello.Greeter", discovery.WithNamespace("shop"))
+	if assert.Len(t, descs, 1) {
+		assert.Equal(t, "hello_2", descs[0].ID)
+	}
+
+	descs, _ = m.Lookup("hello.Greeter")
+	assert.Len(t, descs, 2)
+
+	assert.NoError(t, m.Deregister("hello_1"))
+	_, ok = m.Lookup("hello.Greeter", discovery.WithServiceType(mx.ServerType))
+	assert.False(t, ok)
+}
+
+func TestMemoryAgent_Notify(t *testing.T) {
+	m := MemoryAgent()
+	assert.NoError(t, m.Register(discovery.ServiceDesc{ID: "hello_1", Service: "hello.Greeter", Type: mx.ServerType}))
+	assert.NoError(t, m.Register(discovery.ServiceDesc{ID: "config_1", Service: "mx.config", Type: mx.ConfigType}))
+
+	// registered services are replayed
+	msg := recv(t, m)
+	assert.Equal(t, discovery.ServiceJoin, msg.Method)
+	assert.Equal(t, "hello_1", msg.Desc.ID)
+
+	sd := m.Discover()
+	assert.Equal(t, "hello_1", recv(t, sd).Desc.ID)
+
+	assert.NoError(t, m.Register(discovery.ServiceDesc{ID: "hello_2", Service: "hello.Greeter", Type: mx.ServerType}))
+	assert.NoError(t, m.Register(discovery.ServiceDesc{ID: "hello_2", Service: "hello.Greeter", Type: mx.ServerType, Weight: 2}))
+	assert.NoError(t, m.Deregister("hello_1"))
+
+	for _, sd := range []discovery.ServiceDiscover{m, sd} {
+		msg = recv(t, sd)
+		assert.Equal(t, discovery.ServiceJoin, msg.Method)
+		assert.Equal(t, "hello_2", msg.Desc.ID)
+
+		msg = recv(t, sd)
+		assert.Equal(t, discovery.ServiceUpdate, msg.Method)
+		assert.Equal(t, 2, msg.Desc.Weight)
+
+		msg = recv(t, sd)
+		assert.Equal(t, discovery.ServiceLeave, msg.Method)
+		assert.Equal(t, "hello_1", msg.Desc.ID)
+	}
+}
+
+func TestMemoryAgent_Concurrent(t *testing.T) {
+	var (
+		m  = MemoryAgent()
+		sd = m.Discover()
+		wg sync.WaitGroup
+		n  = 100
+	)
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := "hello_" + strconv.Itoa(i)
+			m.Register(discovery.ServiceDesc{ID: id, Service: "hello.Greeter", Type: mx.ServerType})
+			m.Lookup("hello.Greeter")
+			if i%2 == 0 {
+				m.Deregister(id)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	descs, _ := m.Lookup("hello.Greeter")
+	assert.Len(t, descs, n/2)
+
+	// every join and leave is delivered, in order per service
+	var joined = make(map[string]bool)
+	for i := 0; i < n+n/2; i++ {
+		msg := recv(t, sd)
+		switch msg.Method {
+		case discovery.ServiceJoin:
+			joined[msg.Desc.ID] = true
+		case discovery.ServiceLeave:
+			assert.True(t, joined[msg.Desc.ID])
+			delete(joined, msg.Desc.ID)
+		}
+	}
+	assert.Len(t, joined, n/2)
+}
+
+func TestMemoryAgent_CloseDiscover(t *testing.T) {
+	m := MemoryAgent()
+	sd := m.Discover()
+	assert.Len(t, m.watchers, 1)
+
+	assert.NoError(t, sd.(io.Closer).Close())
+	assert.Empty(t, m.watchers)
+
+	select {
+	case _, ok := <-sd.Notify():
+		assert.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("channel not closed")
+	}
+
+	// later registrations are not queued to the closed watcher
+	assert.NoError(t, m.Register(discovery.ServiceDesc{ID: "hello_1", Service: "hello.Greeter", Type: mx.ServerType}))
+	assert.NoError(t, sd.(io.Closer).Close())
+}
@@ -0,0 +1,11 @@
+package agent
+
+import (
+	"github.com/hysios/mx/discovery"
+	"github.com/hysios/mx/discovery/resolver"
+)
+
+func init() {
+	// mx:/// targets look up the instances from the default agent
+	resolver.Register(resolver.WithAgent(func() discovery.Agent { return Default }))
+}
@@ -0,0 +1,83 @@
+package agent
+
+import (
+	"path"
+	"strings"
+
+	"github.com/hysios/mx/discovery"
+)
+
+const globalConfigName = "global.config"
+
+// Scope selects the config layers of a config.Config, from the lowest to the
+// highest precedence: global -> namespace -> service -> instance.
+//
+// The zero Scope is the namespace scope of discovery.Namespace.
+type Scope struct {
+	// Global selects the global layer only
+	Global bool
+	// Namespace defaults to discovery.Namespace
+	Namespace string
+	// Service adds the service layer over the namespace
+	Service string
+	// Instance adds the instance layer over the service, requires Service
+	Instance string
+}
+
+// Keys returns the config keys of the scope layers, from the lowest to the
+// highest precedence. nsKey is the key of the namespace layer, as configured
+// in the config provider target URI (e.g. /mx.config); the other keys are
+// derived from it:
+//
+//	global    /global.config
+//	namespace /mx.config
+//	service   /mx.user.config
+//	instance  /mx.user.user_1234.config
+func (s Scope) Keys(nsKey string) []string {
+	var (
+		dir  = path.Dir(nsKey)
+		base = strings.TrimSuffix(path.Base(nsKey), ".config")
+		keys = []string{path.Join(dir, globalConfigName)}
+	)
+
+	if s.Global {
+		return keys
+	}
+
+	if s.Namespace != "" && s.Namespace != discovery.Namespace {
+		base = s.Namespace
+		nsKey = path.Join(dir, base+".config")
+	}
+	keys = append(keys, nsKey)
+
+	if s.Service == "" {
+		return keys
+	}
+	keys = append(keys, path.Join(dir, base+"."+s.Service+".config"))
+
+	if s.Instance == "" {
+		return keys
+	}
+	return append(keys, path.Join(dir, base+"."+s.Service+"."+s.Instance+".config"))
+}
+
+// String returns the readable name of the scope.
+func (s Scope) String() string {
+	if s.Global {
+		return "global"
+	}
+
+	var parts = []string{s.Namespace}
+	if s.Namespace == "" {
+		parts[0] = discovery.Namespace
+	}
+
+	if s.Service != "" {
+		parts = append(parts, s.Service)
+		if s.Instance != "" {
+			parts = append(parts, s.Instance)
+		}
+	}
+
+	return strings.Join(parts, "/")
+}
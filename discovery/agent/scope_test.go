@@ -0,0 +1,34 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScope_Keys(t *testing.T) {
+	tests := []struct {
+		name  string
+		scope Scope
+		want  []string
+	}{
+		{"global", Scope{Global: true}, []string{"/global.config"}},
+		{"namespace", Scope{}, []string{"/global.config", "/mx.config"}},
+		{"other namespace", Scope{Namespace: "shop"}, []string{"/global.config", "/shop.config"}},
+		{"service", Scope{Service: "user"}, []string{"/global.config", "/mx.config", "/mx.user.config"}},
+		{"instance", Scope{Service: "user", Instance: "user_1"}, []string{"/global.config", "/mx.config", "/mx.user.config", "/mx.user.user_1.config"}},
+		{"instance without service", Scope{Instance: "user_1"}, []string{"/global.config", "/mx.config"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.scope.Keys("/mx.config"))
+		})
+	}
+}
+
+func TestScope_String(t *testing.T) {
+	assert.Equal(t, "global", Scope{Global: true}.String())
+	assert.Equal(t, "mx", Scope{}.String())
+	assert.Equal(t, "mx/user/user_1", Scope{Service: "user", Instance: "user_1"}.String())
+}
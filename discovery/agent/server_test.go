@@ -0,0 +1,109 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hysios/mx"
+	"github.com/hysios/mx/discovery"
+	"github.com/hysios/mx/server"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestRegisterServer_Shutdown(t *testing.T) {
+	m := MemoryAgent()
+	old := Default
+	Default = m
+	defer func() { Default = old }()
+
+	srv := server.New("hello",
+		server.WithDrainDelay(300*time.Millisecond),
+		server.WithHealthCheck("database", func(ctx context.Context) error { return errors.New("connection refused") }),
+	)
+	srv.RegisterService(&grpc.ServiceDesc{ServiceName: "hello.Greeter", HandlerType: (*any)(nil)}, struct{}{})
+	assert.NoError(t, RegisterServer(srv))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	go srv.Serve(ln)
+
+	sd := m.Discover()
+	msg := recv(t, sd)
+	assert.Equal(t, discovery.ServiceJoin, msg.Method)
+	assert.False(t, msg.Desc.Draining)
+	// the agents report the health checks of the server
+	if assert.NotNil(t, msg.Desc.Health) {
+		assert.EqualError(t, msg.Desc.Health(context.Background()), "database: connection refused")
+	}
+
+	conn, err := grpc.Dial(ln.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	done := make(chan error, 1)
+	go func() { done <- srv.Shutdown(context.Background()) }()
+
+	// draining is announced while the server still serves
+	msg = recv(t, sd)
+	assert.Equal(t, discovery.ServiceUpdate, msg.Method)
+	assert.True(t, msg.Desc.Draining)
+
+	// the health service reports not serving, while the calls are served
+	resp, err := grpc_health_v1.NewHealthClient(conn).Check(context.Background(), &grpc_health_v1.HealthCheckRequest{Service: "hello.Greeter"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, grpc_health_v1.HealthCheckResponse_NOT_SERVING, resp.Status)
+	}
+
+	// deregistered once stopped
+	msg = recv(t, sd)
+	assert.Equal(t, discovery.ServiceLeave, msg.Method)
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("shutdown not finished")
+	}
+
+	_, ok := m.Lookup(msg.Desc.Service)
+	assert.False(t, ok)
+
+	// later calls return the first result
+	assert.NoError(t, srv.Shutdown(context.Background()))
+}
+
+func TestRegisterConfigServer_Shutdown(t *testing.T) {
+	m := MemoryAgent()
+	old := Default
+	Default = m
+	defer func() { Default = old }()
+
+	srv := server.New("mx.Config")
+	assert.NoError(t, RegisterConfigServer(srv))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	go srv.Serve(ln)
+
+	assert.Eventually(t, func() bool {
+		_, ok := m.Lookup(configName(), discovery.WithServiceType(mx.ConfigType))
+		return ok
+	}, 2*time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, srv.Shutdown(context.Background()))
+
+	_, ok := m.Lookup(configName(), discovery.WithServiceType(mx.ConfigType))
+	assert.False(t, ok)
+}
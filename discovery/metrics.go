@@ -0,0 +1,44 @@
+package discovery
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	eventsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mx",
+		Subsystem: "discovery",
+		Name:      "events_total",
+		Help:      "Registry messages received from the discovery providers.",
+	}, []string{"provider", "method"})
+
+	dispatchedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mx",
+		Subsystem: "discovery",
+		Name:      "dispatched_total",
+		Help:      "Registry messages dispatched to the discovery handlers.",
+	}, []string{"method"})
+
+	droppedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "mx",
+		Subsystem: "discovery",
+		Name:      "dropped_total",
+		Help:      "Registry messages dropped, superseded by a later message or duplicating the dispatched state.",
+	}, []string{"reason"})
+
+	pendingEvents = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "mx",
+		Subsystem: "discovery",
+		Name:      "pending_events",
+		Help:      "Registry messages waiting to be dispatched.",
+	})
+
+	eventLag = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "mx",
+		Subsystem: "discovery",
+		Name:      "event_lag_seconds",
+		Help:      "Time from receiving a registry message to dispatching it.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+	})
+)
@@ -1,7 +1,11 @@
 package discovery
 
+import "slices"
+
 type LookupOption struct {
-	Namespace   string
+	Namespace string
+	// Namespaces are matched besides the Namespace
+	Namespaces  []string
 	ServiceType string
 }
 
@@ -13,6 +17,13 @@ func WithNamespace(ns string) LookupOptionFunc {
 	}
 }
 
+// WithNamespaces matches the services of the namespaces as well
+func WithNamespaces(ns ...string) LookupOptionFunc {
+	return func(opt *LookupOption) {
+		opt.Namespaces = append(opt.Namespaces, ns...)
+	}
+}
+
 func WithServiceType(serviceType string) LookupOptionFunc {
 	return func(opt *LookupOption) {
 		opt.ServiceType = serviceType
@@ -27,5 +38,5 @@ func (option *LookupOption) MatchServiceType(serviceType string) bool {
 }
 
 func (option *LookupOption) MatchNamespace(ns string) bool {
-	return option.Namespace == ns
+	return option.Namespace == ns || slices.Contains(option.Namespaces, ns)
 }
@@ -1,43 +1,165 @@
 package discovery
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"errors"
 	"fmt"
-	"reflect"
 
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/reflect/protodesc"
 	"google.golang.org/protobuf/reflect/protoreflect"
-	"google.golang.org/protobuf/runtime/protoimpl"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
 )
 
+// FileDescriptorPacker packs a file descriptor with all its imports into a
+// FileDescriptorSet, the file itself is the last one of the set
 type FileDescriptorPacker struct {
 }
 
 func (p *FileDescriptorPacker) Pack(desc protoreflect.FileDescriptor) ([]byte, error) {
-	descProto := protodesc.ToFileDescriptorProto(desc)
-	return proto.MarshalOptions{AllowPartial: true, Deterministic: true}.Marshal(descProto)
-}
-
-func (p *FileDescriptorPacker) Unpack(src []byte) (desc protoreflect.FileDescriptor, err error) {
-	defer func() {
-		if _err := recover(); _err != nil {
-			switch r := _err.(type) {
-			case error:
-				err = r
-			case string:
-				err = errors.New(r)
-			default:
-				err = fmt.Errorf("%v", r)
+	set, err := FileDescriptorSet(desc)
+	if err != nil {
+		return nil, err
+	}
+
+	return marshalDeterministic(set)
+}
+
+// Unpack builds the packed file descriptor into a registry of its own, the
+// imports which are linked in with the same content are shared with the
+// global registry
+func (p *FileDescriptorPacker) Unpack(src []byte) (protoreflect.FileDescriptor, error) {
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(src, &set); err != nil || !isFileDescriptorSet(&set) {
+		// a single FileDescriptorProto packed by earlier versions
+		var fdp descriptorpb.FileDescriptorProto
+		if err := proto.Unmarshal(src, &fdp); err != nil {
+			return nil, err
+		}
+		set.File = []*descriptorpb.FileDescriptorProto{&fdp}
+	}
+
+	return UnpackFileDescriptorSet(&set, "")
+}
+
+// FileDescriptorSet returns the file descriptor and its transitive imports,
+// imports come before the files which import them. Files of the same path
+// must have the same content.
+func FileDescriptorSet(desc protoreflect.FileDescriptor) (*descriptorpb.FileDescriptorSet, error) {
+	var (
+		set    descriptorpb.FileDescriptorSet
+		hashes = make(map[string][]byte)
+		walk   func(fd protoreflect.FileDescriptor) error
+	)
+
+	walk = func(fd protoreflect.FileDescriptor) error {
+		fdp := protodesc.ToFileDescriptorProto(fd)
+		sum, err := hashFile(fdp)
+		if err != nil {
+			return err
+		}
+
+		if seen, ok := hashes[fd.Path()]; ok {
+			if !bytes.Equal(seen, sum) {
+				return fmt.Errorf("conflicting file descriptors of %s", fd.Path())
 			}
+			return nil
 		}
-	}()
+		hashes[fd.Path()] = sum
+
+		imports := fd.Imports()
+		for i := 0; i < imports.Len(); i++ {
+			if err := walk(imports.Get(i).FileDescriptor); err != nil {
+				return err
+			}
+		}
+
+		set.File = append(set.File, fdp)
+		return nil
+	}
+
+	if err := walk(desc); err != nil {
+		return nil, err
+	}
+
+	return &set, nil
+}
+
+// UnpackFileDescriptorSet builds the set into a registry of its own and
+// returns the file defining the service, or the last file of the set when
+// service is empty
+func UnpackFileDescriptorSet(set *descriptorpb.FileDescriptorSet, service string) (protoreflect.FileDescriptor, error) {
+	if len(set.GetFile()) == 0 {
+		return nil, errors.New("empty file descriptor set")
+	}
 
-	out := protoimpl.DescBuilder{
-		GoPackagePath: reflect.TypeOf(struct{}{}).PkgPath(),
-		RawDescriptor: src,
-	}.Build()
+	var protos = make(map[string]*descriptorpb.FileDescriptorProto)
+	for _, fdp := range set.GetFile() {
+		if linked(fdp) {
+			continue
+		}
+		protos[fdp.GetName()] = fdp
+	}
+
+	files, err := BuildFiles(protos)
+	if err != nil {
+		return nil, err
+	}
+
+	resolver := &fallbackResolver{files: files}
+	if service != "" {
+		desc, err := resolver.FindDescriptorByName(protoreflect.FullName(service))
+		if err != nil {
+			return nil, fmt.Errorf("service %s: %w", service, err)
+		}
+		return desc.ParentFile(), nil
+	}
+
+	return resolver.FindFileByPath(set.File[len(set.File)-1].GetName())
+}
+
+// linked reports whether the file is in the global registry with the same
+// content, e.g. google/protobuf/*.proto
+func linked(fdp *descriptorpb.FileDescriptorProto) bool {
+	fd, err := protoregistry.GlobalFiles.FindFileByPath(fdp.GetName())
+	if err != nil {
+		return false
+	}
+
+	global, err := hashFile(protodesc.ToFileDescriptorProto(fd))
+	if err != nil {
+		return false
+	}
+
+	sum, err := hashFile(fdp)
+	return err == nil && bytes.Equal(global, sum)
+}
+
+func isFileDescriptorSet(set *descriptorpb.FileDescriptorSet) bool {
+	if len(set.GetFile()) == 0 {
+		return false
+	}
+
+	for _, fdp := range set.GetFile() {
+		if fdp.GetName() == "" {
+			return false
+		}
+	}
+	return true
+}
+
+func hashFile(fdp *descriptorpb.FileDescriptorProto) ([]byte, error) {
+	b, err := marshalDeterministic(fdp)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(b)
+	return sum[:], nil
+}
 
-	desc = out.File
-	return
+func marshalDeterministic(m proto.Message) ([]byte, error) {
+	return proto.MarshalOptions{AllowPartial: true, Deterministic: true}.Marshal(m)
 }
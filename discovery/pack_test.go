@@ -0,0 +1,137 @@
+package discovery
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	_ "google.golang.org/protobuf/types/known/emptypb"
+	_ "google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func packFile(name, pkg string, deps []string, msgs ...*descriptorpb.DescriptorProto) *descriptorpb.FileDescriptorProto {
+	return &descriptorpb.FileDescriptorProto{
+		Name:        proto.String(name),
+		Package:     proto.String(pkg),
+		Dependency:  deps,
+		MessageType: msgs,
+		Syntax:      proto.String("proto3"),
+	}
+}
+
+func packMessage(name string, fields ...*descriptorpb.FieldDescriptorProto) *descriptorpb.DescriptorProto {
+	return &descriptorpb.DescriptorProto{Name: proto.String(name), Field: fields}
+}
+
+func packField(name, typeName string) *descriptorpb.FieldDescriptorProto {
+	return &descriptorpb.FieldDescriptorProto{
+		Name:     proto.String(name),
+		JsonName: proto.String(name),
+		Number:   proto.Int32(1),
+		Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+		Type:     descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum(),
+		TypeName: proto.String(typeName),
+	}
+}
+
+func newFile(t *testing.T, fdp *descriptorpb.FileDescriptorProto, r protodesc.Resolver) protoreflect.FileDescriptor {
+	fd, err := protodesc.NewFile(fdp, r)
+	assert.NoError(t, err)
+	return fd
+}
+
+func TestPackTransitive(t *testing.T) {
+	var (
+		files = new(protoregistry.Files)
+		r     = &fallbackResolver{files: files}
+		user  = newFile(t, packFile("packtest/user.proto", "packtest", []string{"google/protobuf/timestamp.proto"},
+			packMessage("User", packField("created", ".google.protobuf.Timestamp"))), r)
+	)
+	assert.NoError(t, files.RegisterFile(user))
+
+	hello := newFile(t, &descriptorpb.FileDescriptorProto{
+		Name:        proto.String("packtest/hello.proto"),
+		Package:     proto.String("packtest"),
+		Dependency:  []string{"packtest/user.proto"},
+		MessageType: []*descriptorpb.DescriptorProto{packMessage("HelloRequest", packField("user", ".packtest.User"))},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("Greeter"),
+			Method: []*descriptorpb.MethodDescriptorProto{{
+				Name:       proto.String("SayHello"),
+				InputType:  proto.String(".packtest.HelloRequest"),
+				OutputType: proto.String(".packtest.User"),
+			}},
+		}},
+		Syntax: proto.String("proto3"),
+	}, r)
+
+	set, err := FileDescriptorSet(hello)
+	assert.NoError(t, err)
+	var names []string
+	for _, fdp := range set.File {
+		names = append(names, fdp.GetName())
+	}
+	assert.Equal(t, []string{"google/protobuf/timestamp.proto", "packtest/user.proto", "packtest/hello.proto"}, names)
+
+	var pack FileDescriptorPacker
+	b, err := pack.Pack(hello)
+	assert.NoError(t, err)
+
+	// unpacked apart from the global registry, so again and again
+	for i := 0; i < 2; i++ {
+		fd, err := pack.Unpack(b)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, "packtest/hello.proto", fd.Path())
+
+		method := fd.Services().ByName("Greeter").Methods().ByName("SayHello")
+		assert.Equal(t, protoreflect.FullName("packtest.User"), method.Output().FullName())
+		created := method.Output().Fields().ByName("created").Message()
+		// linked in imports are shared with the global registry
+		assert.Equal(t, "google/protobuf/timestamp.proto", created.ParentFile().Path())
+	}
+
+	_, err = protoregistry.GlobalFiles.FindFileByPath("packtest/hello.proto")
+	assert.Error(t, err)
+}
+
+func TestPackConflict(t *testing.T) {
+	var (
+		v1 = newFile(t, packFile("conflict/dep.proto", "conflict", nil, packMessage("A")), nil)
+		v2 = newFile(t, packFile("conflict/dep.proto", "conflict", nil, packMessage("A"), packMessage("B")), nil)
+		r1 = new(protoregistry.Files)
+		r2 = new(protoregistry.Files)
+	)
+	assert.NoError(t, r1.RegisterFile(v1))
+	assert.NoError(t, r2.RegisterFile(v2))
+
+	a := newFile(t, packFile("conflict/a.proto", "conflict.a", []string{"conflict/dep.proto"}), r1)
+	b := newFile(t, packFile("conflict/b.proto", "conflict.b", []string{"conflict/dep.proto"}), r2)
+
+	files := new(protoregistry.Files)
+	assert.NoError(t, files.RegisterFile(a))
+	assert.NoError(t, files.RegisterFile(b))
+
+	root := newFile(t, packFile("conflict/root.proto", "conflict", []string{"conflict/a.proto", "conflict/b.proto"}), files)
+	_, err := FileDescriptorSet(root)
+	assert.Error(t, err)
+}
+
+func TestUnpackSingleFile(t *testing.T) {
+	fdp := packFile("legacy/hello.proto", "legacy", []string{"google/protobuf/empty.proto"},
+		packMessage("Hello", packField("empty", ".google.protobuf.Empty")))
+	b, err := proto.Marshal(fdp)
+	assert.NoError(t, err)
+
+	var pack FileDescriptorPacker
+	fd, err := pack.Unpack(b)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "legacy/hello.proto", fd.Path())
+		assert.NotNil(t, fd.Messages().ByName("Hello"))
+	}
+}
@@ -3,6 +3,9 @@ package discovery
 const (
 	ServiceJoin  = "join"
 	ServiceLeave = "leave"
+	// ServiceUpdate carries the new desc of a joined service, whose address,
+	// version, weight, tags, draining flag or descriptor changed
+	ServiceUpdate = "update"
 )
 
 type Provider interface {
@@ -5,20 +5,21 @@ import (
 	"fmt"
 	"log"
 	"net"
-	"os"
-	"os/signal"
 	"strconv"
-	"syscall"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/consul/api"
 	"github.com/hysios/mx/discovery"
+	"github.com/hysios/mx/discovery/schema"
 	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
 type AgentOption struct {
 	Config    *api.Config
 	Namespace string
+	// Check is the health check of the registered services
+	Check CheckOption
 }
 
 type AgentOptionFunc func(*AgentOption)
@@ -47,9 +48,12 @@ func NewConsulAgent(optFns ...AgentOptionFunc) discovery.Agent {
 		opt.Config = api.DefaultConfig()
 		// opt.Config.Namespace = discovery.Namespace
 	}
+	opt.Check.init()
 
 	agent := &consulAgent{
-		opts: opt,
+		opts:       opt,
+		schedules:  make(map[string]context.CancelFunc),
+		registered: make(map[string]bool),
 	}
 
 	cli, err := api.NewClient(opt.Config)
@@ -77,6 +81,12 @@ type consulAgent struct {
 	closefn     context.CancelFunc
 	resolverURI resolverURI
 	pack        discovery.FileDescriptorPacker
+
+	l sync.Mutex
+	// schedules stop the ttl updates of the registered services
+	schedules map[string]context.CancelFunc
+	// registered are the ids registered by the agent
+	registered map[string]bool
 }
 
 func (c *consulAgent) namespace() string {
@@ -109,22 +119,27 @@ func (c *consulAgent) Register(desc discovery.ServiceDesc) error {
 		meta["namespace"] = c.namespace()
 	}
 
-	if desc.FileDescriptor != nil {
-		b, err := c.pack.Pack(desc.FileDescriptor)
-		if err != nil {
-			return err
-		}
+	if desc.TargetURI != "" {
+		meta["targetURI"] = desc.TargetURI
+	}
 
+	if desc.FileDescriptor != nil {
 		if desc.FileDescriptorKey == "" {
 			desc.FileDescriptorKey = desc.FileDescriptor.Path()
 		}
 
 		meta["file_descriptor_key"] = desc.FileDescriptorKey
-		if _, err := c.cli.KV().Put(&api.KVPair{
-			Key:   fmt.Sprintf("mx/registry/protofile/%s/%s", c.Namespace, desc.FileDescriptorKey),
-			Value: b,
-		}, nil); err != nil {
-			return err
+
+		c.l.Lock()
+		registered := c.registered[desc.ID]
+		c.l.Unlock()
+
+		// rejected when it breaks the registered version, updates of a
+		// registered service, e.g. draining, were checked when it joined
+		if !registered {
+			if _, err := schema.NewRegistry(SchemaStore(c.cli)).Register(c.ctx, c.Namespace, desc.FileDescriptorKey, desc.FileDescriptor); err != nil {
+				return err
+			}
 		}
 	}
 
@@ -133,52 +148,74 @@ func (c *consulAgent) Register(desc discovery.ServiceDesc) error {
 		meta["group"] = desc.Group
 	}
 
+	if desc.Version != "" {
+		meta["version"] = desc.Version
+	}
+
+	if desc.Draining {
+		meta["draining"] = "true"
+	}
+
+	var weights *api.AgentWeights
+	if desc.Weight > 0 {
+		weights = &api.AgentWeights{Passing: desc.Weight, Warning: 1}
+	}
+
 	if err = agent.ServiceRegister(&api.AgentServiceRegistration{
 		ID:        desc.ID,
 		Name:      desc.Service,
 		Port:      port,
 		Address:   host,
 		Meta:      meta,
+		Tags:      desc.Tags,
+		Weights:   weights,
 		Namespace: desc.Namespace,
-		Check: &api.AgentServiceCheck{
-			CheckID:                        "service:" + desc.ID,
-			TTL:                            "30s",
-			Timeout:                        "45s",
-			DeregisterCriticalServiceAfter: "60s",
-		},
+		Check:     c.opts.Check.check(desc, hostPort(host, port)),
 	}); err != nil {
 		return err
 	}
 
-	_ = c.Update(desc.ID, "service registered", api.HealthPassing)
+	c.l.Lock()
+	c.registered[desc.ID] = true
+	c.l.Unlock()
+
+	if c.opts.Check.Kind != CheckTTL {
+		return nil
+	}
+
+	status, output := c.opts.Check.health(c.ctx, desc)
+	_ = c.Update(desc.ID, output, status)
 
-	go c.teardown()
-	go c.updateSchedule(desc)
+	// registering again updates the service, e.g. draining, which keeps
+	// its ttl updates
+	c.l.Lock()
+	if _, ok := c.schedules[desc.ID]; !ok {
+		ctx, cancel := context.WithCancel(c.ctx)
+		c.schedules[desc.ID] = cancel
+		go c.updateSchedule(ctx, desc)
+	}
+	c.l.Unlock()
 
 	return nil
 }
 
-func (c *consulAgent) updateSchedule(desc discovery.ServiceDesc) error {
-	var (
-		agent = c.cli.Agent()
-		tick  = time.NewTicker(15 * time.Second)
-	)
+// updateSchedule updates the ttl check of the service with its health
+// until it is deregistered
+func (c *consulAgent) updateSchedule(ctx context.Context, desc discovery.ServiceDesc) {
+	var tick = time.NewTicker(c.opts.Check.Interval)
+	defer tick.Stop()
 
 	for {
 		select {
-		case t := <-tick.C:
-			if err := agent.UpdateTTL("service:"+desc.ID, t.Format("2006-01-02 15:04:05"), api.HealthPassing); err != nil {
+		case <-tick.C:
+			status, output := c.opts.Check.health(ctx, desc)
+			if err := c.Update(desc.ID, output, status); err != nil {
 				log.Printf("update ttl failed: %v", err)
-				continue
 			}
-		case <-c.ctx.Done():
-			tick.Stop()
-			return c.Deregister(desc.ID)
-			// return c.ctx.Err()
+		case <-ctx.Done():
+			return
 		}
 	}
-
-	return nil
 }
 
 func (c *consulAgent) getFileDescriptor(key string) (desc protoreflect.FileDescriptor, err error) {
@@ -199,7 +236,7 @@ func (c *consulAgent) getFileDescriptor(key string) (desc protoreflect.FileDescr
 	return c.pack.Unpack(pair.Value)
 }
 
-func (c consulAgent) Update(serviceID, output, status string) error {
+func (c *consulAgent) Update(serviceID, output, status string) error {
 	var (
 		agent = c.cli.Agent()
 	)
@@ -213,6 +250,15 @@ func (c *consulAgent) Deregister(serviceID string) error {
 	var (
 		agent = c.cli.Agent()
 	)
+
+	c.l.Lock()
+	if cancel, ok := c.schedules[serviceID]; ok {
+		cancel()
+		delete(c.schedules, serviceID)
+	}
+	delete(c.registered, serviceID)
+	c.l.Unlock()
+
 	if err := agent.ServiceDeregister(serviceID); err != nil {
 		return err
 	}
@@ -260,28 +306,29 @@ func (c *consulAgent) Lookup(serviceName string, optfns ...discovery.LookupOptio
 			FileDescriptorKey: service.Meta["file_descriptor_key"],
 			FileDescriptor:    filedescriptor,
 			Group:             service.Meta["group"],
+			Version:           service.Meta["version"],
+			Weight:            service.Weights.Passing,
+			Tags:              service.Tags,
+			Draining:          service.Meta["draining"] == "true",
 		})
 	}
 
 	return descs, true
 }
 
-// setupTeardown
-func (c *consulAgent) teardown() {
-	// on os signal ctrl+c or kill
-	//
-	// 1. deregister service
-	// 2. close consul client
-	// 3. close context
-	// 4. close cancel function
-
-	var ch = make(chan os.Signal, 1)
-	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		<-ch
-
-		if c.closefn != nil {
-			c.closefn()
-		}
-	}()
+// Close deregisters the registered services and stops the agent
+func (c *consulAgent) Close() error {
+	c.l.Lock()
+	var ids []string
+	for id := range c.schedules {
+		ids = append(ids, id)
+	}
+	c.l.Unlock()
+
+	for _, id := range ids {
+		_ = c.Deregister(id)
+	}
+
+	c.closefn()
+	return nil
 }
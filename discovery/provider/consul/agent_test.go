@@ -0,0 +1,157 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hysios/mx/discovery"
+	"github.com/stretchr/testify/assert"
+)
+
+type checkUpdate struct {
+	Status string
+	Output string
+}
+
+// fakeAgent records the service registrations and the ttl updates
+type fakeAgent struct {
+	l       sync.Mutex
+	checks  []*api.AgentServiceCheck
+	updates []checkUpdate
+}
+
+func (f *fakeAgent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	switch {
+	case r.URL.Path == "/v1/agent/service/register":
+		var reg api.AgentServiceRegistration
+		json.NewDecoder(r.Body).Decode(&reg)
+		f.checks = append(f.checks, reg.Check)
+	case strings.HasPrefix(r.URL.Path, "/v1/agent/check/update/"):
+		var update checkUpdate
+		json.NewDecoder(r.Body).Decode(&update)
+		f.updates = append(f.updates, update)
+	case strings.HasPrefix(r.URL.Path, "/v1/agent/service/deregister/"):
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeAgent) lastUpdate() (checkUpdate, bool) {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	if len(f.updates) == 0 {
+		return checkUpdate{}, false
+	}
+	return f.updates[len(f.updates)-1], true
+}
+
+func newTestAgent(t *testing.T, f *fakeAgent, optfns ...AgentOptionFunc) *consulAgent {
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	cfg := api.DefaultConfig()
+	cfg.Address = strings.TrimPrefix(srv.URL, "http://")
+
+	a := NewConsulAgent(append([]AgentOptionFunc{WithConfig(cfg)}, optfns...)...).(*consulAgent)
+	t.Cleanup(func() { a.Close() })
+	return a
+}
+
+func TestConsulAgentChecks(t *testing.T) {
+	desc := discovery.ServiceDesc{ID: "hello_1", Service: "hello.Greeter", Address: "127.0.0.1:9000"}
+
+	f := &fakeAgent{}
+	assert.NoError(t, newTestAgent(t, f, WithGRPCCheck()).Register(desc))
+	assert.NoError(t, newTestAgent(t, f, WithHTTPCheck("http://{address}/healthz")).Register(desc))
+	assert.NoError(t, newTestAgent(t, f).Register(desc))
+	assert.NoError(t, newTestAgent(t, f, WithGRPCCheck(), WithCheckTLS("hello.internal")).Register(desc))
+
+	if assert.Len(t, f.checks, 4) {
+		assert.Equal(t, "127.0.0.1:9000/hello.Greeter", f.checks[0].GRPC)
+		assert.Equal(t, "15s", f.checks[0].Interval)
+		assert.Empty(t, f.checks[0].TTL)
+		assert.False(t, f.checks[0].GRPCUseTLS)
+
+		assert.Equal(t, "http://127.0.0.1:9000/healthz", f.checks[1].HTTP)
+
+		assert.Equal(t, "30s", f.checks[2].TTL)
+		assert.Equal(t, "service:hello_1", f.checks[2].CheckID)
+
+		assert.True(t, f.checks[3].GRPCUseTLS)
+		assert.Equal(t, "hello.internal", f.checks[3].TLSServerName)
+	}
+
+	// only the ttl check is updated by the agent
+	assert.Len(t, f.updates, 1)
+}
+
+func TestConsulAgentHTTPCheckWithoutURL(t *testing.T) {
+	t.Setenv("MX_CONSUL_CHECK", "http")
+	t.Setenv("MX_CONSUL_CHECK_HTTP", "")
+
+	var (
+		desc = discovery.ServiceDesc{ID: "hello_1", Service: "hello.Greeter", Address: "127.0.0.1:9000"}
+		f    = &fakeAgent{}
+	)
+	assert.NoError(t, newTestAgent(t, f, AgentEnvOptions()...).Register(desc))
+
+	// the ttl check rather than an http check of an empty url
+	if assert.Len(t, f.checks, 1) {
+		assert.Empty(t, f.checks[0].HTTP)
+		assert.Equal(t, "30s", f.checks[0].TTL)
+	}
+}
+
+func TestConsulAgentTTLHealth(t *testing.T) {
+	var (
+		f       = &fakeAgent{}
+		a       = newTestAgent(t, f, WithCheckInterval(10*time.Millisecond))
+		healthy atomic.Bool
+	)
+
+	assert.NoError(t, a.Register(discovery.ServiceDesc{
+		ID:      "hello_1",
+		Service: "hello.Greeter",
+		Address: "127.0.0.1:9000",
+		Health: func(ctx context.Context) error {
+			if !healthy.Load() {
+				return errors.New("database: connection refused")
+			}
+			return nil
+		},
+	}))
+
+	update, _ := f.lastUpdate()
+	assert.Equal(t, api.HealthCritical, update.Status)
+	assert.Equal(t, "database: connection refused", update.Output)
+
+	healthy.Store(true)
+	assert.Eventually(t, func() bool {
+		update, ok := f.lastUpdate()
+		return ok && update.Status == api.HealthPassing
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// no updates once deregistered
+	assert.NoError(t, a.Deregister("hello_1"))
+	f.l.Lock()
+	n := len(f.updates)
+	f.l.Unlock()
+
+	time.Sleep(50 * time.Millisecond)
+	f.l.Lock()
+	assert.Equal(t, n, len(f.updates))
+	f.l.Unlock()
+}
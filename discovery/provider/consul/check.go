@@ -0,0 +1,181 @@
+package consul
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hysios/mx/discovery"
+	"github.com/hysios/mx/logger"
+	"github.com/hysios/mx/tlsconfig"
+)
+
+// CheckKind is the kind of the consul check of the registered services
+type CheckKind string
+
+const (
+	// CheckTTL is passed by the agent with the result of the service's
+	// Health, or as long as the process runs when it has none
+	CheckTTL CheckKind = "ttl"
+	// CheckGRPC is run by consul against the grpc.health.v1.Health service,
+	// for the status of the service. Servers built with
+	// server.WithoutHealth() have no health service, so the check of their
+	// services always fails.
+	CheckGRPC CheckKind = "grpc"
+	// CheckHTTP is run by consul against an HTTP endpoint
+	CheckHTTP CheckKind = "http"
+)
+
+type CheckOption struct {
+	Kind CheckKind
+	// HTTP is the url of the http check, {address} is replaced with the
+	// host:port of the service
+	HTTP string
+	// Interval is how often the check runs, or the TTL is updated, default
+	// is 15s
+	Interval time.Duration
+	// Timeout bounds a check, default is 5s
+	Timeout time.Duration
+	// DeregisterAfter removes the service critical for so long, default is
+	// 60s
+	DeregisterAfter time.Duration
+	// TLS runs the gRPC check over TLS, the server certificate is verified
+	// for TLSServerName, default is the host of the service. Consul presents
+	// the client certificate of its agent, so servers requiring client
+	// certificates must trust the CA of the agent.
+	TLS           bool
+	TLSServerName string
+}
+
+// WithTTLCheck registers the TTL check, which is the default
+func WithTTLCheck() AgentOptionFunc {
+	return func(opt *AgentOption) {
+		opt.Check.Kind = CheckTTL
+	}
+}
+
+// WithGRPCCheck registers a gRPC check of the standard health service
+func WithGRPCCheck() AgentOptionFunc {
+	return func(opt *AgentOption) {
+		opt.Check.Kind = CheckGRPC
+	}
+}
+
+// WithHTTPCheck registers an HTTP check of the url, e.g.
+// http://{address}/healthz
+func WithHTTPCheck(url string) AgentOptionFunc {
+	return func(opt *AgentOption) {
+		opt.Check.Kind = CheckHTTP
+		opt.Check.HTTP = url
+	}
+}
+
+// WithCheckTLS runs the gRPC check over TLS, verified for the server name
+// when it is not empty
+func WithCheckTLS(serverName string) AgentOptionFunc {
+	return func(opt *AgentOption) {
+		opt.Check.TLS = true
+		opt.Check.TLSServerName = serverName
+	}
+}
+
+func WithCheckInterval(d time.Duration) AgentOptionFunc {
+	return func(opt *AgentOption) {
+		opt.Check.Interval = d
+	}
+}
+
+// AgentEnvOptions returns the options of MX_CONSUL_CHECK (ttl, grpc or
+// http), MX_CONSUL_CHECK_HTTP and MX_CONSUL_CHECK_INTERVAL. The gRPC check
+// runs over TLS when the servers do, see tlsconfig.EnvConfig. The http
+// check without MX_CONSUL_CHECK_HTTP falls back to the TTL check.
+func AgentEnvOptions() []AgentOptionFunc {
+	var optfns []AgentOptionFunc
+	switch CheckKind(strings.ToLower(os.Getenv("MX_CONSUL_CHECK"))) {
+	case CheckGRPC:
+		optfns = append(optfns, WithGRPCCheck())
+		if cfg := tlsconfig.EnvConfig(); !cfg.Empty() {
+			optfns = append(optfns, WithCheckTLS(cfg.ServerName))
+		}
+	case CheckHTTP:
+		optfns = append(optfns, WithHTTPCheck(os.Getenv("MX_CONSUL_CHECK_HTTP")))
+	}
+
+	if d, err := time.ParseDuration(os.Getenv("MX_CONSUL_CHECK_INTERVAL")); err == nil && d > 0 {
+		optfns = append(optfns, WithCheckInterval(d))
+	}
+	return optfns
+}
+
+func (opt *CheckOption) init() {
+	if opt.Kind == "" {
+		opt.Kind = CheckTTL
+	}
+
+	if opt.Kind == CheckHTTP && opt.HTTP == "" {
+		logger.Logger.Warn("consul http check without url, fall back to the ttl check")
+		opt.Kind = CheckTTL
+	}
+
+	if opt.Interval <= 0 {
+		opt.Interval = 15 * time.Second
+	}
+
+	if opt.Timeout <= 0 {
+		opt.Timeout = 5 * time.Second
+	}
+
+	if opt.DeregisterAfter <= 0 {
+		opt.DeregisterAfter = 60 * time.Second
+	}
+}
+
+// check returns the consul check of the service at the address
+func (opt CheckOption) check(desc discovery.ServiceDesc, address string) *api.AgentServiceCheck {
+	var check = &api.AgentServiceCheck{
+		CheckID:                        "service:" + desc.ID,
+		DeregisterCriticalServiceAfter: opt.DeregisterAfter.String(),
+	}
+
+	switch opt.Kind {
+	case CheckGRPC:
+		// the status of the service itself
+		check.GRPC = address + "/" + desc.Service
+		check.GRPCUseTLS = opt.TLS
+		check.TLSServerName = opt.TLSServerName
+		check.Interval = opt.Interval.String()
+		check.Timeout = opt.Timeout.String()
+	case CheckHTTP:
+		check.HTTP = strings.ReplaceAll(opt.HTTP, "{address}", address)
+		check.Interval = opt.Interval.String()
+		check.Timeout = opt.Timeout.String()
+	default:
+		// missing two updates fails the check
+		check.TTL = (2 * opt.Interval).String()
+	}
+
+	return check
+}
+
+// health returns the status of the TTL check of the service
+func (opt CheckOption) health(ctx context.Context, desc discovery.ServiceDesc) (status, output string) {
+	if desc.Health == nil {
+		return api.HealthPassing, "service alive"
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, opt.Timeout)
+	defer cancel()
+
+	if err := desc.Health(ctx); err != nil {
+		return api.HealthCritical, err.Error()
+	}
+	return api.HealthPassing, "service healthy"
+}
+
+func hostPort(host string, port int) string {
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
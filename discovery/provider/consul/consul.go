@@ -3,6 +3,11 @@ package consul
 import (
 	"context"
 	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -12,30 +17,86 @@ import (
 	"github.com/hysios/mx/discovery/agent"
 	"github.com/hysios/mx/logger"
 	"go.uber.org/zap"
-	"google.golang.org/protobuf/proto"
-	"google.golang.org/protobuf/reflect/protodesc"
 	"google.golang.org/protobuf/reflect/protoreflect"
-	"google.golang.org/protobuf/reflect/protoregistry"
-	"google.golang.org/protobuf/types/descriptorpb"
 )
 
-func NewConsulProvider() discovery.ServiceDiscover {
-	c := &consulDiscovery{}
+type DiscoveryOption struct {
+	// Namespaces are discovered besides the namespace of the gateway
+	Namespaces []string
+	// Datacenters are discovered instead of the datacenter of the agent,
+	// the agent's one should be listed to keep its services
+	Datacenters []string
+}
+
+type DiscoveryOptionFunc func(*DiscoveryOption)
+
+func WithNamespaces(ns ...string) DiscoveryOptionFunc {
+	return func(opt *DiscoveryOption) {
+		opt.Namespaces = append(opt.Namespaces, ns...)
+	}
+}
+
+func WithDatacenters(dcs ...string) DiscoveryOptionFunc {
+	return func(opt *DiscoveryOption) {
+		opt.Datacenters = append(opt.Datacenters, dcs...)
+	}
+}
+
+// EnvOptions returns the options of MX_DISCOVERY_NAMESPACES and
+// MX_DISCOVERY_DATACENTERS, both comma separated lists
+func EnvOptions() []DiscoveryOptionFunc {
+	var optfns []DiscoveryOptionFunc
+	if ns := splitList(os.Getenv("MX_DISCOVERY_NAMESPACES")); len(ns) > 0 {
+		optfns = append(optfns, WithNamespaces(ns...))
+	}
+
+	if dcs := splitList(os.Getenv("MX_DISCOVERY_DATACENTERS")); len(dcs) > 0 {
+		optfns = append(optfns, WithDatacenters(dcs...))
+	}
+	return optfns
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func NewConsulProvider(optfns ...DiscoveryOptionFunc) discovery.ServiceDiscover {
+	var opts DiscoveryOption
+	for _, fn := range optfns {
+		fn(&opts)
+	}
+
+	c := &consulDiscovery{opts: opts}
 	go c.Run()
 	return c
 }
 
+// consulDiscovery watches the catalog with blocking queries, each service
+// name is watched by its own health query, so changes on any node are seen
+// as soon as consul applies them. Services of other namespaces or
+// datacenters are sent as remote ones.
 type consulDiscovery struct {
 	Namespace string
 
+	opts DiscoveryOption
+	// datacenter is the datacenter of the agent
+	datacenter string
+
+	// interval is the first delay to retry a failed query
 	interval    time.Duration
 	config      *api.Config
 	cli         *api.Client
 	closefn     context.CancelFunc
 	ctx         context.Context
 	msgch       chan discovery.RegistryMessage
-	shadow      map[string]discovery.ServiceDesc
 	resolverURI resolverURI
+	pack        discovery.FileDescriptorPacker
 	l           sync.Mutex
 }
 
@@ -70,7 +131,7 @@ func (c *consulDiscovery) init() error {
 	if c.cli == nil {
 		cli, err := api.NewClient(c.config)
 		if err != nil {
-			return nil
+			return err
 		}
 		c.cli = cli
 	}
@@ -80,12 +141,15 @@ func (c *consulDiscovery) init() error {
 		c.resolverURI = r.normalResolveURI
 	}
 
-	if c.shadow == nil {
-		c.shadow = make(map[string]discovery.ServiceDesc)
+	if c.interval == 0 {
+		c.interval = time.Second
 	}
 
-	if c.interval == 0 {
-		c.interval = time.Second * 5
+	// set once, the watchers read it concurrently
+	c.namespace()
+
+	if c.ctx == nil {
+		c.ctx, c.closefn = context.WithCancel(context.Background())
 	}
 
 	// create msg channel
@@ -105,12 +169,18 @@ func (c *consulDiscovery) namespace() string {
 	return c.Namespace
 }
 
-func (c *consulDiscovery) getFileDescriptor(key string) (desc protoreflect.FileDescriptor, err error) {
+// getFileDescriptor reads the file descriptor of the key from the namespace
+// and datacenter of the service which registered it
+func (c *consulDiscovery) getFileDescriptor(ns, dc, key string) (desc protoreflect.FileDescriptor, err error) {
 	var (
 		pair *api.KVPair
 	)
 
-	pair, _, err = c.cli.KV().Get(fmt.Sprintf("mx/registry/protofile/%s/%s", c.Namespace, key), nil)
+	if ns == "" {
+		ns = c.namespace()
+	}
+
+	pair, _, err = c.cli.KV().Get(fmt.Sprintf("mx/registry/protofile/%s/%s", ns, key), (&api.QueryOptions{Datacenter: dc}).WithContext(c.ctx))
 	if err != nil {
 		return
 	}
@@ -120,166 +190,391 @@ func (c *consulDiscovery) getFileDescriptor(key string) (desc protoreflect.FileD
 		return
 	}
 
-	out := &descriptorpb.FileDescriptorProto{}
-	err = proto.Unmarshal(pair.Value, out)
-	if err != nil {
-		return
+	return c.pack.Unpack(pair.Value)
+}
+
+// Run watches the service names of the catalog of each datacenter, and
+// starts a watcher for each of them until Close.
+func (c *consulDiscovery) Run() error {
+	if err := c.init(); err != nil {
+		logger.Logger.Error("consul client", zap.Error(err))
+		return err
 	}
 
-	desc, err = protodesc.NewFile(out, protoregistry.GlobalFiles)
-	if err != nil {
-		return nil, err
+	if len(c.opts.Datacenters) == 0 {
+		return c.watchCatalog("")
 	}
 
-	safeRegister(desc)
-	return
-}
+	// the local services are only told from the remote ones once the
+	// datacenter of the agent is known
+	for backoff := c.interval; c.datacenter == ""; backoff = nextBackoff(backoff) {
+		if c.datacenter = c.localDatacenter(); c.datacenter != "" {
+			break
+		}
 
-func safeRegister(desc protoreflect.FileDescriptor) {
-	defer func() {
-		recover()
-	}()
-	protoregistry.GlobalFiles.RegisterFile(desc)
+		if !sleep(c.ctx, backoff) {
+			return c.ctx.Err()
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, dc := range c.opts.Datacenters {
+		wg.Add(1)
+		go func(dc string) {
+			defer wg.Done()
+			c.watchCatalog(dc)
+		}(dc)
+	}
+
+	wg.Wait()
+	return c.ctx.Err()
 }
 
-func (c *consulDiscovery) Run() error {
-	c.init()
+// localDatacenter returns the datacenter of the agent, empty when it is
+// unknown
+func (c *consulDiscovery) localDatacenter() string {
+	self, err := c.cli.Agent().Self()
+	if err != nil {
+		logger.Logger.Warn("consul agent datacenter", zap.Error(err))
+		return ""
+	}
+
+	dc, _ := self["Config"]["Datacenter"].(string)
+	return dc
+}
 
+// watchCatalog watches the service names of the datacenter, empty is the
+// one of the agent
+func (c *consulDiscovery) watchCatalog(dc string) error {
 	var (
-		agent       = c.cli.Agent()
-		ctx, cancel = context.WithCancel(context.Background())
-		tick        = time.NewTicker(c.interval)
+		index    uint64
+		backoff  = c.interval
+		watchers = make(map[string]*serviceWatcher)
 	)
 
-	c.closefn = cancel
-	c.ctx = ctx
-	// loop interval 5s to filter services
+	defer func() {
+		for _, w := range watchers {
+			w.stop()
+		}
+	}()
+
 	for {
-		select {
-		case <-tick.C:
-			services, err := c.filterServices(agent, discovery.WithServiceType(mx.ServerType))
-			if err != nil {
-				continue
+		opts := (&api.QueryOptions{WaitIndex: index, Datacenter: dc}).WithContext(c.ctx)
+		services, meta, err := c.cli.Catalog().Services(opts)
+		if err != nil {
+			if c.ctx.Err() != nil {
+				return c.ctx.Err()
 			}
 
-			var (
-				adds, _, dels = c.diffServices(services)
-			)
-
-			if len(adds) != 0 || len(dels) != 0 {
-				logger.Logger.Debug("change services", zap.Strings("adds", adds), zap.Strings("dels", dels))
+			logger.Logger.Warn("watch consul catalog", zap.String("datacenter", dc), zap.Error(err))
+			if !sleep(c.ctx, backoff) {
+				return c.ctx.Err()
 			}
+			backoff = nextBackoff(backoff)
+			continue
+		}
+		backoff = c.interval
+		index = nextIndex(index, meta.LastIndex)
 
-			for _, id := range adds {
-				desc := discovery.ServiceDesc{
-					ID:        id,
-					Service:   services[id].Service,
-					Address:   services[id].Address,
-					Namespace: services[id].Meta["namespace"],
-					TargetURI: c.resolverURI(services[id]),
-					Group:     services[id].Meta["group"],
-				}
-
-				if services[id].Meta["file_descriptor_key"] != "" {
-					desc.FileDescriptorKey = services[id].Meta["file_descriptor_key"]
-					filedescriptor, err := c.getFileDescriptor(desc.FileDescriptorKey)
-					if err != nil {
-						logger.Logger.Error("getFileDescriptor", zap.String("key", desc.FileDescriptorKey), zap.Error(err))
-						continue
-					}
-					desc.FileDescriptor = filedescriptor
-				}
-
-				if len(c.msgch) < cap(c.msgch) {
-					c.msgch <- discovery.RegistryMessage{
-						Method: discovery.ServiceJoin,
-						Desc:   desc,
-					}
-					c.shadow[id] = desc
-				}
+		for name := range services {
+			if _, ok := watchers[name]; !ok {
+				watchers[name] = c.watch(dc, name)
 			}
+		}
 
-			for _, id := range dels {
-				if len(c.msgch) < cap(c.msgch) {
-					c.msgch <- discovery.RegistryMessage{
-						Method: discovery.ServiceLeave,
-						Desc: discovery.ServiceDesc{
-							ID:        id,
-							Service:   c.shadow[id].Service,
-							Type:      "",
-							Address:   c.shadow[id].Address,
-							Namespace: c.shadow[id].Namespace,
-						},
-					}
-
-					delete(c.shadow, id)
-				}
+		// a removed service leaves before it may be watched again, so its
+		// leaves never follow the joins of the new watcher
+		for name, w := range watchers {
+			if _, ok := services[name]; !ok {
+				w.stop()
+				delete(watchers, name)
 			}
-		case <-c.ctx.Done():
-			return c.ctx.Err()
 		}
 	}
 }
 
-func (c *consulDiscovery) filterServices(agent *api.Agent, optfn ...discovery.LookupOptionFunc) (map[string]*api.AgentService, error) {
+type serviceWatcher struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// stop stops the watcher and waits for the leaves of its services
+func (w *serviceWatcher) stop() {
+	w.cancel()
+	<-w.done
+}
+
+// watch starts watching the healthy instances of the service name
+func (c *consulDiscovery) watch(dc, name string) *serviceWatcher {
+	ctx, cancel := context.WithCancel(c.ctx)
+	w := &serviceWatcher{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	go func() {
+		defer close(w.done)
+		c.watchService(ctx, dc, name)
+	}()
+
+	return w
+}
+
+// watchService sends the joins and leaves of the service, the shadow is
+// only changed once a message is sent, so no change is lost. All instances
+// leave when the watch stops.
+func (c *consulDiscovery) watchService(ctx context.Context, dc, name string) {
 	var (
-		opts = discovery.LookupOption{
-			Namespace: c.namespace(),
+		index   uint64
+		backoff = c.interval
+		shadow  = make(map[string]discovery.ServiceDesc)
+	)
+
+	defer func() {
+		for _, desc := range shadow {
+			c.leave(desc)
 		}
+	}()
+
+	for {
+		opts := (&api.QueryOptions{WaitIndex: index, Datacenter: dc}).WithContext(ctx)
+		entries, meta, err := c.cli.Health().Service(name, "", true, opts)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			logger.Logger.Warn("watch consul service", zap.String("service", name), zap.Error(err))
+			if !sleep(ctx, backoff) {
+				return
+			}
+			backoff = nextBackoff(backoff)
+			continue
+		}
+		backoff = c.interval
+		index = nextIndex(index, meta.LastIndex)
+
+		services := c.filterServices(entries, dc, discovery.WithServiceType(mx.ServerType))
+		if !c.sync(shadow, services) {
+			return
+		}
+	}
+}
+
+// sync sends the difference between the services and the shadow, it
+// returns false when the discovery is closed
+func (c *consulDiscovery) sync(shadow map[string]discovery.ServiceDesc, services map[string]discovery.ServiceDesc) bool {
+	var (
+		adds, updates, dels = c.diffServices(shadow, services)
 	)
-	for _, fn := range optfn {
-		fn(&opts)
+
+	if len(adds) != 0 || len(updates) != 0 || len(dels) != 0 {
+		logger.Logger.Debug("change services", zap.Strings("adds", adds), zap.Strings("updates", updates), zap.Strings("dels", dels))
 	}
 
-	filterd := make(map[string]*api.AgentService)
+	for _, id := range dels {
+		if !c.leave(shadow[id]) {
+			return false
+		}
+		delete(shadow, id)
+	}
 
-	services, err := agent.ServicesWithFilterOpts("", nil)
-	if err != nil {
-		return nil, err
+	for _, id := range updates {
+		desc, ok := c.resolve(services[id], shadow[id])
+		if !ok {
+			continue
+		}
+
+		if !c.send(discovery.RegistryMessage{
+			Method: discovery.ServiceUpdate,
+			Desc:   desc,
+		}) {
+			return false
+		}
+		shadow[id] = desc
+	}
+
+	for _, id := range adds {
+		desc, ok := c.resolve(services[id], discovery.ServiceDesc{})
+		if !ok {
+			continue
+		}
+
+		if !c.send(discovery.RegistryMessage{
+			Method: discovery.ServiceJoin,
+			Desc:   desc,
+		}) {
+			return false
+		}
+		shadow[id] = desc
+	}
+
+	return true
+}
+
+// resolve loads the file descriptor of the desc, unless the old desc has the
+// same one. A failed load is retried on the next change or query timeout.
+func (c *consulDiscovery) resolve(desc discovery.ServiceDesc, old discovery.ServiceDesc) (discovery.ServiceDesc, bool) {
+	if desc.FileDescriptorKey == "" {
+		return desc, true
+	}
+
+	if old.FileDescriptor != nil && old.FileDescriptorKey == desc.FileDescriptorKey {
+		desc.FileDescriptor = old.FileDescriptor
+		return desc, true
 	}
 
-	checks, err := agent.Checks()
+	filedescriptor, err := c.getFileDescriptor(desc.Namespace, desc.Datacenter, desc.FileDescriptorKey)
 	if err != nil {
-		return nil, err
+		logger.Logger.Error("getFileDescriptor", zap.String("key", desc.FileDescriptorKey), zap.Error(err))
+		return desc, false
 	}
 
-	// logger.Logger.Debug("checks services", zap.Any("checks", checks), zap.Any("services", services))
-	for name, srv := range services {
+	desc.FileDescriptor = filedescriptor
+	return desc, true
+}
 
-		if check, ok := checks["service:"+name]; ok && check.Status != "passing" {
-			continue
+func (c *consulDiscovery) leave(desc discovery.ServiceDesc) bool {
+	return c.send(discovery.RegistryMessage{
+		Method: discovery.ServiceLeave,
+		Desc: discovery.ServiceDesc{
+			ID:        desc.ID,
+			Service:   desc.Service,
+			Type:      desc.Type,
+			Address:   desc.Address,
+			Namespace: desc.Namespace,
+		},
+	})
+}
+
+// send blocks until the message is received or the discovery is closed
+func (c *consulDiscovery) send(msg discovery.RegistryMessage) bool {
+	select {
+	case c.msgch <- msg:
+		return true
+	case <-c.ctx.Done():
+		return false
+	}
+}
+
+// filterServices returns the services of the health entries of the
+// datacenter matching the namespaces and options
+func (c *consulDiscovery) filterServices(entries []*api.ServiceEntry, dc string, optfn ...discovery.LookupOptionFunc) map[string]discovery.ServiceDesc {
+	var (
+		opts = discovery.LookupOption{
+			Namespace:  c.namespace(),
+			Namespaces: c.opts.Namespaces,
 		}
+		remoteDC = dc != "" && dc != c.datacenter
+	)
 
+	if dc == "" {
+		dc = c.datacenter
+	}
+	for _, fn := range optfn {
+		fn(&opts)
+	}
+
+	filterd := make(map[string]discovery.ServiceDesc)
+	for _, entry := range entries {
+		srv := *entry.Service
 		if !opts.MatchNamespace(srv.Meta["namespace"]) {
 			continue
 		}
 
-		if opts.MatchServiceType(srv.Meta["service_type"]) {
-			filterd[srv.ID] = srv
+		if !opts.MatchServiceType(srv.Meta["service_type"]) {
+			continue
+		}
+
+		// services registered without address use the node address
+		if srv.Address == "" && entry.Node != nil {
+			srv.Address = entry.Node.Address
+		}
+
+		// the ids are only unique in their datacenter
+		id := srv.ID
+		if remoteDC {
+			id += "@" + dc
 		}
 
+		filterd[id] = discovery.ServiceDesc{
+			ID:                id,
+			Service:           srv.Service,
+			Type:              srv.Meta["service_type"],
+			Address:           net.JoinHostPort(srv.Address, strconv.Itoa(srv.Port)),
+			Namespace:         srv.Meta["namespace"],
+			TargetURI:         c.resolverURI(&srv),
+			Group:             srv.Meta["group"],
+			FileDescriptorKey: srv.Meta["file_descriptor_key"],
+			Version:           srv.Meta["version"],
+			Weight:            srv.Weights.Passing,
+			Tags:              srv.Tags,
+			Draining:          srv.Meta["draining"] == "true",
+			Datacenter:        dc,
+			Remote:            remoteDC || srv.Meta["namespace"] != c.namespace(),
+		}
 	}
 
-	return filterd, err
+	return filterd
 }
 
-func (c *consulDiscovery) diffServices(services map[string]*api.AgentService) (adds []string, updates []string, dels []string) {
-	for srvId := range services {
-		if _, ok := c.shadow[srvId]; !ok {
+func (c *consulDiscovery) diffServices(shadow map[string]discovery.ServiceDesc, services map[string]discovery.ServiceDesc) (adds []string, updates []string, dels []string) {
+	for srvId, desc := range services {
+		old, ok := shadow[srvId]
+		if !ok {
 			adds = append(adds, srvId)
+		} else if desc.Changed(old) {
+			updates = append(updates, srvId)
 		}
 	}
 
-	for srvId := range c.shadow {
+	for srvId := range shadow {
 		if _, ok := services[srvId]; !ok {
 			dels = append(dels, srvId)
 		}
 	}
 
+	sort.Strings(adds)
+	sort.Strings(updates)
+	sort.Strings(dels)
 	return
 }
 
+// nextIndex returns the wait index of the next blocking query, it is reset
+// when the index goes backwards, e.g. after the consul state is restored
+func nextIndex(prev, last uint64) uint64 {
+	if last < prev {
+		return 0
+	}
+
+	if last < 1 {
+		return 1
+	}
+
+	return last
+}
+
+func nextBackoff(d time.Duration) time.Duration {
+	if d *= 2; d > 30*time.Second {
+		return 30 * time.Second
+	}
+	return d
+}
+
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
 func (c *consulDiscovery) Close() error {
+	c.init()
 	c.closefn()
 
 	return nil
@@ -297,16 +592,16 @@ func init() {
 		return &provider{}
 	})
 
-	agent.SetDefaultAgent(NewConsulAgent())
+	agent.SetDefaultAgent(NewConsulAgent(AgentEnvOptions()...))
 }
 
 type provider struct {
 }
 
 func (p *provider) Discover() discovery.ServiceDiscover {
-	return NewConsulProvider()
+	return NewConsulProvider(EnvOptions()...)
 }
 
 func (p *provider) Agent() discovery.Agent {
-	return NewConsulAgent()
+	return NewConsulAgent(AgentEnvOptions()...)
 }
@@ -0,0 +1,367 @@
+package consul
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hysios/mx/discovery"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// fakeConsul serves the catalog and health blocking queries of the services
+type fakeConsul struct {
+	l        sync.Mutex
+	index    uint64
+	changed  chan struct{}
+	services map[string][]*api.ServiceEntry
+	// remote are the services of the other datacenters
+	remote map[string]map[string][]*api.ServiceEntry
+	// kv are the values of the keys by datacenter
+	kv map[string]map[string][]byte
+	// selfFailures is the number of agent self queries left to fail
+	selfFailures int
+}
+
+func newFakeConsul() *fakeConsul {
+	return &fakeConsul{
+		index:    1,
+		changed:  make(chan struct{}),
+		services: make(map[string][]*api.ServiceEntry),
+		remote:   make(map[string]map[string][]*api.ServiceEntry),
+		kv:       make(map[string]map[string][]byte),
+	}
+}
+
+func (f *fakeConsul) put(dc, key string, value []byte) {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	if f.kv[dc] == nil {
+		f.kv[dc] = make(map[string][]byte)
+	}
+	f.kv[dc][key] = value
+}
+
+func (f *fakeConsul) setRemote(dc, name string, entries ...*api.ServiceEntry) {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	if f.remote[dc] == nil {
+		f.remote[dc] = make(map[string][]*api.ServiceEntry)
+	}
+	f.remote[dc][name] = entries
+	f.bump()
+}
+
+// bump advances the index and wakes the blocking queries, the lock must be
+// held
+func (f *fakeConsul) bump() {
+	f.index++
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeConsul) set(name string, entries ...*api.ServiceEntry) {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	if len(entries) == 0 {
+		delete(f.services, name)
+	} else {
+		f.services[name] = entries
+	}
+	f.bump()
+}
+
+// wait blocks until the index passes the wait index of the request
+func (f *fakeConsul) wait(r *http.Request) {
+	wait, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+	for {
+		f.l.Lock()
+		index, changed := f.index, f.changed
+		f.l.Unlock()
+
+		if index > wait {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.wait(r)
+
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	var (
+		services = f.services
+		dc       = r.URL.Query().Get("dc")
+	)
+	if dc == "" {
+		dc = "dc1"
+	}
+	if dc != "dc1" {
+		services = f.remote[dc]
+	}
+
+	var body interface{}
+	switch {
+	case r.URL.Path == "/v1/agent/self":
+		if f.selfFailures > 0 {
+			f.selfFailures--
+			http.Error(w, "agent unavailable", http.StatusInternalServerError)
+			return
+		}
+		body = map[string]map[string]interface{}{"Config": {"Datacenter": "dc1"}}
+	case strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		value, ok := f.kv[dc][key]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		body = []*api.KVPair{{Key: key, Value: value}}
+	case r.URL.Path == "/v1/catalog/services":
+		names := make(map[string][]string)
+		for name := range services {
+			names[name] = nil
+		}
+		body = names
+	case strings.HasPrefix(r.URL.Path, "/v1/health/service/"):
+		entries := services[strings.TrimPrefix(r.URL.Path, "/v1/health/service/")]
+		if entries == nil {
+			entries = []*api.ServiceEntry{}
+		}
+		body = entries
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+	json.NewEncoder(w).Encode(body)
+}
+
+func entry(node, id, service, addr string, port int) *api.ServiceEntry {
+	return &api.ServiceEntry{
+		Node: &api.Node{Node: node, Address: "10.0.0." + node},
+		Service: &api.AgentService{
+			ID:      id,
+			Service: service,
+			Address: addr,
+			Port:    port,
+			Meta: map[string]string{
+				"service_type": "grpc_server",
+				"namespace":    discovery.Namespace,
+			},
+		},
+	}
+}
+
+func newTestDiscovery(t *testing.T, f *fakeConsul, optfns ...DiscoveryOptionFunc) *consulDiscovery {
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	cfg := api.DefaultConfig()
+	cfg.Address = strings.TrimPrefix(srv.URL, "http://")
+
+	var opts DiscoveryOption
+	for _, fn := range optfns {
+		fn(&opts)
+	}
+
+	c := &consulDiscovery{config: cfg, interval: 10 * time.Millisecond, opts: opts}
+	go c.Run()
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func recv(t *testing.T, c discovery.ServiceDiscover) discovery.RegistryMessage {
+	select {
+	case msg := <-c.Notify():
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatal("no registry message")
+		return discovery.RegistryMessage{}
+	}
+}
+
+func TestConsulDiscovery(t *testing.T) {
+	var (
+		f = newFakeConsul()
+		c = newTestDiscovery(t, f)
+	)
+
+	// services of other nodes, without address use the node address
+	f.set("hello.Greeter", entry("1", "hello_1", "hello.Greeter", "", 9000))
+	msg := recv(t, c)
+	assert.Equal(t, discovery.ServiceJoin, msg.Method)
+	assert.Equal(t, "hello_1", msg.Desc.ID)
+	assert.Equal(t, "10.0.0.1:9000", msg.Desc.Address)
+	assert.Equal(t, "10.0.0.1:9000", msg.Desc.TargetURI)
+
+	f.set("hello.Greeter",
+		entry("1", "hello_1", "hello.Greeter", "", 9000),
+		entry("2", "hello_2", "hello.Greeter", "10.1.0.2", 9000),
+	)
+	msg = recv(t, c)
+	assert.Equal(t, discovery.ServiceJoin, msg.Method)
+	assert.Equal(t, "hello_2", msg.Desc.ID)
+	assert.Equal(t, "10.1.0.2:9000", msg.Desc.Address)
+
+	// a moved instance is updated
+	f.set("hello.Greeter",
+		entry("1", "hello_1", "hello.Greeter", "", 9000),
+		entry("2", "hello_2", "hello.Greeter", "10.1.0.3", 9000),
+	)
+	msg = recv(t, c)
+	assert.Equal(t, discovery.ServiceUpdate, msg.Method)
+	assert.Equal(t, "hello_2", msg.Desc.ID)
+	assert.Equal(t, "10.1.0.3:9000", msg.Desc.Address)
+
+	// so are its weight and draining flag
+	draining := entry("2", "hello_2", "hello.Greeter", "10.1.0.3", 9000)
+	draining.Service.Weights = api.AgentWeights{Passing: 5, Warning: 1}
+	draining.Service.Meta["draining"] = "true"
+	f.set("hello.Greeter", entry("1", "hello_1", "hello.Greeter", "", 9000), draining)
+	msg = recv(t, c)
+	assert.Equal(t, discovery.ServiceUpdate, msg.Method)
+	assert.Equal(t, 5, msg.Desc.Weight)
+	assert.True(t, msg.Desc.Draining)
+
+	// other types are ignored
+	other := entry("3", "config_1", "mx.config", "", 9400)
+	other.Service.Meta["service_type"] = "config_provider"
+	f.set("mx.config", other)
+
+	// a service removed from the catalog leaves
+	f.set("hello.Greeter")
+	left := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		msg = recv(t, c)
+		assert.Equal(t, discovery.ServiceLeave, msg.Method)
+		left[msg.Desc.ID] = true
+	}
+	assert.Equal(t, map[string]bool{"hello_1": true, "hello_2": true}, left)
+
+	select {
+	case msg := <-c.Notify():
+		t.Fatalf("unexpected message %v", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestConsulDiscoveryNoDrop(t *testing.T) {
+	var (
+		f = newFakeConsul()
+		c = newTestDiscovery(t, f)
+		n = 50
+	)
+
+	// more changes than the channel buffer while nobody reads
+	var entries []*api.ServiceEntry
+	for i := 0; i < n; i++ {
+		entries = append(entries, entry("1", "hello_"+strconv.Itoa(i), "hello.Greeter", "10.1.0.1", 9000+i))
+	}
+	f.set("hello.Greeter", entries...)
+	time.Sleep(100 * time.Millisecond)
+
+	joined := map[string]bool{}
+	for i := 0; i < n; i++ {
+		msg := recv(t, c)
+		assert.Equal(t, discovery.ServiceJoin, msg.Method)
+		joined[msg.Desc.ID] = true
+	}
+	assert.Len(t, joined, n)
+}
+
+func TestNextIndex(t *testing.T) {
+	assert.Equal(t, uint64(1), nextIndex(0, 0))
+	assert.Equal(t, uint64(5), nextIndex(1, 5))
+	assert.Equal(t, uint64(5), nextIndex(5, 5))
+	// reset when it goes backwards
+	assert.Equal(t, uint64(0), nextIndex(5, 3))
+}
+
+func TestConsulDiscoveryFederated(t *testing.T) {
+	var (
+		f = newFakeConsul()
+		c = newTestDiscovery(t, f, WithDatacenters("dc1", "dc2"), WithNamespaces("billing"))
+	)
+
+	local := entry("1", "user_1", "user.User", "10.1.0.1", 9000)
+	other := entry("2", "user_2", "user.User", "10.1.0.2", 9000)
+	other.Service.Meta["namespace"] = "billing"
+	ignored := entry("3", "user_3", "user.User", "10.1.0.3", 9000)
+	ignored.Service.Meta["namespace"] = "other"
+	f.set("user.User", local, other, ignored)
+
+	msgs := map[string]discovery.ServiceDesc{}
+	for i := 0; i < 2; i++ {
+		msg := recv(t, c)
+		msgs[msg.Desc.ID] = msg.Desc
+	}
+
+	assert.Equal(t, "dc1", msgs["user_1"].Datacenter)
+	assert.False(t, msgs["user_1"].Remote)
+	assert.Equal(t, "mx@dc1", msgs["user_1"].Origin())
+	assert.True(t, msgs["user_2"].Remote)
+	assert.Equal(t, "billing@dc1", msgs["user_2"].Origin())
+
+	// the same id in another datacenter is another instance
+	f.setRemote("dc2", "user.User", entry("4", "user_1", "user.User", "10.2.0.1", 9000))
+	msg := recv(t, c)
+	assert.Equal(t, discovery.ServiceJoin, msg.Method)
+	assert.Equal(t, "user_1@dc2", msg.Desc.ID)
+	assert.Equal(t, "dc2", msg.Desc.Datacenter)
+	assert.True(t, msg.Desc.Remote)
+}
+
+func TestConsulDiscoveryRemoteDescriptor(t *testing.T) {
+	var (
+		f    = newFakeConsul()
+		pack discovery.FileDescriptorPacker
+	)
+	// the agent is not reachable at first
+	f.selfFailures = 2
+
+	b, err := pack.Pack(emptypb.File_google_protobuf_empty_proto)
+	assert.NoError(t, err)
+	f.put("dc2", "mx/registry/protofile/billing/empty", b)
+
+	c := newTestDiscovery(t, f, WithDatacenters("dc1", "dc2"), WithNamespaces("billing"))
+
+	remote := entry("1", "empty_1", "empty.Empty", "10.2.0.1", 9000)
+	remote.Service.Meta["namespace"] = "billing"
+	remote.Service.Meta["file_descriptor_key"] = "empty"
+	f.setRemote("dc2", "empty.Empty", remote)
+
+	msg := recv(t, c)
+	assert.Equal(t, discovery.ServiceJoin, msg.Method)
+	assert.Equal(t, "empty_1@dc2", msg.Desc.ID)
+	assert.True(t, msg.Desc.Remote)
+	if assert.NotNil(t, msg.Desc.FileDescriptor) {
+		assert.Equal(t, "google/protobuf/empty.proto", msg.Desc.FileDescriptor.Path())
+	}
+
+	// the local services are not taken for remote ones
+	f.set("user.User", entry("2", "user_2", "user.User", "10.1.0.2", 9000))
+	msg = recv(t, c)
+	assert.Equal(t, "user_2", msg.Desc.ID)
+	assert.Equal(t, "dc1", msg.Desc.Datacenter)
+	assert.False(t, msg.Desc.Remote)
+}
@@ -0,0 +1,50 @@
+package consul
+
+import (
+	"context"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/hysios/mx/discovery/schema"
+)
+
+// SchemaStore returns the schema store on the Consul KV
+func SchemaStore(cli *api.Client) schema.Store {
+	return &kvStore{kv: cli.KV()}
+}
+
+type kvStore struct {
+	kv *api.KV
+}
+
+func (s *kvStore) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	pair, _, err := s.kv.Get(key, (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil || pair == nil {
+		return nil, false, err
+	}
+	return pair.Value, true, nil
+}
+
+func (s *kvStore) Put(ctx context.Context, key string, value []byte) error {
+	_, err := s.kv.Put(&api.KVPair{Key: key, Value: value}, (&api.WriteOptions{}).WithContext(ctx))
+	return err
+}
+
+// Create puts the value with a check-and-set index of 0, which Consul only
+// accepts when the key does not exist
+func (s *kvStore) Create(ctx context.Context, key string, value []byte) (bool, error) {
+	ok, _, err := s.kv.CAS(&api.KVPair{Key: key, Value: value, ModifyIndex: 0}, (&api.WriteOptions{}).WithContext(ctx))
+	return ok, err
+}
+
+func (s *kvStore) List(ctx context.Context, prefix string) (map[string][]byte, error) {
+	pairs, _, err := s.kv.List(prefix, (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	kvs := make(map[string][]byte, len(pairs))
+	for _, pair := range pairs {
+		kvs[pair.Key] = pair.Value
+	}
+	return kvs, nil
+}
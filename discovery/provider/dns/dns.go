@@ -0,0 +1,274 @@
+// Package dns implements service discovery from DNS SRV records, e.g. the
+// records of a Kubernetes headless service or a Consul DNS interface.
+//
+// Each service is mapped to a SRV name, which is resolved periodically;
+// targets added or removed join or leave.
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hysios/mx/discovery"
+	"github.com/hysios/mx/logger"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Resolver resolves SRV records, net.DefaultResolver implements it.
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// Service maps a service name to its SRV record.
+type Service struct {
+	Service string
+	// Name is the SRV name, e.g. _grpc._tcp.user.default.svc.cluster.local
+	Name           string
+	FileDescriptor protoreflect.FileDescriptor
+}
+
+type DNSOption struct {
+	Services []Service
+	Resolver Resolver
+	// Interval is the interval between resolves, default is 30s
+	Interval time.Duration
+}
+
+type DNSOptionFunc func(*DNSOption)
+
+// WithService adds the service resolved from the SRV name.
+func WithService(service, name string) DNSOptionFunc {
+	return func(o *DNSOption) {
+		o.Services = append(o.Services, Service{Service: service, Name: name})
+	}
+}
+
+// WithFileDescriptor adds the service resolved from the SRV name, with the
+// file descriptor defining it.
+func WithFileDescriptor(service, name string, fd protoreflect.FileDescriptor) DNSOptionFunc {
+	return func(o *DNSOption) {
+		o.Services = append(o.Services, Service{Service: service, Name: name, FileDescriptor: fd})
+	}
+}
+
+func WithResolver(r Resolver) DNSOptionFunc {
+	return func(o *DNSOption) {
+		o.Resolver = r
+	}
+}
+
+func WithInterval(d time.Duration) DNSOptionFunc {
+	return func(o *DNSOption) {
+		o.Interval = d
+	}
+}
+
+// NewDNSProvider returns a service discover resolving the SRV records of the
+// services.
+func NewDNSProvider(optfns ...DNSOptionFunc) discovery.ServiceDiscover {
+	c := newDNSDiscovery(optfns...)
+	go c.Run()
+	return c
+}
+
+func newDNSDiscovery(optfns ...DNSOptionFunc) *dnsDiscovery {
+	var opt = DNSOption{
+		Resolver: net.DefaultResolver,
+		Interval: 30 * time.Second,
+	}
+
+	for _, fn := range optfns {
+		fn(&opt)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &dnsDiscovery{
+		opts:    opt,
+		ctx:     ctx,
+		closefn: cancel,
+		msgch:   make(chan discovery.RegistryMessage, 10),
+		shadow:  make(map[string]discovery.ServiceDesc),
+	}
+}
+
+type dnsDiscovery struct {
+	opts    DNSOption
+	ctx     context.Context
+	closefn context.CancelFunc
+	msgch   chan discovery.RegistryMessage
+	shadow  map[string]discovery.ServiceDesc
+}
+
+// Run resolves the services every interval until Close.
+func (c *dnsDiscovery) Run() error {
+	tick := time.NewTicker(c.opts.Interval)
+	defer tick.Stop()
+
+	for {
+		for _, s := range c.opts.Services {
+			c.resolve(s)
+		}
+
+		select {
+		case <-tick.C:
+		case <-c.ctx.Done():
+			return c.ctx.Err()
+		}
+	}
+}
+
+// resolve emits the difference between the records and the known targets
+// of the service. A failed lookup keeps the known targets, a lookup
+// without records leaves them.
+func (c *dnsDiscovery) resolve(s Service) {
+	ctx, cancel := context.WithTimeout(c.ctx, 10*time.Second)
+	defer cancel()
+
+	_, srvs, err := c.opts.Resolver.LookupSRV(ctx, "", "", s.Name)
+	if err != nil && !isNotFound(err) {
+		logger.Logger.Warn("lookup srv", zap.String("service", s.Service), zap.String("name", s.Name), zap.Error(err))
+		return
+	}
+
+	var descs = make(map[string]discovery.ServiceDesc)
+	for _, srv := range srvs {
+		var (
+			addr = net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), fmt.Sprint(srv.Port))
+			desc = discovery.ServiceDesc{
+				ID:             s.Service + "_" + addr,
+				Service:        s.Service,
+				Address:        addr,
+				TargetURI:      addr,
+				FileDescriptor: s.FileDescriptor,
+				Weight:         int(srv.Weight),
+			}
+		)
+
+		if s.FileDescriptor != nil {
+			desc.FileDescriptorKey = s.FileDescriptor.Path()
+		}
+		descs[desc.ID] = desc
+	}
+
+	var leaves []string
+	for id, desc := range c.shadow {
+		if _, ok := descs[id]; !ok && desc.Service == s.Service {
+			leaves = append(leaves, id)
+		}
+	}
+	sort.Strings(leaves)
+
+	for _, id := range leaves {
+		desc := c.shadow[id]
+		delete(c.shadow, id)
+		c.send(discovery.RegistryMessage{
+			Method: discovery.ServiceLeave,
+			Desc: discovery.ServiceDesc{
+				ID:      id,
+				Service: desc.Service,
+				Address: desc.Address,
+			},
+		})
+	}
+
+	var joins, updates []string
+	for id, desc := range descs {
+		if old, ok := c.shadow[id]; !ok {
+			joins = append(joins, id)
+		} else if desc.Changed(old) {
+			updates = append(updates, id)
+		}
+	}
+	sort.Strings(joins)
+	sort.Strings(updates)
+
+	for _, id := range updates {
+		c.shadow[id] = descs[id]
+		c.send(discovery.RegistryMessage{
+			Method: discovery.ServiceUpdate,
+			Desc:   descs[id],
+		})
+	}
+
+	for _, id := range joins {
+		c.shadow[id] = descs[id]
+		c.send(discovery.RegistryMessage{
+			Method: discovery.ServiceJoin,
+			Desc:   descs[id],
+		})
+	}
+}
+
+func isNotFound(err error) bool {
+	dnserr, ok := err.(*net.DNSError)
+	return ok && dnserr.IsNotFound
+}
+
+func (c *dnsDiscovery) send(msg discovery.RegistryMessage) {
+	select {
+	case c.msgch <- msg:
+	case <-c.ctx.Done():
+	}
+}
+
+func (c *dnsDiscovery) Close() error {
+	c.closefn()
+	return nil
+}
+
+func (c *dnsDiscovery) Notify() chan discovery.RegistryMessage {
+	return c.msgch
+}
+
+// Register registers the dns discovery provider.
+func Register(optfns ...DNSOptionFunc) {
+	discovery.RegistryProvider("dns", func() discovery.Provider {
+		return &provider{optfns: optfns}
+	})
+}
+
+// ParseServices parses the services from service=name pairs separated by
+// commas, e.g. user.User=_grpc._tcp.user.svc.cluster.local
+func ParseServices(s string) ([]DNSOptionFunc, error) {
+	var optfns []DNSOptionFunc
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		service, name, ok := strings.Cut(pair, "=")
+		if !ok || service == "" || name == "" {
+			return nil, fmt.Errorf("invalid dns service %q, example: user.User=_grpc._tcp.user", pair)
+		}
+		optfns = append(optfns, WithService(service, name))
+	}
+
+	return optfns, nil
+}
+
+func init() {
+	// register dns discovery when the services are set
+	if s := os.Getenv("MX_DISCOVERY_DNS"); s != "" {
+		optfns, err := ParseServices(s)
+		if err != nil {
+			logger.Logger.Error("parse MX_DISCOVERY_DNS", zap.Error(err))
+			return
+		}
+		Register(optfns...)
+	}
+}
+
+type provider struct {
+	optfns []DNSOptionFunc
+}
+
+func (p *provider) Discover() discovery.ServiceDiscover {
+	return NewDNSProvider(p.optfns...)
+}
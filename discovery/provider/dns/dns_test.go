@@ -0,0 +1,107 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/hysios/mx/discovery"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeResolver struct {
+	records map[string][]*net.SRV
+	err     error
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	if r.err != nil {
+		return "", nil, r.err
+	}
+
+	srvs, ok := r.records[name]
+	if !ok {
+		return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return name, srvs, nil
+}
+
+func TestResolve(t *testing.T) {
+	var (
+		r = &fakeResolver{records: map[string][]*net.SRV{
+			"_grpc._tcp.user": {
+				{Target: "10.0.0.1.", Port: 9000},
+				{Target: "10.0.0.2.", Port: 9000},
+			},
+		}}
+		c    = newDNSDiscovery(WithResolver(r), WithService("user.User", "_grpc._tcp.user"))
+		user = c.opts.Services[0]
+	)
+
+	c.resolve(user)
+	assert.Len(t, c.msgch, 2)
+
+	msg := <-c.msgch
+	assert.Equal(t, discovery.ServiceJoin, msg.Method)
+	assert.Equal(t, "user.User_10.0.0.1:9000", msg.Desc.ID)
+	assert.Equal(t, "10.0.0.1:9000", msg.Desc.TargetURI)
+	<-c.msgch
+
+	// unchanged records emit nothing
+	c.resolve(user)
+	assert.Len(t, c.msgch, 0)
+
+	// a failed lookup keeps the known targets
+	r.err = &net.DNSError{Err: "timeout", IsTimeout: true}
+	c.resolve(user)
+	assert.Len(t, c.msgch, 0)
+	r.err = nil
+
+	r.records["_grpc._tcp.user"] = []*net.SRV{
+		{Target: "10.0.0.2.", Port: 9000},
+		{Target: "10.0.0.3.", Port: 9000},
+	}
+	c.resolve(user)
+	assert.Len(t, c.msgch, 2)
+
+	msg = <-c.msgch
+	assert.Equal(t, discovery.ServiceLeave, msg.Method)
+	assert.Equal(t, "user.User_10.0.0.1:9000", msg.Desc.ID)
+	msg = <-c.msgch
+	assert.Equal(t, discovery.ServiceJoin, msg.Method)
+	assert.Equal(t, "user.User_10.0.0.3:9000", msg.Desc.ID)
+
+	// a changed weight updates the target
+	r.records["_grpc._tcp.user"] = []*net.SRV{
+		{Target: "10.0.0.2.", Port: 9000, Weight: 10},
+		{Target: "10.0.0.3.", Port: 9000},
+	}
+	c.resolve(user)
+	assert.Len(t, c.msgch, 1)
+	msg = <-c.msgch
+	assert.Equal(t, discovery.ServiceUpdate, msg.Method)
+	assert.Equal(t, "user.User_10.0.0.2:9000", msg.Desc.ID)
+	assert.Equal(t, 10, msg.Desc.Weight)
+
+	// the name is gone, every target leaves
+	delete(r.records, "_grpc._tcp.user")
+	c.resolve(user)
+	assert.Len(t, c.msgch, 2)
+}
+
+func TestParseServices(t *testing.T) {
+	optfns, err := ParseServices("user.User=_grpc._tcp.user, echo.Echo=_grpc._tcp.echo")
+	assert.NoError(t, err)
+
+	var opt DNSOption
+	for _, fn := range optfns {
+		fn(&opt)
+	}
+	assert.Equal(t, []Service{
+		{Service: "user.User", Name: "_grpc._tcp.user"},
+		{Service: "echo.Echo", Name: "_grpc._tcp.echo"},
+	}, opt.Services)
+
+	_, err = ParseServices("user.User")
+	assert.Error(t, err)
+}
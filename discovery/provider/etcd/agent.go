@@ -0,0 +1,362 @@
+package etcd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/hysios/mx/discovery"
+	"github.com/hysios/mx/discovery/schema"
+	"github.com/hysios/mx/logger"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+type AgentOption struct {
+	Config    *clientv3.Config
+	Client    *clientv3.Client
+	Namespace string
+	// TTL is the lease ttl of the registered services in seconds, a service
+	// leaves when its process stops keeping the lease alive, default is 30
+	TTL int64
+}
+
+type AgentOptionFunc func(*AgentOption)
+
+func WithConfig(cfg *clientv3.Config) AgentOptionFunc {
+	return func(opt *AgentOption) {
+		opt.Config = cfg
+	}
+}
+
+func WithClient(cli *clientv3.Client) AgentOptionFunc {
+	return func(opt *AgentOption) {
+		opt.Client = cli
+	}
+}
+
+func WithNamespace(ns string) AgentOptionFunc {
+	return func(opt *AgentOption) {
+		opt.Namespace = ns
+	}
+}
+
+func WithTTL(ttl int64) AgentOptionFunc {
+	return func(opt *AgentOption) {
+		opt.TTL = ttl
+	}
+}
+
+func NewEtcdAgent(optFns ...AgentOptionFunc) discovery.Agent {
+	var (
+		opt = AgentOption{
+			TTL: 30,
+		}
+	)
+	for _, fn := range optFns {
+		fn(&opt)
+	}
+
+	cli := opt.Client
+	if cli == nil {
+		if opt.Config == nil {
+			opt.Config = DefaultConfig()
+		}
+
+		var err error
+		cli, err = clientv3.New(*opt.Config)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &etcdAgent{
+		Namespace: opt.Namespace,
+		cli:       cli,
+		opts:      opt,
+		ctx:       ctx,
+		closefn:   cancel,
+		leases:    make(map[string]*registration),
+	}
+}
+
+type etcdAgent struct {
+	Namespace string
+	cli       *clientv3.Client
+	opts      AgentOption
+	ctx       context.Context
+	closefn   context.CancelFunc
+	pack      discovery.FileDescriptorPacker
+
+	leases map[string]*registration
+	l      sync.Mutex
+}
+
+// registration is the key of a registered service and the lease keeping
+// it, guarded by the agent lock
+type registration struct {
+	key   string
+	value string
+	lease clientv3.LeaseID
+}
+
+func (c *etcdAgent) namespace() string {
+	if c.Namespace == "" {
+		c.Namespace = discovery.Namespace
+	}
+
+	return c.Namespace
+}
+
+// Register puts the service under a lease kept alive until Deregister or
+// the process exits.
+func (c *etcdAgent) Register(desc discovery.ServiceDesc) error {
+	if desc.ID == "" {
+		return errors.New("service id is required")
+	}
+
+	var ns = c.namespace()
+
+	c.l.Lock()
+	_, registered := c.leases[desc.ID]
+	c.l.Unlock()
+
+	if desc.FileDescriptor != nil {
+		if desc.FileDescriptorKey == "" {
+			desc.FileDescriptorKey = desc.FileDescriptor.Path()
+		}
+
+		// rejected when it breaks the registered version, updates of a
+		// registered service, e.g. draining, were checked when it joined
+		if !registered {
+			if _, err := schema.NewRegistry(SchemaStore(c.cli)).Register(c.ctx, ns, desc.FileDescriptorKey, desc.FileDescriptor); err != nil {
+				return err
+			}
+		}
+	}
+
+	b, err := json.Marshal(newRecord(desc))
+	if err != nil {
+		return err
+	}
+
+	var key = serviceKey(ns, desc.Service, desc.ID)
+
+	c.l.Lock()
+	reg, ok := c.leases[desc.ID]
+	if ok {
+		// a lease being granted again after it was lost puts the latest value
+		reg.key, reg.value = key, string(b)
+	}
+	c.l.Unlock()
+
+	if ok {
+		// updates of a registered service, e.g. draining, keep its lease
+		_, err := c.cli.Put(c.ctx, key, string(b), clientv3.WithLease(c.leaseOf(reg)))
+		return err
+	}
+
+	reg = &registration{key: key, value: string(b)}
+	keepalive, err := c.grant(reg)
+	if err != nil {
+		return err
+	}
+
+	c.l.Lock()
+	c.leases[desc.ID] = reg
+	c.l.Unlock()
+
+	go c.keepAlive(desc, reg, keepalive)
+	return nil
+}
+
+func (c *etcdAgent) leaseOf(reg *registration) clientv3.LeaseID {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	return reg.lease
+}
+
+// grant puts the key of the registration under a new lease and keeps it
+// alive.
+func (c *etcdAgent) grant(reg *registration) (<-chan *clientv3.LeaseKeepAliveResponse, error) {
+	lease, err := c.cli.Grant(c.ctx, c.opts.TTL)
+	if err != nil {
+		return nil, err
+	}
+
+	c.l.Lock()
+	key, value := reg.key, reg.value
+	c.l.Unlock()
+
+	if _, err := c.cli.Put(c.ctx, key, value, clientv3.WithLease(lease.ID)); err != nil {
+		c.revoke(lease.ID)
+		return nil, err
+	}
+
+	keepalive, err := c.cli.KeepAlive(c.ctx, lease.ID)
+	if err != nil {
+		c.revoke(lease.ID)
+		return nil, err
+	}
+
+	c.l.Lock()
+	reg.lease = lease.ID
+	c.l.Unlock()
+
+	return keepalive, nil
+}
+
+// keepAlive drains the keepalive responses of the registration. The
+// channel closes when the agent is closed, the service is deregistered or
+// the lease expired, e.g. etcd was unreachable for longer than the ttl,
+// then the lease is granted again until the agent is closed.
+func (c *etcdAgent) keepAlive(desc discovery.ServiceDesc, reg *registration, keepalive <-chan *clientv3.LeaseKeepAliveResponse) {
+	for {
+		for range keepalive {
+		}
+
+		if !c.registered(desc.ID, reg) {
+			return
+		}
+
+		logger.Logger.Warn("etcd lease lost, registering again", zap.String("service", desc.Service), zap.String("id", desc.ID))
+
+		var backoff = time.Second
+		for {
+			var err error
+			if keepalive, err = c.grant(reg); err == nil {
+				break
+			}
+
+			logger.Logger.Warn("etcd register failed", zap.String("service", desc.Service), zap.String("id", desc.ID), zap.Error(err))
+			select {
+			case <-time.After(backoff):
+			case <-c.ctx.Done():
+				return
+			}
+
+			if backoff *= 2; backoff > 30*time.Second {
+				backoff = 30 * time.Second
+			}
+		}
+
+		// deregistered while the lease was granted
+		if !c.registered(desc.ID, reg) {
+			c.revoke(c.leaseOf(reg))
+			return
+		}
+	}
+}
+
+// registered reports whether the registration is still the one of the id
+// and the agent is open.
+func (c *etcdAgent) registered(id string, reg *registration) bool {
+	if c.ctx.Err() != nil {
+		return false
+	}
+
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	return c.leases[id] == reg
+}
+
+func (c *etcdAgent) revoke(lease clientv3.LeaseID) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := c.cli.Revoke(ctx, lease)
+	return err
+}
+
+// Deregister revokes the lease of the service, which removes its key.
+func (c *etcdAgent) Deregister(serviceID string) error {
+	c.l.Lock()
+	reg, ok := c.leases[serviceID]
+	delete(c.leases, serviceID)
+	c.l.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	return c.revoke(c.leaseOf(reg))
+}
+
+// Close deregisters the services of the agent and closes the client.
+func (c *etcdAgent) Close() error {
+	c.l.Lock()
+	var ids []string
+	for id := range c.leases {
+		ids = append(ids, id)
+	}
+	c.l.Unlock()
+
+	for _, id := range ids {
+		_ = c.Deregister(id)
+	}
+
+	c.closefn()
+	return c.cli.Close()
+}
+
+func (c *etcdAgent) Lookup(serviceName string, optfns ...discovery.LookupOptionFunc) ([]discovery.ServiceDesc, bool) {
+	var opt = discovery.LookupOption{}
+	for _, fn := range optfns {
+		fn(&opt)
+	}
+
+	ns := opt.Namespace
+	if ns == "" {
+		ns = c.namespace()
+	}
+
+	resp, err := c.cli.Get(c.ctx, servicePrefixOf(ns, serviceName), clientv3.WithPrefix())
+	if err != nil {
+		return nil, false
+	}
+
+	var descs []discovery.ServiceDesc
+	for _, kv := range resp.Kvs {
+		r, err := decodeRecord(kv.Value)
+		if err != nil {
+			continue
+		}
+
+		if !opt.MatchServiceType(r.Type) {
+			continue
+		}
+
+		desc := r.desc()
+		if desc.FileDescriptorKey != "" {
+			if fd, err := c.getFileDescriptor(ns, desc.FileDescriptorKey); err == nil {
+				desc.FileDescriptor = fd
+			}
+		}
+		descs = append(descs, desc)
+	}
+
+	return descs, true
+}
+
+func (c *etcdAgent) getFileDescriptor(ns, key string) (protoreflect.FileDescriptor, error) {
+	return getFileDescriptor(c.ctx, c.cli, &c.pack, ns, key)
+}
+
+func getFileDescriptor(ctx context.Context, cli *clientv3.Client, pack *discovery.FileDescriptorPacker, ns, key string) (protoreflect.FileDescriptor, error) {
+	resp, err := cli.Get(ctx, protofileKey(ns, key))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Kvs) == 0 {
+		return nil, errors.New("file descriptor not found: " + key)
+	}
+
+	return pack.Unpack(resp.Kvs[0].Value)
+}
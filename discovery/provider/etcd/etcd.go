@@ -0,0 +1,298 @@
+// Package etcd implements service discovery on etcd.
+//
+// Services are stored as JSON under mx/registry/services/{ns}/{service}/{id}
+// with a lease kept alive by the registering process, and packed file
+// descriptors under mx/registry/protofile/{ns}/{key} like the consul
+// provider. Importing the package with ETCD_ENDPOINTS set registers the
+// provider and sets the etcd agent as the default agent, otherwise call
+// Register.
+package etcd
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hysios/mx"
+	"github.com/hysios/mx/discovery"
+	"github.com/hysios/mx/discovery/agent"
+	"github.com/hysios/mx/logger"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+// DefaultConfig returns the client config from the environment,
+// ETCD_ENDPOINTS (comma separated, default 127.0.0.1:2379), ETCD_USERNAME
+// and ETCD_PASSWORD.
+func DefaultConfig() *clientv3.Config {
+	endpoints := os.Getenv("ETCD_ENDPOINTS")
+	if endpoints == "" {
+		endpoints = "127.0.0.1:2379"
+	}
+
+	return &clientv3.Config{
+		Endpoints:   strings.Split(endpoints, ","),
+		Username:    os.Getenv("ETCD_USERNAME"),
+		Password:    os.Getenv("ETCD_PASSWORD"),
+		DialTimeout: 5 * time.Second,
+	}
+}
+
+func NewEtcdProvider() discovery.ServiceDiscover {
+	c := &etcdDiscovery{}
+	go c.Run()
+	return c
+}
+
+type etcdDiscovery struct {
+	Namespace string
+
+	config  *clientv3.Config
+	cli     *clientv3.Client
+	closefn context.CancelFunc
+	ctx     context.Context
+	msgch   chan discovery.RegistryMessage
+	shadow  map[string]discovery.ServiceDesc
+	pack    discovery.FileDescriptorPacker
+	l       sync.Mutex
+}
+
+// init
+func (c *etcdDiscovery) init() error {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	if c.ctx == nil {
+		c.ctx, c.closefn = context.WithCancel(context.Background())
+	}
+
+	if c.shadow == nil {
+		c.shadow = make(map[string]discovery.ServiceDesc)
+	}
+
+	// create msg channel
+	if c.msgch == nil {
+		c.msgch = make(chan discovery.RegistryMessage, 10)
+	}
+
+	if c.config == nil {
+		c.config = DefaultConfig()
+	}
+
+	if c.cli == nil {
+		cli, err := clientv3.New(*c.config)
+		if err != nil {
+			return err
+		}
+		c.cli = cli
+	}
+
+	return nil
+}
+
+// namespace
+func (c *etcdDiscovery) namespace() string {
+	if c.Namespace == "" {
+		c.Namespace = discovery.Namespace
+	}
+
+	return c.Namespace
+}
+
+// Run lists the services of the namespace, then watches the changes from
+// the listed revision, so no event between the two is missed. The watch is
+// restarted with a fresh list when it fails or is compacted.
+func (c *etcdDiscovery) Run() error {
+	if err := c.init(); err != nil {
+		logger.Logger.Error("etcd discovery init", zap.Error(err))
+		return err
+	}
+
+	var prefix = nsPrefix(c.namespace())
+	for {
+		resp, err := c.cli.Get(c.ctx, prefix, clientv3.WithPrefix())
+		if err != nil {
+			if !c.wait(5 * time.Second) {
+				return c.ctx.Err()
+			}
+			continue
+		}
+
+		c.sync(resp.Kvs)
+
+		wch := c.cli.Watch(c.ctx, prefix, clientv3.WithPrefix(), clientv3.WithRev(resp.Header.Revision+1), clientv3.WithPrevKV())
+		for wresp := range wch {
+			if err := wresp.Err(); err != nil {
+				logger.Logger.Warn("etcd watch", zap.Error(err))
+				break
+			}
+
+			for _, ev := range wresp.Events {
+				c.handle(ev)
+			}
+		}
+
+		if !c.wait(time.Second) {
+			return c.ctx.Err()
+		}
+	}
+}
+
+// wait waits for d, it returns false when the discovery is closed
+func (c *etcdDiscovery) wait(d time.Duration) bool {
+	select {
+	case <-c.ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// sync joins the listed services and leaves the known ones missing from
+// the list
+func (c *etcdDiscovery) sync(kvs []*mvccpb.KeyValue) {
+	var seen = make(map[string]bool)
+	for _, kv := range kvs {
+		if id, ok := c.join(kv); ok {
+			seen[id] = true
+		}
+	}
+
+	for id := range c.shadow {
+		if !seen[id] {
+			c.leave(id)
+		}
+	}
+}
+
+// handle turns a watch event into a registry message
+func (c *etcdDiscovery) handle(ev *clientv3.Event) {
+	switch ev.Type {
+	case mvccpb.PUT:
+		c.join(ev.Kv)
+	case mvccpb.DELETE:
+		_, id, ok := parseServiceKey(c.namespace(), string(ev.Kv.Key))
+		if !ok {
+			return
+		}
+		c.leave(id)
+	}
+}
+
+func (c *etcdDiscovery) join(kv *mvccpb.KeyValue) (string, bool) {
+	if _, _, ok := parseServiceKey(c.namespace(), string(kv.Key)); !ok {
+		return "", false
+	}
+
+	r, err := decodeRecord(kv.Value)
+	if err != nil {
+		logger.Logger.Warn("decode etcd service", zap.String("key", string(kv.Key)), zap.Error(err))
+		return "", false
+	}
+
+	if r.Type != mx.ServerType {
+		return "", false
+	}
+
+	desc := r.desc()
+	old, joined := c.shadow[r.ID]
+	if joined && !desc.Changed(old) {
+		return r.ID, true
+	}
+
+	if joined && old.FileDescriptorKey == desc.FileDescriptorKey {
+		desc.FileDescriptor = old.FileDescriptor
+	} else if desc.FileDescriptorKey != "" {
+		fd, err := getFileDescriptor(c.ctx, c.cli, &c.pack, c.namespace(), desc.FileDescriptorKey)
+		if err != nil {
+			logger.Logger.Error("getFileDescriptor", zap.String("key", desc.FileDescriptorKey), zap.Error(err))
+			// a joined service keeps its old desc
+			return r.ID, joined
+		}
+		desc.FileDescriptor = fd
+	}
+
+	var method = discovery.ServiceJoin
+	if joined {
+		method = discovery.ServiceUpdate
+	}
+
+	c.shadow[r.ID] = desc
+	c.send(discovery.RegistryMessage{
+		Method: method,
+		Desc:   desc,
+	})
+	return r.ID, true
+}
+
+func (c *etcdDiscovery) leave(id string) {
+	desc, ok := c.shadow[id]
+	if !ok {
+		return
+	}
+
+	delete(c.shadow, id)
+	c.send(discovery.RegistryMessage{
+		Method: discovery.ServiceLeave,
+		Desc: discovery.ServiceDesc{
+			ID:        id,
+			Service:   desc.Service,
+			Address:   desc.Address,
+			Namespace: desc.Namespace,
+		},
+	})
+}
+
+// send blocks until the message is consumed, dropping it would lose the
+// service for good as etcd only reports each change once.
+func (c *etcdDiscovery) send(msg discovery.RegistryMessage) {
+	select {
+	case c.msgch <- msg:
+	case <-c.ctx.Done():
+	}
+}
+
+func (c *etcdDiscovery) Close() error {
+	if c.closefn != nil {
+		c.closefn()
+	}
+
+	return nil
+}
+
+func (c *etcdDiscovery) Notify() chan discovery.RegistryMessage {
+	c.init()
+
+	return c.msgch
+}
+
+// Register registers the etcd discovery provider and sets the etcd agent
+// as the default agent.
+func Register() {
+	discovery.RegistryProvider("etcd", func() discovery.Provider {
+		return &provider{}
+	})
+
+	agent.SetDefaultAgent(NewEtcdAgent())
+}
+
+func init() {
+	// register etcd discovery when the endpoints are set
+	if os.Getenv("ETCD_ENDPOINTS") != "" {
+		Register()
+	}
+}
+
+type provider struct {
+}
+
+func (p *provider) Discover() discovery.ServiceDiscover {
+	return NewEtcdProvider()
+}
+
+func (p *provider) Agent() discovery.Agent {
+	return NewEtcdAgent()
+}
@@ -0,0 +1,109 @@
+package etcd
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/hysios/mx"
+	"github.com/hysios/mx/discovery"
+	"github.com/stretchr/testify/assert"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func TestKeys(t *testing.T) {
+	assert.Equal(t, "mx/registry/services/mx/user/user_1", serviceKey("mx", "user", "user_1"))
+	assert.Equal(t, "mx/registry/protofile/mx/proto/user.proto", protofileKey("mx", "proto/user.proto"))
+
+	service, id, ok := parseServiceKey("mx", "mx/registry/services/mx/pkg.User/user_1")
+	assert.True(t, ok)
+	assert.Equal(t, "pkg.User", service)
+	assert.Equal(t, "user_1", id)
+
+	_, _, ok = parseServiceKey("mx", "mx/registry/services/other/user/user_1")
+	assert.False(t, ok)
+	_, _, ok = parseServiceKey("mx", "mx/registry/services/mx/user")
+	assert.False(t, ok)
+}
+
+func TestRecord(t *testing.T) {
+	desc := discovery.ServiceDesc{
+		ID:                "user_1",
+		Service:           "user",
+		Type:              mx.ServerType,
+		Address:           "127.0.0.1:9000",
+		Group:             "user_100",
+		FileDescriptorKey: "user.proto",
+		Weight:            2,
+		Tags:              []string{"canary"},
+	}
+
+	b, err := json.Marshal(newRecord(desc))
+	assert.NoError(t, err)
+
+	r, err := decodeRecord(b)
+	assert.NoError(t, err)
+
+	// the address is the target when none is given
+	desc.TargetURI = desc.Address
+	assert.Equal(t, desc, r.desc())
+}
+
+func testEvent(typ mvccpb.Event_EventType, desc discovery.ServiceDesc) *clientv3.Event {
+	b, _ := json.Marshal(newRecord(desc))
+	return &clientv3.Event{
+		Type: typ,
+		Kv: &mvccpb.KeyValue{
+			Key:   []byte(serviceKey("mx", desc.Service, desc.ID)),
+			Value: b,
+		},
+	}
+}
+
+func TestHandle(t *testing.T) {
+	var (
+		c = &etcdDiscovery{
+			Namespace: "mx",
+			ctx:       context.Background(),
+			shadow:    make(map[string]discovery.ServiceDesc),
+			msgch:     make(chan discovery.RegistryMessage, 10),
+		}
+		user   = discovery.ServiceDesc{ID: "user_1", Service: "user", Type: mx.ServerType, Address: "127.0.0.1:9000"}
+		config = discovery.ServiceDesc{ID: "config_1", Service: "mx.config", Type: mx.ConfigType, Address: "127.0.0.1:9400"}
+	)
+
+	c.handle(testEvent(mvccpb.PUT, user))
+	c.handle(testEvent(mvccpb.PUT, config))
+	// registering the same service again does not join twice
+	c.handle(testEvent(mvccpb.PUT, user))
+
+	msg := <-c.msgch
+	assert.Equal(t, discovery.ServiceJoin, msg.Method)
+	assert.Equal(t, "user_1", msg.Desc.ID)
+	assert.Equal(t, "127.0.0.1:9000", msg.Desc.TargetURI)
+	assert.Len(t, c.msgch, 0)
+
+	// a changed service is updated
+	drained := user
+	drained.Weight, drained.Draining = 5, true
+	c.handle(testEvent(mvccpb.PUT, drained))
+	msg = <-c.msgch
+	assert.Equal(t, discovery.ServiceUpdate, msg.Method)
+	assert.Equal(t, 5, msg.Desc.Weight)
+	assert.True(t, msg.Desc.Draining)
+
+	c.handle(testEvent(mvccpb.DELETE, user))
+	msg = <-c.msgch
+	assert.Equal(t, discovery.ServiceLeave, msg.Method)
+	assert.Equal(t, "user_1", msg.Desc.ID)
+	assert.Equal(t, "user", msg.Desc.Service)
+
+	// a list after a lost watch leaves the services gone meanwhile
+	c.handle(testEvent(mvccpb.PUT, user))
+	<-c.msgch
+	c.sync(nil)
+	msg = <-c.msgch
+	assert.Equal(t, discovery.ServiceLeave, msg.Method)
+	assert.Empty(t, c.shadow)
+}
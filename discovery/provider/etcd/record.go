@@ -0,0 +1,114 @@
+package etcd
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hysios/mx/discovery"
+)
+
+const (
+	servicePrefix   = "mx/registry/services"
+	protofilePrefix = "mx/registry/protofile"
+)
+
+// record is the ServiceDesc stored under the service key, the file
+// descriptor is stored apart under the protofile key.
+type record struct {
+	ID                string   `json:"id"`
+	Service           string   `json:"service"`
+	Version           string   `json:"version,omitempty"`
+	Type              string   `json:"type"`
+	Address           string   `json:"address"`
+	TargetURI         string   `json:"target_uri,omitempty"`
+	Namespace         string   `json:"namespace"`
+	Group             string   `json:"group,omitempty"`
+	FileDescriptorKey string   `json:"file_descriptor_key,omitempty"`
+	Weight            int      `json:"weight,omitempty"`
+	Tags              []string `json:"tags,omitempty"`
+	Draining          bool     `json:"draining,omitempty"`
+}
+
+// nsPrefix returns the prefix of the services in the namespace,
+// mx/registry/services/{ns}/
+func nsPrefix(ns string) string {
+	return fmt.Sprintf("%s/%s/", servicePrefix, ns)
+}
+
+// servicePrefixOf returns the prefix of the service instances,
+// mx/registry/services/{ns}/{service}/
+func servicePrefixOf(ns, service string) string {
+	return nsPrefix(ns) + service + "/"
+}
+
+// serviceKey returns the key of the service instance,
+// mx/registry/services/{ns}/{service}/{id}
+func serviceKey(ns, service, id string) string {
+	return servicePrefixOf(ns, service) + id
+}
+
+// protofileKey returns the key of the packed file descriptor, the same
+// layout as the consul provider, mx/registry/protofile/{ns}/{key}
+func protofileKey(ns, key string) string {
+	return fmt.Sprintf("%s/%s/%s", protofilePrefix, ns, key)
+}
+
+// parseServiceKey returns the service and id of the service key
+func parseServiceKey(ns, key string) (service, id string, ok bool) {
+	rest := strings.TrimPrefix(key, nsPrefix(ns))
+	if rest == key {
+		return "", "", false
+	}
+
+	i := strings.LastIndex(rest, "/")
+	if i <= 0 || i == len(rest)-1 {
+		return "", "", false
+	}
+
+	return rest[:i], rest[i+1:], true
+}
+
+func newRecord(desc discovery.ServiceDesc) record {
+	return record{
+		ID:                desc.ID,
+		Service:           desc.Service,
+		Version:           desc.Version,
+		Type:              desc.Type,
+		Address:           desc.Address,
+		TargetURI:         desc.TargetURI,
+		Namespace:         desc.Namespace,
+		Group:             desc.Group,
+		FileDescriptorKey: desc.FileDescriptorKey,
+		Weight:            desc.Weight,
+		Tags:              desc.Tags,
+		Draining:          desc.Draining,
+	}
+}
+
+func (r record) desc() discovery.ServiceDesc {
+	target := r.TargetURI
+	if target == "" {
+		target = r.Address
+	}
+
+	return discovery.ServiceDesc{
+		ID:                r.ID,
+		Service:           r.Service,
+		Version:           r.Version,
+		Type:              r.Type,
+		Address:           r.Address,
+		TargetURI:         target,
+		Namespace:         r.Namespace,
+		Group:             r.Group,
+		FileDescriptorKey: r.FileDescriptorKey,
+		Weight:            r.Weight,
+		Tags:              r.Tags,
+		Draining:          r.Draining,
+	}
+}
+
+func decodeRecord(b []byte) (r record, err error) {
+	err = json.Unmarshal(b, &r)
+	return
+}
@@ -0,0 +1,56 @@
+package etcd
+
+import (
+	"context"
+
+	"github.com/hysios/mx/discovery/schema"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// SchemaStore returns the schema store on etcd
+func SchemaStore(cli *clientv3.Client) schema.Store {
+	return &kvStore{cli: cli}
+}
+
+type kvStore struct {
+	cli *clientv3.Client
+}
+
+func (s *kvStore) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	resp, err := s.cli.Get(ctx, key)
+	if err != nil || len(resp.Kvs) == 0 {
+		return nil, false, err
+	}
+	return resp.Kvs[0].Value, true, nil
+}
+
+func (s *kvStore) Put(ctx context.Context, key string, value []byte) error {
+	_, err := s.cli.Put(ctx, key, string(value))
+	return err
+}
+
+// Create puts the value in a transaction which requires the key to have no
+// create revision, i.e. to not exist
+func (s *kvStore) Create(ctx context.Context, key string, value []byte) (bool, error) {
+	resp, err := s.cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, string(value))).
+		Commit()
+	if err != nil {
+		return false, err
+	}
+	return resp.Succeeded, nil
+}
+
+func (s *kvStore) List(ctx context.Context, prefix string) (map[string][]byte, error) {
+	resp, err := s.cli.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	kvs := make(map[string][]byte, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		kvs[string(kv.Key)] = kv.Value
+	}
+	return kvs, nil
+}
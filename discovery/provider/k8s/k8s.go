@@ -0,0 +1,594 @@
+// Package k8s implements service discovery from Kubernetes EndpointSlices.
+//
+// Services labelled mx/discovery=true are discovered, the EndpointSlice
+// controller copies the label onto their slices. The Service annotations
+// describe the gRPC service:
+//
+//	mx/service                 gRPC service name, e.g. hello.Greeter (required)
+//	mx/service-type            default grpc_server
+//	mx/namespace               mx namespace, default discovery.Namespace
+//	mx/port                    port name of the slice, default the first port
+//	mx/descriptor-key          file descriptor key, e.g. hello.proto
+//	mx/descriptor-configmap    ConfigMap with the packed file descriptor under
+//	                           binaryData[ConfigMapKey(descriptor-key)]
+//	mx/reflection              "true" fetches the descriptor by gRPC reflection
+//	mx/weight                  relative share of the requests
+//
+// Every ready endpoint address joins, addresses which are removed or no longer
+// ready leave. Terminating endpoints which still serve are draining, changes
+// of the draining state, weight or descriptor are sent as updates.
+//
+// The EndpointSlices, Services and ConfigMaps of the namespace are watched,
+// so changes of the annotations or of the descriptor ConfigMap are sent too.
+// The ConfigMap descriptor is loaded again when its resourceVersion changes,
+// the reflected one when the endpoint addresses change.
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hysios/mx"
+	"github.com/hysios/mx/discovery"
+	"github.com/hysios/mx/logger"
+	"github.com/hysios/mx/tlsconfig"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	discoverylisters "k8s.io/client-go/listers/discovery/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	LabelDiscovery = "mx/discovery"
+
+	AnnotationService             = "mx/service"
+	AnnotationServiceType         = "mx/service-type"
+	AnnotationNamespace           = "mx/namespace"
+	AnnotationPort                = "mx/port"
+	AnnotationDescriptorKey       = "mx/descriptor-key"
+	AnnotationDescriptorConfigMap = "mx/descriptor-configmap"
+	AnnotationReflection          = "mx/reflection"
+	AnnotationWeight              = "mx/weight"
+)
+
+// ConfigMapKey returns the ConfigMap key of the descriptor key, ConfigMap
+// keys can not contain slashes.
+func ConfigMapKey(descriptorKey string) string {
+	return strings.ReplaceAll(descriptorKey, "/", "_")
+}
+
+type KubeOption struct {
+	Client kubernetes.Interface
+	// Namespace is the Kubernetes namespace to watch, default is all
+	Namespace string
+	// Selector is the label selector of the services, default is
+	// mx/discovery=true
+	Selector string
+	Resync   time.Duration
+	// Dial dials an endpoint to fetch its descriptor by reflection
+	Dial func(ctx context.Context, target string) (grpc.ClientConnInterface, func(), error)
+}
+
+type KubeOptionFunc func(*KubeOption)
+
+func WithClient(cli kubernetes.Interface) KubeOptionFunc {
+	return func(o *KubeOption) {
+		o.Client = cli
+	}
+}
+
+func WithNamespace(ns string) KubeOptionFunc {
+	return func(o *KubeOption) {
+		o.Namespace = ns
+	}
+}
+
+func WithSelector(selector string) KubeOptionFunc {
+	return func(o *KubeOption) {
+		o.Selector = selector
+	}
+}
+
+// NewClient returns a client from KUBECONFIG, or the in-cluster config.
+func NewClient() (kubernetes.Interface, error) {
+	cfg, err := clientcmd.BuildConfigFromFlags("", os.Getenv("KUBECONFIG"))
+	if err != nil {
+		return nil, err
+	}
+
+	return kubernetes.NewForConfig(cfg)
+}
+
+// NewKubeProvider returns a service discover watching the EndpointSlices.
+func NewKubeProvider(optfns ...KubeOptionFunc) discovery.ServiceDiscover {
+	c := newKubeDiscovery(optfns...)
+	go c.Run()
+	return c
+}
+
+func newKubeDiscovery(optfns ...KubeOptionFunc) *kubeDiscovery {
+	var opt = KubeOption{
+		Namespace: metav1.NamespaceAll,
+		Selector:  LabelDiscovery + "=true",
+		Resync:    10 * time.Minute,
+		Dial:      dial,
+	}
+
+	for _, fn := range optfns {
+		fn(&opt)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &kubeDiscovery{
+		opts:        opt,
+		ctx:         ctx,
+		closefn:     cancel,
+		msgch:       make(chan discovery.RegistryMessage, 10),
+		queue:       workqueue.New(),
+		services:    make(map[string]map[string]discovery.ServiceDesc),
+		descriptors: make(map[string]cachedDescriptor),
+	}
+}
+
+// kubeDiscovery queues the key of the Service of every changed
+// EndpointSlice, Service or descriptor ConfigMap. A single worker syncs the
+// queued Services from the informer caches, so the events keep their order
+// without a lock.
+type kubeDiscovery struct {
+	opts    KubeOption
+	ctx     context.Context
+	closefn context.CancelFunc
+	msgch   chan discovery.RegistryMessage
+	queue   workqueue.Interface
+
+	serviceLister   corelisters.ServiceLister
+	sliceLister     discoverylisters.EndpointSliceLister
+	configMapLister corelisters.ConfigMapLister
+
+	// services are the joined instances of each Service, only used by the
+	// worker
+	services map[string]map[string]discovery.ServiceDesc
+	// descriptors caches the descriptor of each Service, only used by the
+	// worker
+	descriptors map[string]cachedDescriptor
+}
+
+// cachedDescriptor is the descriptor of a Service, loaded again when the
+// version of its source changes
+type cachedDescriptor struct {
+	version string
+	fd      protoreflect.FileDescriptor
+}
+
+// Run watches the EndpointSlices, Services and ConfigMaps until Close.
+func (c *kubeDiscovery) Run() error {
+	if c.opts.Client == nil {
+		cli, err := NewClient()
+		if err != nil {
+			logger.Logger.Error("kubernetes client", zap.Error(err))
+			return err
+		}
+		c.opts.Client = cli
+	}
+
+	var (
+		factory = informers.NewSharedInformerFactoryWithOptions(c.opts.Client, c.opts.Resync,
+			informers.WithNamespace(c.opts.Namespace),
+			informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+				opts.LabelSelector = c.opts.Selector
+			}),
+		)
+		// the descriptor ConfigMaps are not labelled
+		configMapFactory = informers.NewSharedInformerFactoryWithOptions(c.opts.Client, c.opts.Resync,
+			informers.WithNamespace(c.opts.Namespace),
+		)
+		slices     = factory.Discovery().V1().EndpointSlices()
+		services   = factory.Core().V1().Services()
+		configMaps = configMapFactory.Core().V1().ConfigMaps()
+	)
+
+	c.sliceLister = slices.Lister()
+	c.serviceLister = services.Lister()
+	c.configMapLister = configMaps.Lister()
+
+	slices.Informer().AddEventHandler(handler(func(obj interface{}) {
+		if slice, ok := obj.(*discoveryv1.EndpointSlice); ok && slice.Labels[discoveryv1.LabelServiceName] != "" {
+			c.queue.Add(slice.Namespace + "/" + slice.Labels[discoveryv1.LabelServiceName])
+		}
+	}))
+	services.Informer().AddEventHandler(handler(func(obj interface{}) {
+		if svc, ok := obj.(*corev1.Service); ok {
+			c.queue.Add(svc.Namespace + "/" + svc.Name)
+		}
+	}))
+	configMaps.Informer().AddEventHandler(handler(func(obj interface{}) {
+		if cm, ok := obj.(*corev1.ConfigMap); ok {
+			c.configMapChanged(cm)
+		}
+	}))
+
+	factory.Start(c.ctx.Done())
+	configMapFactory.Start(c.ctx.Done())
+	go func() {
+		factory.WaitForCacheSync(c.ctx.Done())
+		configMapFactory.WaitForCacheSync(c.ctx.Done())
+		c.work()
+	}()
+
+	<-c.ctx.Done()
+	c.queue.ShutDown()
+	factory.Shutdown()
+	configMapFactory.Shutdown()
+	return c.ctx.Err()
+}
+
+// handler calls fn with the object of every event, the final state of the
+// deleted ones
+func handler(fn func(obj interface{})) cache.ResourceEventHandlerFuncs {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: fn,
+		UpdateFunc: func(_, obj interface{}) {
+			fn(obj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			fn(obj)
+		},
+	}
+}
+
+// configMapChanged queues the Services with their descriptor in the
+// ConfigMap
+func (c *kubeDiscovery) configMapChanged(cm *corev1.ConfigMap) {
+	services, err := c.serviceLister.Services(cm.Namespace).List(labels.Everything())
+	if err != nil {
+		return
+	}
+
+	for _, svc := range services {
+		if svc.Annotations[AnnotationDescriptorConfigMap] == cm.Name {
+			c.queue.Add(svc.Namespace + "/" + svc.Name)
+		}
+	}
+}
+
+// work syncs the queued Services until the queue shuts down
+func (c *kubeDiscovery) work() {
+	for {
+		key, shutdown := c.queue.Get()
+		if shutdown {
+			return
+		}
+
+		c.sync(key.(string))
+		c.queue.Done(key)
+	}
+}
+
+// sync emits the difference between the ready endpoints of the Service and
+// the ones joined before
+func (c *kubeDiscovery) sync(key string) {
+	var (
+		msgs   []discovery.RegistryMessage
+		joined = c.services[key]
+		descs  = c.descs(key)
+	)
+
+	for id, desc := range joined {
+		if _, ok := descs[id]; !ok {
+			msgs = append(msgs, leave(desc))
+		}
+	}
+
+	for id, desc := range descs {
+		old, ok := joined[id]
+		switch {
+		case !ok:
+			msgs = append(msgs, discovery.RegistryMessage{
+				Method: discovery.ServiceJoin,
+				Desc:   desc,
+			})
+		case desc.Changed(old) || desc.FileDescriptor != old.FileDescriptor:
+			msgs = append(msgs, discovery.RegistryMessage{
+				Method: discovery.ServiceUpdate,
+				Desc:   desc,
+			})
+		}
+	}
+
+	if len(descs) == 0 {
+		delete(c.services, key)
+		delete(c.descriptors, key)
+	} else {
+		c.services[key] = descs
+	}
+
+	c.send(msgs...)
+}
+
+func leave(desc discovery.ServiceDesc) discovery.RegistryMessage {
+	return discovery.RegistryMessage{
+		Method: discovery.ServiceLeave,
+		Desc: discovery.ServiceDesc{
+			ID:        desc.ID,
+			Service:   desc.Service,
+			Address:   desc.Address,
+			Namespace: desc.Namespace,
+		},
+	}
+}
+
+func (c *kubeDiscovery) send(msgs ...discovery.RegistryMessage) {
+	for _, msg := range msgs {
+		select {
+		case c.msgch <- msg:
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// descs returns the services of the ready endpoints of the slices of the
+// Service of the key
+func (c *kubeDiscovery) descs(key string) map[string]discovery.ServiceDesc {
+	var descs = make(map[string]discovery.ServiceDesc)
+
+	ns, svcName, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return descs
+	}
+
+	svc, err := c.serviceLister.Services(ns).Get(svcName)
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			logger.Logger.Warn("get kubernetes service", zap.String("namespace", ns), zap.String("service", svcName), zap.Error(err))
+		}
+		return descs
+	}
+
+	slices, err := c.sliceLister.EndpointSlices(ns).List(labels.SelectorFromSet(labels.Set{discoveryv1.LabelServiceName: svcName}))
+	if err != nil {
+		return descs
+	}
+
+	var (
+		annotations = svc.Annotations
+		service     = annotations[AnnotationService]
+		serviceType = annotations[AnnotationServiceType]
+		namespace   = annotations[AnnotationNamespace]
+	)
+
+	if service == "" {
+		logger.Logger.Warn("kubernetes service without mx/service annotation", zap.String("namespace", ns), zap.String("service", svcName))
+		return descs
+	}
+
+	if serviceType == "" {
+		serviceType = mx.ServerType
+	}
+
+	if namespace == "" {
+		namespace = discovery.Namespace
+	}
+
+	var weight int
+	if w := annotations[AnnotationWeight]; w != "" {
+		if weight, err = strconv.Atoi(w); err != nil {
+			logger.Logger.Warn("kubernetes service weight", zap.String("service", service), zap.String("weight", w), zap.Error(err))
+		}
+	}
+
+	for _, slice := range slices {
+		port, ok := slicePort(slice, annotations[AnnotationPort])
+		if !ok {
+			continue
+		}
+
+		for _, ep := range slice.Endpoints {
+			// terminating endpoints are not ready, but serve while they drain
+			draining := isTrue(ep.Conditions.Terminating) && isTrue(ep.Conditions.Serving)
+			if ep.Conditions.Ready != nil && !*ep.Conditions.Ready && !draining {
+				continue
+			}
+
+			for _, ip := range ep.Addresses {
+				addr := net.JoinHostPort(ip, strconv.Itoa(port))
+				descs[service+"_"+addr] = discovery.ServiceDesc{
+					ID:        service + "_" + addr,
+					Service:   service,
+					Type:      serviceType,
+					Address:   addr,
+					TargetURI: addr,
+					Namespace: namespace,
+					Group:     key,
+					Weight:    weight,
+					Draining:  draining,
+				}
+			}
+		}
+	}
+
+	if len(descs) == 0 {
+		return descs
+	}
+
+	fd, err := c.descriptor(key, annotations, descs)
+	if err != nil {
+		logger.Logger.Warn("kubernetes service descriptor", zap.String("service", service), zap.Error(err))
+	}
+
+	if fd != nil {
+		for id, desc := range descs {
+			desc.FileDescriptor = fd
+			desc.FileDescriptorKey = fd.Path()
+			descs[id] = desc
+		}
+	}
+
+	return descs
+}
+
+func isTrue(b *bool) bool {
+	return b != nil && *b
+}
+
+// slicePort returns the named port of the slice, or the first one
+func slicePort(slice *discoveryv1.EndpointSlice, name string) (int, bool) {
+	for _, p := range slice.Ports {
+		if p.Port == nil {
+			continue
+		}
+
+		if name == "" || (p.Name != nil && *p.Name == name) {
+			return int(*p.Port), true
+		}
+	}
+
+	return 0, false
+}
+
+// descriptor returns the file descriptor of the Service from the ConfigMap
+// or by reflection. It is cached until the annotations or the version of
+// the ConfigMap change, the reflected one until the endpoints change.
+func (c *kubeDiscovery) descriptor(key string, annotations map[string]string, descs map[string]discovery.ServiceDesc) (protoreflect.FileDescriptor, error) {
+	var (
+		ns, _, _      = cache.SplitMetaNamespaceKey(key)
+		descriptorKey = annotations[AnnotationDescriptorKey]
+		configMap     = annotations[AnnotationDescriptorConfigMap]
+		reflection    = annotations[AnnotationReflection] == "true"
+		version       string
+		load          func() (protoreflect.FileDescriptor, error)
+	)
+
+	switch {
+	case configMap != "" && descriptorKey != "":
+		cm, err := c.configMapLister.ConfigMaps(ns).Get(configMap)
+		if err != nil {
+			return nil, err
+		}
+
+		version = fmt.Sprintf("configmap/%s/%s@%s", configMap, descriptorKey, cm.ResourceVersion)
+		load = func() (protoreflect.FileDescriptor, error) {
+			return configMapDescriptor(cm, descriptorKey)
+		}
+	case reflection:
+		addrs := make([]string, 0, len(descs))
+		for _, desc := range descs {
+			addrs = append(addrs, desc.Address)
+		}
+		sort.Strings(addrs)
+
+		version = "reflection/" + strings.Join(addrs, ",")
+		load = func() (fd protoreflect.FileDescriptor, err error) {
+			for _, addr := range addrs {
+				if fd, err = c.reflectDescriptor(descs[annotations[AnnotationService]+"_"+addr]); err == nil {
+					return fd, nil
+				}
+			}
+			return nil, err
+		}
+	default:
+		delete(c.descriptors, key)
+		return nil, nil
+	}
+
+	if cached, ok := c.descriptors[key]; ok && cached.version == version {
+		return cached.fd, nil
+	}
+
+	fd, err := load()
+	if err != nil {
+		return nil, err
+	}
+
+	c.descriptors[key] = cachedDescriptor{version: version, fd: fd}
+	return fd, nil
+}
+
+func configMapDescriptor(cm *corev1.ConfigMap, descriptorKey string) (protoreflect.FileDescriptor, error) {
+	b, ok := cm.BinaryData[ConfigMapKey(descriptorKey)]
+	if !ok {
+		return nil, fmt.Errorf("configmap %s/%s has no descriptor %s", cm.Namespace, cm.Name, descriptorKey)
+	}
+
+	// built apart from the global registry, which may hold another version
+	var pack discovery.FileDescriptorPacker
+	return pack.Unpack(b)
+}
+
+func (c *kubeDiscovery) reflectDescriptor(desc discovery.ServiceDesc) (protoreflect.FileDescriptor, error) {
+	ctx, cancel := context.WithTimeout(c.ctx, 10*time.Second)
+	defer cancel()
+
+	conn, closefn, err := c.opts.Dial(ctx, desc.TargetURI)
+	if err != nil {
+		return nil, err
+	}
+	defer closefn()
+
+	return discovery.ReflectFileDescriptor(ctx, conn, desc.Service)
+}
+
+func dial(ctx context.Context, target string) (grpc.ClientConnInterface, func(), error) {
+	opt, err := tlsconfig.DialOption()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conn, err := grpc.DialContext(ctx, target, opt)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return conn, func() { conn.Close() }, nil
+}
+
+func (c *kubeDiscovery) Close() error {
+	c.closefn()
+	return nil
+}
+
+func (c *kubeDiscovery) Notify() chan discovery.RegistryMessage {
+	return c.msgch
+}
+
+// Register registers the kubernetes discovery provider.
+func Register(optfns ...KubeOptionFunc) {
+	discovery.RegistryProvider("kubernetes", func() discovery.Provider {
+		return &provider{optfns: optfns}
+	})
+}
+
+func init() {
+	// register kubernetes discovery when running in a cluster
+	if os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		Register()
+	}
+}
+
+type provider struct {
+	optfns []KubeOptionFunc
+}
+
+func (p *provider) Discover() discovery.ServiceDiscover {
+	return NewKubeProvider(p.optfns...)
+}
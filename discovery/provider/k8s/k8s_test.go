@@ -0,0 +1,377 @@
+package k8s
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hysios/mx/discovery"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func recv(t *testing.T, c discovery.ServiceDiscover) discovery.RegistryMessage {
+	select {
+	case msg := <-c.Notify():
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no registry message")
+		return discovery.RegistryMessage{}
+	}
+}
+
+func service(name string, annotations map[string]string) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   "default",
+			Labels:      map[string]string{LabelDiscovery: "true"},
+			Annotations: annotations,
+		},
+	}
+}
+
+func endpointSlice(name, svc string, port int32, ready bool, ips ...string) *discoveryv1.EndpointSlice {
+	var (
+		portName = "grpc"
+		endpoint = discoveryv1.Endpoint{
+			Addresses:  ips,
+			Conditions: discoveryv1.EndpointConditions{Ready: &ready},
+		}
+	)
+
+	return &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			Labels: map[string]string{
+				LabelDiscovery:               "true",
+				discoveryv1.LabelServiceName: svc,
+			},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Endpoints:   []discoveryv1.Endpoint{endpoint},
+		Ports:       []discoveryv1.EndpointPort{{Name: &portName, Port: &port}},
+	}
+}
+
+// helloFile returns a descriptor which is not linked in
+func helloFile(t *testing.T) protoreflect.FileDescriptor {
+	fd, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:    proto.String("k8stest/hello.proto"),
+		Package: proto.String("k8stest"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			{Name: proto.String("HelloRequest")},
+		},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("Greeter"),
+			Method: []*descriptorpb.MethodDescriptorProto{{
+				Name:       proto.String("SayHello"),
+				InputType:  proto.String(".k8stest.HelloRequest"),
+				OutputType: proto.String(".k8stest.HelloRequest"),
+			}},
+		}},
+	}, nil)
+	assert.NoError(t, err)
+	return fd
+}
+
+func TestKubeProviderConfigMap(t *testing.T) {
+	var pack discovery.FileDescriptorPacker
+	b, err := pack.Pack(helloFile(t))
+	assert.NoError(t, err)
+
+	var (
+		ctx = context.Background()
+		cli = fake.NewSimpleClientset(
+			service("hello", map[string]string{
+				AnnotationService:             "k8stest.Greeter",
+				AnnotationNamespace:           "mx",
+				AnnotationDescriptorKey:       "k8stest/hello.proto",
+				AnnotationDescriptorConfigMap: "descriptors",
+			}),
+			&corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: "descriptors", Namespace: "default"},
+				BinaryData: map[string][]byte{
+					ConfigMapKey("k8stest/hello.proto"): b,
+				},
+			},
+		)
+	)
+
+	c := NewKubeProvider(WithClient(cli))
+	defer c.(*kubeDiscovery).Close()
+
+	slices := cli.DiscoveryV1().EndpointSlices("default")
+	_, err = slices.Create(ctx, endpointSlice("hello-1", "hello", 9000, true, "10.0.0.1"), metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	msg := recv(t, c)
+	assert.Equal(t, discovery.ServiceJoin, msg.Method)
+	assert.Equal(t, "k8stest.Greeter", msg.Desc.Service)
+	assert.Equal(t, "grpc_server", msg.Desc.Type)
+	assert.Equal(t, "mx", msg.Desc.Namespace)
+	assert.Equal(t, "10.0.0.1:9000", msg.Desc.Address)
+	if assert.NotNil(t, msg.Desc.FileDescriptor) {
+		assert.Equal(t, "k8stest/hello.proto", msg.Desc.FileDescriptor.Path())
+	}
+
+	// a new endpoint joins, an unready one leaves
+	slice := endpointSlice("hello-1", "hello", 9000, true, "10.0.0.1", "10.0.0.2")
+	_, err = slices.Update(ctx, slice, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+
+	msg = recv(t, c)
+	assert.Equal(t, discovery.ServiceJoin, msg.Method)
+	assert.Equal(t, "10.0.0.2:9000", msg.Desc.Address)
+
+	slice = endpointSlice("hello-1", "hello", 9000, false, "10.0.0.1", "10.0.0.2")
+	_, err = slices.Update(ctx, slice, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+
+	left := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		msg = recv(t, c)
+		assert.Equal(t, discovery.ServiceLeave, msg.Method)
+		left[msg.Desc.Address] = true
+	}
+	assert.Equal(t, map[string]bool{"10.0.0.1:9000": true, "10.0.0.2:9000": true}, left)
+
+	slice = endpointSlice("hello-1", "hello", 9000, true, "10.0.0.3")
+	_, err = slices.Update(ctx, slice, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	msg = recv(t, c)
+	assert.Equal(t, discovery.ServiceJoin, msg.Method)
+
+	// deleting the slice leaves its endpoints
+	assert.NoError(t, slices.Delete(ctx, "hello-1", metav1.DeleteOptions{}))
+	msg = recv(t, c)
+	assert.Equal(t, discovery.ServiceLeave, msg.Method)
+	assert.Equal(t, "10.0.0.3:9000", msg.Desc.Address)
+}
+
+func TestKubeProviderUpdate(t *testing.T) {
+	var (
+		ctx = context.Background()
+		cli = fake.NewSimpleClientset(service("hello", map[string]string{
+			AnnotationService: "k8stest.Greeter",
+			AnnotationWeight:  "10",
+		}))
+	)
+
+	c := NewKubeProvider(WithClient(cli))
+	defer c.(*kubeDiscovery).Close()
+
+	slices := cli.DiscoveryV1().EndpointSlices("default")
+	_, err := slices.Create(ctx, endpointSlice("hello-1", "hello", 9000, true, "10.0.0.1"), metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	msg := recv(t, c)
+	assert.Equal(t, discovery.ServiceJoin, msg.Method)
+	assert.Equal(t, 10, msg.Desc.Weight)
+	assert.False(t, msg.Desc.Draining)
+
+	// a terminating endpoint which still serves is draining
+	var (
+		slice       = endpointSlice("hello-1", "hello", 9000, false, "10.0.0.1")
+		serving     = true
+		terminating = true
+	)
+	slice.Endpoints[0].Conditions.Serving = &serving
+	slice.Endpoints[0].Conditions.Terminating = &terminating
+	_, err = slices.Update(ctx, slice, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+
+	msg = recv(t, c)
+	assert.Equal(t, discovery.ServiceUpdate, msg.Method)
+	assert.Equal(t, "10.0.0.1:9000", msg.Desc.Address)
+	assert.True(t, msg.Desc.Draining)
+
+	// it leaves once it stops serving
+	serving = false
+	_, err = slices.Update(ctx, slice, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+
+	msg = recv(t, c)
+	assert.Equal(t, discovery.ServiceLeave, msg.Method)
+}
+
+func TestKubeProviderReflection(t *testing.T) {
+	var (
+		ctx = context.Background()
+		lis = bufconn.Listen(1 << 20)
+		srv = grpc.NewServer()
+	)
+	healthpb.RegisterHealthServer(srv, health.NewServer())
+	reflection.Register(srv)
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	var dialed []string
+	dialer := func(ctx context.Context, target string) (grpc.ClientConnInterface, func(), error) {
+		dialed = append(dialed, target)
+		conn, err := grpc.DialContext(ctx, "bufnet",
+			grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+				return lis.DialContext(ctx)
+			}),
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+		return conn, func() { conn.Close() }, nil
+	}
+
+	cli := fake.NewSimpleClientset(service("health", map[string]string{
+		AnnotationService:    "grpc.health.v1.Health",
+		AnnotationReflection: "true",
+	}))
+
+	c := NewKubeProvider(WithClient(cli), func(o *KubeOption) { o.Dial = dialer })
+	defer c.(*kubeDiscovery).Close()
+
+	_, err := cli.DiscoveryV1().EndpointSlices("default").Create(ctx, endpointSlice("health-1", "health", 9000, true, "10.0.0.1"), metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	msg := recv(t, c)
+	assert.Equal(t, discovery.ServiceJoin, msg.Method)
+	assert.Equal(t, discovery.Namespace, msg.Desc.Namespace)
+	assert.Equal(t, []string{net.JoinHostPort("10.0.0.1", strconv.Itoa(9000))}, dialed)
+	if assert.NotNil(t, msg.Desc.FileDescriptor) {
+		assert.NotNil(t, msg.Desc.FileDescriptor.Services().ByName("Health"))
+	}
+}
+
+func TestKubeProviderSkipsUnannotated(t *testing.T) {
+	var (
+		ctx = context.Background()
+		cli = fake.NewSimpleClientset(service("plain", nil))
+	)
+
+	c := NewKubeProvider(WithClient(cli))
+	defer c.(*kubeDiscovery).Close()
+
+	slices := cli.DiscoveryV1().EndpointSlices("default")
+	_, err := slices.Create(ctx, endpointSlice("plain-1", "plain", 9000, true, "10.0.0.1"), metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	_, err = cli.CoreV1().Services("default").Create(ctx, service("other", map[string]string{AnnotationService: "hello.Greeter"}), metav1.CreateOptions{})
+	assert.NoError(t, err)
+	_, err = slices.Create(ctx, endpointSlice("other-1", "other", 9000, true, "10.0.0.2"), metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	// the unannotated service never joins
+	msg := recv(t, c)
+	assert.Equal(t, discovery.ServiceJoin, msg.Method)
+	assert.Equal(t, "hello.Greeter", msg.Desc.Service)
+	assert.Equal(t, "10.0.0.2:9000", msg.Desc.Address)
+}
+
+func TestKubeProviderServiceChange(t *testing.T) {
+	var (
+		ctx = context.Background()
+		svc = service("hello", map[string]string{
+			AnnotationService: "k8stest.Greeter",
+			AnnotationWeight:  "10",
+		})
+		cli = fake.NewSimpleClientset(svc)
+	)
+
+	c := NewKubeProvider(WithClient(cli))
+	defer c.(*kubeDiscovery).Close()
+
+	_, err := cli.DiscoveryV1().EndpointSlices("default").Create(ctx, endpointSlice("hello-1", "hello", 9000, true, "10.0.0.1"), metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	msg := recv(t, c)
+	assert.Equal(t, discovery.ServiceJoin, msg.Method)
+	assert.Equal(t, 10, msg.Desc.Weight)
+
+	// only the annotation changes
+	svc = svc.DeepCopy()
+	svc.Annotations[AnnotationWeight] = "20"
+	_, err = cli.CoreV1().Services("default").Update(ctx, svc, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+
+	msg = recv(t, c)
+	assert.Equal(t, discovery.ServiceUpdate, msg.Method)
+	assert.Equal(t, 20, msg.Desc.Weight)
+
+	// deleting the service leaves its endpoints
+	assert.NoError(t, cli.CoreV1().Services("default").Delete(ctx, "hello", metav1.DeleteOptions{}))
+	msg = recv(t, c)
+	assert.Equal(t, discovery.ServiceLeave, msg.Method)
+	assert.Equal(t, "10.0.0.1:9000", msg.Desc.Address)
+}
+
+func TestKubeProviderConfigMapChange(t *testing.T) {
+	var pack discovery.FileDescriptorPacker
+	b, err := pack.Pack(helloFile(t))
+	assert.NoError(t, err)
+
+	var (
+		ctx = context.Background()
+		cm  = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "descriptors", Namespace: "default", ResourceVersion: "1"},
+			BinaryData: map[string][]byte{
+				ConfigMapKey("k8stest/hello.proto"): b,
+			},
+		}
+		cli = fake.NewSimpleClientset(
+			service("hello", map[string]string{
+				AnnotationService:             "k8stest.Greeter",
+				AnnotationDescriptorKey:       "k8stest/hello.proto",
+				AnnotationDescriptorConfigMap: "descriptors",
+			}),
+			cm,
+		)
+	)
+
+	c := NewKubeProvider(WithClient(cli))
+	defer c.(*kubeDiscovery).Close()
+
+	_, err = cli.DiscoveryV1().EndpointSlices("default").Create(ctx, endpointSlice("hello-1", "hello", 9000, true, "10.0.0.1"), metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	msg := recv(t, c)
+	assert.Equal(t, discovery.ServiceJoin, msg.Method)
+	if assert.NotNil(t, msg.Desc.FileDescriptor) {
+		assert.Nil(t, msg.Desc.FileDescriptor.Messages().ByName("HelloReply"))
+	}
+
+	// the same key with a new descriptor
+	fdp := protodesc.ToFileDescriptorProto(helloFile(t))
+	fdp.MessageType = append(fdp.MessageType, &descriptorpb.DescriptorProto{Name: proto.String("HelloReply")})
+	fd, err := protodesc.NewFile(fdp, nil)
+	assert.NoError(t, err)
+	b, err = pack.Pack(fd)
+	assert.NoError(t, err)
+
+	cm = cm.DeepCopy()
+	cm.ResourceVersion = "2"
+	cm.BinaryData[ConfigMapKey("k8stest/hello.proto")] = b
+	_, err = cli.CoreV1().ConfigMaps("default").Update(ctx, cm, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+
+	msg = recv(t, c)
+	assert.Equal(t, discovery.ServiceUpdate, msg.Method)
+	if assert.NotNil(t, msg.Desc.FileDescriptor) {
+		assert.NotNil(t, msg.Desc.FileDescriptor.Messages().ByName("HelloReply"))
+	}
+}
@@ -0,0 +1,78 @@
+package static
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bufbuild/protocompile"
+	"github.com/hysios/mx/discovery"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// LoadFileDescriptor returns the file descriptor defining the service from
+// a .proto file, compiled with the import paths (default is the directory
+// of the file), or from a descriptor set (.pb, .binpb, .desc) as written by
+// protoc --descriptor_set_out or buf build.
+func LoadFileDescriptor(path, service string, importPaths ...string) (protoreflect.FileDescriptor, error) {
+	if strings.EqualFold(filepath.Ext(path), ".proto") {
+		return compileProto(path, importPaths)
+	}
+
+	return loadDescriptorSet(path, service)
+}
+
+func compileProto(path string, importPaths []string) (protoreflect.FileDescriptor, error) {
+	var name = filepath.Base(path)
+	if len(importPaths) == 0 {
+		importPaths = []string{filepath.Dir(path)}
+	} else {
+		// the file name is relative to the import path containing it
+		for _, dir := range importPaths {
+			if rel, err := filepath.Rel(dir, path); err == nil && !strings.HasPrefix(rel, "..") {
+				name = filepath.ToSlash(rel)
+				break
+			}
+		}
+	}
+
+	compiler := protocompile.Compiler{
+		Resolver: protocompile.WithStandardImports(&protocompile.SourceResolver{
+			ImportPaths: importPaths,
+		}),
+	}
+
+	files, err := compiler.Compile(context.Background(), name)
+	if err != nil {
+		return nil, fmt.Errorf("compile %s: %w", path, err)
+	}
+
+	return files[0], nil
+}
+
+func loadDescriptorSet(path, service string) (protoreflect.FileDescriptor, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("decode descriptor set %s: %w", path, err)
+	}
+
+	if len(set.File) == 0 {
+		return nil, fmt.Errorf("descriptor set %s is empty", path)
+	}
+
+	fd, err := discovery.UnpackFileDescriptorSet(&set, service)
+	if err != nil {
+		return nil, fmt.Errorf("build descriptor set %s: %w", path, err)
+	}
+
+	return fd, nil
+}
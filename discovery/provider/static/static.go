@@ -0,0 +1,361 @@
+// Package static implements service discovery from a YAML or JSON file, for
+// local development and simple deployments:
+//
+//	services:
+//	  - service: helloworld.Greeter
+//	    address: 127.0.0.1:9000
+//	    proto: proto/hello.proto
+//	  - service: echo.Echo
+//	    address: 127.0.0.1:9001
+//	    descriptor_set: gen/echo.binpb
+//
+// Relative paths are resolved from the directory of the file. The file is
+// reloaded when it changes, services added or removed join or leave.
+package static
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/hysios/mx/discovery"
+	"github.com/hysios/mx/logger"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// File is the content of the services file.
+type File struct {
+	Services []Service `json:"services" yaml:"services"`
+}
+
+// Service is a service instance of the services file.
+type Service struct {
+	// ID defaults to {service}_{address}
+	ID        string `json:"id,omitempty" yaml:"id,omitempty"`
+	Service   string `json:"service" yaml:"service"`
+	Address   string `json:"address" yaml:"address"`
+	TargetURI string `json:"target_uri,omitempty" yaml:"target_uri,omitempty"`
+	Namespace string `json:"namespace,omitempty" yaml:"namespace,omitempty"`
+	Group     string `json:"group,omitempty" yaml:"group,omitempty"`
+	Version   string `json:"version,omitempty" yaml:"version,omitempty"`
+	// Weight is the relative share of the requests
+	Weight   int      `json:"weight,omitempty" yaml:"weight,omitempty"`
+	Tags     []string `json:"tags,omitempty" yaml:"tags,omitempty"`
+	Draining bool     `json:"draining,omitempty" yaml:"draining,omitempty"`
+	// Proto is the .proto file defining the service
+	Proto       string   `json:"proto,omitempty" yaml:"proto,omitempty"`
+	ImportPaths []string `json:"import_paths,omitempty" yaml:"import_paths,omitempty"`
+	// DescriptorSet is a descriptor set containing the service
+	DescriptorSet string `json:"descriptor_set,omitempty" yaml:"descriptor_set,omitempty"`
+}
+
+func (s *Service) id() string {
+	if s.ID != "" {
+		return s.ID
+	}
+
+	return s.Service + "_" + s.Address
+}
+
+// Load reads the services file.
+func Load(path string) (*File, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var f File
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(b, &f)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &f)
+	default:
+		return nil, fmt.Errorf("unsupported services file format: %s", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decode %s: %w", path, err)
+	}
+
+	for i, s := range f.Services {
+		if s.Service == "" || s.Address == "" {
+			return nil, fmt.Errorf("%s: service %d requires service and address", path, i)
+		}
+	}
+
+	return &f, nil
+}
+
+type StaticOption struct {
+	// Watch reloads the file when it changes, default is true
+	Watch bool
+}
+
+type StaticOptionFunc func(*StaticOption)
+
+// WithWatch enables or disables reloading the file when it changes.
+func WithWatch(on bool) StaticOptionFunc {
+	return func(o *StaticOption) {
+		o.Watch = on
+	}
+}
+
+// NewStaticProvider returns a service discover reading the services file.
+func NewStaticProvider(path string, optfns ...StaticOptionFunc) discovery.ServiceDiscover {
+	var opt = StaticOption{
+		Watch: true,
+	}
+
+	for _, fn := range optfns {
+		fn(&opt)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &staticDiscovery{
+		path:    path,
+		opts:    opt,
+		ctx:     ctx,
+		closefn: cancel,
+		msgch:   make(chan discovery.RegistryMessage, 10),
+		shadow:  make(map[string]entry),
+	}
+
+	go c.Run()
+	return c
+}
+
+type staticDiscovery struct {
+	path    string
+	opts    StaticOption
+	ctx     context.Context
+	closefn context.CancelFunc
+	msgch   chan discovery.RegistryMessage
+	shadow  map[string]entry
+	l       sync.Mutex
+}
+
+type entry struct {
+	service Service
+	desc    discovery.ServiceDesc
+}
+
+// Run loads the file and reloads it on change until Close.
+func (c *staticDiscovery) Run() error {
+	if err := c.reload(); err != nil {
+		logger.Logger.Error("load services file", zap.String("path", c.path), zap.Error(err))
+	}
+
+	if !c.opts.Watch {
+		return nil
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	// watch the directory, editors replace the file instead of writing it
+	if err := watcher.Add(filepath.Dir(c.path)); err != nil {
+		logger.Logger.Error("watch services file", zap.String("path", c.path), zap.Error(err))
+		return err
+	}
+
+	var (
+		name     = filepath.Clean(c.path)
+		debounce = time.NewTimer(time.Hour)
+	)
+	debounce.Stop()
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+
+			if filepath.Clean(event.Name) != name {
+				continue
+			}
+
+			// an editor save is several events, reload once they settle
+			debounce.Reset(100 * time.Millisecond)
+		case <-debounce.C:
+			if err := c.reload(); err != nil {
+				logger.Logger.Warn("reload services file", zap.String("path", c.path), zap.Error(err))
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			logger.Logger.Warn("watch services file", zap.String("path", c.path), zap.Error(err))
+		case <-c.ctx.Done():
+			return c.ctx.Err()
+		}
+	}
+}
+
+// reload loads the file and emits the difference with the known services,
+// a changed service is updated.
+func (c *staticDiscovery) reload() error {
+	f, err := Load(c.path)
+	if err != nil {
+		return err
+	}
+
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	var services = make(map[string]Service)
+	for _, s := range f.Services {
+		services[s.id()] = s
+	}
+
+	for id := range c.shadow {
+		if _, ok := services[id]; !ok {
+			c.leave(id)
+		}
+	}
+
+	for _, s := range f.Services {
+		e, joined := c.shadow[s.id()]
+		if joined && reflect.DeepEqual(s, e.service) {
+			continue
+		}
+
+		// a service failing to load keeps its old desc
+		desc, err := c.desc(s)
+		if err != nil {
+			logger.Logger.Error("load service descriptor", zap.String("service", s.Service), zap.Error(err))
+			continue
+		}
+
+		var method = discovery.ServiceJoin
+		if joined {
+			method = discovery.ServiceUpdate
+		}
+
+		c.shadow[desc.ID] = entry{service: s, desc: desc}
+		c.send(discovery.RegistryMessage{
+			Method: method,
+			Desc:   desc,
+		})
+	}
+
+	return nil
+}
+
+func (c *staticDiscovery) desc(s Service) (discovery.ServiceDesc, error) {
+	desc := discovery.ServiceDesc{
+		ID:        s.id(),
+		Service:   s.Service,
+		Address:   s.Address,
+		TargetURI: s.TargetURI,
+		Namespace: s.Namespace,
+		Group:     s.Group,
+		Version:   s.Version,
+		Weight:    s.Weight,
+		Tags:      s.Tags,
+		Draining:  s.Draining,
+	}
+
+	if desc.TargetURI == "" {
+		desc.TargetURI = s.Address
+	}
+
+	var path string
+	switch {
+	case s.Proto != "":
+		path = s.Proto
+	case s.DescriptorSet != "":
+		path = s.DescriptorSet
+	default:
+		return desc, nil
+	}
+
+	var importPaths []string
+	for _, dir := range s.ImportPaths {
+		importPaths = append(importPaths, c.resolve(dir))
+	}
+
+	fd, err := LoadFileDescriptor(c.resolve(path), s.Service, importPaths...)
+	if err != nil {
+		return desc, err
+	}
+
+	desc.FileDescriptor = fd
+	desc.FileDescriptorKey = fd.Path()
+	return desc, nil
+}
+
+// resolve returns the path relative to the services file
+func (c *staticDiscovery) resolve(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+
+	return filepath.Join(filepath.Dir(c.path), path)
+}
+
+func (c *staticDiscovery) leave(id string) {
+	e := c.shadow[id]
+	delete(c.shadow, id)
+
+	c.send(discovery.RegistryMessage{
+		Method: discovery.ServiceLeave,
+		Desc: discovery.ServiceDesc{
+			ID:        id,
+			Service:   e.desc.Service,
+			Address:   e.desc.Address,
+			Namespace: e.desc.Namespace,
+		},
+	})
+}
+
+func (c *staticDiscovery) send(msg discovery.RegistryMessage) {
+	select {
+	case c.msgch <- msg:
+	case <-c.ctx.Done():
+	}
+}
+
+func (c *staticDiscovery) Close() error {
+	c.closefn()
+	return nil
+}
+
+func (c *staticDiscovery) Notify() chan discovery.RegistryMessage {
+	return c.msgch
+}
+
+// Register registers the static discovery provider reading the services
+// file.
+func Register(path string, optfns ...StaticOptionFunc) {
+	discovery.RegistryProvider("static", func() discovery.Provider {
+		return &provider{path: path, optfns: optfns}
+	})
+}
+
+func init() {
+	// register static discovery when the services file is set
+	if path := os.Getenv("MX_DISCOVERY_FILE"); path != "" {
+		Register(path)
+	}
+}
+
+type provider struct {
+	path   string
+	optfns []StaticOptionFunc
+}
+
+func (p *provider) Discover() discovery.ServiceDiscover {
+	return NewStaticProvider(p.path, p.optfns...)
+}
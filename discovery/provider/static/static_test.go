@@ -0,0 +1,153 @@
+package static
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hysios/mx/discovery"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+const helloProto = `syntax = "proto3";
+
+package hello;
+
+message HelloRequest {
+  string name = 1;
+}
+
+message HelloReply {
+  string message = 1;
+}
+
+service Greeter {
+  rpc SayHello(HelloRequest) returns (HelloReply);
+}
+`
+
+func writeFile(t *testing.T, path, data string) {
+	assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	assert.NoError(t, os.WriteFile(path, []byte(data), 0644))
+}
+
+func recv(t *testing.T, c discovery.ServiceDiscover) discovery.RegistryMessage {
+	select {
+	case msg := <-c.Notify():
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatal("no registry message")
+		return discovery.RegistryMessage{}
+	}
+}
+
+func TestLoadFileDescriptor(t *testing.T) {
+	var (
+		dir   = t.TempDir()
+		proto = filepath.Join(dir, "proto", "hello.proto")
+	)
+	writeFile(t, proto, helloProto)
+
+	fd, err := LoadFileDescriptor(proto, "hello.Greeter")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello.Greeter", string(fd.Services().Get(0).FullName()))
+
+	// the path is relative to the import path
+	fd, err = LoadFileDescriptor(proto, "hello.Greeter", dir)
+	assert.NoError(t, err)
+	assert.Equal(t, "proto/hello.proto", fd.Path())
+
+	b, err := protoMarshalSet(fd)
+	assert.NoError(t, err)
+	set := filepath.Join(dir, "hello.binpb")
+	writeFile(t, set, string(b))
+
+	fd, err = LoadFileDescriptor(set, "hello.Greeter")
+	assert.NoError(t, err)
+	assert.Equal(t, "proto/hello.proto", fd.Path())
+
+	_, err = LoadFileDescriptor(set, "hello.Missing")
+	assert.Error(t, err)
+}
+
+func protoMarshalSet(fd protoreflect.FileDescriptor) ([]byte, error) {
+	return proto.Marshal(&descriptorpb.FileDescriptorSet{
+		File: []*descriptorpb.FileDescriptorProto{protodesc.ToFileDescriptorProto(fd)},
+	})
+}
+
+func TestStaticProvider(t *testing.T) {
+	var (
+		dir  = t.TempDir()
+		path = filepath.Join(dir, "services.yaml")
+	)
+	writeFile(t, filepath.Join(dir, "proto", "hello.proto"), helloProto)
+	writeFile(t, path, `
+services:
+  - service: hello.Greeter
+    address: 127.0.0.1:9000
+    proto: proto/hello.proto
+  - service: echo.Echo
+    address: 127.0.0.1:9001
+`)
+
+	c := NewStaticProvider(path)
+	defer c.(*staticDiscovery).Close()
+
+	var joins = make(map[string]discovery.ServiceDesc)
+	for i := 0; i < 2; i++ {
+		msg := recv(t, c)
+		assert.Equal(t, discovery.ServiceJoin, msg.Method)
+		joins[msg.Desc.ID] = msg.Desc
+	}
+
+	greeter := joins["hello.Greeter_127.0.0.1:9000"]
+	assert.Equal(t, "127.0.0.1:9000", greeter.TargetURI)
+	assert.NotNil(t, greeter.FileDescriptor)
+	assert.Equal(t, "hello.proto", greeter.FileDescriptorKey)
+	assert.Nil(t, joins["echo.Echo_127.0.0.1:9001"].FileDescriptor)
+
+	// remove echo and move greeter
+	time.Sleep(50 * time.Millisecond)
+	writeFile(t, path, `
+services:
+  - service: hello.Greeter
+    address: 127.0.0.1:9100
+    proto: proto/hello.proto
+`)
+
+	var msgs = make(map[string]string)
+	for i := 0; i < 3; i++ {
+		msg := recv(t, c)
+		msgs[msg.Desc.ID] = msg.Method
+	}
+
+	assert.Equal(t, map[string]string{
+		"hello.Greeter_127.0.0.1:9000": discovery.ServiceLeave,
+		"echo.Echo_127.0.0.1:9001":     discovery.ServiceLeave,
+		"hello.Greeter_127.0.0.1:9100": discovery.ServiceJoin,
+	}, msgs)
+
+	// a changed weight or draining flag updates the service
+	time.Sleep(50 * time.Millisecond)
+	writeFile(t, path, `
+services:
+  - service: hello.Greeter
+    address: 127.0.0.1:9100
+    proto: proto/hello.proto
+    weight: 3
+    draining: true
+`)
+
+	msg := recv(t, c)
+	assert.Equal(t, discovery.ServiceUpdate, msg.Method)
+	assert.Equal(t, "hello.Greeter_127.0.0.1:9100", msg.Desc.ID)
+	assert.Equal(t, 3, msg.Desc.Weight)
+	assert.True(t, msg.Desc.Draining)
+	assert.NotNil(t, msg.Desc.FileDescriptor)
+}
@@ -0,0 +1,164 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/grpc"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// ReflectFileDescriptor fetches the file descriptor defining the service
+// from the gRPC reflection service of the connection.
+func ReflectFileDescriptor(ctx context.Context, conn grpc.ClientConnInterface, service string) (protoreflect.FileDescriptor, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := rpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.CloseSend()
+
+	var (
+		files = make(map[string]*descriptorpb.FileDescriptorProto)
+		req   = &rpb.ServerReflectionRequest{
+			MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{
+				FileContainingSymbol: service,
+			},
+		}
+	)
+
+	for req != nil {
+		if err := stream.Send(req); err != nil {
+			return nil, err
+		}
+
+		resp, err := stream.Recv()
+		if err != nil {
+			return nil, err
+		}
+
+		if e := resp.GetErrorResponse(); e != nil {
+			return nil, fmt.Errorf("reflect %s: %s", service, e.GetErrorMessage())
+		}
+
+		for _, b := range resp.GetFileDescriptorResponse().GetFileDescriptorProto() {
+			var fdp descriptorpb.FileDescriptorProto
+			if err := proto.Unmarshal(b, &fdp); err != nil {
+				return nil, err
+			}
+			files[fdp.GetName()] = &fdp
+		}
+
+		// servers may leave out the dependencies already sent, ask for the
+		// missing ones which are not linked in
+		req = nil
+		for _, fdp := range files {
+			for _, dep := range fdp.GetDependency() {
+				if _, ok := files[dep]; ok {
+					continue
+				}
+
+				if _, err := protoregistry.GlobalFiles.FindFileByPath(dep); err == nil {
+					continue
+				}
+
+				req = &rpb.ServerReflectionRequest{
+					MessageRequest: &rpb.ServerReflectionRequest_FileByFilename{
+						FileByFilename: dep,
+					},
+				}
+				break
+			}
+
+			if req != nil {
+				break
+			}
+		}
+	}
+
+	reg, err := BuildFiles(files)
+	if err != nil {
+		return nil, err
+	}
+
+	desc, err := reg.FindDescriptorByName(protoreflect.FullName(service))
+	if err != nil {
+		return nil, fmt.Errorf("reflect %s: %w", service, err)
+	}
+
+	return desc.ParentFile(), nil
+}
+
+// BuildFiles links the file descriptor protos into a registry, imports
+// missing from the protos are resolved from the global registry.
+func BuildFiles(protos map[string]*descriptorpb.FileDescriptorProto) (*protoregistry.Files, error) {
+	var (
+		files    = new(protoregistry.Files)
+		resolver = &fallbackResolver{files: files}
+		build    func(name string, path map[string]bool) error
+	)
+
+	build = func(name string, path map[string]bool) error {
+		if _, err := files.FindFileByPath(name); err == nil {
+			return nil
+		}
+
+		fdp, ok := protos[name]
+		if !ok {
+			// linked in, e.g. google/protobuf/*.proto
+			return nil
+		}
+
+		if path[name] {
+			return fmt.Errorf("import cycle at %s", name)
+		}
+		path[name] = true
+		defer delete(path, name)
+
+		for _, dep := range fdp.GetDependency() {
+			if err := build(dep, path); err != nil {
+				return err
+			}
+		}
+
+		fd, err := protodesc.NewFile(fdp, resolver)
+		if err != nil {
+			return fmt.Errorf("build %s: %w", name, err)
+		}
+		return files.RegisterFile(fd)
+	}
+
+	for name := range protos {
+		if err := build(name, make(map[string]bool)); err != nil {
+			return nil, err
+		}
+	}
+
+	return files, nil
+}
+
+// fallbackResolver resolves from the files first, then the global registry
+type fallbackResolver struct {
+	files *protoregistry.Files
+}
+
+func (r *fallbackResolver) FindFileByPath(path string) (protoreflect.FileDescriptor, error) {
+	if fd, err := r.files.FindFileByPath(path); err == nil {
+		return fd, nil
+	}
+	return protoregistry.GlobalFiles.FindFileByPath(path)
+}
+
+func (r *fallbackResolver) FindDescriptorByName(name protoreflect.FullName) (protoreflect.Descriptor, error) {
+	if d, err := r.files.FindDescriptorByName(name); err == nil {
+		return d, nil
+	}
+	return protoregistry.GlobalFiles.FindDescriptorByName(name)
+}
@@ -1,6 +1,11 @@
 package discovery
 
-import "google.golang.org/protobuf/reflect/protoreflect"
+import (
+	"context"
+	"slices"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
 
 type ServiceDiscover interface {
 	Notify() chan RegistryMessage
@@ -27,6 +32,42 @@ type ServiceDesc struct {
 	Group             string
 	FileDescriptorKey string
 	FileDescriptor    protoreflect.FileDescriptor
+	// Weight is the relative share of the requests, 0 is the default weight
+	Weight int
+	Tags   []string
+	// Draining services get no new requests while they have peers
+	Draining bool
+	// Datacenter is the datacenter of the instance, empty when the provider
+	// has none
+	Datacenter string
+	// Remote instances are of another datacenter or namespace than the
+	// gateway, they only get requests when no local instance is left
+	Remote bool
+	// Health reports the health of the instance, agents which pass its
+	// checks themselves, e.g. the consul TTL check, report it
+	Health func(ctx context.Context) error
+}
+
+// Origin returns the namespace and datacenter of the instance, e.g.
+// mx@dc1
+func (desc ServiceDesc) Origin() string {
+	if desc.Datacenter == "" {
+		return desc.Namespace
+	}
+	return desc.Namespace + "@" + desc.Datacenter
+}
+
+// Changed reports whether the desc of the same service ID differs from old
+// in a way its consumers must apply.
+func (desc ServiceDesc) Changed(old ServiceDesc) bool {
+	return desc.Address != old.Address ||
+		desc.TargetURI != old.TargetURI ||
+		desc.Version != old.Version ||
+		desc.Weight != old.Weight ||
+		desc.Draining != old.Draining ||
+		desc.Remote != old.Remote ||
+		desc.FileDescriptorKey != old.FileDescriptorKey ||
+		!slices.Equal(desc.Tags, old.Tags)
 }
 
 var (
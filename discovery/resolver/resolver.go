@@ -0,0 +1,362 @@
+// Package resolver resolves mx:///{service} and mx://{namespace}/{service}
+// targets to the addresses of the service instances, so grpc.Dial follows
+// the instances as they join and leave and can balance over them:
+//
+//	conn, err := grpc.Dial("mx:///hello.Greeter",
+//		grpc.WithDefaultServiceConfig(resolver.RoundRobin),
+//	)
+//
+// The instances are seeded from the discovery agent and kept up to date by
+// the registry messages of the discovery providers. The first mx target
+// starts discovery.Default, which runs the watchers of every registered
+// provider in the process until the Context of the builder is done; a
+// process which already runs it, e.g. the gateway, shares its watchers.
+// WithWatch subscribes to another source instead.
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hysios/mx"
+	"github.com/hysios/mx/discovery"
+	"google.golang.org/grpc/resolver"
+)
+
+const (
+	Scheme = "mx"
+	// RoundRobin is the service config balancing over all instances
+	RoundRobin = `{"loadBalancingConfig":[{"round_robin":{}}]}`
+)
+
+// Target returns the target of the service in the namespace.
+func Target(namespace, service string) string {
+	return fmt.Sprintf("%s://%s/%s", Scheme, namespace, service)
+}
+
+type BuilderOption struct {
+	// Agent returns the agent to look up the instances which are not known
+	// from the registry messages
+	Agent func() discovery.Agent
+	// Watch subscribes fn to the registry messages until ctx is done,
+	// default is discovery.Default, which is started if it is not running yet
+	Watch func(ctx context.Context, fn func(discovery.RegistryMessage))
+	// Context stops the watch when it is done, default is
+	// context.Background()
+	Context context.Context
+	// Interval is the interval to look up the instances again, default 30s
+	Interval time.Duration
+}
+
+type BuilderOptionFunc func(*BuilderOption)
+
+func WithAgent(agent func() discovery.Agent) BuilderOptionFunc {
+	return func(o *BuilderOption) {
+		o.Agent = agent
+	}
+}
+
+func WithWatch(watch func(ctx context.Context, fn func(discovery.RegistryMessage))) BuilderOptionFunc {
+	return func(o *BuilderOption) {
+		o.Watch = watch
+	}
+}
+
+func WithContext(ctx context.Context) BuilderOptionFunc {
+	return func(o *BuilderOption) {
+		o.Context = ctx
+	}
+}
+
+func WithInterval(d time.Duration) BuilderOptionFunc {
+	return func(o *BuilderOption) {
+		o.Interval = d
+	}
+}
+
+// NewBuilder returns a resolver builder of the mx scheme.
+func NewBuilder(optfns ...BuilderOptionFunc) resolver.Builder {
+	var opt = BuilderOption{
+		Agent:    func() discovery.Agent { return discovery.DefaultAgent },
+		Watch:    watch,
+		Context:  context.Background(),
+		Interval: 30 * time.Second,
+	}
+
+	for _, fn := range optfns {
+		fn(&opt)
+	}
+
+	return &builder{
+		opts:      opt,
+		services:  make(map[string]map[string]discovery.ServiceDesc),
+		resolvers: make(map[string]map[*mxResolver]struct{}),
+	}
+}
+
+// Register registers the resolver builder of the mx scheme.
+func Register(optfns ...BuilderOptionFunc) {
+	resolver.Register(NewBuilder(optfns...))
+}
+
+// watch subscribes fn to the discovery of the process, e.g. the one of the
+// gateway, so the providers are not watched twice. When it starts the
+// discovery, the provider watchers stop once ctx is done.
+func watch(ctx context.Context, fn func(discovery.RegistryMessage)) {
+	discovery.Default.Discovery(fn)
+	go discovery.Default.Start(ctx)
+}
+
+type builder struct {
+	opts BuilderOption
+	once sync.Once
+
+	l sync.Mutex
+	// services are the instances of each namespace/service from the
+	// registry messages
+	services  map[string]map[string]discovery.ServiceDesc
+	resolvers map[string]map[*mxResolver]struct{}
+}
+
+func serviceKey(namespace, service string) string {
+	return namespace + "/" + service
+}
+
+func (b *builder) Scheme() string {
+	return Scheme
+}
+
+func (b *builder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	var (
+		service   = strings.TrimPrefix(target.URL.Path, "/")
+		namespace = target.URL.Host
+	)
+
+	if service == "" {
+		return nil, fmt.Errorf("mx resolver: no service in target %s", target.URL.String())
+	}
+
+	if namespace == "" {
+		namespace = discovery.Namespace
+	}
+
+	b.once.Do(func() { b.opts.Watch(b.opts.Context, b.handle) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &mxResolver{
+		b:         b,
+		cc:        cc,
+		service:   service,
+		namespace: namespace,
+		key:       serviceKey(namespace, service),
+		notify:    make(chan struct{}, 1),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+
+	b.l.Lock()
+	if b.resolvers[r.key] == nil {
+		b.resolvers[r.key] = make(map[*mxResolver]struct{})
+	}
+	b.resolvers[r.key][r] = struct{}{}
+	b.l.Unlock()
+
+	r.resolve()
+	go r.run()
+	return r, nil
+}
+
+// handle applies the registry message and notifies the resolvers of its
+// service
+func (b *builder) handle(msg discovery.RegistryMessage) {
+	var (
+		desc      = msg.Desc
+		namespace = desc.Namespace
+	)
+
+	if desc.Type != "" && desc.Type != mx.ServerType {
+		return
+	}
+
+	if namespace == "" {
+		namespace = discovery.Namespace
+	}
+
+	key := serviceKey(namespace, desc.Service)
+
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	switch msg.Method {
+	case discovery.ServiceJoin, discovery.ServiceUpdate:
+		if b.services[key] == nil {
+			b.services[key] = make(map[string]discovery.ServiceDesc)
+		}
+		b.services[key][desc.ID] = desc
+	case discovery.ServiceLeave:
+		delete(b.services[key], desc.ID)
+		if len(b.services[key]) == 0 {
+			delete(b.services, key)
+		}
+	}
+
+	for r := range b.resolvers[key] {
+		r.ResolveNow(resolver.ResolveNowOptions{})
+	}
+}
+
+// instances returns the instances of the service from the registry
+// messages
+func (b *builder) instances(key string) []discovery.ServiceDesc {
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	var descs []discovery.ServiceDesc
+	for _, desc := range b.services[key] {
+		descs = append(descs, desc)
+	}
+	return descs
+}
+
+func (b *builder) remove(r *mxResolver) {
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	delete(b.resolvers[r.key], r)
+	if len(b.resolvers[r.key]) == 0 {
+		delete(b.resolvers, r.key)
+	}
+}
+
+type mxResolver struct {
+	b                       *builder
+	cc                      resolver.ClientConn
+	service, namespace, key string
+	notify                  chan struct{}
+	ctx                     context.Context
+	cancel                  context.CancelFunc
+}
+
+func (r *mxResolver) run() {
+	tick := time.NewTicker(r.b.opts.Interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-r.notify:
+		case <-tick.C:
+		case <-r.ctx.Done():
+			return
+		}
+		r.resolve()
+	}
+}
+
+// resolve updates the addresses of the conn, the agent is asked when no
+// registry message reported the service
+func (r *mxResolver) resolve() {
+	descs := r.b.instances(r.key)
+	if len(descs) == 0 {
+		if agent := r.b.opts.Agent(); agent != nil {
+			descs, _ = agent.Lookup(r.service,
+				discovery.WithServiceType(mx.ServerType),
+				discovery.WithNamespace(r.namespace),
+			)
+		}
+	}
+
+	addrs := addresses(descs)
+	if len(addrs) == 0 {
+		r.cc.ReportError(fmt.Errorf("%w: %s", mx.ErrServiceNotFound, r.key))
+		return
+	}
+
+	if err := r.cc.UpdateState(resolver.State{Addresses: addrs}); err != nil {
+		r.cc.ReportError(err)
+	}
+}
+
+// addresses returns the addresses of the instances, local instances are
+// preferred over remote ones, and draining instances are left out unless all
+// of them drain
+func addresses(descs []discovery.ServiceDesc) []resolver.Address {
+	// local, remote, local draining, remote draining
+	var tiers [4][]discovery.ServiceDesc
+	for _, desc := range descs {
+		var tier int
+		if desc.Remote {
+			tier++
+		}
+		if desc.Draining {
+			tier += 2
+		}
+		tiers[tier] = append(tiers[tier], desc)
+	}
+
+	for _, tier := range tiers {
+		if len(tier) > 0 {
+			descs = tier
+			break
+		}
+	}
+
+	var (
+		seen  = make(map[string]bool)
+		addrs []resolver.Address
+	)
+
+	for _, desc := range descs {
+		addr := targetAddr(desc)
+		if addr == "" || seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		// the tls authority defaults to the endpoint of the target, which is
+		// the service name, so verify the host of the instance instead
+		var serverName = addr
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			serverName = host
+		}
+		addrs = append(addrs, resolver.Address{Addr: addr, ServerName: serverName})
+	}
+
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i].Addr < addrs[j].Addr })
+	return addrs
+}
+
+// targetAddr returns the host:port of the target uri of the instance, e.g.
+// grpc://127.0.0.1:9000/hello.Greeter
+func targetAddr(desc discovery.ServiceDesc) string {
+	target := desc.TargetURI
+	if target == "" {
+		return desc.Address
+	}
+
+	if !strings.Contains(target, "://") {
+		return target
+	}
+
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		return desc.Address
+	}
+	return u.Host
+}
+
+func (r *mxResolver) ResolveNow(resolver.ResolveNowOptions) {
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (r *mxResolver) Close() {
+	r.cancel()
+	r.b.remove(r)
+}
@@ -0,0 +1,191 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hysios/mx"
+	"github.com/hysios/mx/discovery"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/resolver"
+)
+
+type fakeAgent struct {
+	l     sync.Mutex
+	descs []discovery.ServiceDesc
+}
+
+func (a *fakeAgent) Register(desc discovery.ServiceDesc) error { return nil }
+
+func (a *fakeAgent) Deregister(serviceID string) error { return nil }
+
+func (a *fakeAgent) Lookup(serviceName string, opts ...discovery.LookupOptionFunc) ([]discovery.ServiceDesc, bool) {
+	a.l.Lock()
+	defer a.l.Unlock()
+	return a.descs, len(a.descs) > 0
+}
+
+type countServer struct {
+	addr string
+	hits int
+	l    sync.Mutex
+}
+
+func (s *countServer) count() int {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.hits
+}
+
+func startServer(t *testing.T) *countServer {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	cs := &countServer{addr: lis.Addr().String()}
+	srv := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		cs.l.Lock()
+		cs.hits++
+		cs.l.Unlock()
+		return handler(ctx, req)
+	}))
+	grpc_health_v1.RegisterHealthServer(srv, health.NewServer())
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	return cs
+}
+
+func desc(id, addr string) discovery.ServiceDesc {
+	return discovery.ServiceDesc{
+		ID:        id,
+		Service:   "grpc.health.v1.Health",
+		Type:      mx.ServerType,
+		Namespace: discovery.Namespace,
+		TargetURI: "grpc://" + addr,
+	}
+}
+
+func TestResolver(t *testing.T) {
+	var (
+		s1, s2 = startServer(t), startServer(t)
+		agent  = &fakeAgent{descs: []discovery.ServiceDesc{desc("h1", s1.addr)}}
+		notify func(discovery.RegistryMessage)
+		b      = NewBuilder(
+			WithAgent(func() discovery.Agent { return agent }),
+			WithWatch(func(_ context.Context, fn func(discovery.RegistryMessage)) { notify = fn }),
+		)
+	)
+
+	conn, err := grpc.Dial("mx:///grpc.health.v1.Health",
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithResolvers(b),
+		grpc.WithDefaultServiceConfig(RoundRobin),
+	)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	var (
+		client = grpc_health_v1.NewHealthClient(conn)
+		check  = func(n int) {
+			for i := 0; i < n; i++ {
+				_, err := client.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{}, grpc.WaitForReady(true))
+				assert.NoError(t, err)
+			}
+		}
+	)
+
+	// seeded from the agent
+	check(4)
+	assert.Equal(t, 4, s1.count())
+	assert.Equal(t, 0, s2.count())
+
+	// a joined instance gets its share
+	notify(discovery.RegistryMessage{Method: discovery.ServiceJoin, Desc: desc("h1", s1.addr)})
+	notify(discovery.RegistryMessage{Method: discovery.ServiceJoin, Desc: desc("h2", s2.addr)})
+	assert.Eventually(t, func() bool {
+		check(1)
+		return s2.count() > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// a draining instance gets no requests while it has peers
+	d2 := desc("h2", s2.addr)
+	d2.Draining = true
+	notify(discovery.RegistryMessage{Method: discovery.ServiceUpdate, Desc: d2})
+	assert.Eventually(t, func() bool {
+		before := s2.count()
+		check(4)
+		return s2.count() == before
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the left instance gets no requests
+	notify(discovery.RegistryMessage{Method: discovery.ServiceLeave, Desc: desc("h1", s1.addr)})
+	assert.Eventually(t, func() bool {
+		before := s1.count()
+		check(4)
+		return s1.count() == before
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestAddresses(t *testing.T) {
+	d1, d2, d3 := desc("a", "10.0.0.2:9000"), desc("b", "10.0.0.1:9000"), desc("c", "10.0.0.3:9000")
+	d3.Draining = true
+	d4 := discovery.ServiceDesc{ID: "d", Address: "10.0.0.4:9000"}
+
+	var addrs []string
+	for _, addr := range addresses([]discovery.ServiceDesc{d1, d2, d3, d4, d1}) {
+		addrs = append(addrs, addr.Addr)
+		// tls verifies the host of the instance, not the service name
+		assert.Equal(t, strings.TrimSuffix(addr.Addr, ":9000"), addr.ServerName)
+	}
+	assert.Equal(t, []string{"10.0.0.1:9000", "10.0.0.2:9000", "10.0.0.4:9000"}, addrs)
+
+	// all draining, keep them rather than nothing
+	assert.Len(t, addresses([]discovery.ServiceDesc{d3}), 1)
+
+	// remote instances only when no local one is left
+	d5 := desc("e", "10.1.0.1:9000")
+	d5.Remote = true
+	assert.Equal(t, "10.0.0.2:9000", addresses([]discovery.ServiceDesc{d1, d5})[0].Addr)
+	assert.Equal(t, "10.1.0.1:9000", addresses([]discovery.ServiceDesc{d3, d5})[0].Addr)
+}
+
+type stubConn struct {
+	resolver.ClientConn
+}
+
+func (stubConn) UpdateState(resolver.State) error { return nil }
+
+func (stubConn) ReportError(error) {}
+
+func TestBuilderContext(t *testing.T) {
+	var (
+		ctx, cancel = context.WithCancel(context.Background())
+		watched     = make(chan context.Context, 1)
+		b           = NewBuilder(
+			WithAgent(func() discovery.Agent { return nil }),
+			WithContext(ctx),
+			WithWatch(func(ctx context.Context, fn func(discovery.RegistryMessage)) { watched <- ctx }),
+		)
+	)
+
+	u, err := url.Parse("mx:///grpc.health.v1.Health")
+	assert.NoError(t, err)
+
+	r, err := b.Build(resolver.Target{URL: *u}, stubConn{}, resolver.BuildOptions{})
+	assert.NoError(t, err)
+	defer r.Close()
+
+	// the watch stops with the context of the builder
+	watchCtx := <-watched
+	assert.NoError(t, watchCtx.Err())
+	cancel()
+	assert.ErrorIs(t, watchCtx.Err(), context.Canceled)
+}
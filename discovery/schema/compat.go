@@ -0,0 +1,258 @@
+package schema
+
+import (
+	"fmt"
+
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// Change is a difference between two versions of a file descriptor
+type Change struct {
+	// Path is the full name of the changed element
+	Path    string
+	Message string
+	// Breaking changes are wire or HTTP incompatible with the old version
+	Breaking bool
+}
+
+func (c Change) String() string {
+	if c.Breaking {
+		return fmt.Sprintf("%s: %s (breaking)", c.Path, c.Message)
+	}
+	return fmt.Sprintf("%s: %s", c.Path, c.Message)
+}
+
+// Diff returns the changes of the messages, enums and services of the old
+// file in the new one
+func Diff(old, new protoreflect.FileDescriptor) []Change {
+	var d differ
+	d.messages(old.Messages(), new.Messages())
+	d.enums(old.Enums(), new.Enums())
+	d.services(old.Services(), new.Services())
+	return d.changes
+}
+
+// Breaking returns the breaking changes
+func Breaking(changes []Change) []Change {
+	var breaking []Change
+	for _, c := range changes {
+		if c.Breaking {
+			breaking = append(breaking, c)
+		}
+	}
+	return breaking
+}
+
+type differ struct {
+	changes []Change
+}
+
+func (d *differ) add(path protoreflect.FullName, breaking bool, format string, args ...interface{}) {
+	d.changes = append(d.changes, Change{
+		Path:     string(path),
+		Message:  fmt.Sprintf(format, args...),
+		Breaking: breaking,
+	})
+}
+
+func (d *differ) messages(old, new protoreflect.MessageDescriptors) {
+	for i := 0; i < old.Len(); i++ {
+		om := old.Get(i)
+		nm := new.ByName(om.Name())
+		if nm == nil {
+			d.add(om.FullName(), true, "message removed")
+			continue
+		}
+		d.message(om, nm)
+	}
+
+	for i := 0; i < new.Len(); i++ {
+		if nm := new.Get(i); old.ByName(nm.Name()) == nil {
+			d.add(nm.FullName(), false, "message added")
+		}
+	}
+}
+
+func (d *differ) message(old, new protoreflect.MessageDescriptor) {
+	var (
+		ofields = old.Fields()
+		nfields = new.Fields()
+	)
+
+	for i := 0; i < ofields.Len(); i++ {
+		of := ofields.Get(i)
+		nf := nfields.ByNumber(of.Number())
+		if nf == nil {
+			if moved := nfields.ByName(of.Name()); moved != nil {
+				d.add(of.FullName(), true, "field number changed from %d to %d", of.Number(), moved.Number())
+			} else {
+				d.add(of.FullName(), true, "field %d removed", of.Number())
+			}
+			continue
+		}
+
+		if of.Name() != nf.Name() {
+			d.add(of.FullName(), true, "field %d renamed to %s", of.Number(), nf.Name())
+		}
+
+		if ot, nt := fieldType(of), fieldType(nf); ot != nt {
+			d.add(of.FullName(), true, "field type changed from %s to %s", ot, nt)
+		}
+	}
+
+	for i := 0; i < nfields.Len(); i++ {
+		nf := nfields.Get(i)
+		if ofields.ByNumber(nf.Number()) == nil && ofields.ByName(nf.Name()) == nil {
+			d.add(nf.FullName(), false, "field %d added", nf.Number())
+		}
+	}
+
+	d.messages(old.Messages(), new.Messages())
+	d.enums(old.Enums(), new.Enums())
+}
+
+func (d *differ) enums(old, new protoreflect.EnumDescriptors) {
+	for i := 0; i < old.Len(); i++ {
+		oe := old.Get(i)
+		ne := new.ByName(oe.Name())
+		if ne == nil {
+			d.add(oe.FullName(), true, "enum removed")
+			continue
+		}
+		d.enum(oe, ne)
+	}
+
+	for i := 0; i < new.Len(); i++ {
+		if ne := new.Get(i); old.ByName(ne.Name()) == nil {
+			d.add(ne.FullName(), false, "enum added")
+		}
+	}
+}
+
+// enum compares the values of the enum, the names matter as well as the
+// numbers since JSON encodes the names
+func (d *differ) enum(old, new protoreflect.EnumDescriptor) {
+	var (
+		ovalues = old.Values()
+		nvalues = new.Values()
+	)
+
+	for i := 0; i < ovalues.Len(); i++ {
+		var (
+			ov   = ovalues.Get(i)
+			path = old.FullName().Append(ov.Name())
+		)
+
+		switch nv := nvalues.ByName(ov.Name()); {
+		case nv != nil && nv.Number() != ov.Number():
+			d.add(path, true, "enum value number changed from %d to %d", ov.Number(), nv.Number())
+		case nv != nil:
+		case nvalues.ByNumber(ov.Number()) != nil:
+			d.add(path, true, "enum value %d renamed to %s", ov.Number(), nvalues.ByNumber(ov.Number()).Name())
+		default:
+			d.add(path, true, "enum value %d removed", ov.Number())
+		}
+	}
+
+	for i := 0; i < nvalues.Len(); i++ {
+		nv := nvalues.Get(i)
+		if ovalues.ByName(nv.Name()) == nil && ovalues.ByNumber(nv.Number()) == nil {
+			d.add(new.FullName().Append(nv.Name()), false, "enum value %d added", nv.Number())
+		}
+	}
+}
+
+// fieldType returns the type of the field as written in a .proto file
+func fieldType(fd protoreflect.FieldDescriptor) string {
+	var typ string
+	switch {
+	case fd.IsMap():
+		return fmt.Sprintf("map<%s, %s>", fieldType(fd.MapKey()), fieldType(fd.MapValue()))
+	case fd.Message() != nil:
+		typ = string(fd.Message().FullName())
+	case fd.Enum() != nil:
+		typ = string(fd.Enum().FullName())
+	default:
+		typ = fd.Kind().String()
+	}
+
+	if fd.Cardinality() == protoreflect.Repeated {
+		return "repeated " + typ
+	}
+	return typ
+}
+
+func (d *differ) services(old, new protoreflect.ServiceDescriptors) {
+	for i := 0; i < old.Len(); i++ {
+		osrv := old.Get(i)
+		nsrv := new.ByName(osrv.Name())
+		if nsrv == nil {
+			d.add(osrv.FullName(), true, "service removed")
+			continue
+		}
+		d.methods(osrv.Methods(), nsrv.Methods())
+	}
+
+	for i := 0; i < new.Len(); i++ {
+		if nsrv := new.Get(i); old.ByName(nsrv.Name()) == nil {
+			d.add(nsrv.FullName(), false, "service added")
+		}
+	}
+}
+
+func (d *differ) methods(old, new protoreflect.MethodDescriptors) {
+	for i := 0; i < old.Len(); i++ {
+		om := old.Get(i)
+		nm := new.ByName(om.Name())
+		if nm == nil {
+			d.add(om.FullName(), true, "rpc removed")
+			continue
+		}
+
+		if om.Input().FullName() != nm.Input().FullName() {
+			d.add(om.FullName(), true, "request changed from %s to %s", om.Input().FullName(), nm.Input().FullName())
+		}
+
+		if om.Output().FullName() != nm.Output().FullName() {
+			d.add(om.FullName(), true, "response changed from %s to %s", om.Output().FullName(), nm.Output().FullName())
+		}
+
+		if om.IsStreamingClient() != nm.IsStreamingClient() || om.IsStreamingServer() != nm.IsStreamingServer() {
+			d.add(om.FullName(), true, "streaming changed")
+		}
+
+		switch orule, nrule := httpRule(om), httpRule(nm); {
+		case orule == nil && nrule != nil:
+			d.add(om.FullName(), false, "http binding added")
+		case orule != nil && !proto.Equal(orule, nrule):
+			d.add(om.FullName(), true, "http binding changed")
+		}
+	}
+
+	for i := 0; i < new.Len(); i++ {
+		if nm := new.Get(i); old.ByName(nm.Name()) == nil {
+			d.add(nm.FullName(), false, "rpc added")
+		}
+	}
+}
+
+// httpRule returns the google.api.http option of the method, the options
+// are decoded again as they may hold the extension as unknown fields or a
+// dynamic message
+func httpRule(md protoreflect.MethodDescriptor) *annotations.HttpRule {
+	b, err := proto.Marshal(md.Options())
+	if err != nil {
+		return nil
+	}
+
+	var opts descriptorpb.MethodOptions
+	if err := proto.Unmarshal(b, &opts); err != nil || !proto.HasExtension(&opts, annotations.E_Http) {
+		return nil
+	}
+
+	rule, _ := proto.GetExtension(&opts, annotations.E_Http).(*annotations.HttpRule)
+	return rule
+}
@@ -0,0 +1,165 @@
+package schema
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bufbuild/protocompile"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+const helloV1 = `syntax = "proto3";
+package hello;
+
+import "google/api/annotations.proto";
+
+message HelloRequest {
+  string name = 1;
+  int32 count = 2;
+  string locale = 3;
+}
+
+message HelloReply {
+  string message = 1;
+}
+
+service Greeter {
+  rpc SayHello(HelloRequest) returns (HelloReply) {
+    option (google.api.http) = { get: "/v1/hello/{name}" };
+  }
+  rpc SayGoodbye(HelloRequest) returns (HelloReply);
+}
+`
+
+func compile(t *testing.T, src string) protoreflect.FileDescriptor {
+	compiler := protocompile.Compiler{
+		Resolver: protocompile.CompositeResolver{
+			&protocompile.SourceResolver{
+				Accessor: protocompile.SourceAccessorFromMap(map[string]string{"hello.proto": src}),
+			},
+			protocompile.ResolverFunc(func(path string) (protocompile.SearchResult, error) {
+				fd, err := protoregistry.GlobalFiles.FindFileByPath(path)
+				return protocompile.SearchResult{Desc: fd}, err
+			}),
+		},
+	}
+
+	files, err := compiler.Compile(context.Background(), "hello.proto")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return files[0]
+}
+
+func TestDiff(t *testing.T) {
+	var (
+		old = compile(t, helloV1)
+		fd  = compile(t, `syntax = "proto3";
+package hello;
+
+import "google/api/annotations.proto";
+
+message HelloRequest {
+  string name = 1;
+  int64 count = 2;
+  string lang = 3;
+  string title = 4;
+}
+
+message HelloReply {
+  string message = 2;
+}
+
+service Greeter {
+  rpc SayHello(HelloRequest) returns (HelloReply) {
+    option (google.api.http) = { post: "/v1/hello" body: "*" };
+  }
+  rpc SayHi(HelloRequest) returns (HelloReply);
+}
+`)
+	)
+
+	var got []string
+	for _, c := range Diff(old, fd) {
+		got = append(got, c.String())
+	}
+
+	assert.Equal(t, []string{
+		"hello.HelloRequest.count: field type changed from int32 to int64 (breaking)",
+		"hello.HelloRequest.locale: field 3 renamed to lang (breaking)",
+		"hello.HelloRequest.title: field 4 added",
+		"hello.HelloReply.message: field number changed from 1 to 2 (breaking)",
+		"hello.Greeter.SayHello: http binding changed (breaking)",
+		"hello.Greeter.SayGoodbye: rpc removed (breaking)",
+		"hello.Greeter.SayHi: rpc added",
+	}, got)
+
+	assert.Len(t, Breaking(Diff(old, fd)), 5)
+	assert.Empty(t, Diff(old, compile(t, helloV1)))
+}
+
+func TestDiffEnums(t *testing.T) {
+	var (
+		old = compile(t, `syntax = "proto3";
+package hello;
+
+enum Mood {
+  MOOD_UNSPECIFIED = 0;
+  HAPPY = 1;
+  SAD = 2;
+  ANGRY = 3;
+}
+
+enum Color {
+  COLOR_UNSPECIFIED = 0;
+}
+
+message HelloRequest {
+  enum Kind {
+    KIND_UNSPECIFIED = 0;
+    FORMAL = 1;
+  }
+  Kind kind = 1;
+}
+`)
+		fd = compile(t, `syntax = "proto3";
+package hello;
+
+enum Mood {
+  MOOD_UNSPECIFIED = 0;
+  HAPPY = 2;
+  GLAD = 1;
+  CALM = 4;
+}
+
+enum Shape {
+  SHAPE_UNSPECIFIED = 0;
+}
+
+message HelloRequest {
+  enum Kind {
+    KIND_UNSPECIFIED = 0;
+    CASUAL = 1;
+  }
+  Kind kind = 1;
+}
+`)
+	)
+
+	var got []string
+	for _, c := range Diff(old, fd) {
+		got = append(got, c.String())
+	}
+
+	assert.Equal(t, []string{
+		"hello.HelloRequest.Kind.FORMAL: enum value 1 renamed to CASUAL (breaking)",
+		"hello.Mood.HAPPY: enum value number changed from 1 to 2 (breaking)",
+		"hello.Mood.SAD: enum value 2 renamed to HAPPY (breaking)",
+		"hello.Mood.ANGRY: enum value 3 removed (breaking)",
+		"hello.Mood.CALM: enum value 4 added",
+		"hello.Color: enum removed (breaking)",
+		"hello.Shape: enum added",
+	}, got)
+}
@@ -0,0 +1,59 @@
+package schema
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// MemoryStore returns a store in memory, for tests and single process
+// deployments
+func MemoryStore() Store {
+	return &memoryStore{kvs: make(map[string][]byte)}
+}
+
+type memoryStore struct {
+	l   sync.RWMutex
+	kvs map[string][]byte
+}
+
+func (m *memoryStore) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	m.l.RLock()
+	defer m.l.RUnlock()
+
+	v, ok := m.kvs[key]
+	return v, ok, nil
+}
+
+func (m *memoryStore) Put(ctx context.Context, key string, value []byte) error {
+	m.l.Lock()
+	defer m.l.Unlock()
+
+	m.kvs[key] = append([]byte(nil), value...)
+	return nil
+}
+
+func (m *memoryStore) Create(ctx context.Context, key string, value []byte) (bool, error) {
+	m.l.Lock()
+	defer m.l.Unlock()
+
+	if _, ok := m.kvs[key]; ok {
+		return false, nil
+	}
+
+	m.kvs[key] = append([]byte(nil), value...)
+	return true, nil
+}
+
+func (m *memoryStore) List(ctx context.Context, prefix string) (map[string][]byte, error) {
+	m.l.RLock()
+	defer m.l.RUnlock()
+
+	kvs := make(map[string][]byte)
+	for k, v := range m.kvs {
+		if strings.HasPrefix(k, prefix) {
+			kvs[k] = v
+		}
+	}
+	return kvs, nil
+}
@@ -0,0 +1,303 @@
+// Package schema keeps the versions of the file descriptors the services
+// publish, and checks a new version is compatible with the last one before
+// it is accepted.
+//
+// The versions are kept under mx/registry/schema/{ns}/{key}/{version}, the
+// latest one is also written to mx/registry/protofile/{ns}/{key} where the
+// discovery providers read it.
+package schema
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hysios/mx/discovery"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+const (
+	ProtofilePrefix = "mx/registry/protofile"
+	SchemaPrefix    = "mx/registry/schema"
+)
+
+var ErrNotFound = errors.New("schema not found")
+
+// Store is the key value store of the registry, e.g. the Consul KV or etcd
+type Store interface {
+	// Get returns the value of the key, ok is false when it is missing
+	Get(ctx context.Context, key string) (value []byte, ok bool, err error)
+	Put(ctx context.Context, key string, value []byte) error
+	// Create puts the value unless the key exists, ok is false then
+	Create(ctx context.Context, key string, value []byte) (ok bool, err error)
+	// List returns the values of the keys with the prefix
+	List(ctx context.Context, prefix string) (map[string][]byte, error)
+}
+
+// Version is a registered version of a file descriptor
+type Version struct {
+	Version int       `json:"version"`
+	Hash    string    `json:"hash"`
+	Created time.Time `json:"created"`
+	// Descriptor is the packed FileDescriptorSet
+	Descriptor []byte `json:"descriptor"`
+}
+
+// IncompatibleError rejects a version with breaking changes
+type IncompatibleError struct {
+	Key     string
+	Version int
+	Changes []Change
+}
+
+func (e *IncompatibleError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "schema %s is incompatible with version %d:", e.Key, e.Version)
+	for _, c := range e.Changes {
+		b.WriteString("\n  ")
+		b.WriteString(c.String())
+	}
+	return b.String()
+}
+
+type Registry struct {
+	Store Store
+	// AllowBreaking accepts versions with breaking changes
+	AllowBreaking bool
+
+	pack discovery.FileDescriptorPacker
+}
+
+// NewRegistry returns the registry on the store, breaking changes are
+// allowed when MX_SCHEMA_ALLOW_BREAKING is true
+func NewRegistry(store Store) *Registry {
+	allow, _ := strconv.ParseBool(os.Getenv("MX_SCHEMA_ALLOW_BREAKING"))
+	return &Registry{Store: store, AllowBreaking: allow}
+}
+
+func versionsPrefix(ns, key string) string {
+	return fmt.Sprintf("%s/%s/%s/", SchemaPrefix, ns, key)
+}
+
+func versionKey(ns, key string, version int) string {
+	return versionsPrefix(ns, key) + strconv.Itoa(version)
+}
+
+func protofileKey(ns, key string) string {
+	return fmt.Sprintf("%s/%s/%s", ProtofilePrefix, ns, key)
+}
+
+// maxRegisterAttempts bounds the retries of concurrent registrations
+// claiming the same version
+const maxRegisterAttempts = 5
+
+// Register records the file descriptor as the next version of the key
+// unless it is a registered version, e.g. of an older instance during a
+// rolling deploy. A new version breaking the latest one is rejected with
+// an IncompatibleError. Versions are created only if missing, so
+// concurrent registrations never claim the same version.
+func (r *Registry) Register(ctx context.Context, ns, key string, fd protoreflect.FileDescriptor) (Version, error) {
+	b, err := r.pack.Pack(fd)
+	if err != nil {
+		return Version{}, err
+	}
+
+	sum := sha256.Sum256(b)
+	hash := hex.EncodeToString(sum[:])
+
+	for attempt := 0; attempt < maxRegisterAttempts; attempt++ {
+		versions, err := r.Versions(ctx, ns, key)
+		if err != nil {
+			return Version{}, err
+		}
+
+		for _, v := range versions {
+			if v.Hash == hash {
+				return v, r.ensureProtofile(ctx, ns, key, versions)
+			}
+		}
+
+		next := Version{
+			Version:    1,
+			Hash:       hash,
+			Created:    time.Now(),
+			Descriptor: b,
+		}
+
+		if len(versions) > 0 {
+			latest := versions[len(versions)-1]
+			old, err := r.pack.Unpack(latest.Descriptor)
+			if err != nil {
+				return Version{}, fmt.Errorf("unpack version %d of %s: %w", latest.Version, key, err)
+			}
+
+			if breaking := Breaking(Diff(old, fd)); len(breaking) > 0 && !r.AllowBreaking {
+				return Version{}, &IncompatibleError{Key: key, Version: latest.Version, Changes: breaking}
+			}
+			next.Version = latest.Version + 1
+		}
+
+		record, err := json.Marshal(next)
+		if err != nil {
+			return Version{}, err
+		}
+
+		ok, err := r.Store.Create(ctx, versionKey(ns, key, next.Version), record)
+		if err != nil {
+			return Version{}, err
+		}
+
+		// another registration claimed the version, check against it
+		if !ok {
+			continue
+		}
+
+		// publish the latest version, which a concurrent registration may
+		// have created after this one
+		latest, err := r.Latest(ctx, ns, key)
+		if err != nil {
+			return Version{}, err
+		}
+		return next, r.Store.Put(ctx, protofileKey(ns, key), latest.Descriptor)
+	}
+
+	return Version{}, fmt.Errorf("register schema %s: version conflict after %d attempts", key, maxRegisterAttempts)
+}
+
+// ensureProtofile writes the latest version where the providers read it
+// when it is missing, an existing one is left as is
+func (r *Registry) ensureProtofile(ctx context.Context, ns, key string, versions []Version) error {
+	_, ok, err := r.Store.Get(ctx, protofileKey(ns, key))
+	if err != nil || ok {
+		return err
+	}
+
+	return r.Store.Put(ctx, protofileKey(ns, key), versions[len(versions)-1].Descriptor)
+}
+
+// Check returns the breaking changes of the file descriptor against the
+// latest version of the key, none when the key has no version yet
+func (r *Registry) Check(ctx context.Context, ns, key string, fd protoreflect.FileDescriptor) ([]Change, error) {
+	latest, err := r.Latest(ctx, ns, key)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	old, err := r.pack.Unpack(latest.Descriptor)
+	if err != nil {
+		return nil, err
+	}
+	return Breaking(Diff(old, fd)), nil
+}
+
+// Versions returns the versions of the key in order
+func (r *Registry) Versions(ctx context.Context, ns, key string) ([]Version, error) {
+	kvs, err := r.Store.List(ctx, versionsPrefix(ns, key))
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []Version
+	for k, v := range kvs {
+		// keys of longer paths sharing the prefix
+		if strings.Contains(strings.TrimPrefix(k, versionsPrefix(ns, key)), "/") {
+			continue
+		}
+
+		var version Version
+		if err := json.Unmarshal(v, &version); err != nil {
+			return nil, fmt.Errorf("decode %s: %w", k, err)
+		}
+		versions = append(versions, version)
+	}
+
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+	return versions, nil
+}
+
+// Latest returns the latest version of the key
+func (r *Registry) Latest(ctx context.Context, ns, key string) (Version, error) {
+	versions, err := r.Versions(ctx, ns, key)
+	if err != nil {
+		return Version{}, err
+	}
+
+	if len(versions) == 0 {
+		return Version{}, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	return versions[len(versions)-1], nil
+}
+
+// Get returns the version of the key, 0 is the latest one
+func (r *Registry) Get(ctx context.Context, ns, key string, version int) (Version, protoreflect.FileDescriptor, error) {
+	v, err := r.version(ctx, ns, key, version)
+	if err != nil {
+		return Version{}, nil, err
+	}
+
+	fd, err := r.pack.Unpack(v.Descriptor)
+	if err != nil {
+		return Version{}, nil, err
+	}
+	return v, fd, nil
+}
+
+func (r *Registry) version(ctx context.Context, ns, key string, version int) (Version, error) {
+	if version == 0 {
+		return r.Latest(ctx, ns, key)
+	}
+
+	b, ok, err := r.Store.Get(ctx, versionKey(ns, key, version))
+	if err != nil {
+		return Version{}, err
+	}
+
+	if !ok {
+		return Version{}, fmt.Errorf("%w: %s version %d", ErrNotFound, key, version)
+	}
+
+	var v Version
+	err = json.Unmarshal(b, &v)
+	return v, err
+}
+
+// Keys returns the keys of the namespace with versions
+func (r *Registry) Keys(ctx context.Context, ns string) ([]string, error) {
+	prefix := fmt.Sprintf("%s/%s/", SchemaPrefix, ns)
+	kvs, err := r.Store.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		seen = make(map[string]bool)
+		keys []string
+	)
+
+	for k := range kvs {
+		k = strings.TrimPrefix(k, prefix)
+		i := strings.LastIndex(k, "/")
+		if i < 0 {
+			continue
+		}
+
+		if key := k[:i]; !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
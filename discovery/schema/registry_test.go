@@ -0,0 +1,120 @@
+package schema
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry(t *testing.T) {
+	var (
+		ctx = context.Background()
+		reg = &Registry{Store: MemoryStore()}
+		v1  = compile(t, helloV1)
+	)
+
+	version, err := reg.Register(ctx, "mx", "hello.proto", v1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, version.Version)
+
+	// the same descriptor is no new version
+	version, err = reg.Register(ctx, "mx", "hello.proto", compile(t, helloV1))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, version.Version)
+
+	// compatible changes are the next version
+	src := strings.Replace(helloV1, "string locale = 3;", "string locale = 3;\n  string title = 4;", 1)
+	v2 := compile(t, src)
+	version, err = reg.Register(ctx, "mx", "hello.proto", v2)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, version.Version)
+
+	// an older instance registering v1 again, e.g. during a rolling
+	// deploy, is accepted without a new version or republishing v1
+	version, err = reg.Register(ctx, "mx", "hello.proto", compile(t, helloV1))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, version.Version)
+
+	latest, err := reg.Latest(ctx, "mx", "hello.proto")
+	assert.NoError(t, err)
+	published, _, _ := reg.Store.Get(ctx, "mx/registry/protofile/mx/hello.proto")
+	assert.Equal(t, latest.Descriptor, published)
+
+	// breaking changes are rejected
+	v3 := compile(t, strings.Replace(src, "  rpc SayGoodbye(HelloRequest) returns (HelloReply);\n", "", 1))
+	_, err = reg.Register(ctx, "mx", "hello.proto", v3)
+	var incompatible *IncompatibleError
+	if assert.True(t, errors.As(err, &incompatible)) {
+		assert.Equal(t, 2, incompatible.Version)
+		assert.Equal(t, "hello.Greeter.SayGoodbye", incompatible.Changes[0].Path)
+	}
+
+	breaking, err := reg.Check(ctx, "mx", "hello.proto", v3)
+	assert.NoError(t, err)
+	assert.Len(t, breaking, 1)
+
+	versions, err := reg.Versions(ctx, "mx", "hello.proto")
+	assert.NoError(t, err)
+	assert.Len(t, versions, 2)
+
+	version, fd, err := reg.Get(ctx, "mx", "hello.proto", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, version.Version)
+	assert.Nil(t, fd.Messages().ByName("HelloRequest").Fields().ByName("title"))
+
+	// the latest version is where the providers read it
+	_, ok, _ := reg.Store.Get(ctx, "mx/registry/protofile/mx/hello.proto")
+	assert.True(t, ok)
+
+	keys, err := reg.Keys(ctx, "mx")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"hello.proto"}, keys)
+
+	reg.AllowBreaking = true
+	version, err = reg.Register(ctx, "mx", "hello.proto", v3)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, version.Version)
+
+	_, _, err = reg.Get(ctx, "mx", "missing.proto", 0)
+	assert.True(t, errors.Is(err, ErrNotFound))
+}
+
+func TestRegistryConcurrent(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		reg   = &Registry{Store: MemoryStore()}
+		v1    = compile(t, helloV1)
+		src   = strings.Replace(helloV1, "string locale = 3;", "string locale = 3;\n  string title = 4;", 1)
+		v2    = compile(t, src)
+		wg    sync.WaitGroup
+		found = make(chan int, 20)
+	)
+
+	_, err := reg.Register(ctx, "mx", "hello.proto", v1)
+	assert.NoError(t, err)
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			version, err := reg.Register(ctx, "mx", "hello.proto", v2)
+			assert.NoError(t, err)
+			found <- version.Version
+		}()
+	}
+	wg.Wait()
+	close(found)
+
+	// every registration of v2 agrees on one version
+	for version := range found {
+		assert.Equal(t, 2, version)
+	}
+
+	versions, err := reg.Versions(ctx, "mx", "hello.proto")
+	assert.NoError(t, err)
+	assert.Len(t, versions, 2)
+}
@@ -2,6 +2,9 @@ package discovery
 
 import (
 	"context"
+	"io"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/hysios/mx/utils"
@@ -9,18 +12,75 @@ import (
 
 var Default = &ServiceDiscovery{}
 
+// ServiceDiscovery merges the registry messages of the providers and
+// dispatches them to the discovery handlers.
+//
+// Messages are kept per service ID until dispatched, a later message of
+// the ID supersedes the pending one. Before dispatch the message is checked
+// against the dispatched state of the ID, so handlers see a join, updates,
+// then a leave, and never a duplicate. The messages of a service are
+// dispatched in order, one at a time.
 type ServiceDiscovery struct {
-	Namespace        string
+	Namespace string
+	// MaxPending bounds the pending messages, the providers wait while it is
+	// reached, default is 10000
+	MaxPending int
+	// Workers is the number of services dispatched concurrently, default is 1
+	Workers int
+
 	discoveryFns     []func(desc RegistryMessage)
 	closefn          context.CancelFunc
 	providerRegistry utils.Registry[Provider]
-	queue            []RegistryMessage
+
+	l       sync.Mutex
+	cond    *sync.Cond
+	running bool
+	closed  bool
+	pending map[string]*pendingMessage
+	order   []string
+	known   map[string]ServiceDesc
+	busy    map[string]bool
+}
+
+type pendingMessage struct {
+	msg RegistryMessage
+	at  time.Time
 }
 
+// Discovery adds a handler of the messages. When the discovery already
+// runs, the joined services are replayed to the handler first, their later
+// messages wait until it has seen them. It must not be called from a
+// handler.
 func (discovery *ServiceDiscovery) Discovery(discovry func(desc RegistryMessage)) {
 	discovery.init()
 
+	discovery.l.Lock()
+	for len(discovery.busy) > 0 && !discovery.closed {
+		discovery.cond.Wait()
+	}
+
+	var replay []ServiceDesc
+	for _, desc := range discovery.known {
+		replay = append(replay, desc)
+		discovery.busy[desc.Service] = true
+	}
 	discovery.discoveryFns = append(discovery.discoveryFns, discovry)
+	discovery.l.Unlock()
+
+	if len(replay) == 0 {
+		return
+	}
+
+	for _, desc := range replay {
+		discovry(RegistryMessage{Method: ServiceJoin, Desc: desc})
+	}
+
+	discovery.l.Lock()
+	for _, desc := range replay {
+		delete(discovery.busy, desc.Service)
+	}
+	discovery.cond.Broadcast()
+	discovery.l.Unlock()
 }
 
 func (discovery *ServiceDiscovery) Close() error {
@@ -31,38 +91,75 @@ func (discovery *ServiceDiscovery) Close() error {
 	return nil
 }
 
+// Start runs the discovery until ctx is done. The discovery runs once, so
+// the users in a process share one set of provider watchers, a later Start
+// only waits for its ctx.
 func (discovery *ServiceDiscovery) Start(ctx context.Context) error {
 	discovery.init()
+
+	discovery.l.Lock()
+	if discovery.running {
+		discovery.l.Unlock()
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	discovery.running = true
+
 	ctx, cancel := context.WithCancel(ctx)
 	discovery.closefn = cancel
+	discovery.l.Unlock()
 
 	return discovery.run(ctx)
 }
 
 func (discovery *ServiceDiscovery) init() {
+	discovery.l.Lock()
+	defer discovery.l.Unlock()
+
 	if discovery.Namespace == "" {
 		discovery.Namespace = Namespace
 	}
 
-	if discovery.queue == nil {
-		discovery.queue = make([]RegistryMessage, 0)
+	if discovery.MaxPending <= 0 {
+		discovery.MaxPending = 10000
+	}
+
+	if discovery.Workers <= 0 {
+		discovery.Workers = 1
+	}
+
+	if discovery.cond == nil {
+		discovery.cond = sync.NewCond(&discovery.l)
+		discovery.pending = make(map[string]*pendingMessage)
+		discovery.known = make(map[string]ServiceDesc)
+		discovery.busy = make(map[string]bool)
 	}
 }
 
 func (discovery *ServiceDiscovery) run(ctx context.Context) error {
-	var ch = make(chan RegistryMessage, 100)
+	var wg sync.WaitGroup
 
 	discovery.providerRegistry.Range(func(name string, ctor utils.Ctor[Provider]) {
-		srvDiscover := ctor().Discover()
+		var (
+			sd = ctor().Discover()
+			ch = sd.Notify()
+		)
+
+		wg.Add(1)
 		go func() {
+			defer wg.Done()
+			// the discovers which hold resources, e.g. watchers, release them
+			if closer, ok := sd.(io.Closer); ok {
+				defer closer.Close()
+			}
+
 			for {
 				select {
-				case desc := <-srvDiscover.Notify():
-					if len(ch) < cap(ch) {
-						ch <- desc
-					} else {
-						discovery.queue = append(discovery.queue, desc)
+				case msg, ok := <-ch:
+					if !ok {
+						return
 					}
+					discovery.push(name, msg)
 				case <-ctx.Done():
 					return
 				}
@@ -70,22 +167,144 @@ func (discovery *ServiceDiscovery) run(ctx context.Context) error {
 		}()
 	})
 
+	for i := 0; i < discovery.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			discovery.work()
+		}()
+	}
+
+	<-ctx.Done()
+
+	discovery.l.Lock()
+	discovery.closed = true
+	discovery.cond.Broadcast()
+	discovery.l.Unlock()
+
+	wg.Wait()
+	return ctx.Err()
+}
+
+// push adds the message of a provider, it waits while MaxPending messages
+// of other IDs are pending
+func (discovery *ServiceDiscovery) push(provider string, msg RegistryMessage) {
+	discovery.l.Lock()
+	defer discovery.l.Unlock()
+
+	eventsTotal.WithLabelValues(provider, msg.Method).Inc()
+
+	var id = msg.Desc.ID
+	if p, ok := discovery.pending[id]; ok {
+		p.msg = msg
+		droppedTotal.WithLabelValues("superseded").Inc()
+		return
+	}
+
+	for len(discovery.pending) >= discovery.MaxPending && !discovery.closed {
+		discovery.cond.Wait()
+	}
+
+	if discovery.closed {
+		return
+	}
+
+	discovery.pending[id] = &pendingMessage{msg: msg, at: time.Now()}
+	discovery.order = append(discovery.order, id)
+	pendingEvents.Set(float64(len(discovery.pending)))
+	discovery.cond.Broadcast()
+}
+
+// work dispatches the pending messages until the discovery is closed
+func (discovery *ServiceDiscovery) work() {
 	for {
-		select {
-		case desc := <-ch:
-			discovery.dispatch(desc)
-		case <-time.After(10 * time.Second):
-			for _, desc := range discovery.queue {
-				discovery.dispatch(desc)
+		msg, fns, ok := discovery.next()
+		if !ok {
+			return
+		}
+
+		for _, fn := range fns {
+			fn(msg)
+		}
+
+		discovery.l.Lock()
+		delete(discovery.busy, msg.Desc.Service)
+		discovery.cond.Broadcast()
+		discovery.l.Unlock()
+	}
+}
+
+// next takes the oldest pending message of a service which is not being
+// dispatched, and marks the service busy
+func (discovery *ServiceDiscovery) next() (RegistryMessage, []func(RegistryMessage), bool) {
+	discovery.l.Lock()
+	defer discovery.l.Unlock()
+
+	for !discovery.closed {
+		for i := 0; i < len(discovery.order); i++ {
+			var (
+				id = discovery.order[i]
+				p  = discovery.pending[id]
+			)
+
+			if discovery.busy[p.msg.Desc.Service] {
+				continue
+			}
+
+			discovery.order = slices.Delete(discovery.order, i, i+1)
+			delete(discovery.pending, id)
+			pendingEvents.Set(float64(len(discovery.pending)))
+			discovery.cond.Broadcast()
+			i--
+
+			msg, ok := discovery.resolve(p.msg)
+			if !ok {
+				droppedTotal.WithLabelValues("duplicate").Inc()
+				continue
 			}
-		case <-ctx.Done():
-			return ctx.Err()
+
+			eventLag.Observe(time.Since(p.at).Seconds())
+			dispatchedTotal.WithLabelValues(msg.Method).Inc()
+			discovery.busy[msg.Desc.Service] = true
+			return msg, slices.Clone(discovery.discoveryFns), true
 		}
+
+		discovery.cond.Wait()
 	}
+
+	return RegistryMessage{}, nil, false
 }
 
-func (discovery *ServiceDiscovery) dispatch(desc RegistryMessage) {
-	for _, fn := range discovery.discoveryFns {
-		fn(desc)
+// resolve turns the message into the change of the dispatched state of its
+// ID, it returns false when nothing changes
+func (discovery *ServiceDiscovery) resolve(msg RegistryMessage) (RegistryMessage, bool) {
+	var (
+		id          = msg.Desc.ID
+		old, joined = discovery.known[id]
+	)
+
+	switch msg.Method {
+	case ServiceLeave:
+		if !joined {
+			return msg, false
+		}
+
+		delete(discovery.known, id)
+		return msg, true
+	case ServiceJoin, ServiceUpdate:
+		discovery.known[id] = msg.Desc
+		if !joined {
+			msg.Method = ServiceJoin
+			return msg, true
+		}
+
+		if !msg.Desc.Changed(old) {
+			return msg, false
+		}
+
+		msg.Method = ServiceUpdate
+		return msg, true
+	default:
+		return msg, true
 	}
 }
@@ -0,0 +1,265 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testProvider struct {
+	ch chan RegistryMessage
+}
+
+func (p *testProvider) Discover() ServiceDiscover { return p }
+
+func (p *testProvider) Notify() chan RegistryMessage { return p.ch }
+
+// testHandler applies the messages and checks each one changes the state
+type testHandler struct {
+	t *testing.T
+
+	l        sync.Mutex
+	state    map[string]ServiceDesc
+	inflight map[string]bool
+	count    int
+}
+
+func newTestHandler(t *testing.T) *testHandler {
+	return &testHandler{
+		t:        t,
+		state:    make(map[string]ServiceDesc),
+		inflight: make(map[string]bool),
+	}
+}
+
+func (h *testHandler) handle(msg RegistryMessage) {
+	h.l.Lock()
+	assert.False(h.t, h.inflight[msg.Desc.Service], "service %s dispatched concurrently", msg.Desc.Service)
+	h.inflight[msg.Desc.Service] = true
+	h.l.Unlock()
+
+	time.Sleep(time.Duration(rand.Intn(50)) * time.Microsecond)
+
+	h.l.Lock()
+	defer h.l.Unlock()
+	delete(h.inflight, msg.Desc.Service)
+	h.count++
+
+	old, joined := h.state[msg.Desc.ID]
+	switch msg.Method {
+	case ServiceJoin:
+		assert.False(h.t, joined, "join of joined %s", msg.Desc.ID)
+		h.state[msg.Desc.ID] = msg.Desc
+	case ServiceUpdate:
+		assert.True(h.t, joined, "update of unknown %s", msg.Desc.ID)
+		assert.True(h.t, msg.Desc.Changed(old), "update without change %s", msg.Desc.ID)
+		h.state[msg.Desc.ID] = msg.Desc
+	case ServiceLeave:
+		assert.True(h.t, joined, "leave of unknown %s", msg.Desc.ID)
+		delete(h.state, msg.Desc.ID)
+	}
+}
+
+func (h *testHandler) weights() map[string]int {
+	h.l.Lock()
+	defer h.l.Unlock()
+
+	var weights = make(map[string]int)
+	for id, desc := range h.state {
+		weights[id] = desc.Weight
+	}
+	return weights
+}
+
+func newTestDiscovery(maxPending, workers int, providers ...*testProvider) *ServiceDiscovery {
+	d := &ServiceDiscovery{MaxPending: maxPending, Workers: workers}
+	for i, p := range providers {
+		p := p
+		d.providerRegistry.Register(fmt.Sprintf("test%d", i), func() Provider { return p })
+	}
+	return d
+}
+
+func TestServiceDiscoveryBurst(t *testing.T) {
+	var (
+		providers = []*testProvider{
+			{ch: make(chan RegistryMessage, 10)},
+			{ch: make(chan RegistryMessage, 10)},
+			{ch: make(chan RegistryMessage)},
+		}
+		d      = newTestDiscovery(50, 4, providers...)
+		h      = newTestHandler(t)
+		expect = make(map[string]int)
+		l      sync.Mutex
+		wg     sync.WaitGroup
+	)
+	d.Discovery(h.handle)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Start(ctx)
+
+	for i, p := range providers {
+		wg.Add(1)
+		go func(i int, p *testProvider) {
+			defer wg.Done()
+
+			var (
+				r     = rand.New(rand.NewSource(int64(i)))
+				state = make(map[string]int)
+			)
+
+			// joins, duplicate joins, weight updates and leaves of
+			// instances spread over a few services
+			for n := 0; n < 3000; n++ {
+				var (
+					service = fmt.Sprintf("svc%d", r.Intn(20))
+					id      = fmt.Sprintf("p%d_%s_%d", i, service, r.Intn(10))
+					desc    = ServiceDesc{ID: id, Service: service, Weight: r.Intn(3)}
+					method  = ServiceJoin
+				)
+
+				switch r.Intn(4) {
+				case 0:
+					method = ServiceLeave
+					delete(state, id)
+				case 1:
+					if _, ok := state[id]; ok {
+						method = ServiceUpdate
+					}
+					state[id] = desc.Weight
+				default:
+					state[id] = desc.Weight
+				}
+
+				p.ch <- RegistryMessage{Method: method, Desc: desc}
+			}
+
+			l.Lock()
+			for id, w := range state {
+				expect[id] = w
+			}
+			l.Unlock()
+		}(i, p)
+	}
+	wg.Wait()
+
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual(expect, h.weights())
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, expect, h.weights())
+
+	d.l.Lock()
+	assert.Empty(t, d.pending)
+	assert.Len(t, d.known, len(expect))
+	d.l.Unlock()
+}
+
+func TestServiceDiscoveryBackpressure(t *testing.T) {
+	var (
+		p       = &testProvider{ch: make(chan RegistryMessage)}
+		d       = newTestDiscovery(10, 1, p)
+		release = make(chan struct{})
+		h       = newTestHandler(t)
+	)
+
+	d.Discovery(func(msg RegistryMessage) {
+		<-release
+		h.handle(msg)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Start(ctx)
+
+	var sent = make(chan int)
+	go func() {
+		for i := 0; i < 100; i++ {
+			p.ch <- RegistryMessage{Method: ServiceJoin, Desc: ServiceDesc{ID: fmt.Sprintf("hello_%d", i), Service: "hello"}}
+		}
+		close(sent)
+	}()
+
+	// the provider waits once the pending messages are full
+	time.Sleep(50 * time.Millisecond)
+	d.l.Lock()
+	assert.LessOrEqual(t, len(d.pending), 10)
+	d.l.Unlock()
+	select {
+	case <-sent:
+		t.Fatal("pending messages are not bounded")
+	default:
+	}
+
+	close(release)
+	<-sent
+	assert.Eventually(t, func() bool { return len(h.weights()) == 100 }, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestServiceDiscoveryDedup(t *testing.T) {
+	var (
+		d    = newTestDiscovery(0, 1)
+		h    = newTestHandler(t)
+		desc = ServiceDesc{ID: "hello_1", Service: "hello"}
+	)
+	d.init()
+	d.Discovery(h.handle)
+
+	// a join superseded by its leave is never dispatched
+	d.push("test", RegistryMessage{Method: ServiceJoin, Desc: desc})
+	d.push("test", RegistryMessage{Method: ServiceLeave, Desc: desc})
+	assert.Len(t, d.pending, 1)
+
+	go d.work()
+	assert.Eventually(t, func() bool {
+		d.l.Lock()
+		defer d.l.Unlock()
+		return len(d.pending) == 0 && len(d.busy) == 0
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, 0, h.count)
+
+	// joins of a joined service with the same desc are dropped, a changed
+	// desc becomes an update
+	d.push("test", RegistryMessage{Method: ServiceJoin, Desc: desc})
+	assert.Eventually(t, func() bool { return len(h.weights()) == 1 }, time.Second, time.Millisecond)
+	d.push("test", RegistryMessage{Method: ServiceJoin, Desc: desc})
+	desc.Weight = 2
+	d.push("test", RegistryMessage{Method: ServiceJoin, Desc: desc})
+	assert.Eventually(t, func() bool { return h.weights()["hello_1"] == 2 }, time.Second, time.Millisecond)
+
+	d.l.Lock()
+	d.closed = true
+	d.cond.Broadcast()
+	d.l.Unlock()
+}
+
+func TestServiceDiscoveryShared(t *testing.T) {
+	var (
+		p  = &testProvider{ch: make(chan RegistryMessage)}
+		d  = newTestDiscovery(0, 1, p)
+		h1 = newTestHandler(t)
+		h2 = newTestHandler(t)
+	)
+	d.Discovery(h1.handle)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Start(ctx)
+	// a second start shares the running discovery
+	go d.Start(ctx)
+
+	p.ch <- RegistryMessage{Method: ServiceJoin, Desc: ServiceDesc{ID: "hello_1", Service: "hello", Weight: 1}}
+	assert.Eventually(t, func() bool { return len(h1.weights()) == 1 }, time.Second, time.Millisecond)
+
+	// a later handler gets the joined services first
+	d.Discovery(h2.handle)
+	assert.Equal(t, map[string]int{"hello_1": 1}, h2.weights())
+
+	p.ch <- RegistryMessage{Method: ServiceLeave, Desc: ServiceDesc{ID: "hello_1", Service: "hello"}}
+	assert.Eventually(t, func() bool { return len(h1.weights()) == 0 && len(h2.weights()) == 0 }, time.Second, time.Millisecond)
+}
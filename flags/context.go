@@ -0,0 +1,118 @@
+package flags
+
+import "context"
+
+type (
+	setKey struct{}
+)
+
+// WithSet returns ctx that carries the evaluated flag set.
+func WithSet(ctx context.Context, set Set) context.Context {
+	return context.WithValue(ctx, setKey{}, set)
+}
+
+// FromContext returns the evaluated flag set from the context.
+func FromContext(ctx context.Context) (Set, bool) {
+	set, ok := ctx.Value(setKey{}).(Set)
+	return set, ok
+}
+
+// BoolFlag is a typed bool flag.
+type BoolFlag struct {
+	Name    string
+	Default bool
+}
+
+// Bool returns a bool flag with the default used when the flag is not
+// defined or not in the context.
+func Bool(name string, def bool) BoolFlag {
+	return BoolFlag{Name: name, Default: def}
+}
+
+// Get returns the evaluated value of the flag in the context.
+func (f BoolFlag) Get(ctx context.Context) bool {
+	set, ok := FromContext(ctx)
+	if !ok {
+		return f.Default
+	}
+
+	if _, ok := set.Value(f.Name); !ok {
+		return f.Default
+	}
+	return set.Bool(f.Name)
+}
+
+// StringFlag is a typed string flag.
+type StringFlag struct {
+	Name    string
+	Default string
+}
+
+// String returns a string flag with the default used when the flag is not
+// defined or not in the context.
+func String(name string, def string) StringFlag {
+	return StringFlag{Name: name, Default: def}
+}
+
+// Get returns the evaluated value of the flag in the context.
+func (f StringFlag) Get(ctx context.Context) string {
+	set, ok := FromContext(ctx)
+	if !ok {
+		return f.Default
+	}
+
+	if _, ok := set.Value(f.Name); !ok {
+		return f.Default
+	}
+	return set.Str(f.Name)
+}
+
+// IntFlag is a typed int flag.
+type IntFlag struct {
+	Name    string
+	Default int
+}
+
+// Int returns an int flag with the default used when the flag is not
+// defined or not in the context.
+func Int(name string, def int) IntFlag {
+	return IntFlag{Name: name, Default: def}
+}
+
+// Get returns the evaluated value of the flag in the context.
+func (f IntFlag) Get(ctx context.Context) int {
+	set, ok := FromContext(ctx)
+	if !ok {
+		return f.Default
+	}
+
+	if _, ok := set.Value(f.Name); !ok {
+		return f.Default
+	}
+	return set.Int(f.Name)
+}
+
+// FloatFlag is a typed float flag.
+type FloatFlag struct {
+	Name    string
+	Default float64
+}
+
+// Float returns a float flag with the default used when the flag is not
+// defined or not in the context.
+func Float(name string, def float64) FloatFlag {
+	return FloatFlag{Name: name, Default: def}
+}
+
+// Get returns the evaluated value of the flag in the context.
+func (f FloatFlag) Get(ctx context.Context) float64 {
+	set, ok := FromContext(ctx)
+	if !ok {
+		return f.Default
+	}
+
+	if _, ok := set.Value(f.Name); !ok {
+		return f.Default
+	}
+	return set.Float64(f.Name)
+}
@@ -0,0 +1,279 @@
+// Package flags implements feature flags stored in a config.Config.
+//
+// Flags are defined under the "flags" selector of the config, for example:
+//
+//	{
+//	    "flags": {
+//	        "new_checkout": {
+//	            "type": "bool",
+//	            "enabled": true,
+//	            "default": false,
+//	            "value": true,
+//	            "rollout": 25,
+//	            "rules": [
+//	                {"attribute": "tenant", "values": ["acme"]},
+//	                {"attribute": "header:X-Beta", "values": ["1"]}
+//	            ]
+//	        }
+//	    }
+//	}
+//
+// A disabled flag evaluates to its default. An enabled flag evaluates to the
+// value of the first matching rule, otherwise to its value if the target
+// falls into the rollout percentage, otherwise to its default.
+package flags
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/hysios/mx/config"
+)
+
+// Selector is the config selector under which flags are defined.
+const Selector = "flags"
+
+const (
+	TypeBool   = "bool"
+	TypeString = "string"
+	TypeInt    = "int"
+	TypeFloat  = "float"
+)
+
+const (
+	AttributeTenant = "tenant"
+	AttributeUser   = "user"
+	// AttributeHeader prefixes a header name, e.g. header:X-Beta
+	AttributeHeader = "header:"
+)
+
+// Flag is the definition of a feature flag.
+type Flag struct {
+	Name        string      `json:"-"`
+	Type        string      `json:"type"`
+	Description string      `json:"description,omitempty"`
+	Enabled     bool        `json:"enabled"`
+	Default     interface{} `json:"default"`
+	Value       interface{} `json:"value"`
+	// Rollout is the percentage of targets, 0 to 100, which get Value. A nil
+	// rollout serves Value to every target.
+	Rollout *float64 `json:"rollout,omitempty"`
+	Rules   []Rule   `json:"rules,omitempty"`
+}
+
+// Rule targets the flag value to matching requests.
+type Rule struct {
+	// Attribute is tenant, user or header:<Name>
+	Attribute string   `json:"attribute"`
+	Values    []string `json:"values"`
+	// Value overrides the flag value when the rule matches
+	Value interface{} `json:"value,omitempty"`
+}
+
+// Target is the subject a flag is evaluated for.
+type Target struct {
+	Tenant string
+	UserID string
+	Header http.Header
+}
+
+// Flags evaluates the flags defined in a config.
+type Flags struct {
+	cfg *config.Config
+}
+
+// New returns the flags defined in the config.
+func New(cfg *config.Config) *Flags {
+	return &Flags{cfg: cfg}
+}
+
+// Definitions returns the flag definitions of every config layer sorted by
+// name.
+func (f *Flags) Definitions() []Flag {
+	var (
+		defs  = f.cfg.MergedMap(Selector)
+		names = make([]string, 0, len(defs))
+		flags = make([]Flag, 0, len(defs))
+	)
+
+	for name := range defs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		flag, ok := f.Lookup(name)
+		if !ok {
+			continue
+		}
+		flags = append(flags, flag)
+	}
+
+	return flags
+}
+
+// Lookup returns the definition of the named flag.
+func (f *Flags) Lookup(name string) (flag Flag, ok bool) {
+	val, ok := f.cfg.Get(Selector + "." + name)
+	if !ok {
+		return flag, false
+	}
+
+	b, err := json.Marshal(val.Data())
+	if err != nil {
+		return flag, false
+	}
+
+	if err := json.Unmarshal(b, &flag); err != nil {
+		return flag, false
+	}
+
+	flag.Name = name
+	if flag.Type == "" {
+		flag.Type = TypeBool
+	}
+	return flag, true
+}
+
+// Evaluate evaluates every defined flag for the target.
+func (f *Flags) Evaluate(target Target) Set {
+	var set = make(Set)
+	for _, flag := range f.Definitions() {
+		set[flag.Name] = flag.Evaluate(target)
+	}
+
+	return set
+}
+
+// Evaluate returns the value of the flag for the target.
+func (flag *Flag) Evaluate(target Target) interface{} {
+	if !flag.Enabled {
+		return flag.Default
+	}
+
+	for _, rule := range flag.Rules {
+		if !rule.Match(target) {
+			continue
+		}
+
+		if rule.Value != nil {
+			return rule.Value
+		}
+		return flag.Value
+	}
+
+	if flag.Rollout != nil && !flag.inRollout(target) {
+		return flag.Default
+	}
+
+	return flag.Value
+}
+
+// inRollout reports whether the target falls into the rollout percentage,
+// the same target always gets the same answer for a flag. A rollout of 100
+// includes everyone and 0 no one, targets without an identity are left out
+// of the percentages in between.
+func (flag *Flag) inRollout(target Target) bool {
+	switch {
+	case *flag.Rollout >= 100:
+		return true
+	case *flag.Rollout <= 0:
+		return false
+	}
+
+	var key = target.UserID
+	if key == "" {
+		key = target.Tenant
+	}
+
+	if key == "" {
+		return false
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(flag.Name + "/" + key))
+	return float64(h.Sum32()%10000)/100 < *flag.Rollout
+}
+
+// Match reports whether the rule matches the target.
+func (rule *Rule) Match(target Target) bool {
+	var actual string
+	switch {
+	case rule.Attribute == AttributeTenant:
+		actual = target.Tenant
+	case rule.Attribute == AttributeUser:
+		actual = target.UserID
+	case strings.HasPrefix(rule.Attribute, AttributeHeader):
+		actual = target.Header.Get(strings.TrimPrefix(rule.Attribute, AttributeHeader))
+	default:
+		return false
+	}
+
+	if actual == "" {
+		return false
+	}
+
+	for _, v := range rule.Values {
+		if v == actual {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Set is the evaluated value of the flags.
+type Set map[string]interface{}
+
+// Value returns the evaluated value of the named flag.
+func (s Set) Value(name string) (*config.Value, bool) {
+	v, ok := s[name]
+	if !ok || v == nil {
+		return nil, false
+	}
+
+	return config.NewMap(map[string]interface{}{"v": v}).Get("v"), true
+}
+
+// Bool returns the bool value of the named flag.
+func (s Set) Bool(name string) bool {
+	v, ok := s.Value(name)
+	if !ok {
+		return false
+	}
+	return v.Bool()
+}
+
+// Str returns the string value of the named flag.
+func (s Set) Str(name string) string {
+	v, ok := s.Value(name)
+	if !ok {
+		return ""
+	}
+	return v.Str()
+}
+
+// Int returns the int value of the named flag.
+func (s Set) Int(name string) int {
+	v, ok := s.Value(name)
+	if !ok {
+		return 0
+	}
+	return v.Int()
+}
+
+// Float64 returns the float64 value of the named flag.
+func (s Set) Float64(name string) float64 {
+	v, ok := s.Value(name)
+	if !ok {
+		return 0
+	}
+
+	if v.IsInt() {
+		return float64(v.Int())
+	}
+	return v.Float64()
+}
@@ -0,0 +1,180 @@
+package flags
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hysios/mx/config"
+	"github.com/hysios/mx/config/provider/file"
+	"github.com/hysios/mx/server/auth"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+func testFlags() *Flags {
+	return New(config.NewConfig(map[string]interface{}{
+		"flags": map[string]interface{}{
+			"new_checkout": map[string]interface{}{
+				"enabled": true,
+				"default": false,
+				"value":   true,
+				"rollout": 0,
+				"rules": []interface{}{
+					map[string]interface{}{"attribute": "tenant", "values": []interface{}{"acme"}},
+					map[string]interface{}{"attribute": "header:X-Beta", "values": []interface{}{"1"}},
+				},
+			},
+			"theme": map[string]interface{}{
+				"type":    "string",
+				"enabled": true,
+				"default": "light",
+				"value":   "dark",
+				"rules": []interface{}{
+					map[string]interface{}{"attribute": "user", "values": []interface{}{"u1"}, "value": "blue"},
+				},
+			},
+			"page_size": map[string]interface{}{
+				"type":    "int",
+				"enabled": false,
+				"default": 20,
+				"value":   50,
+			},
+		},
+	}))
+}
+
+func TestDefinitions(t *testing.T) {
+	defs := testFlags().Definitions()
+	assert.Len(t, defs, 3)
+	assert.Equal(t, "new_checkout", defs[0].Name)
+	assert.Equal(t, TypeBool, defs[0].Type)
+	assert.Equal(t, "page_size", defs[1].Name)
+	assert.Equal(t, "theme", defs[2].Name)
+
+	_, ok := testFlags().Lookup("missing")
+	assert.False(t, ok)
+}
+
+func TestDefinitionsLayers(t *testing.T) {
+	// the service layer defines other flags than the global one
+	path := filepath.Join(t.TempDir(), "service.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`{"flags": {"theme": {"type": "string", "enabled": true, "value": "dark"}}}`), 0644))
+
+	f := New(config.NewConfig(map[string]interface{}{
+		"flags": map[string]interface{}{
+			"new_checkout": map[string]interface{}{"enabled": true, "value": true},
+		},
+	}, file.MustFileProvider(path)))
+
+	defs := f.Definitions()
+	if assert.Len(t, defs, 2) {
+		assert.Equal(t, "new_checkout", defs[0].Name)
+		assert.Equal(t, "theme", defs[1].Name)
+	}
+
+	values := f.Evaluate(Target{})
+	assert.Equal(t, true, values["new_checkout"])
+	assert.Equal(t, "dark", values["theme"])
+}
+
+func TestEvaluate(t *testing.T) {
+	f := testFlags()
+
+	set := f.Evaluate(Target{Tenant: "other", UserID: "u2"})
+	assert.False(t, set.Bool("new_checkout"))
+	assert.Equal(t, "dark", set.Str("theme"))
+	assert.Equal(t, 20, set.Int("page_size"))
+
+	set = f.Evaluate(Target{Tenant: "acme"})
+	assert.True(t, set.Bool("new_checkout"))
+
+	set = f.Evaluate(Target{Header: http.Header{"X-Beta": []string{"1"}}})
+	assert.True(t, set.Bool("new_checkout"))
+
+	set = f.Evaluate(Target{UserID: "u1"})
+	assert.Equal(t, "blue", set.Str("theme"))
+}
+
+func TestRollout(t *testing.T) {
+	var (
+		rollout = 30.0
+		flag    = Flag{Name: "rollout", Enabled: true, Default: false, Value: true, Rollout: &rollout}
+		hits    int
+	)
+
+	for i := 0; i < 1000; i++ {
+		target := Target{UserID: fmt.Sprintf("user_%d", i)}
+		v := flag.Evaluate(target)
+		// the same target always gets the same value
+		assert.Equal(t, v, flag.Evaluate(target))
+		if v == true {
+			hits++
+		}
+	}
+
+	assert.InDelta(t, 300, hits, 60)
+	// targets without an identity are never rolled out
+	assert.Equal(t, false, flag.Evaluate(Target{}))
+
+	// a full rollout includes them, an empty one excludes everyone
+	rollout = 100
+	assert.Equal(t, true, flag.Evaluate(Target{}))
+	rollout = 0
+	assert.Equal(t, false, flag.Evaluate(Target{UserID: "user_1"}))
+}
+
+func TestTypedFlags(t *testing.T) {
+	ctx := WithSet(context.Background(), Set{"on": true, "name": "x", "n": 3, "f": 1})
+
+	assert.True(t, Bool("on", false).Get(ctx))
+	assert.True(t, Bool("missing", true).Get(ctx))
+	assert.Equal(t, "x", String("name", "").Get(ctx))
+	assert.Equal(t, 3, Int("n", 0).Get(ctx))
+	assert.Equal(t, 1.0, Float("f", 0).Get(ctx))
+	assert.Equal(t, 7, Int("n", 7).Get(context.Background()))
+}
+
+func TestMiddleware(t *testing.T) {
+	var got bool
+	h := Middleware(testFlags())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = Bool("new_checkout", false).Get(r.Context())
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req = req.WithContext(auth.NewContext(req.Context(), auth.Principal{
+		Subject: "u2",
+		Claims:  map[string]interface{}{TenantClaim: "acme"},
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	assert.True(t, got)
+
+	// the headers sent by the caller are not trusted
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(TenantHeader, "acme")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	assert.False(t, got)
+
+	h = Middleware(testFlags(), WithTargetFunc(HeaderTarget))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = Bool("new_checkout", false).Get(r.Context())
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	assert.True(t, got)
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	var (
+		interceptor = UnaryServerInterceptor(testFlags())
+		ctx         = auth.NewContext(context.Background(), auth.Principal{Subject: "u1"})
+	)
+
+	resp, err := interceptor(ctx, nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return String("theme", "").Get(ctx), nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "blue", resp)
+}
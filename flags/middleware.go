@@ -0,0 +1,137 @@
+package flags
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/hysios/mx"
+	"github.com/hysios/mx/server/auth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	TenantHeader = "X-Tenant-ID"
+	UserHeader   = "X-User-ID"
+
+	// TenantClaim is the claim of the principal holding the tenant
+	TenantClaim = "tenant"
+)
+
+// TargetFunc extracts the flag target of a request from its context and
+// headers, gRPC metadata is passed as canonical headers.
+type TargetFunc func(ctx context.Context, header http.Header) Target
+
+// DefaultTarget takes the user from the subject of the authenticated
+// principal and the tenant from its tenant claim, see auth.FromContext.
+// Requests without a principal are anonymous, the interceptors must run
+// after the auth interceptor.
+func DefaultTarget(ctx context.Context, header http.Header) Target {
+	var target = Target{Header: header}
+
+	if p, ok := auth.FromContext(ctx); ok {
+		target.UserID = p.Subject
+		if tenant, ok := p.Claims[TenantClaim].(string); ok {
+			target.Tenant = tenant
+		}
+	}
+
+	return target
+}
+
+// HeaderTarget reads the tenant and user id from the X-Tenant-ID and
+// X-User-ID headers. The headers are sent by the caller, so use it only
+// behind a proxy that authenticates the request and overwrites them.
+func HeaderTarget(ctx context.Context, header http.Header) Target {
+	return Target{
+		Tenant: header.Get(TenantHeader),
+		UserID: header.Get(UserHeader),
+		Header: header,
+	}
+}
+
+type Option struct {
+	Target TargetFunc
+}
+
+type OptionFunc func(*Option)
+
+// WithTargetFunc sets the function extracting the flag target.
+func WithTargetFunc(fn TargetFunc) OptionFunc {
+	return func(o *Option) {
+		o.Target = fn
+	}
+}
+
+func newOption(optfns ...OptionFunc) *Option {
+	var opt = &Option{
+		Target: DefaultTarget,
+	}
+
+	for _, fn := range optfns {
+		fn(opt)
+	}
+
+	return opt
+}
+
+// Middleware evaluates the flags for each HTTP request and puts the flag set
+// into the request context.
+func Middleware(f *Flags, optfns ...OptionFunc) mx.Middleware {
+	var opt = newOption(optfns...)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var (
+				ctx    = r.Context()
+				target = opt.Target(ctx, r.Header)
+			)
+
+			ctx = WithSet(ctx, f.Evaluate(target))
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// UnaryServerInterceptor evaluates the flags for each unary call and puts the
+// flag set into the call context.
+func UnaryServerInterceptor(f *Flags, optfns ...OptionFunc) grpc.UnaryServerInterceptor {
+	var opt = newOption(optfns...)
+
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return handler(withSetFromMetadata(ctx, f, opt), req)
+	}
+}
+
+// StreamServerInterceptor evaluates the flags for each stream and puts the
+// flag set into the stream context.
+func StreamServerInterceptor(f *Flags, optfns ...OptionFunc) grpc.StreamServerInterceptor {
+	var opt = newOption(optfns...)
+
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, &serverStream{
+			ServerStream: ss,
+			ctx:          withSetFromMetadata(ss.Context(), f, opt),
+		})
+	}
+}
+
+func withSetFromMetadata(ctx context.Context, f *Flags, opt *Option) context.Context {
+	var header = make(http.Header)
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for k, vs := range md {
+			header[http.CanonicalHeaderKey(k)] = vs
+		}
+	}
+
+	return WithSet(ctx, f.Evaluate(opt.Target(ctx, header)))
+}
+
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
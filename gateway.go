@@ -2,21 +2,40 @@ package mx
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/pprof"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
 	"github.com/hysios/mx/discovery"
+	"github.com/hysios/mx/interceptor/validate"
 	"github.com/hysios/mx/logger"
 	"github.com/hysios/mx/provisioning"
+	"github.com/hysios/mx/telemetry"
+	"github.com/hysios/mx/tlsconfig"
 	"github.com/hysios/utils"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
+// reflectTimeout is the time to fetch a file descriptor by reflection
+const reflectTimeout = 10 * time.Second
+
+// dialTimeout bounds connecting to an instance, an unreachable one must not
+// block the discovery events
+const dialTimeout = 10 * time.Second
+
 // Gateway grpc gateway
 type Gateway struct {
 	ApiPrefix           string
@@ -24,22 +43,31 @@ type Gateway struct {
 	CustomMetricsPath   string
 	CustomDebugPath     string
 	CustomMetricsHander http.Handler
+	// DisableReflection stops fetching the file descriptors of services
+	// without one by gRPC reflection
+	DisableReflection bool
+	// TLS dials the services over TLS, default is tlsconfig.Load
+	TLS *tlsconfig.TLS
+	// DisableValidation forwards the requests of the dynamic services
+	// without checking their buf.validate constraints
+	DisableValidation bool
 	// middleware chain
-	middlewares              []Middleware                   // middleware chain
-	afterMiddlewaares        []Middleware                   // middleware chain
-	muxOptions               []runtime.ServeMuxOption       // grpc-gateway mux options
-	gwmux                    *runtime.ServeMux              // grpc-gateway mux instance
-	muxpool                  *MuxPool                       // mux pool
-	serve                    *http.Server                   // http server
-	prevAddr                 string                         // previous listen address
-	discovery                *discovery.ServiceDiscovery    // service discovery registry
-	routers                  []map[string]routeHandler      // custom routers
-	notFounder               http.Handler                   // not found handler
-	services                 utils.Map[string, Service]     // services
-	ctx                      context.Context                // context
-	closefn                  context.CancelFunc             // close function
-	clientUnaryInterceptors  []grpc.UnaryClientInterceptor  // client unary interceptors
-	clientStreamInterceptors []grpc.StreamClientInterceptor // client stream interceptors
+	middlewares              []Middleware                             // middleware chain
+	afterMiddlewaares        []Middleware                             // middleware chain
+	muxOptions               []runtime.ServeMuxOption                 // grpc-gateway mux options
+	gwmux                    *runtime.ServeMux                        // grpc-gateway mux instance
+	muxpool                  *MuxPool                                 // mux pool
+	serve                    *http.Server                             // http server
+	prevAddr                 string                                   // previous listen address
+	discovery                *discovery.ServiceDiscovery              // service discovery registry
+	routers                  []map[string]routeHandler                // custom routers
+	notFounder               http.Handler                             // not found handler
+	services                 utils.Map[string, Service]               // services
+	instances                utils.Map[string, discovery.ServiceDesc] // discovered service instances
+	ctx                      context.Context                          // context
+	closefn                  context.CancelFunc                       // close function
+	clientUnaryInterceptors  []grpc.UnaryClientInterceptor            // client unary interceptors
+	clientStreamInterceptors []grpc.StreamClientInterceptor           // client stream interceptors
 	run                      runqueue
 }
 
@@ -181,12 +209,25 @@ func (gw *Gateway) createServer(gwmux *runtime.ServeMux) *http.Server {
 	r.PathPrefix(gw.ApiPrefix).Handler(gw.gwmux)
 
 	httpServer := &http.Server{
-		Handler: r,
+		Handler: gw.traced(r),
 	}
 
 	return httpServer
 }
 
+// traced records the spans of the API requests, the trace context goes on
+// to the services in the metadata of the calls
+func (gw *Gateway) traced(h http.Handler) http.Handler {
+	var traced = telemetry.HTTPHandler(h, "mx.gateway")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, gw.ApiPrefix) {
+			traced.ServeHTTP(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
 func (gw *Gateway) buildRouter() *mux.Router {
 	r := mux.NewRouter()
 	// use middlewares
@@ -243,10 +284,24 @@ func (gw *Gateway) addMetrics() {
 
 // dial grpc server
 func (gw *Gateway) dial(addr string) (*grpc.ClientConn, error) {
-	return grpc.Dial(addr,
-		grpc.WithInsecure(),
+	var t = gw.TLS
+	if t == nil {
+		var err error
+		if t, err = tlsconfig.Load(); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(gw.ctx, dialTimeout)
+	defer cancel()
+
+	return grpc.DialContext(ctx, addr,
+		t.DialOption(),
 		grpc.WithBlock(),
+		// balances mx:/// targets over the instances of the service
+		grpc.WithDefaultServiceConfig(`{"loadBalancingConfig":[{"round_robin":{}}]}`),
 		grpc.WithChainUnaryInterceptor(gw.clientUnaryInterceptors...),
+		grpc.WithStatsHandler(telemetry.ClientHandler()),
 	)
 }
 
@@ -261,6 +316,50 @@ func (gw *Gateway) addPprof() {
 	gw.addPrefixRoute(prefix+"/pprof/profile", http.HandlerFunc(pprof.Profile))
 	gw.addPrefixRoute(prefix+"/pprof/symbol", http.HandlerFunc(pprof.Symbol))
 	gw.addPrefixRoute(prefix+"/pprof/trace", http.HandlerFunc(pprof.Trace))
+	gw.addRouter(prefix+"/services", http.HandlerFunc(gw.serveInstances))
+}
+
+type instanceInfo struct {
+	Service    string `json:"service"`
+	ID         string `json:"id"`
+	Target     string `json:"target"`
+	Version    string `json:"version,omitempty"`
+	Origin     string `json:"origin"`
+	Namespace  string `json:"namespace"`
+	Datacenter string `json:"datacenter,omitempty"`
+	Remote     bool   `json:"remote"`
+	Weight     int    `json:"weight"`
+	Draining   bool   `json:"draining"`
+}
+
+// serveInstances lists the discovered service instances with their origin
+func (gw *Gateway) serveInstances(w http.ResponseWriter, r *http.Request) {
+	var instances = make([]instanceInfo, 0)
+	gw.instances.Range(func(id string, desc discovery.ServiceDesc) bool {
+		instances = append(instances, instanceInfo{
+			Service:    desc.Service,
+			ID:         desc.ID,
+			Target:     desc.TargetURI,
+			Version:    desc.Version,
+			Origin:     desc.Origin(),
+			Namespace:  desc.Namespace,
+			Datacenter: desc.Datacenter,
+			Remote:     desc.Remote,
+			Weight:     desc.Weight,
+			Draining:   desc.Draining,
+		})
+		return true
+	})
+
+	sort.Slice(instances, func(i, j int) bool {
+		if instances[i].Service != instances[j].Service {
+			return instances[i].Service < instances[j].Service
+		}
+		return instances[i].ID < instances[j].ID
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(instances)
 }
 
 func (gw *Gateway) initGWServer() {
@@ -272,7 +371,74 @@ func (gw *Gateway) initGWServer() {
 }
 
 func (gw *Gateway) buildMuxOptions() []runtime.ServeMuxOption {
-	return gw.muxOptions
+	// the options of the gateway override the defaults
+	return append([]runtime.ServeMuxOption{
+		runtime.WithIncomingHeaderMatcher(incomingHeader),
+		runtime.WithErrorHandler(errorHandler),
+		runtime.WithMetadata(spanRoute),
+	}, gw.muxOptions...)
+}
+
+// errorHandler writes the errors of the services like the default handler,
+// the retry-after metadata of the limited calls is their Retry-After header,
+// and the field violations of the invalid requests are listed
+func errorHandler(ctx context.Context, mux *runtime.ServeMux, marshaler runtime.Marshaler, w http.ResponseWriter, r *http.Request, err error) {
+	if md, ok := runtime.ServerMetadataFromContext(ctx); ok {
+		for _, vals := range [][]string{md.TrailerMD.Get("retry-after"), md.HeaderMD.Get("retry-after")} {
+			if len(vals) > 0 {
+				w.Header().Set("Retry-After", vals[0])
+				break
+			}
+		}
+	}
+
+	if violations := validate.FieldViolations(err); len(violations) > 0 {
+		writeViolations(w, status.Convert(err), violations)
+		return
+	}
+
+	runtime.DefaultHTTPErrorHandler(ctx, mux, marshaler, w, r, err)
+}
+
+type fieldViolation struct {
+	Field       string `json:"field"`
+	Description string `json:"description"`
+}
+
+// writeViolations writes the error of an invalid request as
+//
+//	{"code": 3, "message": "invalid fields: name", "violations": [{"field": "name", "description": "..."}]}
+func writeViolations(w http.ResponseWriter, st *status.Status, violations []*errdetails.BadRequest_FieldViolation) {
+	var body = struct {
+		Code       codes.Code       `json:"code"`
+		Message    string           `json:"message"`
+		Violations []fieldViolation `json:"violations"`
+	}{Code: st.Code(), Message: st.Message()}
+
+	for _, v := range violations {
+		body.Violations = append(body.Violations, fieldViolation{Field: v.GetField(), Description: v.GetDescription()})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(runtime.HTTPStatusFromCode(st.Code()))
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// spanRoute names the span of the request by its route pattern
+func spanRoute(ctx context.Context, r *http.Request) metadata.MD {
+	if route, ok := runtime.HTTPPathPattern(ctx); ok {
+		telemetry.SetRoute(ctx, r.Method, route)
+	}
+	return nil
+}
+
+// incomingHeader forwards the API keys of the server authenticators besides
+// the default headers
+func incomingHeader(key string) (string, bool) {
+	if http.CanonicalHeaderKey(key) == "X-Api-Key" {
+		return "x-api-key", true
+	}
+	return runtime.DefaultHeaderMatcher(key)
 }
 
 func (gw *Gateway) init() {
@@ -300,61 +466,18 @@ func (gw *Gateway) init() {
 func (gw *Gateway) discoveryService(desc discovery.RegistryMessage) {
 	switch desc.Method {
 	case discovery.ServiceJoin:
-		gw.Logger.Debug("service join", zap.String("service", desc.Desc.Service), zap.String("id", desc.Desc.ID), zap.String("target", desc.Desc.TargetURI))
-		if desc.Desc.FileDescriptor == nil { // no file descriptor
-			gw.getDynamicService(desc.Desc.Service, func(dynservice DynamicService) {
-				// conn, err := grpc.Dial(desc.Desc.TargetURI, grpc.WithInsecure(), grpc.WithBlock())
-				conn, err := gw.dial(desc.Desc.TargetURI)
-				if err != nil {
-					gw.Logger.Warn("dial failed", zap.String("service", desc.Desc.Service), zap.String("id", desc.Desc.ID), zap.String("target", desc.Desc.TargetURI), zap.Error(err))
-					return
-				}
-
-				if err := dynservice.AddConn(desc.Desc.ID, conn); err != nil {
-					gw.Logger.Warn("add conn failed", zap.String("service", desc.Desc.Service), zap.String("id", desc.Desc.ID), zap.String("target", desc.Desc.TargetURI), zap.Error(err))
-				}
-			})
-		} else {
-			if _, ok := gw.GetService(desc.Desc.Service); ok {
-				gw.getDynamicService(desc.Desc.Service, func(dynservice DynamicService) {
-					// conn, err := grpc.Dial(desc.Desc.TargetURI, grpc.WithInsecure(), grpc.WithBlock())
-					conn, err := gw.dial(desc.Desc.TargetURI)
-					if err != nil {
-						gw.Logger.Warn("dial failed", zap.String("service", desc.Desc.Service), zap.String("id", desc.Desc.ID), zap.String("target", desc.Desc.TargetURI), zap.Error(err))
-						return
-					}
-
-					if err := dynservice.AddConn(desc.Desc.ID, conn); err != nil {
-						gw.Logger.Warn("add conn failed", zap.String("service", desc.Desc.Service), zap.String("id", desc.Desc.ID), zap.String("target", desc.Desc.TargetURI), zap.Error(err))
-					}
-				})
-			} else {
-				service := NewDescriptorBuilderService(desc.Desc.Service, desc.Desc.FileDescriptor)
-				service.SetLogger(gw.Logger)
-
-				if err := gw.RegisterService(service); err != nil {
-					gw.Logger.Warn("register service failed", zap.String("service", desc.Desc.Service), zap.String("id", desc.Desc.ID), zap.String("target", desc.Desc.TargetURI), zap.Error(err))
-					return
-				}
-
-				gw.getDynamicService(desc.Desc.Service, func(dynservice DynamicService) {
-					// conn, err := grpc.Dial(desc.Desc.TargetURI, grpc.WithInsecure(), grpc.WithBlock())
-					conn, err := gw.dial(desc.Desc.TargetURI)
-					if err != nil {
-						gw.Logger.Warn("dial failed", zap.String("service", desc.Desc.Service), zap.String("id", desc.Desc.ID), zap.String("target", desc.Desc.TargetURI), zap.Error(err))
-						return
-					}
-
-					if err := dynservice.AddConn(desc.Desc.ID, conn); err != nil {
-						gw.Logger.Warn("add conn failed", zap.String("service", desc.Desc.Service), zap.String("id", desc.Desc.ID), zap.String("target", desc.Desc.TargetURI), zap.Error(err))
-					}
-				})
-			}
-		}
-
-		// g.addService(desc.Service, desc.Callback, desc.Conn)
+		gw.Logger.Debug("service join", zap.String("service", desc.Desc.Service), zap.String("id", desc.Desc.ID), zap.String("target", desc.Desc.TargetURI), zap.String("origin", desc.Desc.Origin()))
+		gw.storeInstance(desc.Desc)
+		gw.joinService(desc.Desc)
+	case discovery.ServiceUpdate:
+		gw.Logger.Debug("service update", zap.String("service", desc.Desc.Service), zap.String("id", desc.Desc.ID), zap.String("target", desc.Desc.TargetURI), zap.String("origin", desc.Desc.Origin()))
+		gw.storeInstance(desc.Desc)
+		gw.updateService(desc.Desc)
 	case discovery.ServiceLeave:
 		gw.Logger.Debug("service leave", zap.String("service", desc.Desc.Service), zap.String("id", desc.Desc.ID), zap.String("target", desc.Desc.TargetURI))
+		if old, ok := gw.instances.LoadAndDelete(desc.Desc.ID); ok {
+			gatewayInstances.With(instanceLabels(old)).Dec()
+		}
 		gw.getDynamicService(desc.Desc.Service, func(dynservice DynamicService) {
 			if err := dynservice.RemoveConn(desc.Desc.ID); err != nil {
 				gw.Logger.Warn("remove conn failed", zap.String("service", desc.Desc.Service), zap.String("id", desc.Desc.ID), zap.String("target", desc.Desc.TargetURI), zap.Error(err))
@@ -363,6 +486,132 @@ func (gw *Gateway) discoveryService(desc discovery.RegistryMessage) {
 	}
 }
 
+// storeInstance records the instance for the admin output and metrics
+func (gw *Gateway) storeInstance(desc discovery.ServiceDesc) {
+	if old, ok := gw.instances.Load(desc.ID); ok {
+		gatewayInstances.With(instanceLabels(old)).Dec()
+	}
+	gw.instances.Store(desc.ID, desc)
+	gatewayInstances.With(instanceLabels(desc)).Inc()
+}
+
+// joinService adds a connection of the service instance, the service is
+// registered from its file descriptor when the gateway does not know it
+func (gw *Gateway) joinService(desc discovery.ServiceDesc) {
+	var conn *grpc.ClientConn
+	if _, ok := gw.GetService(desc.Service); !ok {
+		fd := desc.FileDescriptor
+		if fd == nil && !gw.DisableReflection {
+			// no descriptor was uploaded, ask the instance itself
+			var err error
+			if conn, err = gw.dial(desc.TargetURI); err != nil {
+				gw.Logger.Warn("dial failed", zap.String("service", desc.Service), zap.String("id", desc.ID), zap.String("target", desc.TargetURI), zap.Error(err))
+				return
+			}
+
+			if fd, err = gw.reflectFileDescriptor(conn, desc.Service); err != nil {
+				gw.Logger.Warn("reflect file descriptor failed", zap.String("service", desc.Service), zap.String("id", desc.ID), zap.String("target", desc.TargetURI), zap.Error(err))
+				conn.Close()
+				return
+			}
+		}
+
+		if fd != nil {
+			service := NewDescriptorBuilderService(desc.Service, fd)
+			service.SetLogger(gw.Logger)
+			if !gw.DisableValidation {
+				service.SetValidator(validate.Default())
+			}
+
+			if err := gw.RegisterService(service); err != nil {
+				gw.Logger.Warn("register service failed", zap.String("service", desc.Service), zap.String("id", desc.ID), zap.String("target", desc.TargetURI), zap.Error(err))
+				if conn != nil {
+					conn.Close()
+				}
+				return
+			}
+		}
+	}
+
+	gw.getDynamicService(desc.Service, func(dynservice DynamicService) {
+		if conn == nil {
+			var err error
+			if conn, err = gw.dial(desc.TargetURI); err != nil {
+				gw.Logger.Warn("dial failed", zap.String("service", desc.Service), zap.String("id", desc.ID), zap.String("target", desc.TargetURI), zap.Error(err))
+				return
+			}
+		}
+
+		if err := dynservice.AddConn(desc.ID, conn); err != nil {
+			gw.Logger.Warn("add conn failed", zap.String("service", desc.Service), zap.String("id", desc.ID), zap.String("target", desc.TargetURI), zap.Error(err))
+			return
+		}
+
+		if updatable, ok := dynservice.(UpdatableService); ok && (desc.Weight != 0 || desc.Draining || desc.Remote) {
+			_ = updatable.UpdateConn(desc.ID, nil, connOption(desc))
+		}
+	})
+}
+
+// reflectFileDescriptor fetches the file descriptor of the service with its
+// imports from the reflection service of the instance
+func (gw *Gateway) reflectFileDescriptor(conn *grpc.ClientConn, service string) (protoreflect.FileDescriptor, error) {
+	ctx, cancel := context.WithTimeout(gw.ctx, reflectTimeout)
+	defer cancel()
+
+	return discovery.ReflectFileDescriptor(ctx, conn, service)
+}
+
+// updateService applies the new desc of a joined instance in place, a
+// connection is only dialed again when the target changed, the routes are
+// rebuilt when the file descriptor changed
+func (gw *Gateway) updateService(desc discovery.ServiceDesc) {
+	service, ok := gw.GetService(desc.Service)
+	if !ok {
+		gw.joinService(desc)
+		return
+	}
+
+	updatable, ok := service.(UpdatableService)
+	if !ok {
+		// replace the instance of services without in place updates
+		gw.getDynamicService(desc.Service, func(dynservice DynamicService) {
+			_ = dynservice.RemoveConn(desc.ID)
+		})
+		gw.joinService(desc)
+		return
+	}
+
+	current, ok := updatable.Conn(desc.ID)
+	if !ok {
+		gw.joinService(desc)
+		return
+	}
+
+	if builder, ok := service.(*descriptorBuilderService); ok && desc.FileDescriptor != nil {
+		if err := builder.UpdateFileDescriptor(gw.ctx, gw.gwmux, desc.FileDescriptor); err != nil {
+			gw.Logger.Warn("update file descriptor failed", zap.String("service", desc.Service), zap.String("id", desc.ID), zap.Error(err))
+		}
+	}
+
+	var conn *grpc.ClientConn
+	if current.Target() != desc.TargetURI {
+		var err error
+		if conn, err = gw.dial(desc.TargetURI); err != nil {
+			gw.Logger.Warn("dial failed", zap.String("service", desc.Service), zap.String("id", desc.ID), zap.String("target", desc.TargetURI), zap.Error(err))
+			return
+		}
+	}
+
+	if err := updatable.UpdateConn(desc.ID, conn, connOption(desc)); err != nil {
+		gw.Logger.Warn("update conn failed", zap.String("service", desc.Service), zap.String("id", desc.ID), zap.String("target", desc.TargetURI), zap.Error(err))
+	}
+}
+
+func connOption(desc discovery.ServiceDesc) ConnOption {
+	return ConnOption{Weight: desc.Weight, Draining: desc.Draining, Remote: desc.Remote}
+}
+
 func (gw *Gateway) dynamicService(service Service, fn func(dynamicService DynamicService)) DynamicService {
 	var a any = service
 	dynservice, ok := a.(DynamicService)
@@ -0,0 +1,133 @@
+package mx
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/hysios/mx/discovery"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+)
+
+func testGateway() *Gateway {
+	gw := &Gateway{Logger: zap.NewNop()}
+	gw.ctx, gw.closefn = context.WithCancel(context.Background())
+	gw.gwmux = runtime.NewServeMux()
+	gw.run.cur = Setup
+	return gw
+}
+
+func TestJoinServiceReflection(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	srv := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(srv, health.NewServer())
+	reflection.Register(srv)
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	desc := discovery.ServiceDesc{
+		ID:        "health_1",
+		Service:   "grpc.health.v1.Health",
+		TargetURI: lis.Addr().String(),
+	}
+
+	gw := testGateway()
+	defer gw.closefn()
+	gw.joinService(desc)
+
+	service, ok := gw.GetService(desc.Service)
+	if assert.True(t, ok) {
+		_, ok = service.(UpdatableService).Conn(desc.ID)
+		assert.True(t, ok)
+	}
+
+	// without reflection the service has no descriptor to join with
+	gw = testGateway()
+	defer gw.closefn()
+	gw.DisableReflection = true
+	gw.joinService(desc)
+
+	_, ok = gw.GetService(desc.Service)
+	assert.False(t, ok)
+}
+
+func TestDialUnreachable(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := lis.Addr().String()
+	lis.Close()
+
+	// the dial of an unreachable instance ends with the gateway
+	gw := testGateway()
+	time.AfterFunc(50*time.Millisecond, gw.closefn)
+
+	start := time.Now()
+	_, err = gw.dial(addr)
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), dialTimeout)
+}
+
+func TestErrorHandlerRetryAfter(t *testing.T) {
+	ctx := runtime.NewServerMetadataContext(context.Background(), runtime.ServerMetadata{
+		TrailerMD: metadata.Pairs("retry-after", "2"),
+	})
+
+	var (
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest(http.MethodGet, "/api/hello", nil)
+	)
+	errorHandler(ctx, runtime.NewServeMux(), &runtime.JSONPb{}, w, r, status.Error(codes.ResourceExhausted, "rate limit exceeded"))
+
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "2", w.Header().Get("Retry-After"))
+}
+
+func TestErrorHandlerViolations(t *testing.T) {
+	st, err := status.New(codes.InvalidArgument, "invalid fields: name").WithDetails(&errdetails.BadRequest{
+		FieldViolations: []*errdetails.BadRequest_FieldViolation{
+			{Field: "name", Description: "value length must be at least 1 characters"},
+		},
+	})
+	require.NoError(t, err)
+
+	var (
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest(http.MethodPost, "/api/users", nil)
+	)
+	errorHandler(context.Background(), runtime.NewServeMux(), &runtime.JSONPb{}, w, r, st.Err())
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var body struct {
+		Code       int    `json:"code"`
+		Message    string `json:"message"`
+		Violations []struct {
+			Field       string `json:"field"`
+			Description string `json:"description"`
+		} `json:"violations"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, 3, body.Code)
+	if assert.Len(t, body.Violations, 1) {
+		assert.Equal(t, "name", body.Violations[0].Field)
+		assert.Equal(t, "value length must be at least 1 characters", body.Violations[0].Description)
+	}
+}
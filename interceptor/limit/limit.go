@@ -0,0 +1,306 @@
+// Package limit enforces the rate and concurrency limits of the gRPC
+// methods, configured in a config.Config under the "limits" selector:
+//
+//	{
+//	    "limits": {
+//	        "/hello.Greeter/SayHello": {"rate": 100, "burst": 20, "concurrency": 10},
+//	        "/hello.Greeter/*": {"rate": 10, "per_caller": true},
+//	        "*": {"concurrency": 1000}
+//	    }
+//	}
+//
+// A method is limited by the rule of its full name, else of its service,
+// else the "*" rule. The rules are read again every refresh interval, so
+// they are adjusted at runtime by updating the config. Calls over a limit
+// fail with RESOURCE_EXHAUSTED and the retry-after trailer in seconds.
+package limit
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hysios/mx/config"
+	"github.com/hysios/mx/server/auth"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Selector is the config selector under which the limits are defined
+const Selector = "limits"
+
+// RetryAfter is the trailer of the seconds to wait before retrying
+const RetryAfter = "retry-after"
+
+// Rule is the limit of a method
+type Rule struct {
+	// Rate is the requests per second, 0 is unlimited
+	Rate float64 `json:"rate"`
+	// Burst is the bucket size, default is the rate rounded up
+	Burst int `json:"burst"`
+	// Concurrency is the max in-flight requests, 0 is unlimited
+	Concurrency int `json:"concurrency"`
+	// PerCaller limits each caller separately, by the subject of its
+	// principal or its address
+	PerCaller bool `json:"per_caller"`
+}
+
+func (rule Rule) burst() int {
+	if rule.Burst > 0 {
+		return rule.Burst
+	}
+	return int(math.Ceil(rule.Rate))
+}
+
+type LimiterOption struct {
+	// RefreshInterval is how often the rules are read, default is 10s
+	RefreshInterval time.Duration
+	// IdleTimeout drops the state of the callers idle for so long, default
+	// is 10m
+	IdleTimeout time.Duration
+}
+
+type LimiterOptionFunc func(*LimiterOption)
+
+func WithRefreshInterval(d time.Duration) LimiterOptionFunc {
+	return func(o *LimiterOption) {
+		o.RefreshInterval = d
+	}
+}
+
+func WithIdleTimeout(d time.Duration) LimiterOptionFunc {
+	return func(o *LimiterOption) {
+		o.IdleTimeout = d
+	}
+}
+
+// Limiter enforces the limits of the config
+type Limiter struct {
+	cfg  *config.Config
+	opts LimiterOption
+
+	l       sync.Mutex
+	rules   map[string]Rule
+	loaded  time.Time
+	buckets map[bucketKey]*bucket
+	// ready is closed once the rules are loaded the first time
+	ready     chan struct{}
+	readyOnce sync.Once
+}
+
+type bucketKey struct {
+	rule   string
+	caller string
+}
+
+type bucket struct {
+	limiter  *rate.Limiter
+	inflight int
+	used     time.Time
+}
+
+// New returns the limiter of the limits in the config
+func New(cfg *config.Config, optfns ...LimiterOptionFunc) *Limiter {
+	var opts LimiterOption
+	for _, fn := range optfns {
+		fn(&opts)
+	}
+
+	if opts.RefreshInterval <= 0 {
+		opts.RefreshInterval = 10 * time.Second
+	}
+
+	if opts.IdleTimeout <= 0 {
+		opts.IdleTimeout = 10 * time.Minute
+	}
+
+	return &Limiter{
+		cfg:     cfg,
+		opts:    opts,
+		buckets: make(map[bucketKey]*bucket),
+		ready:   make(chan struct{}),
+	}
+}
+
+// Reload reads the rules of the config now, the rules of every config layer
+// are merged
+func (l *Limiter) Reload() {
+	var rules = make(map[string]Rule)
+	for key, val := range l.cfg.MergedMap(Selector) {
+		b, err := json.Marshal(val)
+		if err != nil {
+			continue
+		}
+
+		var rule Rule
+		if err := json.Unmarshal(b, &rule); err != nil {
+			continue
+		}
+		rules[key] = rule
+	}
+
+	l.l.Lock()
+	defer l.l.Unlock()
+
+	l.rules, l.loaded = rules, time.Now()
+	for key, b := range l.buckets {
+		rule, ok := l.rules[key.rule]
+		if !ok || (b.inflight == 0 && time.Since(b.used) > l.opts.IdleTimeout) {
+			delete(l.buckets, key)
+			continue
+		}
+
+		// the adjusted rates apply with a full bucket
+		if b.limiter.Limit() != rate.Limit(rule.Rate) || b.limiter.Burst() != rule.burst() {
+			b.limiter = rate.NewLimiter(rate.Limit(rule.Rate), rule.burst())
+		}
+	}
+
+	l.readyOnce.Do(func() { close(l.ready) })
+}
+
+// rule returns the rule of the method and its key
+func (l *Limiter) rule(fullMethod string) (string, Rule, bool) {
+	// the caller seeing the stale rules first reloads them, the others use
+	// the loaded ones
+	l.l.Lock()
+	stale := time.Since(l.loaded) > l.opts.RefreshInterval
+	if stale {
+		l.loaded = time.Now()
+	}
+	l.l.Unlock()
+
+	if stale {
+		l.Reload()
+	} else {
+		<-l.ready
+	}
+
+	l.l.Lock()
+	defer l.l.Unlock()
+
+	var keys = []string{fullMethod}
+	if i := strings.LastIndex(fullMethod, "/"); i > 0 {
+		keys = append(keys, fullMethod[:i+1]+"*")
+	}
+	keys = append(keys, "*")
+
+	for _, key := range keys {
+		if rule, ok := l.rules[key]; ok {
+			return key, rule, true
+		}
+	}
+	return "", Rule{}, false
+}
+
+// Acquire takes a request of the method, release must be called when it
+// is done. It fails with RESOURCE_EXHAUSTED over the limits, the seconds
+// to wait before retrying are returned as well.
+func (l *Limiter) Acquire(ctx context.Context, fullMethod string) (release func(), retryAfter time.Duration, err error) {
+	key, rule, ok := l.rule(fullMethod)
+	if !ok || (rule.Rate <= 0 && rule.Concurrency <= 0) {
+		return func() {}, 0, nil
+	}
+
+	var bk = bucketKey{rule: key}
+	if rule.PerCaller {
+		bk.caller = caller(ctx)
+	}
+
+	l.l.Lock()
+	defer l.l.Unlock()
+
+	b, ok := l.buckets[bk]
+	if !ok {
+		b = &bucket{limiter: rate.NewLimiter(rate.Limit(rule.Rate), rule.burst())}
+		l.buckets[bk] = b
+	}
+
+	var now = time.Now()
+	b.used = now
+
+	if rule.Concurrency > 0 && b.inflight >= rule.Concurrency {
+		return nil, time.Second, status.Errorf(codes.ResourceExhausted, "%s: too many concurrent requests", fullMethod)
+	}
+
+	if rule.Rate > 0 {
+		r := b.limiter.ReserveN(now, 1)
+		if delay := r.DelayFrom(now); !r.OK() || delay > 0 {
+			r.CancelAt(now)
+			if delay <= 0 || delay == rate.InfDuration {
+				delay = time.Second
+			}
+			return nil, delay, status.Errorf(codes.ResourceExhausted, "%s: rate limit exceeded", fullMethod)
+		}
+	}
+
+	b.inflight++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.l.Lock()
+			b.inflight--
+			l.l.Unlock()
+		})
+	}, 0, nil
+}
+
+// caller returns the subject of the principal of the call, or the host of
+// its address
+func caller(ctx context.Context) string {
+	if p, ok := auth.FromContext(ctx); ok && p.Subject != "" {
+		return p.Method + ":" + p.Subject
+	}
+
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		host, _, err := net.SplitHostPort(p.Addr.String())
+		if err != nil {
+			return p.Addr.String()
+		}
+		return host
+	}
+	return ""
+}
+
+func retryAfter(d time.Duration) metadata.MD {
+	return metadata.Pairs(RetryAfter, strconv.Itoa(int(math.Ceil(d.Seconds()))))
+}
+
+// UnaryServerInterceptor enforces the limits of the unary calls
+func (l *Limiter) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		release, wait, err := l.Acquire(ctx, info.FullMethod)
+		if err != nil {
+			_ = grpc.SetTrailer(ctx, retryAfter(wait))
+			return nil, err
+		}
+		defer release()
+
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor enforces the limits of the streams, a stream is
+// in flight until it ends
+func (l *Limiter) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		release, wait, err := l.Acquire(stream.Context(), info.FullMethod)
+		if err != nil {
+			stream.SetTrailer(retryAfter(wait))
+			return err
+		}
+		defer release()
+
+		return handler(srv, stream)
+	}
+}
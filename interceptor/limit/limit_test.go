@@ -0,0 +1,175 @@
+package limit
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hysios/mx/config"
+	"github.com/hysios/mx/server/auth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func limits(rules map[string]interface{}) *config.Config {
+	return config.NewConfig(map[string]interface{}{Selector: rules})
+}
+
+func TestLimiterRate(t *testing.T) {
+	l := New(limits(map[string]interface{}{
+		"/hello.Greeter/*": map[string]interface{}{"rate": 1, "burst": 2},
+	}))
+
+	for i := 0; i < 2; i++ {
+		release, _, err := l.Acquire(context.Background(), "/hello.Greeter/SayHello")
+		require.NoError(t, err)
+		release()
+	}
+
+	_, wait, err := l.Acquire(context.Background(), "/hello.Greeter/SayHello")
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.True(t, wait > 0 && wait <= time.Second, "retry after %s", wait)
+
+	// other services have no limit
+	_, _, err = l.Acquire(context.Background(), "/hello.Other/SayHello")
+	assert.NoError(t, err)
+}
+
+func TestLimiterConcurrency(t *testing.T) {
+	l := New(limits(map[string]interface{}{
+		"/hello.Greeter/SayHello": map[string]interface{}{"concurrency": 1},
+		"*":                       map[string]interface{}{"concurrency": 100},
+	}))
+
+	release, _, err := l.Acquire(context.Background(), "/hello.Greeter/SayHello")
+	require.NoError(t, err)
+
+	_, _, err = l.Acquire(context.Background(), "/hello.Greeter/SayHello")
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	// released twice counts once
+	release()
+	release()
+
+	release, _, err = l.Acquire(context.Background(), "/hello.Greeter/SayHello")
+	assert.NoError(t, err)
+	release()
+}
+
+func TestLimiterPerCaller(t *testing.T) {
+	l := New(limits(map[string]interface{}{
+		"*": map[string]interface{}{"rate": 1, "per_caller": true},
+	}))
+
+	var (
+		alice = auth.NewContext(context.Background(), auth.Principal{Subject: "alice", Method: "jwt"})
+		bob   = auth.NewContext(context.Background(), auth.Principal{Subject: "bob", Method: "jwt"})
+	)
+
+	_, _, err := l.Acquire(alice, "/hello.Greeter/SayHello")
+	assert.NoError(t, err)
+	_, _, err = l.Acquire(alice, "/hello.Greeter/SayHello")
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	_, _, err = l.Acquire(bob, "/hello.Greeter/SayHello")
+	assert.NoError(t, err)
+}
+
+func TestLimiterReload(t *testing.T) {
+	cfg := limits(map[string]interface{}{
+		"*": map[string]interface{}{"rate": 1},
+	})
+	l := New(cfg, WithRefreshInterval(time.Hour))
+
+	_, _, err := l.Acquire(context.Background(), "/hello.Greeter/SayHello")
+	assert.NoError(t, err)
+	_, _, err = l.Acquire(context.Background(), "/hello.Greeter/SayHello")
+	assert.Error(t, err)
+
+	// adjusted at runtime
+	cfg.DefaultsUpdate(map[string]interface{}{Selector: map[string]interface{}{
+		"*": map[string]interface{}{"rate": 1000, "burst": 10},
+	}})
+	l.Reload()
+
+	_, _, err = l.Acquire(context.Background(), "/hello.Greeter/SayHello")
+	assert.NoError(t, err)
+}
+
+// layer is a config layer counting its reads
+type layer struct {
+	vals  config.Map
+	reads atomic.Int32
+}
+
+func (p *layer) LookupPath(selector string) (*config.Value, bool) {
+	val := p.vals.Get(selector)
+	return val, !val.IsNil()
+}
+func (p *layer) Set(selector string, val interface{}) interface{} { return nil }
+func (p *layer) Update(vals map[string]interface{}) config.Map    { return p.vals }
+func (p *layer) Data() config.Map                                 { p.reads.Add(1); return p.vals }
+
+func TestLimiterLayers(t *testing.T) {
+	// a service layer with its own rules keeps the global "*" rule
+	service := &layer{vals: config.Map{Selector: map[string]interface{}{
+		"/hello.Greeter/Other": map[string]interface{}{"rate": 1000},
+	}}}
+	l := New(config.NewConfig(map[string]interface{}{Selector: map[string]interface{}{
+		"*": map[string]interface{}{"rate": 1},
+	}}, service), WithRefreshInterval(time.Hour))
+
+	// the callers seeing the stale rules at once reload them once
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.rule("/hello.Greeter/SayHello")
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), service.reads.Load())
+
+	_, _, err := l.Acquire(context.Background(), "/hello.Greeter/SayHello")
+	assert.NoError(t, err)
+	_, _, err = l.Acquire(context.Background(), "/hello.Greeter/SayHello")
+	assert.Error(t, err)
+}
+
+func TestInterceptorRetryAfter(t *testing.T) {
+	l := New(limits(map[string]interface{}{
+		"/grpc.health.v1.Health/Check": map[string]interface{}{"rate": 0.5},
+	}))
+
+	srv := grpc.NewServer(grpc.UnaryInterceptor(l.UnaryServerInterceptor()))
+	grpc_health_v1.RegisterHealthServer(srv, health.NewServer())
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(ln)
+	defer srv.Stop()
+
+	conn, err := grpc.Dial(ln.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	cli := grpc_health_v1.NewHealthClient(conn)
+	_, err = cli.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(t, err)
+
+	var trailer metadata.MD
+	_, err = cli.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{}, grpc.Trailer(&trailer))
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Equal(t, []string{"2"}, trailer.Get(RetryAfter))
+}
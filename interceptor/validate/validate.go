@@ -0,0 +1,151 @@
+// Package validate checks the request messages against the buf.validate
+// constraints of their descriptors:
+//
+//	import "buf/validate/validate.proto";
+//
+//	message CreateUserRequest {
+//	    string name = 1 [(buf.validate.field).string.min_len = 1];
+//	    string email = 2 [(buf.validate.field).string.email = true];
+//	}
+//
+// Invalid messages fail with INVALID_ARGUMENT and a google.rpc.BadRequest
+// detail of the field violations. The constraints are read from the
+// descriptors, so the dynamic messages of the gateway are validated as well.
+package validate
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/bufbuild/protovalidate-go"
+	"github.com/hysios/mx/logger"
+	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// Validator validates the messages by their constraints
+type Validator struct {
+	v *protovalidate.Validator
+}
+
+// New returns a validator, the options are of protovalidate
+func New(opts ...protovalidate.ValidatorOption) (*Validator, error) {
+	v, err := protovalidate.New(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Validator{v: v}, nil
+}
+
+var (
+	defaultOnce      sync.Once
+	defaultValidator *Validator
+)
+
+// Default returns the shared validator, nil when it fails to build
+func Default() *Validator {
+	defaultOnce.Do(func() {
+		v, err := New()
+		if err != nil {
+			logger.Logger.Warn("build validator failed", zap.Error(err))
+			return
+		}
+		defaultValidator = v
+	})
+
+	return defaultValidator
+}
+
+// Validate checks msg against its constraints, a nil validator and the
+// values other than messages pass
+func (v *Validator) Validate(msg interface{}) error {
+	m, ok := msg.(proto.Message)
+	if v == nil || !ok {
+		return nil
+	}
+
+	err := v.v.Validate(m)
+	if err == nil {
+		return nil
+	}
+
+	var verr *protovalidate.ValidationError
+	if errors.As(err, &verr) {
+		return BadRequest(verr)
+	}
+	// the constraints themselves are broken
+	return status.Errorf(codes.Internal, "validate %s: %v", m.ProtoReflect().Descriptor().FullName(), err)
+}
+
+// BadRequest returns the INVALID_ARGUMENT status of the violations
+func BadRequest(verr *protovalidate.ValidationError) error {
+	var (
+		br     errdetails.BadRequest
+		fields []string
+	)
+
+	for _, v := range verr.Violations {
+		br.FieldViolations = append(br.FieldViolations, &errdetails.BadRequest_FieldViolation{
+			Field:       v.GetFieldPath(),
+			Description: v.GetMessage(),
+		})
+		fields = append(fields, v.GetFieldPath())
+	}
+
+	st := status.New(codes.InvalidArgument, "invalid fields: "+strings.Join(fields, ", "))
+	if ds, err := st.WithDetails(&br); err == nil {
+		st = ds
+	}
+	return st.Err()
+}
+
+// FieldViolations returns the field violations of the BadRequest detail of
+// err, nil when it has none
+func FieldViolations(err error) []*errdetails.BadRequest_FieldViolation {
+	st, ok := status.FromError(err)
+	if !ok {
+		return nil
+	}
+
+	for _, detail := range st.Details() {
+		if br, ok := detail.(*errdetails.BadRequest); ok {
+			return br.GetFieldViolations()
+		}
+	}
+	return nil
+}
+
+// UnaryServerInterceptor validates the requests of the unary calls
+func (v *Validator) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := v.Validate(req); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor validates every message received by the streams
+func (v *Validator) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, &validateStream{ServerStream: stream, v: v})
+	}
+}
+
+type validateStream struct {
+	grpc.ServerStream
+	v *Validator
+}
+
+func (stream *validateStream) RecvMsg(m interface{}) error {
+	if err := stream.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return stream.v.Validate(m)
+}
@@ -0,0 +1,111 @@
+package validate
+
+import (
+	"context"
+	"testing"
+
+	_ "buf.build/gen/go/bufbuild/protovalidate/protocolbuffers/go/buf/validate"
+	"github.com/bufbuild/protocompile"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const userProto = `syntax = "proto3";
+package test;
+
+import "buf/validate/validate.proto";
+
+message CreateUserRequest {
+  string name = 1 [(buf.validate.field).string.min_len = 1];
+  string email = 2 [(buf.validate.field).string.email = true];
+  Address address = 3;
+}
+
+message Address {
+  string city = 1 [(buf.validate.field).string.min_len = 1];
+}
+`
+
+// request returns a dynamic CreateUserRequest like the ones of the gateway
+func request(t *testing.T) (*dynamicpb.Message, protoreflect.MessageDescriptor) {
+	compiler := protocompile.Compiler{
+		Resolver: protocompile.CompositeResolver{
+			&protocompile.SourceResolver{
+				Accessor: protocompile.SourceAccessorFromMap(map[string]string{"user.proto": userProto}),
+			},
+			protocompile.ResolverFunc(func(path string) (protocompile.SearchResult, error) {
+				fd, err := protoregistry.GlobalFiles.FindFileByPath(path)
+				return protocompile.SearchResult{Desc: fd}, err
+			}),
+		},
+	}
+
+	files, err := compiler.Compile(context.Background(), "user.proto")
+	require.NoError(t, err)
+
+	md := files[0].Messages().ByName("CreateUserRequest")
+	return dynamicpb.NewMessage(md), md
+}
+
+func set(msg protoreflect.Message, name, val string) {
+	msg.Set(msg.Descriptor().Fields().ByName(protoreflect.Name(name)), protoreflect.ValueOfString(val))
+}
+
+func TestValidate(t *testing.T) {
+	v, err := New()
+	require.NoError(t, err)
+
+	msg, md := request(t)
+	set(msg, "email", "alice")
+	address := msg.Mutable(md.Fields().ByName("address")).Message()
+	set(address, "city", "")
+
+	err = v.Validate(msg)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	var fields []string
+	for _, fv := range FieldViolations(err) {
+		fields = append(fields, fv.GetField())
+		assert.NotEmpty(t, fv.GetDescription())
+	}
+	assert.ElementsMatch(t, []string{"name", "email", "address.city"}, fields)
+
+	set(msg, "name", "alice")
+	set(msg, "email", "alice@example.com")
+	set(address, "city", "Berlin")
+	assert.NoError(t, v.Validate(msg))
+
+	// only the messages are validated
+	assert.NoError(t, v.Validate("alice"))
+	assert.NoError(t, (*Validator)(nil).Validate(msg))
+	assert.Nil(t, FieldViolations(status.Error(codes.InvalidArgument, "invalid")))
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	var (
+		called bool
+		msg, _ = request(t)
+		info   = &grpc.UnaryServerInfo{FullMethod: "/test.Users/Create"}
+	)
+
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		called = true
+		return req, nil
+	}
+
+	_, err := Default().UnaryServerInterceptor()(context.Background(), msg, info, handler)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.False(t, called)
+
+	set(msg, "name", "alice")
+	set(msg, "email", "alice@example.com")
+	_, err = Default().UnaryServerInterceptor()(context.Background(), msg, info, handler)
+	assert.NoError(t, err)
+	assert.True(t, called)
+}
@@ -0,0 +1,24 @@
+package mx
+
+import (
+	"strconv"
+
+	"github.com/hysios/mx/discovery"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var gatewayInstances = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "mx",
+	Subsystem: "gateway",
+	Name:      "instances",
+	Help:      "Service instances known to the gateway by origin.",
+}, []string{"service", "origin", "remote"})
+
+func instanceLabels(desc discovery.ServiceDesc) prometheus.Labels {
+	return prometheus.Labels{
+		"service": desc.Service,
+		"origin":  desc.Origin(),
+		"remote":  strconv.FormatBool(desc.Remote),
+	}
+}
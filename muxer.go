@@ -30,6 +30,19 @@ type Muxer struct {
 type abstractConn struct {
 	ServiceID string
 	Conn      grpc.ClientConnInterface
+	// Weight is the share of the calls, values below 1 count as 1
+	Weight int
+	// Draining conns get no calls while there are other conns
+	Draining bool
+	// Remote conns get no calls while there are local conns
+	Remote bool
+}
+
+func (c abstractConn) weight() int {
+	if c.Weight < 1 {
+		return 1
+	}
+	return c.Weight
 }
 
 // Add is used to add a new connection to the muxer.
@@ -68,6 +81,54 @@ func (m *Muxer) Remove(id string) grpc.ClientConnInterface {
 	return conn
 }
 
+// Replace replaces the connection of the service id, keeping its weight
+// and draining flag, and returns the old one.
+func (m *Muxer) Replace(id string, conn grpc.ClientConnInterface) (grpc.ClientConnInterface, bool) {
+	m.connLock.Lock()
+	defer m.connLock.Unlock()
+
+	for i, c := range m.conns {
+		if c.ServiceID == id {
+			m.conns[i].Conn = conn
+			return c.Conn, true
+		}
+	}
+
+	return nil, false
+}
+
+// SetWeight sets the weight and draining flag of the service id.
+func (m *Muxer) SetWeight(id string, weight int, draining bool) bool {
+	m.connLock.Lock()
+	defer m.connLock.Unlock()
+
+	for i, c := range m.conns {
+		if c.ServiceID == id {
+			m.conns[i].Weight = weight
+			m.conns[i].Draining = draining
+			return true
+		}
+	}
+
+	return false
+}
+
+// SetRemote sets whether the service id is a remote one, e.g. of another
+// datacenter, which only gets calls when no local conn is left.
+func (m *Muxer) SetRemote(id string, remote bool) bool {
+	m.connLock.Lock()
+	defer m.connLock.Unlock()
+
+	for i, c := range m.conns {
+		if c.ServiceID == id {
+			m.conns[i].Remote = remote
+			return true
+		}
+	}
+
+	return false
+}
+
 // Invoke performs a unary RPC and returns after the response is received
 // into reply.
 func (m *Muxer) Invoke(ctx context.Context, method string, args interface{}, reply interface{}, opts ...grpc.CallOption) error {
@@ -86,21 +147,86 @@ func (m *Muxer) NewStream(ctx context.Context, desc *grpc.StreamDesc, method str
 	return
 }
 
+// do calls fn with the picked conn, outside the lock so the updates of
+// the conns do not wait for the calls in flight
 func (m *Muxer) do(fn func(abstractConn) error) error {
+	c, ok, err := m.pick()
+	if err != nil || !ok {
+		return err
+	}
+
+	return fn(c)
+}
+
+// pick returns the conn of the next call
+func (m *Muxer) pick() (abstractConn, bool, error) {
 	m.connLock.RLock()
 	defer m.connLock.RUnlock()
 
 	if len(m.conns) == 0 {
-		return errors.New("no grpc client connection")
+		return abstractConn{}, false, errors.New("no grpc client connection")
 	}
 
+	var (
+		conns = m.candidates()
+		total int
+	)
+
+	for _, c := range conns {
+		total += c.weight()
+	}
+
+	var n int
 	switch m.Streagy {
 	case RoundRobin:
-		idx := int(m.lastIdx.Add(1)) % len(m.conns)
-		return fn(m.conns[idx])
+		n = int(uint32(m.lastIdx.Add(1))) % total
 	case Random:
-		idx := rand.Intn(len(m.conns))
-		return fn(m.conns[idx])
+		n = rand.Intn(total)
+	default:
+		return abstractConn{}, false, nil
+	}
+
+	for _, c := range conns {
+		if n -= c.weight(); n < 0 {
+			return c, true, nil
+		}
+	}
+	return abstractConn{}, false, nil
+}
+
+// candidates returns the conns to call, the lock must be held. Local conns
+// are preferred over remote ones, and draining conns are only called when
+// nothing else is left.
+func (m *Muxer) candidates() []abstractConn {
+	var preferred = true
+	for _, c := range m.conns {
+		if c.Draining || c.Remote {
+			preferred = false
+			break
+		}
+	}
+
+	if preferred {
+		return m.conns
+	}
+
+	// local, remote, local draining, remote draining
+	var tiers [4][]abstractConn
+	for _, c := range m.conns {
+		var tier int
+		if c.Remote {
+			tier++
+		}
+		if c.Draining {
+			tier += 2
+		}
+		tiers[tier] = append(tiers[tier], c)
+	}
+
+	for _, conns := range tiers {
+		if len(conns) > 0 {
+			return conns
+		}
 	}
-	return nil
+	return m.conns
 }
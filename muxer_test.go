@@ -0,0 +1,182 @@
+package mx
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+type countConn struct {
+	calls int
+}
+
+func (c *countConn) Invoke(ctx context.Context, method string, args, reply interface{}, opts ...grpc.CallOption) error {
+	c.calls++
+	return nil
+}
+
+func (c *countConn) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	c.calls++
+	return nil, nil
+}
+
+func TestMuxerWeight(t *testing.T) {
+	var (
+		m    Muxer
+		a, b = &countConn{}, &countConn{}
+	)
+	m.Add("a", a)
+	m.Add("b", b)
+	assert.True(t, m.SetWeight("b", 3, false))
+	assert.False(t, m.SetWeight("c", 3, false))
+
+	for i := 0; i < 400; i++ {
+		assert.NoError(t, m.Invoke(context.Background(), "/hello.Greeter/SayHello", nil, nil))
+	}
+	assert.Equal(t, 100, a.calls)
+	assert.Equal(t, 300, b.calls)
+}
+
+func TestMuxerDraining(t *testing.T) {
+	var (
+		m    Muxer
+		a, b = &countConn{}, &countConn{}
+	)
+	m.Add("a", a)
+	m.Add("b", b)
+	m.SetWeight("a", 0, true)
+
+	for i := 0; i < 10; i++ {
+		m.Invoke(context.Background(), "/hello.Greeter/SayHello", nil, nil)
+	}
+	assert.Equal(t, 0, a.calls)
+	assert.Equal(t, 10, b.calls)
+
+	// the draining conn is used when it is the last one
+	m.Remove("b")
+	m.Invoke(context.Background(), "/hello.Greeter/SayHello", nil, nil)
+	assert.Equal(t, 1, a.calls)
+}
+
+func TestMuxerReplace(t *testing.T) {
+	var (
+		m    Muxer
+		a, b = &countConn{}, &countConn{}
+	)
+	m.Add("a", a)
+	m.SetWeight("a", 2, false)
+
+	old, ok := m.Replace("a", b)
+	assert.True(t, ok)
+	assert.Equal(t, a, old)
+
+	m.Invoke(context.Background(), "/hello.Greeter/SayHello", nil, nil)
+	assert.Equal(t, 0, a.calls)
+	assert.Equal(t, 1, b.calls)
+	assert.Equal(t, 2, m.conns[0].Weight)
+
+	_, ok = m.Replace("c", b)
+	assert.False(t, ok)
+}
+
+func TestDynamicServiceUpdateConn(t *testing.T) {
+	connCloseDelay = 0
+	defer func() { connCloseDelay = 30 * time.Second }()
+
+	dial := func(target string) *grpc.ClientConn {
+		conn, err := grpc.Dial(target, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		assert.NoError(t, err)
+		return conn
+	}
+
+	var (
+		svc UpdatableService = NewDescriptorBuilderService("hello.Greeter", nil)
+		old                  = dial("127.0.0.1:9000")
+	)
+	assert.NoError(t, svc.AddConn("hello_1", old))
+
+	// only the routing option changes
+	assert.NoError(t, svc.UpdateConn("hello_1", nil, ConnOption{Weight: 2, Draining: true}))
+	conn, ok := svc.Conn("hello_1")
+	assert.True(t, ok)
+	assert.Equal(t, old, conn)
+
+	// a new target replaces the connection and closes the old one
+	assert.NoError(t, svc.UpdateConn("hello_1", dial("127.0.0.1:9001"), ConnOption{Weight: 2}))
+	conn, _ = svc.Conn("hello_1")
+	assert.Equal(t, "127.0.0.1:9001", conn.Target())
+	assert.Eventually(t, func() bool {
+		return old.GetState().String() == "SHUTDOWN"
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Error(t, svc.UpdateConn("hello_2", nil, ConnOption{}))
+	assert.NoError(t, svc.RemoveConn("hello_1"))
+}
+
+func TestMuxerRemote(t *testing.T) {
+	var (
+		m             Muxer
+		local, remote = &countConn{}, &countConn{}
+	)
+	m.Add("local", local)
+	m.Add("remote", remote)
+	assert.True(t, m.SetRemote("remote", true))
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, m.Invoke(context.Background(), "/hello.Greeter/SayHello", nil, nil))
+	}
+	assert.Equal(t, 10, local.calls)
+	assert.Equal(t, 0, remote.calls)
+
+	// fails over when the local instances are gone or draining
+	m.SetWeight("local", 0, true)
+	assert.NoError(t, m.Invoke(context.Background(), "/hello.Greeter/SayHello", nil, nil))
+	assert.Equal(t, 1, remote.calls)
+
+	m.Remove("local")
+	assert.NoError(t, m.Invoke(context.Background(), "/hello.Greeter/SayHello", nil, nil))
+	assert.Equal(t, 2, remote.calls)
+}
+
+// blockConn blocks the calls until release is closed
+type blockConn struct {
+	countConn
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (c *blockConn) Invoke(ctx context.Context, method string, args, reply interface{}, opts ...grpc.CallOption) error {
+	close(c.entered)
+	<-c.release
+	return nil
+}
+
+func TestMuxerUpdateInFlight(t *testing.T) {
+	var (
+		m    Muxer
+		conn = &blockConn{entered: make(chan struct{}), release: make(chan struct{})}
+		done = make(chan error, 1)
+	)
+	m.Add("a", conn)
+
+	go func() { done <- m.Invoke(context.Background(), "/hello.Greeter/SayHello", nil, nil) }()
+	<-conn.entered
+
+	// the drain does not wait for the call in flight
+	updated := make(chan bool, 1)
+	go func() { updated <- m.SetWeight("a", 0, true) }()
+
+	select {
+	case ok := <-updated:
+		assert.True(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("update blocked by the call in flight")
+	}
+
+	close(conn.release)
+	assert.NoError(t, <-done)
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 
 	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/hysios/mx/tlsconfig"
 	"google.golang.org/grpc"
 )
 
@@ -37,7 +38,12 @@ const (
 
 func WithConnString(connString string) RegisterOptFunc {
 	return func(o *RegisterOption) (err error) {
-		o.Conn, err = grpc.Dial(connString, grpc.WithInsecure())
+		opt, err := tlsconfig.DialOption()
+		if err != nil {
+			return err
+		}
+
+		o.Conn, err = grpc.Dial(connString, opt)
 		if err != nil {
 			return err
 		}
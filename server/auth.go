@@ -0,0 +1,165 @@
+package server
+
+import (
+	"context"
+	"strings"
+
+	grpc_ctxtags "github.com/grpc-ecosystem/go-grpc-middleware/tags"
+	"github.com/hysios/mx/server/auth"
+	authpb "github.com/hysios/mx/server/auth/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// publicServices are served without authentication, their callers are the
+// health checkers and the gateways
+var publicServices = []string{
+	"/grpc.health.v1.Health/",
+	"/grpc.reflection.",
+}
+
+func (s *Server) unaryAuth(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := s.authenticate(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (s *Server) streamAuth(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := s.authenticate(stream.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authStream{ServerStream: stream, ctx: ctx})
+}
+
+func (s *Server) unaryLimit(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if s.opts.Limiter == nil {
+		return handler(ctx, req)
+	}
+	return s.opts.Limiter.UnaryServerInterceptor()(ctx, req, info, handler)
+}
+
+func (s *Server) streamLimit(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if s.opts.Limiter == nil {
+		return handler(srv, stream)
+	}
+	return s.opts.Limiter.StreamServerInterceptor()(srv, stream, info, handler)
+}
+
+func (s *Server) unaryValidate(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if s.opts.DisableValidation || s.opts.Validator == nil {
+		return handler(ctx, req)
+	}
+	return s.opts.Validator.UnaryServerInterceptor()(ctx, req, info, handler)
+}
+
+func (s *Server) streamValidate(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if s.opts.DisableValidation || s.opts.Validator == nil {
+		return handler(srv, stream)
+	}
+	return s.opts.Validator.StreamServerInterceptor()(srv, stream, info, handler)
+}
+
+type authStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (stream *authStream) Context() context.Context {
+	return stream.ctx
+}
+
+func (s *Server) authenticate(ctx context.Context, fullMethod string) (context.Context, error) {
+	if s.opts.AuthFunc == nil || s.skipsAuth(fullMethod) {
+		return ctx, nil
+	}
+
+	ctx, err := s.opts.AuthFunc(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if p, ok := auth.FromContext(ctx); ok {
+		grpc_ctxtags.Extract(ctx).Set("auth.sub", p.Subject).Set("auth.method", p.Method)
+	}
+	return ctx, nil
+}
+
+// skipsAuth reports whether the method is public or has the
+// (mx.auth.skip_auth) option
+func (s *Server) skipsAuth(fullMethod string) bool {
+	if skip, ok := s.skipAuth.Load(fullMethod); ok {
+		return skip.(bool)
+	}
+
+	var skip bool
+	for _, prefix := range publicServices {
+		if strings.HasPrefix(fullMethod, prefix) {
+			skip = true
+		}
+	}
+
+	if !skip {
+		if md := s.methodDescriptor(fullMethod); md != nil {
+			skip = skipAuthOption(md)
+		}
+	}
+
+	s.skipAuth.Store(fullMethod, skip)
+	return skip
+}
+
+// methodDescriptor returns the descriptor of /pkg.Service/Method from the
+// file descriptors of the services, or the global registry
+func (s *Server) methodDescriptor(fullMethod string) protoreflect.MethodDescriptor {
+	service, method, ok := strings.Cut(strings.TrimPrefix(fullMethod, "/"), "/")
+	if !ok {
+		return nil
+	}
+
+	s.l.Lock()
+	var descs = append([]serviceDesc(nil), s.serviceDescs...)
+	s.l.Unlock()
+
+	for _, desc := range descs {
+		if desc.desc.ServiceName != service || desc.filedescript == nil {
+			continue
+		}
+
+		if sd := desc.filedescript.Services().ByName(protoreflect.FullName(service).Name()); sd != nil {
+			return sd.Methods().ByName(protoreflect.Name(method))
+		}
+	}
+
+	d, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(service))
+	if err != nil {
+		return nil
+	}
+
+	if sd, ok := d.(protoreflect.ServiceDescriptor); ok {
+		return sd.Methods().ByName(protoreflect.Name(method))
+	}
+	return nil
+}
+
+// skipAuthOption reads the option of the method, the options of the
+// descriptors built at runtime are dynamic messages, they are decoded again
+func skipAuthOption(md protoreflect.MethodDescriptor) bool {
+	b, err := proto.Marshal(md.Options())
+	if err != nil {
+		return false
+	}
+
+	var opts descriptorpb.MethodOptions
+	if err := (proto.UnmarshalOptions{Resolver: protoregistry.GlobalTypes}).Unmarshal(b, &opts); err != nil {
+		return false
+	}
+
+	skip, _ := proto.GetExtension(&opts, authpb.E_SkipAuth).(bool)
+	return skip
+}
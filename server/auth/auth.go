@@ -0,0 +1,129 @@
+// Package auth provides the authenticators of the gRPC servers, see
+// server.WithAuthFunc. An authenticator returns the context carrying the
+// Principal of the caller, or an Unauthenticated status.
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+
+	grpc_auth "github.com/grpc-ecosystem/go-grpc-middleware/auth"
+	"github.com/hysios/mx/config"
+	"github.com/hysios/mx/tlsconfig"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// APIKeyHeader is the metadata of the API keys
+const APIKeyHeader = "x-api-key"
+
+// ErrNoCredentials is returned by the authenticators when the call has
+// none of their credentials, Any tries the next one then
+var ErrNoCredentials = status.Error(codes.Unauthenticated, "no credentials")
+
+// Principal is the authenticated caller
+type Principal struct {
+	// Subject is e.g. the sub claim, the name of the API key or the mapped
+	// certificate subject
+	Subject string
+	// Method is jwt, apikey or mtls
+	Method string
+	// Claims are the claims of the JWT
+	Claims map[string]interface{}
+}
+
+type principalKey struct{}
+
+// NewContext returns the context carrying the principal
+func NewContext(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// FromContext returns the principal of the call
+func FromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+// Any authenticates with the first authenticator finding its credentials
+// in the call
+func Any(fns ...grpc_auth.AuthFunc) grpc_auth.AuthFunc {
+	return func(ctx context.Context) (context.Context, error) {
+		for _, fn := range fns {
+			ctx, err := fn(ctx)
+			if errors.Is(err, ErrNoCredentials) {
+				continue
+			}
+			return ctx, err
+		}
+		return nil, ErrNoCredentials
+	}
+}
+
+// APIKeys authenticates the x-api-key metadata with the keys, mapped to the
+// subjects of their principal
+func APIKeys(keys map[string]string) grpc_auth.AuthFunc {
+	return func(ctx context.Context) (context.Context, error) {
+		return apiKey(ctx, keys)
+	}
+}
+
+// ConfigAPIKeys authenticates with the keys of the config map at the
+// selector, key to subject, merged over every config layer. The changes of
+// the config apply to the next calls
+func ConfigAPIKeys(cfg *config.Config, selector string) grpc_auth.AuthFunc {
+	return func(ctx context.Context) (context.Context, error) {
+		var keys = make(map[string]string)
+		for key, subject := range cfg.MergedMap(selector) {
+			if s, ok := subject.(string); ok {
+				keys[key] = s
+			}
+		}
+		return apiKey(ctx, keys)
+	}
+}
+
+func apiKey(ctx context.Context, keys map[string]string) (context.Context, error) {
+	var key = metadata.ValueFromIncomingContext(ctx, APIKeyHeader)
+	if len(key) == 0 || key[0] == "" {
+		return nil, ErrNoCredentials
+	}
+
+	for k, subject := range keys {
+		if subtle.ConstantTimeCompare([]byte(k), []byte(key[0])) == 1 {
+			return NewContext(ctx, Principal{Subject: subject, Method: "apikey"}), nil
+		}
+	}
+	return nil, status.Error(codes.Unauthenticated, "invalid api key")
+}
+
+// MTLS authenticates the verified client certificate of the call. The
+// subjects map its common name or URI SANs, e.g. SPIFFE IDs, to the
+// principal; every verified certificate is accepted with its common name
+// when subjects is empty.
+func MTLS(subjects map[string]string) grpc_auth.AuthFunc {
+	return func(ctx context.Context) (context.Context, error) {
+		id, ok := tlsconfig.PeerIdentity(ctx)
+		if !ok {
+			return nil, ErrNoCredentials
+		}
+
+		if len(subjects) == 0 {
+			return NewContext(ctx, Principal{Subject: id.CommonName, Method: "mtls"}), nil
+		}
+
+		var names = []string{id.CommonName}
+		for _, u := range id.URIs {
+			names = append(names, u.String())
+		}
+
+		for _, name := range names {
+			if subject, ok := subjects[name]; ok {
+				return NewContext(ctx, Principal{Subject: subject, Method: "mtls"}), nil
+			}
+		}
+		return nil, status.Errorf(codes.PermissionDenied, "certificate %s is not allowed", id.CommonName)
+	}
+}
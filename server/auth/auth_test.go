@@ -0,0 +1,289 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/hysios/mx/config"
+	"github.com/hysios/mx/config/provider/file"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func bearer(token string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+token))
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+
+	s, err := token.SignedString(key)
+	require.NoError(t, err)
+	return s
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func claims(sub string) jwt.MapClaims {
+	return jwt.MapClaims{"sub": sub, "iss": "mx", "exp": time.Now().Add(time.Hour).Unix()}
+}
+
+func code(err error) codes.Code {
+	return status.Code(err)
+}
+
+func TestJWTSecret(t *testing.T) {
+	secret := []byte("s3cret")
+	fn, err := JWT(WithSecret(secret), WithIssuer("mx"))
+	require.NoError(t, err)
+
+	ctx, err := fn(bearer(sign(t, jwt.SigningMethodHS256, "", secret, claims("alice"))))
+	if assert.NoError(t, err) {
+		p, ok := FromContext(ctx)
+		assert.True(t, ok)
+		assert.Equal(t, "alice", p.Subject)
+		assert.Equal(t, "jwt", p.Method)
+		assert.Equal(t, "mx", p.Claims["iss"])
+	}
+
+	_, err = fn(bearer(sign(t, jwt.SigningMethodHS256, "", []byte("other"), claims("alice"))))
+	assert.Equal(t, codes.Unauthenticated, code(err))
+
+	// the issuer is required
+	_, err = fn(bearer(sign(t, jwt.SigningMethodHS256, "", secret, jwt.MapClaims{"sub": "alice", "iss": "other"})))
+	assert.Equal(t, codes.Unauthenticated, code(err))
+
+	expired := claims("alice")
+	expired["exp"] = time.Now().Add(-time.Minute).Unix()
+	_, err = fn(bearer(sign(t, jwt.SigningMethodHS256, "", secret, expired)))
+	assert.Equal(t, codes.Unauthenticated, code(err))
+
+	_, err = fn(context.Background())
+	assert.ErrorIs(t, err, ErrNoCredentials)
+}
+
+func TestJWTKeySet(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa1", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64([]byte{1, 0, 1})},
+		{"kty": "EC", "kid": "ec1", "crv": "P-256", "x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+		// keys of unsupported types are skipped
+		{"kty": "OKP", "kid": "ed1", "crv": "Ed25519", "x": b64(make([]byte, 32))},
+	}})
+
+	// from a file
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, os.WriteFile(path, jwks, 0600))
+
+	fn, err := JWT(WithJWKSFile(path))
+	require.NoError(t, err)
+
+	ctx, err := fn(bearer(sign(t, jwt.SigningMethodRS256, "rsa1", rsaKey, claims("alice"))))
+	if assert.NoError(t, err) {
+		p, _ := FromContext(ctx)
+		assert.Equal(t, "alice", p.Subject)
+	}
+
+	_, err = fn(bearer(sign(t, jwt.SigningMethodES256, "ec1", ecKey, claims("bob"))))
+	assert.NoError(t, err)
+
+	_, err = fn(bearer(sign(t, jwt.SigningMethodRS256, "unknown", rsaKey, claims("alice"))))
+	assert.Equal(t, codes.Unauthenticated, code(err))
+
+	// HS tokens are not accepted without a secret
+	_, err = fn(bearer(sign(t, jwt.SigningMethodHS256, "rsa1", []byte("guess"), claims("alice"))))
+	assert.Equal(t, codes.Unauthenticated, code(err))
+
+	// from an URL
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(jwks)
+	}))
+	defer srv.Close()
+
+	fn, err = JWT(WithJWKSURL(srv.URL), WithAlgorithms("ES256"))
+	require.NoError(t, err)
+
+	_, err = fn(bearer(sign(t, jwt.SigningMethodES256, "ec1", ecKey, claims("bob"))))
+	assert.NoError(t, err)
+
+	// not an accepted algorithm
+	_, err = fn(bearer(sign(t, jwt.SigningMethodRS256, "rsa1", rsaKey, claims("alice"))))
+	assert.Equal(t, codes.Unauthenticated, code(err))
+
+	_, err = JWT()
+	assert.Error(t, err)
+}
+
+func TestKeySetRefresh(t *testing.T) {
+	var (
+		fetches atomic.Int32
+		failing atomic.Bool
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		if failing.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"keys":[{"kty":"oct","kid":"hs1","k":"c2VjcmV0"}]}`))
+	}))
+	defer srv.Close()
+
+	ks := &keySet{url: srv.URL, interval: time.Hour}
+	require.NoError(t, ks.refresh())
+
+	// the unknown kids of concurrent requests share one failed refresh
+	failing.Store(true)
+	ks.fetched = time.Now().Add(-2 * time.Minute)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := ks.key("unknown")
+			assert.Error(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(2), fetches.Load())
+
+	// the failed attempt is recorded, the next unknown kid does not fetch
+	_, err := ks.key("unknown")
+	assert.Error(t, err)
+	assert.Equal(t, int32(2), fetches.Load())
+
+	// the known keys are kept
+	key, err := ks.key("hs1")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("secret"), key)
+}
+
+func TestAPIKeys(t *testing.T) {
+	fn := APIKeys(map[string]string{"k-123": "billing"})
+
+	ctx, err := fn(metadata.NewIncomingContext(context.Background(), metadata.Pairs(APIKeyHeader, "k-123")))
+	if assert.NoError(t, err) {
+		p, _ := FromContext(ctx)
+		assert.Equal(t, Principal{Subject: "billing", Method: "apikey"}, p)
+	}
+
+	_, err = fn(metadata.NewIncomingContext(context.Background(), metadata.Pairs(APIKeyHeader, "k-456")))
+	assert.Equal(t, codes.Unauthenticated, code(err))
+
+	_, err = fn(context.Background())
+	assert.ErrorIs(t, err, ErrNoCredentials)
+}
+
+func TestConfigAPIKeys(t *testing.T) {
+	// a key of the service layer keeps the keys of the global one
+	path := filepath.Join(t.TempDir(), "service.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"apikeys": {"k-456": "search"}}`), 0600))
+
+	fn := ConfigAPIKeys(config.NewConfig(map[string]interface{}{
+		"apikeys": map[string]interface{}{"k-123": "billing"},
+	}, file.MustFileProvider(path)), "apikeys")
+
+	for key, subject := range map[string]string{"k-123": "billing", "k-456": "search"} {
+		ctx, err := fn(metadata.NewIncomingContext(context.Background(), metadata.Pairs(APIKeyHeader, key)))
+		if assert.NoError(t, err, key) {
+			p, _ := FromContext(ctx)
+			assert.Equal(t, subject, p.Subject)
+		}
+	}
+
+	_, err := fn(metadata.NewIncomingContext(context.Background(), metadata.Pairs(APIKeyHeader, "k-789")))
+	assert.Equal(t, codes.Unauthenticated, code(err))
+}
+
+func peerContext(cert *x509.Certificate) context.Context {
+	return peer.NewContext(context.Background(), &peer.Peer{
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{
+			VerifiedChains: [][]*x509.Certificate{{cert}},
+		}},
+	})
+}
+
+func TestMTLS(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://mx/ns/shop/sa/gateway")
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "gateway"}, URIs: []*url.URL{spiffe}}
+
+	ctx, err := MTLS(nil)(peerContext(cert))
+	if assert.NoError(t, err) {
+		p, _ := FromContext(ctx)
+		assert.Equal(t, Principal{Subject: "gateway", Method: "mtls"}, p)
+	}
+
+	ctx, err = MTLS(map[string]string{"spiffe://mx/ns/shop/sa/gateway": "shop-gateway"})(peerContext(cert))
+	if assert.NoError(t, err) {
+		p, _ := FromContext(ctx)
+		assert.Equal(t, "shop-gateway", p.Subject)
+	}
+
+	_, err = MTLS(map[string]string{"billing": "billing"})(peerContext(cert))
+	assert.Equal(t, codes.PermissionDenied, code(err))
+
+	_, err = MTLS(nil)(context.Background())
+	assert.ErrorIs(t, err, ErrNoCredentials)
+}
+
+func TestAny(t *testing.T) {
+	secret := []byte("s3cret")
+	jwtfn, err := JWT(WithSecret(secret))
+	require.NoError(t, err)
+
+	fn := Any(MTLS(nil), jwtfn, APIKeys(map[string]string{"k-123": "billing"}))
+
+	ctx, err := fn(metadata.NewIncomingContext(context.Background(), metadata.Pairs(APIKeyHeader, "k-123")))
+	if assert.NoError(t, err) {
+		p, _ := FromContext(ctx)
+		assert.Equal(t, "apikey", p.Method)
+	}
+
+	ctx, err = fn(bearer(sign(t, jwt.SigningMethodHS256, "", secret, claims("alice"))))
+	if assert.NoError(t, err) {
+		p, _ := FromContext(ctx)
+		assert.Equal(t, "jwt", p.Method)
+	}
+
+	// invalid credentials are not passed on
+	_, err = fn(bearer("invalid"))
+	assert.Equal(t, codes.Unauthenticated, code(err))
+	assert.NotErrorIs(t, err, ErrNoCredentials)
+
+	_, err = fn(context.Background())
+	assert.ErrorIs(t, err, ErrNoCredentials)
+}
@@ -0,0 +1,215 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hysios/mx/logger"
+	"go.uber.org/zap"
+)
+
+// jwk is a key of a JSON Web Key Set, RFC 7517
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	// oct
+	K string `json:"k"`
+}
+
+// keySet is the key set of a file or URL, reloaded every interval and when
+// a token has an unknown kid, at most once a minute. Failed reloads count
+// as attempts too, and one reload runs at a time.
+type keySet struct {
+	file     string
+	url      string
+	interval time.Duration
+
+	l       sync.Mutex
+	keys    map[string]interface{}
+	fetched time.Time
+	// refreshing is closed when the running reload is done, err is its
+	// result
+	refreshing chan struct{}
+	err        error
+}
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+func (ks *keySet) key(kid string) (interface{}, error) {
+	ks.l.Lock()
+	key, ok := ks.keys[kid]
+	stale := time.Since(ks.fetched) > ks.interval || (!ok && time.Since(ks.fetched) > time.Minute)
+	// a known key does not wait for the running reload
+	if ok && ks.refreshing != nil {
+		stale = false
+	}
+	ks.l.Unlock()
+
+	if stale {
+		if err := ks.refresh(); err != nil && !ok {
+			return nil, err
+		}
+
+		ks.l.Lock()
+		key, ok = ks.keys[kid]
+		ks.l.Unlock()
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	return key, nil
+}
+
+// refresh reloads the key set, or waits for the running reload and returns
+// its result
+func (ks *keySet) refresh() error {
+	ks.l.Lock()
+	if done := ks.refreshing; done != nil {
+		ks.l.Unlock()
+		<-done
+
+		ks.l.Lock()
+		defer ks.l.Unlock()
+		return ks.err
+	}
+
+	done := make(chan struct{})
+	ks.refreshing = done
+	ks.l.Unlock()
+
+	keys, err := ks.load()
+
+	ks.l.Lock()
+	if err == nil {
+		ks.keys = keys
+	}
+	ks.fetched, ks.err, ks.refreshing = time.Now(), err, nil
+	ks.l.Unlock()
+
+	close(done)
+	return err
+}
+
+func (ks *keySet) load() (map[string]interface{}, error) {
+	b, err := ks.read()
+	if err != nil {
+		return nil, fmt.Errorf("jwks: %w", err)
+	}
+
+	keys, err := parseJWKS(b)
+	if err != nil {
+		return nil, fmt.Errorf("jwks: %w", err)
+	}
+	return keys, nil
+}
+
+func (ks *keySet) read() ([]byte, error) {
+	if ks.file != "" {
+		return os.ReadFile(ks.file)
+	}
+
+	resp, err := httpClient.Get(ks.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch %s: %s", ks.url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func parseJWKS(b []byte) (map[string]interface{}, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, err
+	}
+
+	var keys = make(map[string]interface{})
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		// the keys of other types, e.g. OKP, verify no token we accept
+		key, err := k.publicKey()
+		if err != nil {
+			logger.Logger.Warn("skip jwks key", zap.String("kid", k.Kid), zap.Error(err))
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "oct":
+		return base64.RawURLEncoding.DecodeString(k.K)
+	default:
+		return nil, errors.New("unsupported key type " + k.Kty)
+	}
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
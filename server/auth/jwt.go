@@ -0,0 +1,143 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	grpc_auth "github.com/grpc-ecosystem/go-grpc-middleware/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type JWTOption struct {
+	// JWKSFile and JWKSURL are the key sets verifying the tokens, by the kid
+	// of the token
+	JWKSFile string
+	JWKSURL  string
+	// Secret verifies the HS tokens without a key set
+	Secret []byte
+	// Issuer and Audience are required claims when set
+	Issuer   string
+	Audience string
+	// Algorithms are the accepted algorithms, default are the RS, PS, ES
+	// ones, and the HS ones with a secret
+	Algorithms []string
+	// RefreshInterval reloads the key set, default is 1h
+	RefreshInterval time.Duration
+}
+
+type JWTOptionFunc func(*JWTOption)
+
+func WithJWKSFile(path string) JWTOptionFunc {
+	return func(o *JWTOption) {
+		o.JWKSFile = path
+	}
+}
+
+func WithJWKSURL(url string) JWTOptionFunc {
+	return func(o *JWTOption) {
+		o.JWKSURL = url
+	}
+}
+
+func WithSecret(secret []byte) JWTOptionFunc {
+	return func(o *JWTOption) {
+		o.Secret = secret
+	}
+}
+
+func WithIssuer(iss string) JWTOptionFunc {
+	return func(o *JWTOption) {
+		o.Issuer = iss
+	}
+}
+
+func WithAudience(aud string) JWTOptionFunc {
+	return func(o *JWTOption) {
+		o.Audience = aud
+	}
+}
+
+func WithAlgorithms(algs ...string) JWTOptionFunc {
+	return func(o *JWTOption) {
+		o.Algorithms = algs
+	}
+}
+
+func WithRefreshInterval(d time.Duration) JWTOptionFunc {
+	return func(o *JWTOption) {
+		o.RefreshInterval = d
+	}
+}
+
+// JWT authenticates the bearer token of the authorization metadata, the
+// sub claim is the subject of the principal
+func JWT(optfns ...JWTOptionFunc) (grpc_auth.AuthFunc, error) {
+	var opts JWTOption
+	for _, fn := range optfns {
+		fn(&opts)
+	}
+
+	if opts.RefreshInterval <= 0 {
+		opts.RefreshInterval = time.Hour
+	}
+
+	if len(opts.Algorithms) == 0 {
+		opts.Algorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+		if len(opts.Secret) > 0 {
+			opts.Algorithms = append(opts.Algorithms, "HS256", "HS384", "HS512")
+		}
+	}
+
+	var keys *keySet
+	switch {
+	case opts.JWKSFile != "" || opts.JWKSURL != "":
+		keys = &keySet{file: opts.JWKSFile, url: opts.JWKSURL, interval: opts.RefreshInterval}
+		if err := keys.refresh(); err != nil {
+			return nil, err
+		}
+	case len(opts.Secret) == 0:
+		return nil, errors.New("jwt: no key set or secret")
+	}
+
+	var parserOpts = []jwt.ParserOption{jwt.WithValidMethods(opts.Algorithms)}
+	if opts.Issuer != "" {
+		parserOpts = append(parserOpts, jwt.WithIssuer(opts.Issuer))
+	}
+	if opts.Audience != "" {
+		parserOpts = append(parserOpts, jwt.WithAudience(opts.Audience))
+	}
+	var parser = jwt.NewParser(parserOpts...)
+
+	keyfunc := func(token *jwt.Token) (interface{}, error) {
+		if strings.HasPrefix(token.Method.Alg(), "HS") && len(opts.Secret) > 0 {
+			return opts.Secret, nil
+		}
+
+		if keys == nil {
+			return nil, errors.New("no key set")
+		}
+
+		kid, _ := token.Header["kid"].(string)
+		return keys.key(kid)
+	}
+
+	return func(ctx context.Context) (context.Context, error) {
+		raw, err := grpc_auth.AuthFromMD(ctx, "bearer")
+		if err != nil {
+			return nil, ErrNoCredentials
+		}
+
+		var claims = jwt.MapClaims{}
+		if _, err := parser.ParseWithClaims(raw, claims, keyfunc); err != nil {
+			return nil, status.Error(codes.Unauthenticated, fmt.Sprintf("invalid token: %v", err))
+		}
+
+		sub, _ := claims.GetSubject()
+		return NewContext(ctx, Principal{Subject: sub, Method: "jwt", Claims: claims}), nil
+	}, nil
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bufbuild/protocompile"
+	"github.com/hysios/mx/server/auth"
+	_ "github.com/hysios/mx/server/auth/pb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+const greeterProto = `syntax = "proto3";
+package test;
+
+import "server/auth/pb/auth.proto";
+
+message Empty {}
+
+service Greeter {
+  rpc Hello(Empty) returns (Empty);
+  rpc Login(Empty) returns (Empty) {
+    option (mx.auth.skip_auth) = true;
+  }
+}
+`
+
+func TestServerAuth(t *testing.T) {
+	compiler := protocompile.Compiler{
+		Resolver: protocompile.CompositeResolver{
+			&protocompile.SourceResolver{
+				Accessor: protocompile.SourceAccessorFromMap(map[string]string{"greeter.proto": greeterProto}),
+			},
+			protocompile.ResolverFunc(func(path string) (protocompile.SearchResult, error) {
+				fd, err := protoregistry.GlobalFiles.FindFileByPath(path)
+				return protocompile.SearchResult{Desc: fd}, err
+			}),
+		},
+	}
+
+	files, err := compiler.Compile(context.Background(), "greeter.proto")
+	require.NoError(t, err)
+
+	srv := New("hello", WithAuthFunc(auth.APIKeys(map[string]string{"k-123": "billing"})))
+	srv.RegisterService(testDesc("test.Greeter"), &greeter{}, WithFileDescriptor(files[0]))
+
+	_, err = srv.authenticate(context.Background(), "/test.Greeter/Hello")
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	ctx, err := srv.authenticate(metadata.NewIncomingContext(context.Background(), metadata.Pairs(auth.APIKeyHeader, "k-123")), "/test.Greeter/Hello")
+	if assert.NoError(t, err) {
+		p, _ := auth.FromContext(ctx)
+		assert.Equal(t, "billing", p.Subject)
+	}
+
+	// opted out by the method option
+	_, err = srv.authenticate(context.Background(), "/test.Greeter/Login")
+	assert.NoError(t, err)
+
+	// the health and reflection services are public
+	_, err = srv.authenticate(context.Background(), "/grpc.health.v1.Health/Check")
+	assert.NoError(t, err)
+	_, err = srv.authenticate(context.Background(), "/grpc.reflection.v1.ServerReflection/ServerReflectionInfo")
+	assert.NoError(t, err)
+
+	// no auth func
+	_, err = New("hello").authenticate(context.Background(), "/test.Greeter/Hello")
+	assert.NoError(t, err)
+}
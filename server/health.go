@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/multierr"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// HealthChecker is implemented by the services which check their own
+// health, it is reported by the grpc.health.v1.Health service of the server
+// and to the discovery agents
+type HealthChecker interface {
+	HealthCheck(ctx context.Context) error
+}
+
+// check returns the error of the service's Init, or of its HealthCheck
+func (desc *serviceDesc) check(ctx context.Context) error {
+	if desc.initErr != nil {
+		return desc.initErr
+	}
+
+	if checker, ok := desc.impl.(HealthChecker); ok {
+		return checker.HealthCheck(ctx)
+	}
+	return nil
+}
+
+// serviceHealth returns the health of the service, which includes the
+// health checks of the server
+func (s *Server) serviceHealth(desc serviceDesc) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		return multierr.Append(desc.check(ctx), s.Health(ctx))
+	}
+}
+
+func (s *Server) initHealth() {
+	if s.opts.DisableHealth {
+		return
+	}
+
+	s.health = health.NewServer()
+	grpc_health_v1.RegisterHealthServer(s.grpcserver, s.health)
+}
+
+// setServing sets the status of the service in the health service
+func (s *Server) setServing(service string, err error) {
+	if s.health == nil {
+		return
+	}
+
+	var status = grpc_health_v1.HealthCheckResponse_SERVING
+	if err != nil {
+		status = grpc_health_v1.HealthCheckResponse_NOT_SERVING
+	}
+	s.health.SetServingStatus(service, status)
+}
+
+// updateHealth checks the services and sets their status, the server as a
+// whole ("") is serving when all of them are
+func (s *Server) updateHealth(ctx context.Context) {
+	if s.health == nil {
+		return
+	}
+
+	s.l.Lock()
+	var descs = append([]serviceDesc(nil), s.serviceDescs...)
+	s.l.Unlock()
+
+	var (
+		errs   = s.Health(ctx)
+		server = errs
+	)
+
+	for _, desc := range descs {
+		err := desc.check(ctx)
+		s.setServing(desc.desc.ServiceName, multierr.Append(err, errs))
+		server = multierr.Append(server, err)
+	}
+
+	s.setServing("", server)
+}
+
+// watchHealth updates the health service every HealthInterval until the
+// server shuts down
+func (s *Server) watchHealth() {
+	if s.health == nil {
+		return
+	}
+
+	var tick = time.NewTicker(s.opts.HealthInterval)
+	defer tick.Stop()
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), s.opts.HealthInterval)
+		s.updateHealth(ctx)
+		cancel()
+
+		select {
+		case <-tick.C:
+		case <-s.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+type greeter struct {
+	healthy atomic.Bool
+}
+
+func (g *greeter) HealthCheck(ctx context.Context) error {
+	if !g.healthy.Load() {
+		return errors.New("greeter unhealthy")
+	}
+	return nil
+}
+
+type broken struct{}
+
+func (broken) Init() error { return errors.New("no database") }
+
+func testDesc(name string) *grpc.ServiceDesc {
+	return &grpc.ServiceDesc{ServiceName: name, HandlerType: (*any)(nil)}
+}
+
+func TestServerHealth(t *testing.T) {
+	g := &greeter{}
+	g.healthy.Store(true)
+
+	srv := New("hello", WithHealthInterval(10*time.Millisecond), WithDrainDelay(-1))
+	srv.RegisterService(testDesc("hello.Greeter"), g)
+	srv.RegisterService(testDesc("hello.Broken"), broken{})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	go srv.Serve(ln)
+	defer srv.Shutdown(context.Background())
+
+	conn, err := grpc.Dial(ln.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	var (
+		cli    = grpc_health_v1.NewHealthClient(conn)
+		status = func(service string) grpc_health_v1.HealthCheckResponse_ServingStatus {
+			resp, err := cli.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{Service: service})
+			if err != nil {
+				return grpc_health_v1.HealthCheckResponse_UNKNOWN
+			}
+			return resp.Status
+		}
+	)
+
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_SERVING, status("hello.Greeter"))
+	// failing its Init
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_NOT_SERVING, status("hello.Broken"))
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_NOT_SERVING, status(""))
+
+	g.healthy.Store(false)
+	assert.Eventually(t, func() bool {
+		return status("hello.Greeter") == grpc_health_v1.HealthCheckResponse_NOT_SERVING
+	}, 2*time.Second, 10*time.Millisecond)
+
+	g.healthy.Store(true)
+	assert.Eventually(t, func() bool {
+		return status("hello.Greeter") == grpc_health_v1.HealthCheckResponse_SERVING
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// the checks of the server apply to every service
+	srv.AddHealthCheck("cache", func(ctx context.Context) error { return errors.New("timeout") })
+	assert.Eventually(t, func() bool {
+		return status("hello.Greeter") == grpc_health_v1.HealthCheckResponse_NOT_SERVING
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestServerWithoutHealth(t *testing.T) {
+	srv := New("hello", WithoutHealth(), WithoutReflection())
+	srv.RegisterService(testDesc("hello.Greeter"), &greeter{})
+
+	assert.NotContains(t, srv.grpcserver.GetServiceInfo(), "grpc.health.v1.Health")
+	assert.NotContains(t, srv.grpcserver.GetServiceInfo(), "grpc.reflection.v1.ServerReflection")
+
+	srv = New("hello")
+	srv.RegisterService(testDesc("hello.Greeter"), &greeter{})
+	assert.Contains(t, srv.grpcserver.GetServiceInfo(), "grpc.health.v1.Health")
+	assert.Contains(t, srv.grpcserver.GetServiceInfo(), "grpc.reflection.v1.ServerReflection")
+}
@@ -1,6 +1,14 @@
 package server
 
 import (
+	"context"
+	"time"
+
+	grpc_auth "github.com/grpc-ecosystem/go-grpc-middleware/auth"
+	"github.com/hysios/mx/interceptor/limit"
+	"github.com/hysios/mx/interceptor/validate"
+	"github.com/hysios/mx/telemetry"
+	"github.com/hysios/mx/tlsconfig"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/protobuf/reflect/protoreflect"
@@ -19,8 +27,41 @@ type ServerOption struct {
 	Logger         *zap.Logger
 	FileDescriptor protoreflect.FileDescriptor
 	PersistentPort bool
+	// DisableReflection leaves out the gRPC reflection service
+	DisableReflection bool
+	// DisableHealth leaves out the grpc.health.v1.Health service
+	DisableHealth bool
+	// HealthInterval is how often the health service is updated, default
+	// is 10s
+	HealthInterval time.Duration
+	// DrainDelay is how long a draining server keeps serving before it
+	// stops, so the gateways stop routing to it, default is 5s
+	DrainDelay time.Duration
+	// ShutdownTimeout bounds the graceful stop, the server is stopped
+	// forcibly after it, default is 30s
+	ShutdownTimeout time.Duration
+	// HealthChecks are the checks of the application by name, the server is
+	// healthy when all of them pass
+	HealthChecks map[string]HealthCheckFunc
+	// TLS serves over TLS, default is tlsconfig.Default
+	TLS *tlsconfig.TLS
+	// AuthFunc authenticates the calls, see the auth package
+	AuthFunc grpc_auth.AuthFunc
+	// Limiter enforces the rate and concurrency limits of the methods
+	Limiter *limit.Limiter
+	// Validator checks the requests against their buf.validate constraints,
+	// default is validate.Default
+	Validator *validate.Validator
+	// DisableValidation leaves the requests unchecked
+	DisableValidation bool
+	// Telemetry sets up the telemetry of the options when the server
+	// starts, and flushes it when it shuts down
+	Telemetry []telemetry.OptionFunc
 }
 
+// HealthCheckFunc returns an error when the checked dependency is unhealthy
+type HealthCheckFunc func(ctx context.Context) error
+
 type ServerOptionFunc func(*ServerOption) error
 
 func WithServiceDesc(desc *grpc.ServiceDesc) ServerOptionFunc {
@@ -58,3 +99,113 @@ func WithPersistentPort() ServerOptionFunc {
 		return nil
 	}
 }
+
+// WithoutReflection leaves out the gRPC reflection service, the gateway then
+// needs the file descriptor from WithFileDescriptor
+func WithoutReflection() ServerOptionFunc {
+	return func(o *ServerOption) error {
+		o.DisableReflection = true
+		return nil
+	}
+}
+
+// WithTLS serves over TLS, the clients must present a certificate when it
+// requires client auth
+func WithTLS(t *tlsconfig.TLS) ServerOptionFunc {
+	return func(o *ServerOption) error {
+		o.TLS = t
+		return nil
+	}
+}
+
+// WithAuthFunc authenticates the calls with fn, except the methods with
+// the (mx.auth.skip_auth) option, and the health and reflection services
+func WithAuthFunc(fn grpc_auth.AuthFunc) ServerOptionFunc {
+	return func(o *ServerOption) error {
+		o.AuthFunc = fn
+		return nil
+	}
+}
+
+// WithLimiter enforces the limits of the limiter, the callers are limited
+// after they are authenticated
+func WithLimiter(l *limit.Limiter) ServerOptionFunc {
+	return func(o *ServerOption) error {
+		o.Limiter = l
+		return nil
+	}
+}
+
+// WithTelemetry sets up the telemetry when the server starts, named by the
+// server, e.g. WithTelemetry(telemetry.WithConfig(cfg))
+func WithTelemetry(optfns ...telemetry.OptionFunc) ServerOptionFunc {
+	return func(o *ServerOption) error {
+		o.Telemetry = append([]telemetry.OptionFunc{}, optfns...)
+		return nil
+	}
+}
+
+// WithValidator checks the requests with v
+func WithValidator(v *validate.Validator) ServerOptionFunc {
+	return func(o *ServerOption) error {
+		o.Validator = v
+		return nil
+	}
+}
+
+// WithoutValidation leaves the requests unchecked, the services validate
+// them by themselves
+func WithoutValidation() ServerOptionFunc {
+	return func(o *ServerOption) error {
+		o.DisableValidation = true
+		return nil
+	}
+}
+
+// WithoutHealth leaves out the grpc.health.v1.Health service, a gRPC check
+// of the registry, e.g. consul.WithGRPCCheck(), then always fails
+func WithoutHealth() ServerOptionFunc {
+	return func(o *ServerOption) error {
+		o.DisableHealth = true
+		return nil
+	}
+}
+
+// WithHealthInterval sets how often the services are checked for the
+// health service
+func WithHealthInterval(d time.Duration) ServerOptionFunc {
+	return func(o *ServerOption) error {
+		o.HealthInterval = d
+		return nil
+	}
+}
+
+// WithDrainDelay sets how long the server keeps serving after it is marked
+// draining, a negative delay disables the wait
+func WithDrainDelay(d time.Duration) ServerOptionFunc {
+	return func(o *ServerOption) error {
+		o.DrainDelay = d
+		return nil
+	}
+}
+
+// WithShutdownTimeout sets how long the server waits for the pending
+// requests before it is stopped forcibly
+func WithShutdownTimeout(d time.Duration) ServerOptionFunc {
+	return func(o *ServerOption) error {
+		o.ShutdownTimeout = d
+		return nil
+	}
+}
+
+// WithHealthCheck adds a check of the application to the health of the
+// server, e.g. the database connection
+func WithHealthCheck(name string, check HealthCheckFunc) ServerOptionFunc {
+	return func(o *ServerOption) error {
+		if o.HealthChecks == nil {
+			o.HealthChecks = make(map[string]HealthCheckFunc)
+		}
+		o.HealthChecks[name] = check
+		return nil
+	}
+}
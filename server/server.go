@@ -7,6 +7,7 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -14,23 +15,27 @@ import (
 	"time"
 
 	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
-	grpc_auth "github.com/grpc-ecosystem/go-grpc-middleware/auth"
 	grpc_zap "github.com/grpc-ecosystem/go-grpc-middleware/logging/zap"
 	"github.com/grpc-ecosystem/go-grpc-middleware/logging/zap/ctxzap"
 	grpc_recovery "github.com/grpc-ecosystem/go-grpc-middleware/recovery"
 	grpc_ctxtags "github.com/grpc-ecosystem/go-grpc-middleware/tags"
-	grpc_opentracing "github.com/grpc-ecosystem/go-grpc-middleware/tracing/opentracing"
 	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
 	"github.com/pkg/errors"
+	"go.uber.org/multierr"
 
 	"github.com/hysios/mx"
 	"github.com/hysios/mx/discovery"
+	"github.com/hysios/mx/interceptor/validate"
 	"github.com/hysios/mx/logger"
+	"github.com/hysios/mx/telemetry"
+	"github.com/hysios/mx/tlsconfig"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/reflection"
 	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
@@ -51,8 +56,24 @@ type Server struct {
 	streamInterceptors []grpc.StreamServerInterceptor
 
 	listenAddrs []chan net.Addr
+
+	skipAuth     sync.Map
+	health       *health.Server
+	done         chan struct{}
+	hooks        []ShutdownHook
+	shutdownOnce sync.Once
+	shutdownErr  error
+}
+
+// ShutdownHook takes part in the shutdown of the server, Drain runs before
+// the server stops serving, Deregister after it stopped
+type ShutdownHook struct {
+	Drain      func() error
+	Deregister func() error
 }
 
+// New returns a server of the name, it panics when the TLS of MX_TLS_* is
+// used but fails to load rather than serving plaintext
 func New(name string, optfns ...ServerOptionFunc) *Server {
 	var opts ServerOption
 	for _, fn := range optfns {
@@ -65,12 +86,33 @@ func New(name string, optfns ...ServerOptionFunc) *Server {
 		opts.Logger = logger.Cli
 	}
 
+	if opts.DrainDelay == 0 {
+		opts.DrainDelay = 5 * time.Second
+	}
+
+	if opts.ShutdownTimeout <= 0 {
+		opts.ShutdownTimeout = 30 * time.Second
+	}
+
+	if opts.HealthInterval <= 0 {
+		opts.HealthInterval = 10 * time.Second
+	}
+
+	if opts.TLS == nil {
+		opts.TLS = tlsconfig.Default()
+	}
+
+	if opts.Validator == nil && !opts.DisableValidation {
+		opts.Validator = validate.Default()
+	}
+
 	return &Server{
 		ServerName:         name,
 		opts:               opts,
 		unaryInterceptors:  make([]grpc.UnaryServerInterceptor, 0),
 		streamInterceptors: make([]grpc.StreamServerInterceptor, 0),
 		logger:             opts.Logger,
+		done:               make(chan struct{}),
 	}
 }
 
@@ -104,6 +146,10 @@ func (s *Server) initServer() {
 
 	if s.grpcserver == nil {
 		s.grpcserver = grpc.NewServer(s.buildGrpcOptions()...)
+		if !s.opts.DisableReflection {
+			reflection.Register(s.grpcserver)
+		}
+		s.initHealth()
 	}
 }
 
@@ -111,10 +157,6 @@ func (s *Server) recoverFunc(p interface{}) (err error) {
 	return errors.WithStack(fmt.Errorf("%v", p))
 }
 
-func (s *Server) authFunc(ctx context.Context) (context.Context, error) {
-	return ctx, nil
-}
-
 func (s *Server) buildGrpcOptions() []grpc.ServerOption {
 	var (
 		options []grpc.ServerOption
@@ -122,6 +164,10 @@ func (s *Server) buildGrpcOptions() []grpc.ServerOption {
 
 	options = append(options, grpc.UnaryInterceptor(s.buildUnaryServerInterceptor()))
 	options = append(options, grpc.StreamInterceptor(s.buildStreamServerInterceptor()))
+	options = append(options, grpc.StatsHandler(telemetry.ServerHandler()))
+	if s.opts.TLS != nil {
+		options = append(options, grpc.Creds(s.opts.TLS.ServerCredentials()))
+	}
 	options = append(options, s.grpcOptions...)
 
 	return options
@@ -163,10 +209,11 @@ func (s *Server) buildUnaryServerInterceptor() grpc.UnaryServerInterceptor {
 
 	var interceptors = []grpc.UnaryServerInterceptor{
 		grpc_ctxtags.UnaryServerInterceptor(),
-		grpc_opentracing.UnaryServerInterceptor(),
 		grpc_prometheus.UnaryServerInterceptor,
 		grpc_zap.UnaryServerInterceptor(s.opts.Logger, grpc_zap.WithMessageProducer(s.logProdcuer)),
-		grpc_auth.UnaryServerInterceptor(s.authFunc),
+		s.unaryAuth,
+		s.unaryLimit,
+		s.unaryValidate,
 		grpc_recovery.UnaryServerInterceptor(grpc_recovery.WithRecoveryHandler(s.recoverFunc)),
 	}
 
@@ -179,10 +226,11 @@ func (s *Server) buildUnaryServerInterceptor() grpc.UnaryServerInterceptor {
 func (s *Server) buildStreamServerInterceptor() grpc.StreamServerInterceptor {
 	var interceptors = []grpc.StreamServerInterceptor{
 		grpc_ctxtags.StreamServerInterceptor(),
-		grpc_opentracing.StreamServerInterceptor(),
 		grpc_prometheus.StreamServerInterceptor,
 		grpc_zap.StreamServerInterceptor(s.opts.Logger, grpc_zap.WithMessageProducer(s.logProdcuer)),
-		grpc_auth.StreamServerInterceptor(s.authFunc),
+		s.streamAuth,
+		s.streamLimit,
+		s.streamValidate,
 		grpc_recovery.StreamServerInterceptor(grpc_recovery.WithRecoveryHandler(s.recoverFunc)),
 	}
 
@@ -207,28 +255,34 @@ func (s *Server) registerDesc(desc *grpc.ServiceDesc, impl any, optfns ...Server
 		}
 	}
 
-	s.serviceDescs = append(s.serviceDescs, func() serviceDesc {
-		return serviceDesc{
-			desc:         desc,
-			impl:         impl,
-			namespace:    opts.Namespace,
-			filedescript: opts.FileDescriptor,
-		}
-	}())
+	var sd = serviceDesc{
+		desc:         desc,
+		impl:         impl,
+		namespace:    opts.Namespace,
+		filedescript: opts.FileDescriptor,
+	}
 
+	// a service failing its Init is registered, but not serving
 	if init, ok := impl.(interface {
 		Init() error
 	}); ok {
 		if err := init.Init(); err != nil {
-			panic(fmt.Errorf("service %s init error %w", desc.ServiceName, err))
+			sd.initErr = fmt.Errorf("service %s init error %w", desc.ServiceName, err)
+			s.logger.Error("service init failed", zap.String("service", desc.ServiceName), zap.Error(err))
 		}
 	}
 
+	s.l.Lock()
+	s.serviceDescs = append(s.serviceDescs, sd)
+	s.l.Unlock()
+
 	s.grpcserver.RegisterService(desc, impl)
+	s.setServing(desc.ServiceName, sd.initErr)
 }
 
 func (s *Server) Serve(lns net.Listener) error {
 	s.init()
+	s.setupTelemetry()
 	s.l.Lock()
 	s.ln = lns
 	s.l.Unlock()
@@ -238,6 +292,7 @@ func (s *Server) Serve(lns net.Listener) error {
 
 	grpc_prometheus.Register(s.grpcserver)
 	s.teardown()
+	go s.watchHealth()
 
 	go func() {
 		time.Sleep(time.Millisecond * 500)
@@ -330,16 +385,162 @@ func (s *Server) GetID() string {
 	return fmt.Sprintf("%s_%d", s.ServerName, os.Getpid())
 }
 
+// setupTelemetry sets up the telemetry of the options, it is flushed once
+// the server stopped
+func (s *Server) setupTelemetry() {
+	if s.opts.Telemetry == nil {
+		return
+	}
+
+	t, err := telemetry.Setup(context.Background(), append([]telemetry.OptionFunc{telemetry.WithServiceName(s.ServerName)}, s.opts.Telemetry...)...)
+	if err != nil {
+		s.logger.Warn("telemetry setup", zap.String("name", s.ServerName), zap.Error(err))
+		return
+	}
+
+	s.OnShutdown(ShutdownHook{
+		Deregister: func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), s.opts.ShutdownTimeout)
+			defer cancel()
+
+			return t.Shutdown(ctx)
+		},
+	})
+}
+
+// teardown shuts the server down on SIGINT or SIGTERM
 func (s *Server) teardown() {
-	// on os signal ctrl+c && kill  trigger graceful stop
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM|syscall.SIGINT|syscall.SIGKILL)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
-		s.grpcserver.GracefulStop()
+		signal.Stop(c)
+
+		ctx, cancel := context.WithTimeout(context.Background(), s.opts.ShutdownTimeout)
+		defer cancel()
+
+		if err := s.Shutdown(ctx); err != nil {
+			s.logger.Warn("server shutdown", zap.String("name", s.ServerName), zap.Error(err))
+		}
 	}()
 }
 
+// AddHealthCheck adds a check of the application to the health of the
+// server, a check of the same name is replaced
+func (s *Server) AddHealthCheck(name string, check HealthCheckFunc) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if s.opts.HealthChecks == nil {
+		s.opts.HealthChecks = make(map[string]HealthCheckFunc)
+	}
+	s.opts.HealthChecks[name] = check
+}
+
+// Health runs the health checks of the server, the error names the failed
+// ones
+func (s *Server) Health(ctx context.Context) error {
+	s.l.Lock()
+	var (
+		checks = make(map[string]HealthCheckFunc, len(s.opts.HealthChecks))
+		names  = make([]string, 0, len(s.opts.HealthChecks))
+	)
+	for name, check := range s.opts.HealthChecks {
+		checks[name] = check
+		names = append(names, name)
+	}
+	s.l.Unlock()
+
+	sort.Strings(names)
+
+	var errs error
+	for _, name := range names {
+		if err := checks[name](ctx); err != nil {
+			errs = multierr.Append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	return errs
+}
+
+// OnShutdown adds the hook to the shutdown of the server
+func (s *Server) OnShutdown(hook ShutdownHook) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	s.hooks = append(s.hooks, hook)
+}
+
+// Shutdown drains the server: the Drain hooks mark it draining, it keeps
+// serving for the DrainDelay so the gateways observe it, then it stops
+// gracefully and the Deregister hooks remove it from discovery. The server
+// is stopped forcibly when ctx is done first. Only the first call shuts
+// the server down, later calls return its result.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.shutdownOnce.Do(func() {
+		s.shutdownErr = s.shutdown(ctx)
+	})
+
+	return s.shutdownErr
+}
+
+func (s *Server) shutdown(ctx context.Context) error {
+	s.l.Lock()
+	var (
+		hooks = append([]ShutdownHook(nil), s.hooks...)
+		errs  error
+	)
+	s.l.Unlock()
+
+	s.logger.Info("server draining", zap.String("name", s.ServerName))
+	if s.done != nil {
+		close(s.done)
+	}
+	if s.health != nil {
+		// every service reports not serving from now on
+		s.health.Shutdown()
+	}
+
+	for _, hook := range hooks {
+		if hook.Drain != nil {
+			errs = multierr.Append(errs, hook.Drain())
+		}
+	}
+
+	if s.opts.DrainDelay > 0 {
+		t := time.NewTimer(s.opts.DrainDelay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+		}
+	}
+
+	if s.grpcserver != nil {
+		stopped := make(chan struct{})
+		go func() {
+			s.grpcserver.GracefulStop()
+			close(stopped)
+		}()
+
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			s.grpcserver.Stop()
+			<-stopped
+			errs = multierr.Append(errs, ctx.Err())
+		}
+	}
+
+	for _, hook := range hooks {
+		if hook.Deregister != nil {
+			errs = multierr.Append(errs, hook.Deregister())
+		}
+	}
+
+	s.logger.Info("server stopped", zap.String("name", s.ServerName))
+	return errs
+}
+
 func (s *Server) ServiceDescs() []discovery.ServiceDesc {
 	var descs []discovery.ServiceDesc
 	for _, desc := range s.serviceDescs {
@@ -357,6 +558,7 @@ func (s *Server) ServiceDescs() []discovery.ServiceDesc {
 			FileDescriptor:    desc.filedescript,
 			FileDescriptorKey: filedescriptkey,
 			Group:             s.GetID(),
+			Health:            s.serviceHealth(desc),
 		})
 	}
 
@@ -412,6 +614,7 @@ type serviceDesc struct {
 	impl         any
 	namespace    string
 	filedescript protoreflect.FileDescriptor
+	initErr      error
 }
 
 func (desc *serviceDesc) GetID() string {
@@ -3,12 +3,16 @@ package mx
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
 	"github.com/grpc-ecosystem/grpc-gateway/v2/utilities"
 	"github.com/hysios/mx/httprule"
+	"github.com/hysios/mx/interceptor/validate"
 	"github.com/hysios/mx/internal/delegate"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
@@ -16,6 +20,7 @@ import (
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
 	"google.golang.org/protobuf/reflect/protoreflect"
 	"google.golang.org/protobuf/types/dynamicpb"
 )
@@ -33,6 +38,44 @@ type DynamicService interface {
 	RemoveConn(serviceId string) error
 }
 
+// ConnOption is the routing option of a service instance
+type ConnOption struct {
+	Weight   int
+	Draining bool
+	// Remote instances only get calls when no local one is left
+	Remote bool
+}
+
+// UpdatableService is a DynamicService whose instances are updated in
+// place, without closing the connections of the other instances.
+type UpdatableService interface {
+	DynamicService
+
+	// Conn returns the connection of the instance
+	Conn(serviceId string) (*grpc.ClientConn, bool)
+	// UpdateConn sets the routing option of the instance, a non-nil conn
+	// replaces its connection, the old one is closed after connCloseDelay
+	UpdateConn(serviceId string, conn *grpc.ClientConn, opt ConnOption) error
+}
+
+// connCloseDelay lets the calls on a replaced connection finish
+var connCloseDelay = 30 * time.Second
+
+// replaceConn swaps the connection of the instance in the muxer and closes
+// the old one once its calls had time to finish, the caller must hold the
+// lock of the connMap
+func replaceConn(connMap map[string]*grpc.ClientConn, conns *Muxer, serviceId string, conn *grpc.ClientConn) error {
+	old, ok := connMap[serviceId]
+	if !ok {
+		return fmt.Errorf("service instance %s not found", serviceId)
+	}
+
+	connMap[serviceId] = conn
+	conns.Replace(serviceId, conn)
+	time.AfterFunc(connCloseDelay, func() { old.Close() })
+	return nil
+}
+
 type ServerVersion interface {
 	Version() string
 }
@@ -128,6 +171,7 @@ func (l *localService) init() error {
 type dynamicService struct {
 	name    string
 	connMap map[string]*grpc.ClientConn
+	connL   sync.Mutex
 	conns   Muxer
 	handler delegate.ServiceHandlerClient
 }
@@ -158,26 +202,65 @@ func (d *dynamicService) Register(ctx context.Context, gw *Gateway) error {
 }
 
 func (d *dynamicService) AddConn(serviceId string, conn *grpc.ClientConn) error {
+	d.connL.Lock()
+	defer d.connL.Unlock()
+
 	d.connMap[serviceId] = conn
 	d.conns.Add(serviceId, conn)
 	return nil
 }
 
 func (d *dynamicService) RemoveConn(serviceId string) error {
+	d.connL.Lock()
+	defer d.connL.Unlock()
+
 	delete(d.connMap, serviceId)
 	d.conns.Remove(serviceId)
 	return nil
 }
 
+func (d *dynamicService) Conn(serviceId string) (*grpc.ClientConn, bool) {
+	d.connL.Lock()
+	defer d.connL.Unlock()
+
+	conn, ok := d.connMap[serviceId]
+	return conn, ok
+}
+
+func (d *dynamicService) UpdateConn(serviceId string, conn *grpc.ClientConn, opt ConnOption) error {
+	d.connL.Lock()
+	defer d.connL.Unlock()
+
+	if conn != nil {
+		if err := replaceConn(d.connMap, &d.conns, serviceId, conn); err != nil {
+			return err
+		}
+	}
+
+	if !d.conns.SetWeight(serviceId, opt.Weight, opt.Draining) {
+		return fmt.Errorf("service instance %s not found", serviceId)
+	}
+	d.conns.SetRemote(serviceId, opt.Remote)
+	return nil
+}
+
 type descriptorBuilderService struct {
 	name           string
 	filedescriptor protoreflect.FileDescriptor
 	logger         *zap.Logger
 	connMap        map[string]*grpc.ClientConn
+	connL          sync.Mutex
 	conns          Muxer
 	handlers       map[string][]httpMethod
 	annotateCtx    runtime.AnnotateContextOption
-	// handles map[string]
+	validator      *validate.Validator
+
+	// routes are the handlers of the current descriptor by route key, the
+	// mux only holds a dispatcher per route, so a new descriptor swaps the
+	// table instead of stacking handlers on the mux
+	routes  map[string]runtime.HandlerFunc
+	mounted map[string]bool
+	routeL  sync.RWMutex
 }
 
 type httpMethod struct {
@@ -195,6 +278,7 @@ func NewDescriptorBuilderService(name string, filedescriptor protoreflect.FileDe
 		filedescriptor: filedescriptor,
 		connMap:        make(map[string]*grpc.ClientConn),
 		handlers:       make(map[string][]httpMethod),
+		mounted:        make(map[string]bool),
 	}
 }
 
@@ -202,6 +286,11 @@ func (d *descriptorBuilderService) SetLogger(logger *zap.Logger) {
 	d.logger = logger
 }
 
+// SetValidator checks the requests with v before they are forwarded
+func (d *descriptorBuilderService) SetValidator(v *validate.Validator) {
+	d.validator = v
+}
+
 func (d *descriptorBuilderService) ServiceName() string {
 	return d.name
 }
@@ -216,16 +305,55 @@ func (d *descriptorBuilderService) RegisterServeMux(ctx context.Context, srvmux
 		return err
 	}
 
+	var routes = make(map[string]runtime.HandlerFunc)
 	for _, handlers := range d.handlers {
 		for _, handler := range handlers {
+			routes[routeKey(handler)] = handler.Handler
+		}
+	}
+
+	d.routeL.Lock()
+	defer d.routeL.Unlock()
+
+	d.routes = routes
+	for _, handlers := range d.handlers {
+		for _, handler := range handlers {
+			key := routeKey(handler)
+			if d.mounted[key] {
+				continue
+			}
+
 			d.logger.Info("registering http handler", zap.String("method", handler.Method), zap.String("pattern", handler.Pattern.String()))
-			srvmux.Handle(handler.Method, handler.Pattern, handler.Handler)
+			srvmux.Handle(handler.Method, handler.Pattern, d.dispatch(srvmux, key))
+			d.mounted[key] = true
 		}
 	}
 
 	return nil
 }
 
+func routeKey(handler httpMethod) string {
+	return handler.Method + " " + handler.Pattern.String()
+}
+
+// dispatch returns the mux handler of the route, which calls the handler of
+// the current descriptor, routes removed from it are not found
+func (d *descriptorBuilderService) dispatch(srvmux *runtime.ServeMux, key string) runtime.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request, pathParams map[string]string) {
+		d.routeL.RLock()
+		handler, ok := d.routes[key]
+		d.routeL.RUnlock()
+
+		if !ok {
+			_, outboundMarshaler := runtime.MarshalerForRequest(srvmux, req)
+			runtime.HTTPError(req.Context(), srvmux, outboundMarshaler, w, req, status.Error(codes.NotFound, http.StatusText(http.StatusNotFound)))
+			return
+		}
+
+		handler(w, req, pathParams)
+	}
+}
+
 func (d *descriptorBuilderService) Build(ctx context.Context, mux *runtime.ServeMux) error {
 	// build runtime.ServerMux handler from filedescriptor
 	// read services
@@ -248,21 +376,66 @@ func (d *descriptorBuilderService) Build(ctx context.Context, mux *runtime.Serve
 }
 
 func (d *descriptorBuilderService) AddConn(serviceId string, conn *grpc.ClientConn) error {
+	d.connL.Lock()
+	defer d.connL.Unlock()
+
 	d.connMap[serviceId] = conn
 	d.conns.Add(serviceId, conn)
 	return nil
 }
 
 func (d *descriptorBuilderService) RemoveConn(serviceId string) error {
+	d.connL.Lock()
 	conn, ok := d.connMap[serviceId]
 	if !ok {
+		d.connL.Unlock()
 		return nil
 	}
 	delete(d.connMap, serviceId)
 	d.conns.Remove(serviceId)
+	d.connL.Unlock()
+
 	return conn.Close()
 }
 
+func (d *descriptorBuilderService) Conn(serviceId string) (*grpc.ClientConn, bool) {
+	d.connL.Lock()
+	defer d.connL.Unlock()
+
+	conn, ok := d.connMap[serviceId]
+	return conn, ok
+}
+
+func (d *descriptorBuilderService) UpdateConn(serviceId string, conn *grpc.ClientConn, opt ConnOption) error {
+	d.connL.Lock()
+	defer d.connL.Unlock()
+
+	if conn != nil {
+		if err := replaceConn(d.connMap, &d.conns, serviceId, conn); err != nil {
+			return err
+		}
+	}
+
+	if !d.conns.SetWeight(serviceId, opt.Weight, opt.Draining) {
+		return fmt.Errorf("service instance %s not found", serviceId)
+	}
+	d.conns.SetRemote(serviceId, opt.Remote)
+	return nil
+}
+
+// UpdateFileDescriptor rebuilds the http handlers from the new file
+// descriptor and swaps them in, the connections are kept. Routes removed
+// from the descriptor are not found, only new routes are added to the mux.
+func (d *descriptorBuilderService) UpdateFileDescriptor(ctx context.Context, srvmux *runtime.ServeMux, filedescriptor protoreflect.FileDescriptor) error {
+	if proto.Equal(protodesc.ToFileDescriptorProto(d.filedescriptor), protodesc.ToFileDescriptorProto(filedescriptor)) {
+		return nil
+	}
+
+	d.filedescriptor = filedescriptor
+	d.handlers = make(map[string][]httpMethod)
+	return d.RegisterServeMux(ctx, srvmux)
+}
+
 type methodOptions struct {
 	GoogleAPIHTTP GoogleAPIHTTP                                          `json:"[google.api.http]"`
 	GrpcGateway   GrpcGatewayProtocGenOpenapiv2OptionsOpenapiv2Operation `json:"[grpc.gateway.protoc_gen_openapiv2.options.openapiv2_operation]"`
@@ -412,11 +585,15 @@ func (d *descriptorBuilderService) buildHttpHandlers(mux *runtime.ServeMux, meth
 		Body:   options.GoogleAPIHTTP.Body,
 	}
 
-	hmethod, err := d.build1methodHandler(mux, serviceName, method, hapi)
-	if err != nil {
-		return nil, err
+	// methods without a http rule are only served over gRPC, e.g. the
+	// health checks of a service joined by reflection
+	if hapi.Path() != "" {
+		hmethod, err := d.build1methodHandler(mux, serviceName, method, hapi)
+		if err != nil {
+			return nil, err
+		}
+		httpMethods = append(httpMethods, hmethod)
 	}
-	httpMethods = append(httpMethods, hmethod)
 
 	for _, binding := range options.GoogleAPIHTTP.AdditionalBindings {
 		hapi = &HttpAPI{
@@ -651,6 +828,10 @@ func (d *descriptorBuilderService) request_GetMethod(ctx context.Context, marsha
 		return nil, metadata, status.Errorf(codes.InvalidArgument, "%v", err)
 	}
 
+	if err := d.validator.Validate(input); err != nil {
+		return nil, metadata, err
+	}
+
 	err := d.conns.Invoke(ctx, method, input, output, grpc.Header(&metadata.HeaderMD), grpc.Trailer(&metadata.TrailerMD))
 	return output, metadata, err
 }
@@ -683,6 +864,10 @@ func (d *descriptorBuilderService) request_PostMethod(ctx context.Context,
 		return nil, metadata, status.Errorf(codes.InvalidArgument, "%v", err)
 	}
 
+	if err := d.validator.Validate(input); err != nil {
+		return nil, metadata, err
+	}
+
 	err := d.conns.Invoke(ctx, methodName, input, output, grpc.Header(&metadata.HeaderMD), grpc.Trailer(&metadata.TrailerMD))
 	return output, metadata, err
 }
@@ -0,0 +1,77 @@
+package mx
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// routeFile returns a descriptor of a service with a GET route per path
+func routeFile(t *testing.T, paths ...string) protoreflect.FileDescriptor {
+	var methods []*descriptorpb.MethodDescriptorProto
+	for i, path := range paths {
+		opts := &descriptorpb.MethodOptions{}
+		proto.SetExtension(opts, annotations.E_Http, &annotations.HttpRule{
+			Pattern: &annotations.HttpRule_Get{Get: path},
+		})
+
+		methods = append(methods, &descriptorpb.MethodDescriptorProto{
+			Name:       proto.String("Method" + string(rune('A'+i))),
+			InputType:  proto.String(".routetest.Request"),
+			OutputType: proto.String(".routetest.Request"),
+			Options:    opts,
+		})
+	}
+
+	fd, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:        proto.String("routetest/route.proto"),
+		Package:     proto.String("routetest"),
+		Syntax:      proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{Name: proto.String("Request")}},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name:   proto.String("Routes"),
+			Method: methods,
+		}},
+	}, nil)
+	assert.NoError(t, err)
+	return fd
+}
+
+func TestUpdateFileDescriptorRoutes(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		mux     = runtime.NewServeMux()
+		service = NewDescriptorBuilderService("routetest.Routes", routeFile(t, "/v1/a", "/v1/b"))
+	)
+	service.SetLogger(zap.NewNop())
+	assert.NoError(t, service.RegisterServeMux(ctx, mux))
+
+	code := func(path string) int {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code
+	}
+
+	// without a connection the routes fail, but are found
+	assert.NotEqual(t, http.StatusNotFound, code("/v1/a"))
+	assert.NotEqual(t, http.StatusNotFound, code("/v1/b"))
+
+	// a route removed from the descriptor is gone, a new one is added
+	assert.NoError(t, service.UpdateFileDescriptor(ctx, mux, routeFile(t, "/v1/a", "/v1/c")))
+	assert.NotEqual(t, http.StatusNotFound, code("/v1/a"))
+	assert.Equal(t, http.StatusNotFound, code("/v1/b"))
+	assert.NotEqual(t, http.StatusNotFound, code("/v1/c"))
+
+	// routes are mounted on the mux once
+	assert.Len(t, service.mounted, 3)
+}
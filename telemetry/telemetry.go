@@ -0,0 +1,270 @@
+// Package telemetry sets up the OpenTelemetry tracing and metrics of the
+// gateway, the servers and the clients. The exporter is configured in a
+// config.Config under the "telemetry" selector:
+//
+//	{
+//	    "telemetry": {
+//	        "exporter": "otlp",
+//	        "endpoint": "otel-collector:4317",
+//	        "insecure": true,
+//	        "sample_ratio": 0.1
+//	    }
+//	}
+//
+// The exporter is "otlp", "stdout" or "none". The OTLP endpoint defaults to
+// the OTEL_EXPORTER_OTLP_ENDPOINT environment. The gateway, servers and
+// clients are instrumented with the global providers, so the spans are
+// exported once Setup runs.
+package telemetry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/hysios/mx/config"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc/filters"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdoutmetric"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/multierr"
+	"google.golang.org/grpc/stats"
+)
+
+// Selector is the config selector under which the telemetry is configured
+const Selector = "telemetry"
+
+const (
+	ExporterNone   = "none"
+	ExporterStdout = "stdout"
+	ExporterOTLP   = "otlp"
+)
+
+// Config is the exporter of the telemetry
+type Config struct {
+	// Exporter is otlp, stdout or none, default is none
+	Exporter string `json:"exporter"`
+	// Endpoint is the host:port of the OTLP collector
+	Endpoint string `json:"endpoint"`
+	// Insecure dials the OTLP collector without TLS
+	Insecure bool `json:"insecure"`
+	// SampleRatio is the ratio of the traces started here which are
+	// sampled, default is 1
+	SampleRatio float64 `json:"sample_ratio"`
+}
+
+type Option struct {
+	Config
+	// ServiceName is the service.name of the resource
+	ServiceName string
+	// SpanExporter overrides the exporter of the config, e.g. the in-memory
+	// exporter of the tests
+	SpanExporter sdktrace.SpanExporter
+	// MetricReader overrides the metric exporter of the config
+	MetricReader sdkmetric.Reader
+}
+
+type OptionFunc func(*Option)
+
+// WithConfig reads the exporter from the "telemetry" selector of cfg,
+// merged over the config layers
+func WithConfig(cfg *config.Config) OptionFunc {
+	return func(o *Option) {
+		b, err := json.Marshal(cfg.MergedMap(Selector))
+		if err != nil {
+			return
+		}
+		_ = json.Unmarshal(b, &o.Config)
+	}
+}
+
+func WithServiceName(name string) OptionFunc {
+	return func(o *Option) {
+		o.ServiceName = name
+	}
+}
+
+func WithSpanExporter(exp sdktrace.SpanExporter) OptionFunc {
+	return func(o *Option) {
+		o.SpanExporter = exp
+	}
+}
+
+func WithMetricReader(r sdkmetric.Reader) OptionFunc {
+	return func(o *Option) {
+		o.MetricReader = r
+	}
+}
+
+// Telemetry is the tracer and meter providers set up
+type Telemetry struct {
+	TracerProvider *sdktrace.TracerProvider
+	MeterProvider  *sdkmetric.MeterProvider
+}
+
+// Setup builds the providers of the options and sets them as the global
+// ones, with the W3C trace context and baggage propagators. Shutdown
+// flushes them.
+func Setup(ctx context.Context, optfns ...OptionFunc) (*Telemetry, error) {
+	var opts Option
+	for _, fn := range optfns {
+		fn(&opts)
+	}
+
+	if opts.SampleRatio <= 0 {
+		opts.SampleRatio = 1
+	}
+
+	var res = resource.Default()
+	if opts.ServiceName != "" {
+		merged, err := resource.Merge(res, resource.NewSchemaless(semconv.ServiceName(opts.ServiceName)))
+		if err != nil {
+			return nil, err
+		}
+		res = merged
+	}
+
+	spanExporter, metricReader, err := exporters(ctx, &opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		tpopts = []sdktrace.TracerProviderOption{
+			sdktrace.WithResource(res),
+			sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(opts.SampleRatio))),
+		}
+		mpopts = []sdkmetric.Option{sdkmetric.WithResource(res)}
+	)
+
+	if spanExporter != nil {
+		tpopts = append(tpopts, sdktrace.WithBatcher(spanExporter))
+	}
+
+	if metricReader != nil {
+		mpopts = append(mpopts, sdkmetric.WithReader(metricReader))
+	}
+
+	t := &Telemetry{
+		TracerProvider: sdktrace.NewTracerProvider(tpopts...),
+		MeterProvider:  sdkmetric.NewMeterProvider(mpopts...),
+	}
+
+	otel.SetTracerProvider(t.TracerProvider)
+	otel.SetMeterProvider(t.MeterProvider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return t, nil
+}
+
+// exporters returns the span exporter and metric reader of the options, nil
+// ones for none
+func exporters(ctx context.Context, opts *Option) (sdktrace.SpanExporter, sdkmetric.Reader, error) {
+	var (
+		spanExporter = opts.SpanExporter
+		metricReader = opts.MetricReader
+	)
+
+	if spanExporter != nil || metricReader != nil {
+		return spanExporter, metricReader, nil
+	}
+
+	switch strings.ToLower(opts.Exporter) {
+	case "", ExporterNone:
+		return nil, nil, nil
+	case ExporterStdout:
+		spanExporter, err := stdouttrace.New()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		metricExporter, err := stdoutmetric.New()
+		if err != nil {
+			return nil, nil, err
+		}
+		return spanExporter, sdkmetric.NewPeriodicReader(metricExporter), nil
+	case ExporterOTLP:
+		var (
+			traceopts  []otlptracegrpc.Option
+			metricopts []otlpmetricgrpc.Option
+		)
+
+		if opts.Endpoint != "" {
+			traceopts = append(traceopts, otlptracegrpc.WithEndpoint(opts.Endpoint))
+			metricopts = append(metricopts, otlpmetricgrpc.WithEndpoint(opts.Endpoint))
+		}
+
+		if opts.Insecure {
+			traceopts = append(traceopts, otlptracegrpc.WithInsecure())
+			metricopts = append(metricopts, otlpmetricgrpc.WithInsecure())
+		}
+
+		spanExporter, err := otlptracegrpc.New(ctx, traceopts...)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		metricExporter, err := otlpmetricgrpc.New(ctx, metricopts...)
+		if err != nil {
+			return nil, nil, err
+		}
+		return spanExporter, sdkmetric.NewPeriodicReader(metricExporter), nil
+	default:
+		return nil, nil, fmt.Errorf("telemetry: unknown exporter %q", opts.Exporter)
+	}
+}
+
+// Shutdown flushes and stops the providers
+func (t *Telemetry) Shutdown(ctx context.Context) error {
+	return multierr.Combine(
+		t.TracerProvider.Shutdown(ctx),
+		t.MeterProvider.Shutdown(ctx),
+	)
+}
+
+// untraced leaves out the calls of the health checkers and the gateway
+// reflection
+var untraced = filters.None(
+	filters.ServiceName("grpc.health.v1.Health"),
+	filters.ServicePrefix("grpc.reflection."),
+)
+
+// ServerHandler records the server spans and metrics of the calls, the
+// trace context is extracted from the incoming metadata
+func ServerHandler() stats.Handler {
+	return otelgrpc.NewServerHandler(otelgrpc.WithFilter(untraced))
+}
+
+// ClientHandler records the client spans and metrics of the calls, the
+// trace context is injected into the outgoing metadata
+func ClientHandler() stats.Handler {
+	return otelgrpc.NewClientHandler(otelgrpc.WithFilter(untraced))
+}
+
+// HTTPHandler records the server spans and metrics of the HTTP requests,
+// the trace context is extracted from the request headers. The spans are
+// named by the method until SetRoute names their route.
+func HTTPHandler(h http.Handler, operation string) http.Handler {
+	return otelhttp.NewHandler(h, operation, otelhttp.WithSpanNameFormatter(func(operation string, r *http.Request) string {
+		return r.Method
+	}))
+}
+
+// SetRoute names the HTTP span of ctx by the method and route pattern of
+// the request
+func SetRoute(ctx context.Context, method, route string) {
+	span := trace.SpanFromContext(ctx)
+	span.SetName(method + " " + route)
+	span.SetAttributes(semconv.HTTPRoute(route))
+}
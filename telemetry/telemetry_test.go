@@ -0,0 +1,132 @@
+package telemetry
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hysios/mx/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+)
+
+type testService struct {
+	testpb.UnimplementedTestServiceServer
+}
+
+func (testService) EmptyCall(ctx context.Context, in *testpb.Empty) (*testpb.Empty, error) {
+	return &testpb.Empty{}, nil
+}
+
+// span returns the exported span of the name and kind
+func span(exp *tracetest.InMemoryExporter, name string, kind trace.SpanKind) tracetest.SpanStub {
+	for _, span := range exp.GetSpans() {
+		if span.Name == name && span.SpanKind == kind {
+			return span
+		}
+	}
+	return tracetest.SpanStub{}
+}
+
+func TestPropagation(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	tel, err := Setup(context.Background(), WithServiceName("hello"), WithSpanExporter(exp))
+	require.NoError(t, err)
+	defer tel.Shutdown(context.Background())
+
+	srv := grpc.NewServer(grpc.StatsHandler(ServerHandler()))
+	testpb.RegisterTestServiceServer(srv, testService{})
+	grpc_health_v1.RegisterHealthServer(srv, health.NewServer())
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(ln)
+	defer srv.Stop()
+
+	conn, err := grpc.Dial(ln.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithStatsHandler(ClientHandler()),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// a gateway request calling the service
+	h := HTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		SetRoute(r.Context(), r.Method, "/api/empty")
+		if _, err := testpb.NewTestServiceClient(conn).EmptyCall(r.Context(), &testpb.Empty{}); err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}), "mx.gateway")
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/empty", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// the health checks are not traced
+	_, err = grpc_health_v1.NewHealthClient(conn).Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	require.NoError(t, err)
+
+	require.NoError(t, tel.TracerProvider.ForceFlush(context.Background()))
+	assert.Len(t, exp.GetSpans(), 3)
+
+	var (
+		httpSpan   = span(exp, "GET /api/empty", trace.SpanKindServer)
+		clientSpan = span(exp, "grpc.testing.TestService/EmptyCall", trace.SpanKindClient)
+		serverSpan = span(exp, "grpc.testing.TestService/EmptyCall", trace.SpanKindServer)
+	)
+	require.True(t, httpSpan.SpanContext.IsValid())
+	require.True(t, clientSpan.SpanContext.IsValid())
+	require.True(t, serverSpan.SpanContext.IsValid())
+
+	assert.Equal(t, httpSpan.SpanContext.SpanID(), clientSpan.Parent.SpanID())
+
+	// the trace goes on in the service
+	assert.Equal(t, httpSpan.SpanContext.TraceID(), serverSpan.SpanContext.TraceID())
+	assert.Equal(t, clientSpan.SpanContext.SpanID(), serverSpan.Parent.SpanID())
+	assert.True(t, serverSpan.Parent.IsRemote())
+
+	for _, attr := range httpSpan.Attributes {
+		if attr.Key == "http.route" {
+			assert.Equal(t, "/api/empty", attr.Value.AsString())
+		}
+	}
+	assert.Equal(t, "hello", serviceName(tel))
+}
+
+func serviceName(tel *Telemetry) string {
+	_, span := tel.TracerProvider.Tracer("test").Start(context.Background(), "resource")
+	defer span.End()
+
+	for _, attr := range span.(sdktrace.ReadOnlySpan).Resource().Attributes() {
+		if attr.Key == "service.name" {
+			return attr.Value.AsString()
+		}
+	}
+	return ""
+}
+
+func TestSetupConfig(t *testing.T) {
+	for _, exporter := range []string{"", ExporterNone} {
+		tel, err := Setup(context.Background(), WithConfig(config.NewConfig(map[string]interface{}{
+			Selector: map[string]interface{}{"exporter": exporter, "sample_ratio": 0.5},
+		})))
+		if assert.NoError(t, err, exporter) {
+			assert.NoError(t, tel.Shutdown(context.Background()))
+		}
+	}
+
+	_, err := Setup(context.Background(), WithConfig(config.NewConfig(map[string]interface{}{
+		Selector: map[string]interface{}{"exporter": "zipkin"},
+	})))
+	assert.Error(t, err)
+}
@@ -0,0 +1,43 @@
+package tlsconfig
+
+import (
+	"context"
+	"crypto/x509"
+	"net/url"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// Identity is the identity of a peer from its verified client certificate
+type Identity struct {
+	CommonName   string
+	Organization []string
+	DNSNames     []string
+	// URIs are e.g. the SPIFFE IDs of the peer
+	URIs        []*url.URL
+	Certificate *x509.Certificate
+}
+
+// PeerIdentity returns the identity of the mTLS peer of the gRPC call, ok
+// is false when the peer has no verified certificate
+func PeerIdentity(ctx context.Context) (Identity, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return Identity{}, false
+	}
+
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return Identity{}, false
+	}
+
+	cert := info.State.VerifiedChains[0][0]
+	return Identity{
+		CommonName:   cert.Subject.CommonName,
+		Organization: cert.Subject.Organization,
+		DNSNames:     cert.DNSNames,
+		URIs:         cert.URIs,
+		Certificate:  cert,
+	}, true
+}
@@ -0,0 +1,351 @@
+// Package tlsconfig loads the TLS material shared by the servers, the
+// gateway upstreams and the clients, and reloads it when the files rotate.
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/hysios/mx/logger"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// Config is the TLS material, PEM files or PEM in memory. The CA verifies
+// the peers, servers require a client certificate signed by it when
+// ClientAuth is set.
+type Config struct {
+	CertFile string
+	KeyFile  string
+	CAFile   string
+
+	Cert []byte
+	Key  []byte
+	CA   []byte
+
+	// ServerName overrides the name the server certificates are verified
+	// for, default is the host of the dialed address
+	ServerName string
+	// ClientAuth makes the servers require and verify client certificates
+	ClientAuth bool
+}
+
+// EnvConfig returns the config of MX_TLS_CERT, MX_TLS_KEY, MX_TLS_CA,
+// MX_TLS_SERVER_NAME and MX_TLS_CLIENT_AUTH
+func EnvConfig() Config {
+	clientAuth, _ := strconv.ParseBool(os.Getenv("MX_TLS_CLIENT_AUTH"))
+	return Config{
+		CertFile:   os.Getenv("MX_TLS_CERT"),
+		KeyFile:    os.Getenv("MX_TLS_KEY"),
+		CAFile:     os.Getenv("MX_TLS_CA"),
+		ServerName: os.Getenv("MX_TLS_SERVER_NAME"),
+		ClientAuth: clientAuth,
+	}
+}
+
+// Empty reports whether the config has no material
+func (cfg Config) Empty() bool {
+	return cfg.CertFile == "" && cfg.KeyFile == "" && cfg.CAFile == "" &&
+		len(cfg.Cert) == 0 && len(cfg.Key) == 0 && len(cfg.CA) == 0
+}
+
+func (cfg Config) files() []string {
+	var files []string
+	for _, f := range []string{cfg.CertFile, cfg.KeyFile, cfg.CAFile} {
+		if f != "" {
+			files = append(files, filepath.Clean(f))
+		}
+	}
+	return files
+}
+
+// TLS holds the loaded material, the configs it returns always use the
+// latest one
+type TLS struct {
+	cfg Config
+
+	l    sync.RWMutex
+	cert *tls.Certificate
+	pool *x509.CertPool
+
+	watcher *fsnotify.Watcher
+}
+
+// New loads the config, the files are watched and reloaded when they change
+func New(cfg Config) (*TLS, error) {
+	t := &TLS{cfg: cfg}
+	if err := t.Reload(); err != nil {
+		return nil, err
+	}
+
+	if err := t.watch(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+var (
+	defaultOnce sync.Once
+	defaultTLS  *TLS
+	defaultErr  error
+)
+
+// Load returns the TLS of EnvConfig, nil when it is empty. The error of a
+// config which is set but fails to load is returned, the callers must not
+// fall back to plaintext then.
+func Load() (*TLS, error) {
+	defaultOnce.Do(func() {
+		defaultTLS, defaultErr = load(EnvConfig())
+	})
+
+	return defaultTLS, defaultErr
+}
+
+func load(cfg Config) (*TLS, error) {
+	if cfg.Empty() {
+		return nil, nil
+	}
+
+	t, err := New(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("load tls config: %w", err)
+	}
+	return t, nil
+}
+
+// Default returns the TLS of EnvConfig, nil when it is empty. It panics
+// when the config is set but fails to load.
+func Default() *TLS {
+	t, err := Load()
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// DialOption returns the transport credentials of the client config of t,
+// insecure ones when t is nil
+func (t *TLS) DialOption() grpc.DialOption {
+	if t == nil {
+		return grpc.WithTransportCredentials(insecure.NewCredentials())
+	}
+	return grpc.WithTransportCredentials(t.ClientCredentials())
+}
+
+// DialOption returns the dial option of the TLS of EnvConfig, the error of
+// Load when it fails to load
+func DialOption() (grpc.DialOption, error) {
+	t, err := Load()
+	if err != nil {
+		return nil, err
+	}
+	return t.DialOption(), nil
+}
+
+// Reload reads the material again, on failure the loaded one is kept
+func (t *TLS) Reload() error {
+	var cfg = t.cfg
+	if err := readFiles(&cfg); err != nil {
+		return err
+	}
+
+	var cert *tls.Certificate
+	if len(cfg.Cert) > 0 || len(cfg.Key) > 0 {
+		c, err := tls.X509KeyPair(cfg.Cert, cfg.Key)
+		if err != nil {
+			return err
+		}
+		cert = &c
+	}
+
+	var pool *x509.CertPool
+	if len(cfg.CA) > 0 {
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(cfg.CA) {
+			return errors.New("no certificate in the tls ca")
+		}
+	}
+
+	t.l.Lock()
+	t.cert, t.pool = cert, pool
+	t.l.Unlock()
+	return nil
+}
+
+func readFiles(cfg *Config) (err error) {
+	for _, f := range []struct {
+		path string
+		dst  *[]byte
+	}{
+		{cfg.CertFile, &cfg.Cert},
+		{cfg.KeyFile, &cfg.Key},
+		{cfg.CAFile, &cfg.CA},
+	} {
+		if f.path == "" {
+			continue
+		}
+
+		if *f.dst, err = os.ReadFile(f.path); err != nil {
+			return fmt.Errorf("read tls file: %w", err)
+		}
+	}
+	return nil
+}
+
+func (t *TLS) material() (*tls.Certificate, *x509.CertPool) {
+	t.l.RLock()
+	defer t.l.RUnlock()
+
+	return t.cert, t.pool
+}
+
+// watch watches the directories of the files, the rotations replace the
+// files, e.g. the symlinks of the Kubernetes secrets
+func (t *TLS) watch() error {
+	var files = t.cfg.files()
+	if len(files) == 0 {
+		return nil
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	var dirs = make(map[string]bool)
+	for _, f := range files {
+		dir := filepath.Dir(f)
+		if dirs[dir] {
+			continue
+		}
+		dirs[dir] = true
+
+		if err = watcher.Add(dir); err != nil {
+			watcher.Close()
+			return err
+		}
+	}
+	t.watcher = watcher
+
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+
+				if event.Has(fsnotify.Chmod) {
+					continue
+				}
+
+				if err := t.Reload(); err != nil {
+					logger.Logger.Warn("reload tls config failed", zap.String("path", event.Name), zap.Error(err))
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logger.Logger.Warn("watch tls config failed", zap.Error(err))
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Close stops watching the files
+func (t *TLS) Close() error {
+	if t.watcher != nil {
+		return t.watcher.Close()
+	}
+	return nil
+}
+
+// ServerConfig returns the config of the servers
+func (t *TLS) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := t.material()
+			if cert == nil {
+				return nil, errors.New("tls: no server certificate")
+			}
+
+			cfg := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+				ClientCAs:    pool,
+				NextProtos:   []string{"h2"},
+			}
+
+			switch {
+			case t.cfg.ClientAuth:
+				cfg.ClientAuth = tls.RequireAndVerifyClientCert
+			case pool != nil:
+				cfg.ClientAuth = tls.VerifyClientCertIfGiven
+			}
+			return cfg, nil
+		},
+	}
+}
+
+// ClientConfig returns the config of the clients, the server certificate
+// is verified with the CA of the latest material, or the system roots when
+// there is none
+func (t *TLS) ClientConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: t.cfg.ServerName,
+		// verified by VerifyConnection with the reloaded CA
+		InsecureSkipVerify: true,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := t.material()
+			if cert == nil {
+				return &tls.Certificate{}, nil
+			}
+			return cert, nil
+		},
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			_, pool := t.material()
+			return verify(cs, pool)
+		},
+	}
+}
+
+func verify(cs tls.ConnectionState, pool *x509.CertPool) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("tls: no server certificate")
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         pool,
+		DNSName:       cs.ServerName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// ServerCredentials returns the transport credentials of the gRPC servers
+func (t *TLS) ServerCredentials() credentials.TransportCredentials {
+	return credentials.NewTLS(t.ServerConfig())
+}
+
+// ClientCredentials returns the transport credentials of the gRPC clients
+func (t *TLS) ClientCredentials() credentials.TransportCredentials {
+	return credentials.NewTLS(t.ClientConfig())
+}
@@ -0,0 +1,210 @@
+package tlsconfig
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mx test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns the PEM certificate and key of the common name
+func (ca *testCA) issue(t *testing.T, cn string, serial int64) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn, Organization: []string{"mx"}},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+
+	b, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b})
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newCA(t)
+	serverCert, serverKey := ca.issue(t, "hello", 2)
+	clientCert, clientKey := ca.issue(t, "gateway", 3)
+
+	srvTLS, err := New(Config{Cert: serverCert, Key: serverKey, CA: ca.pem, ClientAuth: true})
+	require.NoError(t, err)
+
+	var identity = make(chan Identity, 1)
+	srv := grpc.NewServer(
+		grpc.Creds(srvTLS.ServerCredentials()),
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if id, ok := PeerIdentity(ctx); ok {
+				identity <- id
+			}
+			return handler(ctx, req)
+		}),
+	)
+	grpc_health_v1.RegisterHealthServer(srv, health.NewServer())
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(ln)
+	defer srv.Stop()
+
+	cliTLS, err := New(Config{Cert: clientCert, Key: clientKey, CA: ca.pem})
+	require.NoError(t, err)
+
+	conn, err := grpc.Dial(ln.Addr().String(), cliTLS.DialOption())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = grpc_health_v1.NewHealthClient(conn).Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	require.NoError(t, err)
+
+	select {
+	case id := <-identity:
+		assert.Equal(t, "gateway", id.CommonName)
+		assert.Equal(t, []string{"mx"}, id.Organization)
+	default:
+		t.Fatal("no peer identity")
+	}
+
+	// no client certificate
+	anonTLS, err := New(Config{CA: ca.pem})
+	require.NoError(t, err)
+
+	anon, err := grpc.Dial(ln.Addr().String(), anonTLS.DialOption())
+	require.NoError(t, err)
+	defer anon.Close()
+
+	_, err = grpc_health_v1.NewHealthClient(anon).Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	assert.Error(t, err)
+
+	// the server certificate of another CA
+	other, err := New(Config{CA: newCA(t).pem})
+	require.NoError(t, err)
+
+	_, err = tls.Dial("tcp", ln.Addr().String(), other.ClientConfig())
+	assert.Error(t, err)
+}
+
+func TestReload(t *testing.T) {
+	var (
+		dir     = t.TempDir()
+		ca      = newCA(t)
+		certA   = filepath.Join(dir, "tls.crt")
+		keyA    = filepath.Join(dir, "tls.key")
+		caFile  = filepath.Join(dir, "ca.crt")
+		write   = func(path string, b []byte) { require.NoError(t, os.WriteFile(path, b, 0600)) }
+		cert, k = ca.issue(t, "hello-1", 2)
+	)
+
+	write(certA, cert)
+	write(keyA, k)
+	write(caFile, ca.pem)
+
+	srvTLS, err := New(Config{CertFile: certA, KeyFile: keyA, CAFile: caFile})
+	require.NoError(t, err)
+	defer srvTLS.Close()
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", srvTLS.ServerConfig())
+	require.NoError(t, err)
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+
+	cliTLS, err := New(Config{CA: ca.pem, ServerName: "localhost"})
+	require.NoError(t, err)
+
+	peerName := func() string {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), cliTLS.ClientConfig())
+		if err != nil {
+			return ""
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+
+	assert.Equal(t, "hello-1", peerName())
+
+	// the rotated certificate is served to the new connections
+	cert, k = ca.issue(t, "hello-2", 3)
+	write(keyA, k)
+	write(certA, cert)
+
+	assert.Eventually(t, func() bool { return peerName() == "hello-2" }, 5*time.Second, 20*time.Millisecond)
+}
+
+func TestLoad(t *testing.T) {
+	// no material is plaintext
+	tlsc, err := load(Config{})
+	assert.NoError(t, err)
+	assert.Nil(t, tlsc)
+
+	// material which fails to load is an error, not plaintext
+	tlsc, err = load(Config{CertFile: filepath.Join(t.TempDir(), "missing.pem")})
+	assert.Error(t, err)
+	assert.Nil(t, tlsc)
+}
@@ -1,9 +1,16 @@
 package mx
 
-import "google.golang.org/grpc"
+import (
+	"github.com/hysios/mx/tlsconfig"
+	"google.golang.org/grpc"
+)
 
 type ConnString string
 
 func (conn ConnString) Open() (*grpc.ClientConn, error) {
-	return grpc.Dial(string(conn), grpc.WithInsecure())
+	opt, err := tlsconfig.DialOption()
+	if err != nil {
+		return nil, err
+	}
+	return grpc.Dial(string(conn), opt)
 }